@@ -0,0 +1,86 @@
+package serverstarter
+
+import (
+	"os"
+	"time"
+)
+
+// envValidate is the environment variable name for telling the process is run
+// for validating the worker program.
+const envValidate = "SERVERSTARTER_VALIDATE"
+
+// SetWorkerArgs sets the command line arguments of worker processes, not including
+// the program name. If no SetWorkerArgs is called, workers are started with
+// the same arguments as the master.
+func SetWorkerArgs(args []string) Option {
+	return func(s *Starter) {
+		s.workerArgs = args
+		s.workerArgsSet = true
+	}
+}
+
+// SetWorkerArgsFunc sets the function which the master calls every time it starts
+// a worker to get the command line arguments of the worker, not including the program
+// name. The generation number of the worker is passed to fn (see Starter.Generation).
+// This can be used to pick up new arguments at reload time, for example the path
+// of a new configuration file. It takes precedence over SetWorkerArgs.
+// If fn returns an error, the master fails to start the worker.
+func SetWorkerArgsFunc(fn func(generation int) ([]string, error)) Option {
+	return func(s *Starter) {
+		s.workerArgsFunc = fn
+	}
+}
+
+// AppendWorkerArgs appends args to the command line arguments of worker processes,
+// for example "--role=worker". The arguments are appended to the ones set by
+// SetWorkerArgs or SetWorkerArgsFunc, or to the arguments of the master if neither
+// is called.
+func AppendWorkerArgs(args ...string) Option {
+	return func(s *Starter) {
+		s.appendedWorkerArgs = append(s.appendedWorkerArgs, args...)
+	}
+}
+
+// SetReloadValidation makes the master validate the worker program before starting
+// a new worker on a reload, like "nginx -t". The master runs the worker binary with
+// the command line arguments of the worker followed by args, for example
+// "--check-config", and the environment variable SERVERSTARTER_VALIDATE set to "1".
+// If the validation process exits with a non-zero status or does not exit within
+// timeout, the master aborts the reload and keeps the old worker untouched.
+// If timeout is zero, the master waits for the validation process without timeout.
+//
+// The validation process does not inherit listeners from the master, so it should
+// check the configuration and exit before getting listeners.
+// The initial worker is not validated.
+func SetReloadValidation(args []string, timeout time.Duration) Option {
+	return func(s *Starter) {
+		s.reloadValidationArgs = args
+		s.reloadValidationTimeout = timeout
+	}
+}
+
+// IsValidation returns whether this process is run by the master for validating
+// the worker program set by SetReloadValidation.
+func (s *Starter) IsValidation() bool {
+	return os.Getenv(envValidate) == "1"
+}
+
+// workerCommandArgs returns the command line arguments for the worker of
+// the generation in slot, not including the program name.
+func (s *Starter) workerCommandArgs(slot *workerSlot, generation int) ([]string, error) {
+	args := os.Args[1:]
+	if slot.spec.Args != nil {
+		args = slot.spec.Args
+	} else if s.workerArgsFunc != nil {
+		var err error
+		if args, err = s.workerArgsFunc(generation); err != nil {
+			return nil, err
+		}
+	} else if s.workerArgsSet {
+		args = s.workerArgs
+	}
+	result := make([]string, 0, len(args)+len(s.appendedWorkerArgs))
+	result = append(result, args...)
+	result = append(result, s.appendedWorkerArgs...)
+	return result, nil
+}
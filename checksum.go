@@ -0,0 +1,84 @@
+package serverstarter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+)
+
+// BinaryChecksumPolicy is the policy for verifying the SHA-256 checksum of
+// the worker binary when the master starts a worker.
+type BinaryChecksumPolicy int
+
+const (
+	// BinaryChecksumOff disables verifying the checksum. This is the default policy.
+	BinaryChecksumOff BinaryChecksumPolicy = iota
+	// BinaryChecksumWarn makes the master print a warning if the verification fails
+	// and start the worker anyway.
+	BinaryChecksumWarn
+	// BinaryChecksumRefuse makes the master refuse to start the worker if
+	// the verification fails, so the reload fails and the old worker keeps running.
+	BinaryChecksumRefuse
+)
+
+// SetBinaryChecksumPolicy sets the policy for verifying the worker binary.
+//
+// When the verification is enabled, the master calculates the SHA-256 checksum of
+// the worker binary before and after executing it, and the verification fails if
+// they differ, which means the binary was being written while it was executed,
+// for example by a deployment which has not finished yet. It also fails if
+// the checksum differs from the one set by the control command "checksum SHA256"
+// (see SetControlFile).
+// If no SetBinaryChecksumPolicy is called, the default value is BinaryChecksumOff.
+func SetBinaryChecksumPolicy(policy BinaryChecksumPolicy) Option {
+	return func(s *Starter) {
+		s.binaryChecksumPolicy = policy
+	}
+}
+
+// fileChecksum returns the hex encoded SHA-256 checksum of the file at path.
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// verifyBinaryChecksum verifies the checksum of the worker binary at path
+// which is calculated before executing it. It returns the error if the
+// verification fails and the policy is BinaryChecksumRefuse.
+func (s *Starter) verifyBinaryChecksum(path, checksum string) error {
+	if s.expectedBinaryChecksum == "" || checksum == s.expectedBinaryChecksum {
+		return nil
+	}
+	return s.binaryChecksumFailed(fmt.Errorf("checksum mismatch of worker binary %s, expected=%s, actual=%s", path, s.expectedBinaryChecksum, checksum))
+}
+
+// verifyBinaryUnchanged verifies the worker binary at path has the same checksum
+// after executing it as the one before executing it.
+func (s *Starter) verifyBinaryUnchanged(path, checksum string) error {
+	after, err := fileChecksum(path)
+	if err != nil {
+		return s.binaryChecksumFailed(fmt.Errorf("failed to calculate checksum of worker binary %s after executing it; %w", path, err))
+	}
+	if after != checksum {
+		return s.binaryChecksumFailed(fmt.Errorf("worker binary %s changed while executing it, before=%s, after=%s", path, checksum, after))
+	}
+	return nil
+}
+
+func (s *Starter) binaryChecksumFailed(err error) error {
+	if s.binaryChecksumPolicy == BinaryChecksumRefuse {
+		return err
+	}
+	s.out.eprintf("warning: %v\n", err)
+	return nil
+}
@@ -0,0 +1,38 @@
+//go:build !windows
+
+package serverstarter
+
+import "syscall"
+
+func closeOnExec(fd uintptr) {
+	syscall.CloseOnExec(int(fd))
+}
+
+func setNonblock(fd uintptr) {
+	syscall.SetNonblock(int(fd), true)
+}
+
+// dupCloseOnExec duplicates fd with the close-on-exec flag. It holds
+// syscall.ForkLock so that the duplicated file descriptor does not leak to
+// the processes started by other goroutines before setting the flag.
+func dupCloseOnExec(fd int) (int, error) {
+	syscall.ForkLock.RLock()
+	defer syscall.ForkLock.RUnlock()
+	nfd, err := syscall.Dup(fd)
+	if err != nil {
+		return 0, err
+	}
+	syscall.CloseOnExec(nfd)
+	return nfd, nil
+}
+
+// clearCloseOnExec clears the close-on-exec flag of fd so that it is inherited
+// by the program which this process executes. The caller must hold
+// syscall.ForkLock for writing until it executes the program, so that fd does
+// not leak to the processes started by other goroutines meanwhile.
+func clearCloseOnExec(fd int) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), syscall.F_SETFD, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,5 @@
+package serverstarter
+
+func closeOnExec(fd uintptr) {}
+
+func setNonblock(fd uintptr) {}
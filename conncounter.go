@@ -0,0 +1,167 @@
+package serverstarter
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// drainReportInterval is the interval for reporting the drain progress in
+// StopAcceptingOnSignal.
+const drainReportInterval = time.Second
+
+// ConnCounter counts the active connections accepted from the listeners wrapped
+// with Listener. It can be used by the worker to wait for the connections to be
+// closed when shutting down gracefully, and to report the drain progress to the
+// master with ReportDrainProgress.
+//
+// The zero value is ready to use.
+type ConnCounter struct {
+	mu     sync.Mutex
+	active int
+	// changed is closed and replaced when active changes.
+	changed chan struct{}
+}
+
+// Listener returns a listener which counts the connections accepted from l
+// with c. A connection is counted until it is closed, even if it is hijacked
+// from http.Server, for example for WebSocket.
+func (c *ConnCounter) Listener(l net.Listener) net.Listener {
+	return &countingListener{Listener: l, counter: c}
+}
+
+// Active returns the number of the active connections.
+func (c *ConnCounter) Active() int {
+	n, _ := c.state()
+	return n
+}
+
+// Wait waits until there are no active connections or ctx is done.
+// Typically it is called after http.Server.Shutdown returns, to wait for
+// the hijacked connections which Shutdown does not wait for.
+func (c *ConnCounter) Wait(ctx context.Context) error {
+	for {
+		n, changed := c.state()
+		if n == 0 {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// state returns the number of the active connections and the channel which is
+// closed when the number changes.
+func (c *ConnCounter) state() (active int, changed <-chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.changed == nil {
+		c.changed = make(chan struct{})
+	}
+	return c.active, c.changed
+}
+
+func (c *ConnCounter) add(delta int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.active += delta
+	if c.changed != nil {
+		close(c.changed)
+		c.changed = nil
+	}
+}
+
+type countingListener struct {
+	net.Listener
+	counter *ConnCounter
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.counter.add(1)
+	return &countingConn{Conn: conn, counter: l.counter}, nil
+}
+
+type countingConn struct {
+	net.Conn
+	counter   *ConnCounter
+	closeOnce sync.Once
+}
+
+func (c *countingConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		c.counter.add(-1)
+	})
+	return err
+}
+
+// ReportDrainProgress reports the number of the active connections counted by c
+// to the master with SendDrainProgress when it changes and at least every interval,
+// until it becomes zero or ctx is done.
+// The worker should call it after receiving the signal set by
+// SetGracefulShutdownSignalToChild.
+func (s *Starter) ReportDrainProgress(ctx context.Context, c *ConnCounter, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n, changed := c.state()
+		if err := s.SendDrainProgress(n); err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// StopAcceptingOnSignal waits for the graceful shutdown signal from the master,
+// and then closes listeners so that no new connections are accepted while
+// the active connections counted by c are being finished. It reports the drain
+// progress to the master with ReportDrainProgress and returns when there are no
+// active connections or ctx is done.
+//
+// The listeners should be the ones wrapped with c.Listener, and the accept loops
+// using them should return when Accept returns an error after they are closed.
+// This is for protocols which have no equivalent of http.Server.Shutdown.
+func (s *Starter) StopAcceptingOnSignal(ctx context.Context, c *ConnCounter, listeners ...net.Listener) error {
+	sig, err := shutdownSignal()
+	if err != nil {
+		return fmt.Errorf("error in StopAcceptingOnSignal after getting shutdown signal; %w", err)
+	}
+	if sig == 0 {
+		sig = syscall.SIGTERM
+	}
+	sigC := make(chan os.Signal, 1)
+	signal.Notify(sigC, sig)
+	defer signal.Stop(sigC)
+	select {
+	case <-sigC:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	for _, l := range listeners {
+		if err := l.Close(); err != nil {
+			return fmt.Errorf("error in StopAcceptingOnSignal after closing listener; %w", err)
+		}
+	}
+	return s.ReportDrainProgress(ctx, c, drainReportInterval)
+}
@@ -0,0 +1,67 @@
+package serverstarter
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnCounter(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var counter ConnCounter
+	cl := counter.Listener(l)
+	defer cl.Close()
+
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := cl.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		client, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		conns = append(conns, <-accepted)
+	}
+	if got, want := counter.Active(), 2; got != want {
+		t.Errorf("active connections mismatch, got=%d, want=%d", got, want)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := counter.Wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("unexpected result of Wait with active connections, got=%v", err)
+	}
+
+	conns[0].Close()
+	// NOTE: Closing twice must not decrement the count twice.
+	conns[0].Close()
+	if got, want := counter.Active(), 1; got != want {
+		t.Errorf("active connections mismatch, got=%d, want=%d", got, want)
+	}
+
+	waitErrC := make(chan error, 1)
+	go func() { waitErrC <- counter.Wait(context.Background()) }()
+	conns[1].Close()
+	select {
+	case err := <-waitErrC:
+		if err != nil {
+			t.Errorf("unexpected error from Wait; %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for Wait to return")
+	}
+}
@@ -0,0 +1,193 @@
+package serverstarter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// SetControlFile sets the path of the control file for the master.
+//
+// When this option is set, the master also handles SIGUSR2 and reads a command
+// from the first line of the control file on receiving it. This is useful in
+// environments where only one custom signal can be sent to the master.
+// The supported commands are:
+//
+//	reload           same as sending SIGHUP to the master
+//	reload NAME      reload only the worker program NAME added by AddWorker
+//	reload --dry-run [NAME]
+//	                 start a new worker and stop it after it gets ready while
+//	                 keeping the old worker, to verify the new worker can start
+//	reload-group NAME
+//	                 reload only the worker programs serving the listener group
+//	                 NAME set by SetListenerGroup
+//	stop             same as sending SIGTERM to the master
+//	status           print the statistics of the master (see SetControlSocket)
+//	last-reload      print the result of the most recent reload (see SetControlSocket)
+//	checksum SHA256  set the expected SHA-256 checksum of the worker binary in hex
+//	                 (see SetBinaryChecksumPolicy)
+//	checksum         clear the expected checksum of the worker binary
+//	listen ADDR [NAME]
+//	                 bind a new listener at ADDR in the form of ParseListenAddress
+//	                 with the optional name for the manifest, which is passed to
+//	                 the workers started after that, for example on the next
+//	                 reload, of the worker programs which are passed all listeners
+//	unlisten ADDR|NAME
+//	                 remove the listener at ADDR or with NAME from the ones passed to
+//	                 workers, reload the workers so that the old workers stop
+//	                 accepting on it, and close it after the reload
+//
+// The command "scale N" is recognized but rejected, since the number of
+// workers is fixed by SetWorkerCount.
+func SetControlFile(path string) Option {
+	return func(s *Starter) {
+		s.controlFile = path
+	}
+}
+
+// readControlFile reads a command from the control file and returns the
+// name of the command.
+func (s *Starter) readControlFile() (string, error) {
+	data, err := ioutil.ReadFile(s.controlFile)
+	if err != nil {
+		return "", fmt.Errorf("error in readControlFile after reading file; %w", err)
+	}
+	line := string(data)
+	if i := strings.IndexByte(line, '\n'); i != -1 {
+		line = line[:i]
+	}
+	command, err := s.parseControlCommand(line)
+	if err != nil {
+		return "", fmt.Errorf("error in readControlFile after reading command from %s; %w", s.controlFile, err)
+	}
+	return command, nil
+}
+
+// parseControlCommand parses a line of a command from the control file or
+// the control socket and returns the command with normalized spaces.
+func (s *Starter) parseControlCommand(line string) (string, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", errors.New("empty command")
+	}
+	switch fields[0] {
+	case "reload":
+		var dryRun bool
+		var name string
+		for _, arg := range fields[1:] {
+			switch {
+			case arg == "--dry-run" && !dryRun:
+				dryRun = true
+			case !strings.HasPrefix(arg, "-") && name == "":
+				if !s.hasWorker(arg) {
+					return "", fmt.Errorf("unknown worker %q", arg)
+				}
+				name = arg
+			default:
+				return "", fmt.Errorf("invalid argument %q for command %q", arg, fields[0])
+			}
+		}
+		command := fields[0]
+		if dryRun {
+			command += " --dry-run"
+		}
+		if name != "" {
+			command += " " + name
+		}
+		return command, nil
+	case "checksum":
+		if len(fields) > 2 {
+			return "", fmt.Errorf("command %q takes at most one argument", fields[0])
+		}
+		if len(fields) == 2 {
+			if b, err := hex.DecodeString(fields[1]); err != nil || len(b) != sha256.Size {
+				return "", fmt.Errorf("invalid SHA-256 checksum %q", fields[1])
+			}
+			fields[1] = strings.ToLower(fields[1])
+		}
+		return strings.Join(fields, " "), nil
+	case "listen":
+		if len(fields) != 2 && len(fields) != 3 {
+			return "", fmt.Errorf("command %q takes an address and an optional name", fields[0])
+		}
+		if _, _, err := ParseListenAddress(fields[1]); err != nil {
+			return "", err
+		}
+		return strings.Join(fields, " "), nil
+	case "reload-group":
+		if len(fields) != 2 {
+			return "", fmt.Errorf("command %q takes a listener group name", fields[0])
+		}
+		if _, ok := s.listenerGroups[fields[1]]; !ok {
+			return "", fmt.Errorf("unknown listener group %q", fields[1])
+		}
+		return strings.Join(fields, " "), nil
+	case "unlisten":
+		if len(fields) != 2 {
+			return "", fmt.Errorf("command %q takes an address or a name", fields[0])
+		}
+		return strings.Join(fields, " "), nil
+	case "stop", "status", "last-reload":
+		if len(fields) != 1 {
+			return "", fmt.Errorf("command %q takes no arguments", fields[0])
+		}
+		return fields[0], nil
+	case "scale":
+		return "", fmt.Errorf("command %q is not supported since the number of workers is fixed by SetWorkerCount", line)
+	default:
+		return "", fmt.Errorf("unknown command %q", line)
+	}
+}
+
+// commandName returns the name of the command returned from parseControlCommand.
+func commandName(command string) string {
+	if i := strings.IndexByte(command, ' '); i != -1 {
+		return command[:i]
+	}
+	return command
+}
+
+// reloadArgs returns whether the reload command returned from parseControlCommand
+// is a dry run and the name of the worker program to reload.
+func reloadArgs(command string) (dryRun bool, name string) {
+	fields := strings.Fields(command)
+	for _, arg := range fields[1:] {
+		if arg == "--dry-run" {
+			dryRun = true
+		} else {
+			name = arg
+		}
+	}
+	return dryRun, name
+}
+
+// listenArgs returns the address and the name of the listen command returned
+// from parseControlCommand.
+func listenArgs(command string) (addr, name string) {
+	fields := strings.Fields(command)
+	if len(fields) > 2 {
+		name = fields[2]
+	}
+	return fields[1], name
+}
+
+// listenResponse returns the response to the listen command for the index of
+// the added listener and the error.
+func listenResponse(index int, err error) string {
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	return fmt.Sprintf("ok index=%d", index)
+}
+
+// commandArg returns the argument of the command returned from parseControlCommand,
+// or an empty string if the command has no argument.
+func commandArg(command string) string {
+	if i := strings.IndexByte(command, ' '); i != -1 {
+		return command[i+1:]
+	}
+	return ""
+}
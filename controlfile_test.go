@@ -0,0 +1,67 @@
+package serverstarter
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseControlCommand(t *testing.T) {
+	const checksum = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	s := New(AddWorker(WorkerSpec{Name: "web"}), AddWorker(WorkerSpec{Name: "batch"}), SetListenerGroup("public", 0))
+	testCases := []struct {
+		line    string
+		want    string
+		wantErr string
+	}{
+		{line: "reload", want: "reload"},
+		{line: "  reload \t", want: "reload"},
+		{line: "reload web", want: "reload web"},
+		{line: "reload --dry-run", want: "reload --dry-run"},
+		{line: "reload batch --dry-run", want: "reload --dry-run batch"},
+		{line: "reload nosuch", wantErr: `unknown worker "nosuch"`},
+		{line: "reload web batch", wantErr: `invalid argument "batch" for command "reload"`},
+		{line: "reload --dry-run --dry-run", wantErr: `invalid argument "--dry-run" for command "reload"`},
+		{line: "reload --force", wantErr: `invalid argument "--force" for command "reload"`},
+		{line: "stop", want: "stop"},
+		{line: "stop now", wantErr: `command "stop" takes no arguments`},
+		{line: "status", want: "status"},
+		{line: "status web", wantErr: `command "status" takes no arguments`},
+		{line: "last-reload", want: "last-reload"},
+		{line: "checksum", want: "checksum"},
+		{line: "checksum " + checksum, want: "checksum " + checksum},
+		{line: "checksum " + strings.ToUpper(checksum), want: "checksum " + checksum},
+		{line: "checksum 0123", wantErr: `invalid SHA-256 checksum "0123"`},
+		{line: "checksum " + checksum + " " + checksum, wantErr: `command "checksum" takes at most one argument`},
+		{line: "listen 127.0.0.1:8080", want: "listen 127.0.0.1:8080"},
+		{line: "listen  /run/app.sock  app", want: "listen /run/app.sock app"},
+		{line: "listen", wantErr: `command "listen" takes an address and an optional name`},
+		{line: "listen 127.0.0.1:8080 app extra", wantErr: `command "listen" takes an address and an optional name`},
+		{line: "listen udp://127.0.0.1:53", wantErr: `unsupported network "udp"`},
+		{line: "reload-group public", want: "reload-group public"},
+		{line: "reload-group nosuch", wantErr: `unknown listener group "nosuch"`},
+		{line: "reload-group", wantErr: `command "reload-group" takes a listener group name`},
+		{line: "unlisten app", want: "unlisten app"},
+		{line: "unlisten", wantErr: `command "unlisten" takes an address or a name`},
+		{line: "scale", wantErr: `command "scale" is not supported since the number of workers is fixed by SetWorkerCount`},
+		{line: "scale 4", wantErr: `command "scale 4" is not supported since the number of workers is fixed by SetWorkerCount`},
+		{line: "restart", wantErr: `unknown command "restart"`},
+		{line: "", wantErr: "empty command"},
+		{line: " \t", wantErr: "empty command"},
+	}
+	for _, c := range testCases {
+		got, err := s.parseControlCommand(c.line)
+		if c.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+				t.Errorf("error mismatch for %q, got=%v, want=%q", c.line, err, c.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %q; %v", c.line, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("command mismatch for %q, got=%q, want=%q", c.line, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package serverstarter
+
+import "fmt"
+
+// ControlBusyPolicy is the policy for commands which the master receives
+// from the control socket while a reload is in progress.
+type ControlBusyPolicy int
+
+const (
+	// ControlBusyQueue makes the master queue commands received during a reload
+	// and execute them in the received order after the reload finishes.
+	// This is the default policy.
+	//
+	// At most one reload command is queued. The same reload command received
+	// while one is queued is merged with it and gets its response, and another
+	// reload command is rejected with an error.
+	ControlBusyQueue ControlBusyPolicy = iota
+	// ControlBusyReject makes the master reject commands received during a reload
+	// with the response "busy", or "busy: reload already in progress" for
+	// reload commands.
+	ControlBusyReject
+)
+
+// controlQueueSize is the maximum number of commands from the control socket
+// which are queued in the master. Connections for commands exceeding it wait
+// until a queued command is executed.
+const controlQueueSize = 64
+
+// controlRequest is a command received from the control socket.
+type controlRequest struct {
+	command string
+	result  chan string
+	// queued is the queued reload command which this request executes, or nil.
+	queued *queuedReload
+}
+
+// queuedReload is a reload command queued while a reload is in progress.
+// The connections which send the same command share the response.
+type queuedReload struct {
+	command string
+	done    chan struct{}
+	resp    string
+}
+
+// SetControlSocket sets the path of the unix domain socket which the master
+// listens on for commands. A client writes a command in a line and reads
+// the response in a line for each command. The supported commands are same
+// as the ones for SetControlFile. The response is "ok" if the command is executed,
+// "busy" if the command is rejected by ControlBusyReject, or "error: " followed
+// by the message if the command is invalid or fails.
+//
+// The status command responds with the statistics of the master in the form of
+// space-separated key=value pairs, including the count, the mean and the max
+// of the histograms in Stats, even while a reload is in progress, for example:
+//
+//	ok generation=2 reloading=false reload_queued=false graceful_shutdowns=1 forced_shutdowns=0 time_to_ready_count=2 time_to_ready_mean=1.002s time_to_ready_max=1.003s ...
+//
+// The last-reload command responds with the result of the most recent reload
+// in the same form as the response to the reload command, with the start time
+// of the reload, for example:
+//
+//	ok started_at=2024-01-02T15:04:05.123456789+09:00 old_pid=1234 new_pid=1240 duration=1.502s
+//
+// The reload command responds after the new worker gets ready and the old worker
+// exits, or the reload fails. The response has the result of each worker in the
+// form of ReloadResult.String, for example:
+//
+//	ok old_pid=1234 new_pid=1240 duration=1.502s
+//	error: old_pid=1234 duration=12ms; error in reload after ...
+//
+// The master removes the existing file at path before listening and removes it
+// after it exits.
+//
+// This option is not supported on Windows.
+func SetControlSocket(path string) Option {
+	return func(s *Starter) {
+		s.controlSocket = path
+	}
+}
+
+// SetControlBusyPolicy sets the policy for commands which the master receives
+// from the control socket while a reload is in progress.
+// If no SetControlBusyPolicy is called, the default value is ControlBusyQueue.
+func SetControlBusyPolicy(policy ControlBusyPolicy) Option {
+	return func(s *Starter) {
+		s.controlBusyPolicy = policy
+	}
+}
+
+// statusResponse returns the response for the status command.
+func (s *Starter) statusResponse() string {
+	stats := s.Stats()
+	resp := fmt.Sprintf("ok generation=%d reloading=%t reload_queued=%t graceful_shutdowns=%d forced_shutdowns=%d",
+		s.Generation(), stats.Reloading, stats.ReloadQueued, stats.GracefulShutdowns, stats.ForcedShutdowns)
+	for _, h := range []struct {
+		name string
+		hist DurationHistogram
+	}{
+		{"time_to_ready", stats.TimeToReady},
+		{"old_worker_exit", stats.OldWorkerExit},
+		{"reload_duration", stats.ReloadDuration},
+	} {
+		resp += fmt.Sprintf(" %[1]s_count=%[2]d %[1]s_mean=%[3]s %[1]s_max=%[4]s", h.name, h.hist.Count, h.hist.Mean(), h.hist.Max)
+	}
+	return resp
+}
+
+// setBusy sets whether a reload is in progress.
+func (s *Starter) setBusy(busy bool) {
+	s.mu.Lock()
+	s.busy = busy
+	s.mu.Unlock()
+}
+
+func (s *Starter) isBusy() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.busy
+}
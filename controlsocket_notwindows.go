@@ -0,0 +1,203 @@
+//go:build !windows
+
+package serverstarter
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// controlServer is the server for the control socket.
+type controlServer struct {
+	listener net.Listener
+	requests chan controlRequest
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// startControlServer starts listening on the control socket and serving commands.
+// The commands are sent to the requests channel of the returned server in the
+// received order.
+func (s *Starter) startControlServer() (*controlServer, error) {
+	if err := os.Remove(s.controlSocket); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error in startControlServer after removing existing control socket; %w", err)
+	}
+	l, err := net.Listen("unix", s.controlSocket)
+	if err != nil {
+		return nil, fmt.Errorf("error in startControlServer after listening on control socket; %w", err)
+	}
+	srv := &controlServer{
+		listener: l,
+		requests: make(chan controlRequest, controlQueueSize),
+		done:     make(chan struct{}),
+	}
+	srv.wg.Add(1)
+	go func() {
+		defer srv.wg.Done()
+		s.serveControl(srv)
+	}()
+	return srv, nil
+}
+
+func (s *Starter) serveControl(srv *controlServer) {
+	for {
+		conn, err := srv.listener.Accept()
+		if err != nil {
+			select {
+			case <-srv.done:
+			default:
+				s.out.eprintf("stopped accepting control connections: %v\n", err)
+			}
+			return
+		}
+		srv.wg.Add(1)
+		go func() {
+			defer srv.wg.Done()
+			s.handleControlConn(srv, conn)
+		}()
+	}
+}
+
+// handleControlConn reads commands from conn and writes the responses.
+func (s *Starter) handleControlConn(srv *controlServer, conn net.Conn) {
+	defer conn.Close()
+	connDone := make(chan struct{})
+	defer close(connDone)
+	go func() {
+		select {
+		case <-srv.done:
+			// NOTE: We unblock reading the next command when the master exits,
+			// but we do not close the connection here so that the response
+			// for the last command can be written.
+			conn.SetReadDeadline(time.Now())
+		case <-connDone:
+		}
+	}()
+
+	sc := bufio.NewScanner(conn)
+	for sc.Scan() {
+		var resp string
+		command, err := s.parseControlCommand(sc.Text())
+		if err != nil {
+			resp = "error: " + err.Error()
+		} else if command == "status" {
+			// NOTE: We respond here instead of in the goroutine running
+			// RunMaster, so that the status can be got during a reload.
+			resp = s.statusResponse()
+		} else if command == "last-reload" {
+			resp = s.lastReloadResponse()
+		} else if commandName(command) == "reload" && s.isBusy() {
+			resp = s.queueReloadCommand(srv, command)
+		} else if s.controlBusyPolicy == ControlBusyReject && s.isBusy() {
+			resp = "busy"
+		} else {
+			resp = srv.execute(command)
+		}
+		if _, err := fmt.Fprintln(conn, resp); err != nil {
+			return
+		}
+	}
+}
+
+// execute sends command to the master and returns the response.
+func (srv *controlServer) execute(command string) string {
+	return srv.send(controlRequest{command: command, result: make(chan string, 1)})
+}
+
+// send sends req to the master and returns the response.
+func (srv *controlServer) send(req controlRequest) string {
+	select {
+	case srv.requests <- req:
+		select {
+		case resp := <-req.result:
+			return resp
+		case <-srv.done:
+			select {
+			case resp := <-req.result:
+				return resp
+			default:
+			}
+		}
+	case <-srv.done:
+	}
+	return "error: master exited before executing command"
+}
+
+// queueReloadCommand queues the reload command received while a reload is in
+// progress according to the policy set by SetControlBusyPolicy and returns
+// the response.
+func (s *Starter) queueReloadCommand(srv *controlServer, command string) string {
+	if s.controlBusyPolicy == ControlBusyReject {
+		return "busy: reload already in progress"
+	}
+
+	s.mu.Lock()
+	if q := s.queuedReload; q != nil {
+		s.mu.Unlock()
+		if q.command != command {
+			return fmt.Sprintf("error: another reload command %q is already queued", q.command)
+		}
+		s.out.printf("received control command %q during reload, merged with queued one\n", command)
+		select {
+		case <-q.done:
+			return q.resp
+		case <-srv.done:
+			return "error: master exited before executing command"
+		}
+	}
+	q := &queuedReload{command: command, done: make(chan struct{})}
+	s.queuedReload = q
+	s.mu.Unlock()
+
+	s.out.printf("received control command %q during reload, queued\n", command)
+	// NOTE: The master clears queuedReload when it takes the command, so that
+	// the command received after the queued reload starts is queued again
+	// instead of being merged with the reload started before it was received.
+	q.resp = srv.send(controlRequest{command: command, result: make(chan string, 1), queued: q})
+	s.mu.Lock()
+	if s.queuedReload == q {
+		s.queuedReload = nil
+	}
+	s.mu.Unlock()
+	close(q.done)
+	return q.resp
+}
+
+// close stops the server and waits for the responses to be written.
+// The commands which are not executed yet are responded with an error.
+// The socket file is removed when the listener is closed.
+func (srv *controlServer) close() {
+	close(srv.done)
+	srv.listener.Close()
+	srv.wg.Wait()
+}
+
+// keepSocketFile makes the socket file kept when the server is closed.
+func (srv *controlServer) keepSocketFile() {
+	if l, ok := srv.listener.(*net.UnixListener); ok {
+		l.SetUnlinkOnClose(false)
+	}
+}
+
+// handleControlRequest executes a command from the control socket and
+// sends the response.
+func (s *Starter) handleControlRequest(req controlRequest) (exit bool, err error) {
+	s.out.printf("received control command %q from control socket\n", req.command)
+	if req.queued != nil {
+		s.mu.Lock()
+		if s.queuedReload == req.queued {
+			s.queuedReload = nil
+		}
+		s.mu.Unlock()
+	}
+	resp, exit, err := s.handleCommand(req.command)
+	if err != nil {
+		resp = "error: " + err.Error()
+	}
+	req.result <- resp
+	return exit, err
+}
@@ -0,0 +1,39 @@
+package serverstarter
+
+// detachedWorker is an entry of the state file set by SetDetachedWorkers.
+type detachedWorker struct {
+	PID int `json:"pid"`
+	// StartTime is the start time of the process, which is used to check
+	// the process ID is not reused by another process. It is zero if it is
+	// not available on the platform.
+	StartTime uint64 `json:"start_time,omitempty"`
+}
+
+// detachedState is the content of the state file set by SetDetachedWorkers.
+type detachedState struct {
+	MasterPID int              `json:"master_pid"`
+	Workers   []detachedWorker `json:"workers"`
+}
+
+// SetDetachedWorkers makes the master start worker processes in new sessions
+// with setsid, so that the workers survive the crash of the master and keep
+// serving on the inherited sockets. This is for operators who prefer to keep
+// serving at all costs. It cannot be used with SetWorkerPdeathsig.
+//
+// The master records the process IDs of the workers in stateFile. When a new
+// master is started with the same stateFile after the crash, it starts its own
+// workers and, after they get ready, sends the signal set by
+// SetGracefulShutdownSignalToChild to the workers left by the crashed master.
+// The new master must be able to bind the addresses which the orphaned workers
+// still listen on, so bind the listeners with ListenOptions.ReusePort or
+// use different addresses. The master removes stateFile after it stops the workers.
+//
+// When the master is replaced with SetMasterUpgrade or SetTakeoverSocket
+// while it is running, the workers are adopted or stopped as usual.
+//
+// This option is not supported on Windows.
+func SetDetachedWorkers(stateFile string) Option {
+	return func(s *Starter) {
+		s.detachedStateFile = stateFile
+	}
+}
@@ -0,0 +1,143 @@
+//go:build !windows
+
+package serverstarter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"syscall"
+)
+
+// readDetachedState reads the state file set by SetDetachedWorkers.
+// It returns an empty state if the file does not exist.
+func (s *Starter) readDetachedState() (detachedState, error) {
+	var state detachedState
+	data, err := ioutil.ReadFile(s.detachedStateFile)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return state, fmt.Errorf("error in readDetachedState after reading file; %w", err)
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("error in readDetachedState after decoding %s; %w", s.detachedStateFile, err)
+	}
+	return state, nil
+}
+
+// writeDetachedState writes the state file set by SetDetachedWorkers atomically.
+func (s *Starter) writeDetachedState(state detachedState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("error in writeDetachedState after encoding state; %w", err)
+	}
+	tmp := s.detachedStateFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("error in writeDetachedState after writing file; %w", err)
+	}
+	if err := os.Rename(tmp, s.detachedStateFile); err != nil {
+		return fmt.Errorf("error in writeDetachedState after renaming file; %w", err)
+	}
+	return nil
+}
+
+// loadOrphanedWorkers loads the workers left by the crashed master from the
+// state file set by SetDetachedWorkers.
+func (s *Starter) loadOrphanedWorkers() error {
+	state, err := s.readDetachedState()
+	if err != nil {
+		return err
+	}
+	// NOTE: The workers recorded by this process are adopted ones after
+	// a master upgrade, which are not orphans.
+	if state.MasterPID == os.Getpid() {
+		return nil
+	}
+	for _, w := range state.Workers {
+		if isDetachedWorkerRunning(w) {
+			s.orphanedWorkers = append(s.orphanedWorkers, w)
+		}
+	}
+	return nil
+}
+
+// recordDetachedWorker adds the worker with pid to the state file set by
+// SetDetachedWorkers, dropping the entries of the exited workers.
+func (s *Starter) recordDetachedWorker(pid int) {
+	if s.detachedStateFile == "" {
+		return
+	}
+	state, err := s.readDetachedState()
+	if err != nil {
+		s.out.eprintf("failed to record detached worker pid=%d: %v\n", pid, err)
+		return
+	}
+	state.MasterPID = os.Getpid()
+	// NOTE: We keep the orphaned workers while they are running, so that
+	// they are stopped by the next master even if this master also crashes.
+	var workers []detachedWorker
+	for _, w := range state.Workers {
+		if isDetachedWorkerRunning(w) {
+			workers = append(workers, w)
+		}
+	}
+	// NOTE: The start time is not available on some platforms,
+	// in which case we record only the process ID.
+	startTime, _ := processStartTime(pid)
+	state.Workers = append(workers, detachedWorker{PID: pid, StartTime: startTime})
+	if err := s.writeDetachedState(state); err != nil {
+		s.out.eprintf("failed to record detached worker pid=%d: %v\n", pid, err)
+	}
+}
+
+// stopOrphanedWorkers sends the graceful shutdown signal to the workers left
+// by the crashed master. It does not wait for them to exit, since they are
+// not children of this process.
+func (s *Starter) stopOrphanedWorkers() {
+	for _, w := range s.orphanedWorkers {
+		if s.isSupervised(w.PID) || !isDetachedWorkerRunning(w) {
+			continue
+		}
+		s.out.printf("stopping orphaned worker pid=%d left by previous master\n", w.PID)
+		if err := s.signalWorker(w.PID, s.gracefulShutdownSignalToChild); err != nil {
+			s.out.eprintf("failed to stop orphaned worker pid=%d: %v\n", w.PID, err)
+		}
+	}
+	s.orphanedWorkers = nil
+}
+
+// removeDetachedState removes the state file set by SetDetachedWorkers after
+// the workers are stopped.
+func (s *Starter) removeDetachedState() {
+	if s.detachedStateFile == "" || len(s.orphanedWorkers) > 0 {
+		return
+	}
+	if err := os.Remove(s.detachedStateFile); err != nil && !os.IsNotExist(err) {
+		s.out.eprintf("failed to remove state file of detached workers: %v\n", err)
+	}
+}
+
+// isSupervised returns whether the process with pid is a worker supervised by
+// this master.
+func (s *Starter) isSupervised(pid int) bool {
+	for _, slot := range s.slots {
+		if slot.child != nil && slot.child.pid() == pid {
+			return true
+		}
+	}
+	return false
+}
+
+// isDetachedWorkerRunning returns whether the worker recorded in the state file
+// is still running and its process ID is not reused by another process.
+func isDetachedWorkerRunning(w detachedWorker) bool {
+	if err := syscall.Kill(w.PID, 0); err != nil && err != syscall.EPERM {
+		return false
+	}
+	if w.StartTime == 0 {
+		return true
+	}
+	startTime, err := processStartTime(w.PID)
+	return err == nil && startTime == w.StartTime
+}
@@ -0,0 +1,122 @@
+package serverstarter
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// drainedWorkerExitGrace is the duration for which the master waits for the old
+// worker to exit by itself before killing it, when the DrainPolicy escalates
+// after the old worker reports no active connections.
+const drainedWorkerExitGrace = 2 * time.Second
+
+// DrainStats is the statistics of the old worker which is shutting down gracefully
+// after the master sends the signal set by SetGracefulShutdownSignalToChild.
+type DrainStats struct {
+	// PID is the process ID of the old worker.
+	PID int
+
+	// Elapsed is the duration since the master sent the graceful shutdown signal.
+	Elapsed time.Duration
+
+	// CPUTime is the user and system CPU time consumed by the old worker so far.
+	// It is zero on platforms where the CPU time of another process is not available.
+	CPUTime time.Duration
+
+	// TCPConns is the number of the established TCP connections of the old worker,
+	// which the master counts by itself without the help of the worker. It includes
+	// the connections the old worker made to other servers, for example databases.
+	// It is valid only if TCPConnsCounted is true, which is only on Linux.
+	TCPConns int
+
+	// TCPConnsCounted is true if the master counted TCPConns.
+	TCPConnsCounted bool
+
+	// ActiveConns is the number of in-flight connections which the old worker
+	// reported last with SendDrainProgress.
+	// It is valid only if ActiveConnsReported is true.
+	ActiveConns int
+
+	// ActiveConnsReported is true if the old worker has reported
+	// the number of in-flight connections with SendDrainProgress.
+	ActiveConnsReported bool
+}
+
+// DrainDecision is the decision made by a DrainPolicy.
+type DrainDecision int
+
+const (
+	// DrainWait makes the master keep waiting for the old worker to exit.
+	DrainWait DrainDecision = iota
+	// DrainContinue makes the master stop waiting for the old worker and
+	// leave it exit in the background.
+	DrainContinue
+	// DrainEscalate makes the master kill the old worker with SIGKILL.
+	// If the old worker has reported no active connections with
+	// SendDrainProgress, the master waits 2 seconds for it to exit by itself
+	// before killing it, and the exit in the meantime is not counted as forced.
+	DrainEscalate
+)
+
+// DrainPolicy decides what to do while the old worker is draining.
+type DrainPolicy interface {
+	// Decide is called when the master sends the graceful shutdown signal to
+	// the old worker and is called again until the old worker exits.
+	// When it returns DrainWait, the next call is made after the returned duration
+	// unless the old worker exits before that. The returned duration is ignored
+	// for the other decisions.
+	Decide(stats DrainStats) (decision DrainDecision, next time.Duration)
+}
+
+// DrainPolicyFunc is an adapter to allow the use of an ordinary function as a DrainPolicy.
+type DrainPolicyFunc func(stats DrainStats) (DrainDecision, time.Duration)
+
+// Decide calls f(stats).
+func (f DrainPolicyFunc) Decide(stats DrainStats) (DrainDecision, time.Duration) {
+	return f(stats)
+}
+
+// TimeoutDrainPolicy returns a DrainPolicy which waits for the old worker until
+// the timeout and escalates after that. This is the default policy with the
+// timeout set by SetChildShutdownWaitTimeout.
+//
+// If the old worker reports zero in-flight connections with SendDrainProgress,
+// the policy escalates without waiting for the timeout.
+func TimeoutDrainPolicy(timeout time.Duration) DrainPolicy {
+	return DrainPolicyFunc(func(stats DrainStats) (DrainDecision, time.Duration) {
+		if stats.Elapsed >= timeout || (stats.ActiveConnsReported && stats.ActiveConns == 0) {
+			return DrainEscalate, 0
+		}
+		return DrainWait, timeout - stats.Elapsed
+	})
+}
+
+// SetDrainPolicy sets the policy to decide whether to keep waiting for the old worker,
+// to stop waiting, or to kill it while it is shutting down gracefully on SIGHUP.
+// If no SetDrainPolicy is called, TimeoutDrainPolicy with the timeout set by
+// SetChildShutdownWaitTimeout is used.
+func SetDrainPolicy(policy DrainPolicy) Option {
+	return func(s *Starter) {
+		s.drainPolicy = policy
+	}
+}
+
+// SendDrainProgress reports the number of in-flight connections from the worker
+// to the master while the worker is shutting down gracefully after receiving
+// the signal set by SetGracefulShutdownSignalToChild.
+// The worker should call it periodically and when the number changes.
+// The master logs the number, emits EventDrainProgress and passes the number
+// to the DrainPolicy in DrainStats.
+func (s *Starter) SendDrainProgress(activeConns int) error {
+	if activeConns < 0 {
+		return errors.New("activeConns must not be negative")
+	}
+	var v [4]byte
+	binary.BigEndian.PutUint32(v[:], uint32(activeConns))
+	if err := s.sendMessage(drainByte, v[:]...); err != nil {
+		return fmt.Errorf("failed to send drain progress to parent; %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package serverstarter
+
+import (
+	"fmt"
+)
+
+// RequestListen asks the master to bind a new listener at the listen address
+// addr in the form of ParseListenAddress while it is running, like the control
+// command "listen". The listener is passed to the workers started after that,
+// so the worker should request a reload with RequestReload and the next
+// worker can get it with ListenerFor.
+//
+// It must be called after SendReady. It needs the master of this version or
+// later. The master logs the result since it does not reply.
+func (s *Starter) RequestListen(addr string) error {
+	if s.readyPipe() == nil {
+		return fmt.Errorf("RequestListen %w", ErrReadyNotSent)
+	}
+	if _, _, err := ParseListenAddress(addr); err != nil {
+		return err
+	}
+	if err := s.sendMessage(listenRequestByte, []byte(addr)...); err != nil {
+		return fmt.Errorf("failed to send listen request to parent; %w", err)
+	}
+	return nil
+}
+
+// addListenRequest records the listen address requested by the worker with
+// RequestListen.
+func (w *worker) addListenRequest(addr string) {
+	w.mu.Lock()
+	w.listenRequests = append(w.listenRequests, addr)
+	w.mu.Unlock()
+}
+
+// takeListenRequests returns the listen addresses requested by the worker and
+// clears them.
+func (w *worker) takeListenRequests() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	addrs := w.listenRequests
+	w.listenRequests = nil
+	return addrs
+}
@@ -0,0 +1,294 @@
+//go:build !windows
+
+package serverstarter
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+// addListener binds a new listener at the listen address addr in the form of
+// ParseListenAddress while the master is running, and returns its index.
+// The listener is passed to the worker programs which are passed all the
+// listeners, from the workers started after this, for example on the next
+// reload. The name is used in the manifest if not empty.
+func (s *Starter) addListener(addr, name string) (int, error) {
+	// NOTE: The workers in the pool must be passed their own sockets bound
+	// with SO_REUSEPORT, which are bound only when the master starts.
+	if s.reusePortPool {
+		return 0, errors.New("listener cannot be added with SetReusePortPool")
+	}
+	network, address, err := ParseListenAddress(addr)
+	if err != nil {
+		return 0, err
+	}
+	for _, l := range s.listeners {
+		if addrMatches(network, address, l.Addr()) {
+			return 0, fmt.Errorf("listener for %s already exists", addr)
+		}
+	}
+	l, err := s.ListenWithOptions(network, address, s.listenOptions)
+	if err != nil {
+		return 0, fmt.Errorf("error in addListener after binding listener; %w", err)
+	}
+	s.unixSocketFiles = append(s.unixSocketFiles, s.createdUnixSocketFiles(keepUnixSocketFiles([]net.Listener{l}))...)
+	files, err := listenerFiles([]net.Listener{l})
+	// NOTE: The master keeps the duplicated file, not the listener.
+	l.Close()
+	if err != nil {
+		return 0, fmt.Errorf("error in addListener after getting file from listener; %w", err)
+	}
+
+	// NOTE: We hold mu while modifying the listeners so that the goroutines
+	// serving the takeover socket can read them.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	index := len(s.listeners)
+	s.listeners = append(s.listeners, l)
+	s.listenerFiles = append(s.listenerFiles, files[0])
+	if name != "" {
+		for len(s.listenerNames) < index {
+			s.listenerNames = append(s.listenerNames, "")
+		}
+		s.listenerNames = append(s.listenerNames, name)
+	}
+	for _, slot := range s.slots {
+		if slot.spec.Listeners == nil && slot.spec.ListenerGroup == "" {
+			slot.listenerFiles = append(slot.listenerFiles, files[0])
+			slot.listenerIndexes = append(slot.listenerIndexes, index)
+		}
+	}
+	s.out.printf("added listener %s at index %d, which is passed to workers started from now on\n", l.Addr(), index)
+	return index, nil
+}
+
+// listenCommand executes the control command "listen" and returns the response.
+func (s *Starter) listenCommand(command string) string {
+	index, err := s.addListener(listenArgs(command))
+	if err != nil {
+		s.out.eprintf("failed to add listener: %v\n", err)
+	}
+	return listenResponse(index, err)
+}
+
+// handleListenRequests adds the listeners requested by the worker w with
+// RequestListen.
+func (s *Starter) handleListenRequests(w *worker) {
+	for _, addr := range w.takeListenRequests() {
+		s.out.printf("received listen request for %s from worker: %s\n", addr, w.label())
+		if _, err := s.addListener(addr, ""); err != nil {
+			s.out.eprintf("failed to add listener for %s requested by worker %s: %v\n", addr, w.label(), err)
+		}
+	}
+}
+
+// removedListener is the listener removed by removeListener, which is closed
+// after the old workers exit, or put back if the reload fails.
+type removedListener struct {
+	listener net.Listener
+	// files are the files of the listener including the sockets for
+	// the workers bound by SetReusePortPool.
+	files []*os.File
+	// path is the path of the socket file if it is a unix domain socket
+	// listener whose socket file this process created.
+	path string
+
+	// The fields below are the state before removing the listener, which
+	// restoreListener puts back.
+	listeners       []net.Listener
+	listenerFiles   []*os.File
+	listenerNames   []string
+	listenerGroups  map[string][]int
+	unixSocketFiles []string
+	slotFiles       map[*workerSlot][]*os.File
+	slotIndexes     map[*workerSlot][]int
+	slotListeners   map[*workerSlot][]int
+}
+
+// removeListener removes the listener with the name or at the listen address
+// target in the form of ParseListenAddress from the listeners passed to
+// the workers started after this.
+func (s *Starter) removeListener(target string) (*removedListener, error) {
+	index := -1
+	for i, name := range s.listenerNames {
+		if name == target {
+			index = i
+			break
+		}
+	}
+	if index == -1 {
+		network, address, err := ParseListenAddress(target)
+		if err != nil {
+			return nil, fmt.Errorf("no listener with name %q; %w", target, err)
+		}
+		for i, l := range s.listeners {
+			if addrMatches(network, address, l.Addr()) {
+				index = i
+				break
+			}
+		}
+	}
+	if index == -1 {
+		return nil, fmt.Errorf("listener for %s is not found", target)
+	}
+	if len(s.listeners) == 1 {
+		return nil, errors.New("the last listener cannot be removed")
+	}
+
+	// NOTE: We make new slices instead of removing in place, since the slots
+	// may share the underlying arrays with the master, and restoreListener
+	// puts back the old slices.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := &removedListener{
+		listener:        s.listeners[index],
+		listeners:       s.listeners,
+		listenerFiles:   s.listenerFiles,
+		listenerNames:   s.listenerNames,
+		listenerGroups:  s.listenerGroups,
+		unixSocketFiles: s.unixSocketFiles,
+		slotFiles:       make(map[*workerSlot][]*os.File),
+		slotIndexes:     make(map[*workerSlot][]int),
+		slotListeners:   make(map[*workerSlot][]int),
+	}
+	addr := r.listener.Addr()
+	file := s.listenerFiles[index]
+	s.listeners = append(append([]net.Listener(nil), s.listeners[:index]...), s.listeners[index+1:]...)
+	s.listenerFiles = append(append([]*os.File(nil), s.listenerFiles[:index]...), s.listenerFiles[index+1:]...)
+	if index < len(s.listenerNames) {
+		s.listenerNames = append(append([]string(nil), s.listenerNames[:index]...), s.listenerNames[index+1:]...)
+	}
+	if s.listenerGroups != nil {
+		groups := make(map[string][]int, len(s.listenerGroups))
+		for name, indexes := range s.listenerGroups {
+			groups[name] = removeListenerIndex(indexes, index)
+		}
+		s.listenerGroups = groups
+	}
+	r.files = []*os.File{file}
+	for _, slot := range s.slots {
+		r.slotFiles[slot] = slot.listenerFiles
+		r.slotIndexes[slot] = slot.listenerIndexes
+		r.slotListeners[slot] = slot.spec.Listeners
+		if slot.spec.Listeners != nil {
+			slot.spec.Listeners = removeListenerIndex(slot.spec.Listeners, index)
+		}
+		var files []*os.File
+		var indexes []int
+		for j, i := range slot.listenerIndexes {
+			switch {
+			case i < index:
+				indexes = append(indexes, i)
+			case i > index:
+				indexes = append(indexes, i-1)
+			default:
+				// NOTE: The socket for the worker bound by SetReusePortPool is removed too.
+				if slot.listenerFiles[j] != file {
+					r.files = append(r.files, slot.listenerFiles[j])
+				}
+				continue
+			}
+			files = append(files, slot.listenerFiles[j])
+		}
+		slot.listenerFiles = files
+		slot.listenerIndexes = indexes
+	}
+
+	if addr.Network() == "unix" || addr.Network() == "unixpacket" {
+		for i, p := range s.unixSocketFiles {
+			if p == addr.String() {
+				r.path = p
+				s.unixSocketFiles = append(append([]string(nil), s.unixSocketFiles[:i]...), s.unixSocketFiles[i+1:]...)
+				break
+			}
+		}
+	}
+	s.out.printf("removed listener %s at index %d, which is not passed to workers started from now on\n", addr, index)
+	return r, nil
+}
+
+// removeListenerIndex returns indexes of the listeners without index and with
+// the ones after it shifted, for the listener at index removed. It returns
+// an empty slice instead of nil, which means all the listeners in WorkerSpec.
+func removeListenerIndex(indexes []int, index int) []int {
+	remapped := []int{}
+	for _, i := range indexes {
+		switch {
+		case i < index:
+			remapped = append(remapped, i)
+		case i > index:
+			remapped = append(remapped, i-1)
+		}
+	}
+	return remapped
+}
+
+// restoreListener puts back the listener removed by removeListener, so that it
+// is passed to the workers again.
+func (s *Starter) restoreListener(r *removedListener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeners = r.listeners
+	s.listenerFiles = r.listenerFiles
+	s.listenerNames = r.listenerNames
+	s.listenerGroups = r.listenerGroups
+	s.unixSocketFiles = r.unixSocketFiles
+	for _, slot := range s.slots {
+		if files, ok := r.slotFiles[slot]; ok {
+			slot.listenerFiles = files
+			slot.listenerIndexes = r.slotIndexes[slot]
+			slot.spec.Listeners = r.slotListeners[slot]
+		}
+	}
+	s.out.printf("put back listener %s, which is passed to workers started from now on\n", r.listener.Addr())
+}
+
+// closeRemovedListener closes the listener removed by removeListener and its
+// files, and removes its socket file if this process created it.
+func (s *Starter) closeRemovedListener(r *removedListener) {
+	// NOTE: The listener passed to RunMaster shares the socket with the files,
+	// so it must be closed too. The listener added with addListener is already
+	// closed and the error is ignored.
+	r.listener.Close()
+	closeFiles(r.files)
+	if r.path != "" {
+		removeUnixSocketFiles(&s.out, []string{r.path})
+	}
+}
+
+// reloadSucceeded returns whether all the workers were replaced in the reload
+// with results.
+func reloadSucceeded(results []ReloadResult) bool {
+	if len(results) == 0 {
+		return false
+	}
+	for _, r := range results {
+		if r.Err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// unlistenCommand executes the control command "unlisten", which removes
+// the listener and reloads the workers so that the old workers stop accepting
+// on it, and closes the listener after the old workers exit. If the reload
+// fails, the listener is put back since the old workers keep accepting on it.
+func (s *Starter) unlistenCommand(command string) (resp string, exit bool, err error) {
+	removed, err := s.removeListener(commandArg(command))
+	if err != nil {
+		s.out.eprintf("failed to remove listener: %v\n", err)
+		return "error: " + err.Error(), false, nil
+	}
+	results, exit, err := s.reloadOnSignal()
+	if !exit && err == nil && !reloadSucceeded(results) {
+		s.out.eprintf("failed to reload workers after removing listener %s, putting it back\n", commandArg(command))
+		s.restoreListener(removed)
+		return reloadResponse(results), exit, err
+	}
+	s.closeRemovedListener(removed)
+	s.out.printf("closed removed listener %s\n", commandArg(command))
+	return reloadResponse(results), exit, err
+}
@@ -0,0 +1,147 @@
+//go:build !windows
+
+package serverstarter
+
+import (
+	"io/ioutil"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// listenersForTest binds n TCP listeners and sets them to s like RunMaster.
+func listenersForTest(t *testing.T, s *Starter, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { l.Close() })
+		s.listeners = append(s.listeners, l)
+	}
+	files, err := listenerFiles(s.listeners)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { closeFiles(files) })
+	s.listenerFiles = files
+	slots, err := s.newWorkerSlots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.slots = slots
+}
+
+// slotListenerIndexes returns the indexes of the listeners passed to the slots
+// and the indexes in their WorkerSpec by the worker names.
+func slotListenerIndexes(s *Starter) (indexes, specListeners map[string][]int) {
+	indexes = make(map[string][]int)
+	specListeners = make(map[string][]int)
+	for _, slot := range s.slots {
+		indexes[slot.spec.Name] = slot.listenerIndexes
+		specListeners[slot.spec.Name] = slot.spec.Listeners
+	}
+	return indexes, specListeners
+}
+
+func TestRemoveListenerRemapsIndexes(t *testing.T) {
+	s := New(SetOutput(ioutil.Discard),
+		SetListenerGroup("public", 0, 1), SetListenerGroup("admin", 2),
+		AddWorker(WorkerSpec{Name: "web", ListenerGroup: "public"}),
+		AddWorker(WorkerSpec{Name: "admin", ListenerGroup: "admin"}),
+		AddWorker(WorkerSpec{Name: "api", Listeners: []int{1, 2}}),
+		AddWorker(WorkerSpec{Name: "all"}))
+	listenersForTest(t, s, 3)
+	oldIndexes, oldSpecListeners := slotListenerIndexes(s)
+
+	r, err := s.removeListener(s.listeners[1].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantGroups := map[string][]int{"public": {0}, "admin": {1}}
+	if !reflect.DeepEqual(s.listenerGroups, wantGroups) {
+		t.Errorf("listener groups mismatch, got=%v, want=%v", s.listenerGroups, wantGroups)
+	}
+	indexes, specListeners := slotListenerIndexes(s)
+	wantIndexes := map[string][]int{"web": {0}, "admin": {1}, "api": {1}, "all": {0, 1}}
+	if !reflect.DeepEqual(indexes, wantIndexes) {
+		t.Errorf("slot listener indexes mismatch, got=%v, want=%v", indexes, wantIndexes)
+	}
+	wantSpecListeners := map[string][]int{"web": nil, "admin": nil, "api": {1}, "all": nil}
+	if !reflect.DeepEqual(specListeners, wantSpecListeners) {
+		t.Errorf("worker spec listeners mismatch, got=%v, want=%v", specListeners, wantSpecListeners)
+	}
+
+	s.restoreListener(r)
+	wantGroups = map[string][]int{"public": {0, 1}, "admin": {2}}
+	if !reflect.DeepEqual(s.listenerGroups, wantGroups) {
+		t.Errorf("restored listener groups mismatch, got=%v, want=%v", s.listenerGroups, wantGroups)
+	}
+	indexes, specListeners = slotListenerIndexes(s)
+	if !reflect.DeepEqual(indexes, oldIndexes) {
+		t.Errorf("restored slot listener indexes mismatch, got=%v, want=%v", indexes, oldIndexes)
+	}
+	if !reflect.DeepEqual(specListeners, oldSpecListeners) {
+		t.Errorf("restored worker spec listeners mismatch, got=%v, want=%v", specListeners, oldSpecListeners)
+	}
+}
+
+func TestRemoveListenerRemapsShards(t *testing.T) {
+	s := New(SetOutput(ioutil.Discard), SetWorkerCount(2), SetShardPolicy(RoundRobinShardPolicy()))
+	listenersForTest(t, s, 3)
+
+	if _, err := s.removeListener(s.listeners[1].Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	indexes, specListeners := slotListenerIndexes(s)
+	// NOTE: The worker whose only listener is removed must not get all
+	// the listeners, which a nil WorkerSpec.Listeners means.
+	wantSpecListeners := map[string][]int{"worker-0": {0, 1}, "worker-1": {}}
+	if !reflect.DeepEqual(specListeners, wantSpecListeners) {
+		t.Errorf("worker spec listeners mismatch, got=%v, want=%v", specListeners, wantSpecListeners)
+	}
+	if got, want := indexes["worker-0"], []int{0, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("slot listener indexes mismatch, got=%v, want=%v", got, want)
+	}
+	if got := indexes["worker-1"]; len(got) != 0 {
+		t.Errorf("slot listener indexes must be empty, got=%v", got)
+	}
+
+	// NOTE: The added listener is not passed to the workers with assigned listeners.
+	if _, err := s.addListener("127.0.0.1:0", ""); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { closeFiles(s.listenerFiles[2:]) })
+	indexes, _ = slotListenerIndexes(s)
+	if got, want := indexes["worker-0"], []int{0, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("slot listener indexes after adding listener mismatch, got=%v, want=%v", got, want)
+	}
+}
+
+func TestAddListenerListenerGroup(t *testing.T) {
+	s := New(SetOutput(ioutil.Discard), SetListenerGroup("public", 0),
+		AddWorker(WorkerSpec{Name: "web", ListenerGroup: "public"}),
+		AddWorker(WorkerSpec{Name: "all"}))
+	listenersForTest(t, s, 1)
+
+	if _, err := s.addListener("127.0.0.1:0", ""); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { closeFiles(s.listenerFiles[1:]) })
+	indexes, _ := slotListenerIndexes(s)
+	wantIndexes := map[string][]int{"web": {0}, "all": {0, 1}}
+	if !reflect.DeepEqual(indexes, wantIndexes) {
+		t.Errorf("slot listener indexes mismatch, got=%v, want=%v", indexes, wantIndexes)
+	}
+}
+
+func TestAddListenerReusePortPool(t *testing.T) {
+	s := New(SetOutput(ioutil.Discard), SetWorkerCount(2), SetReusePortPool(true))
+	if _, err := s.addListener("127.0.0.1:0", ""); err == nil {
+		t.Error("listener must not be added with SetReusePortPool")
+	}
+	if len(s.listeners) != 0 {
+		t.Errorf("listener is added, got=%v", s.listeners)
+	}
+}
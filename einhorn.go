@@ -0,0 +1,131 @@
+package serverstarter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+const (
+	// envEinhornFDCount is the environment variable which Einhorn sets for
+	// passing the number of the listeners.
+	envEinhornFDCount = "EINHORN_FD_COUNT"
+	// envEinhornFDPrefix is the prefix of the environment variables which Einhorn
+	// sets for passing the file descriptor of each listener, for example EINHORN_FD_0.
+	envEinhornFDPrefix = "EINHORN_FD_"
+	// envEinhornSockPath is the environment variable which Einhorn sets for
+	// passing the path of its command socket.
+	envEinhornSockPath = "EINHORN_SOCK_PATH"
+	// envEinhornSockFD is the environment variable which Einhorn sets for
+	// passing the file descriptor of the connection to its command socket.
+	envEinhornSockFD = "EINHORN_SOCK_FD"
+	// envEinhornMasterPID is the environment variable which Einhorn sets for
+	// passing its process ID.
+	envEinhornMasterPID = "EINHORN_MASTER_PID"
+)
+
+// SetEinhornEnv makes the master and the worker use the environment variables
+// and the worker ACK protocol of Einhorn in addition to LISTEN_FDS and SendReady,
+// so that the workers written for Einhorn run under this master and the workers
+// using this package run under Einhorn.
+//
+// The master sets EINHORN_FD_COUNT, EINHORN_FD_0, EINHORN_FD_1 and so on,
+// EINHORN_MASTER_PID and EINHORN_SOCK_PATH for the workers, and treats
+// the worker as ready when the worker sends the ACK {"command":"worker:ack","pid":PID}
+// to the command socket at EINHORN_SOCK_PATH, in addition to when it sends
+// ready with SendReady. The command socket accepts only the ACK.
+//
+// The worker started by Einhorn, which sets EINHORN_FD_COUNT but not LISTEN_FDS,
+// gets the listeners from EINHORN_FD_n, and SendReady sends the ACK to Einhorn.
+// The other notifications to the master do nothing in such a worker.
+//
+// It cannot be used with SetPassFDsOverSocket, since the file descriptors of
+// the listeners in the worker are not known to the master.
+func SetEinhornEnv(enabled bool) Option {
+	return func(s *Starter) {
+		s.einhornEnv = enabled
+	}
+}
+
+// einhornMessage is a message sent to the command socket of Einhorn.
+type einhornMessage struct {
+	Command string `json:"command"`
+	PID     int    `json:"pid"`
+}
+
+// einhornAckCommand is the command of the ACK sent by the worker.
+const einhornAckCommand = "worker:ack"
+
+// startedByEinhorn returns whether this process is the worker started by
+// Einhorn, not by the master of this package.
+func (s *Starter) startedByEinhorn() bool {
+	if !s.einhornEnv {
+		return false
+	}
+	if _, ok := lookupWorkerEnv(s.envListenFDs); ok {
+		return false
+	}
+	_, ok := os.LookupEnv(envEinhornFDCount)
+	return ok
+}
+
+// einhornFDs returns the file descriptors of the listeners passed from Einhorn.
+func einhornFDs() ([]uintptr, error) {
+	count, err := strconv.Atoi(os.Getenv(envEinhornFDCount))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s; %w", envEinhornFDCount, err)
+	}
+	fds := make([]uintptr, count)
+	for i := range fds {
+		key := envEinhornFDPrefix + strconv.Itoa(i)
+		fd, err := strconv.Atoi(os.Getenv(key))
+		if err != nil || fd < 0 {
+			return nil, fmt.Errorf("invalid file descriptor in %s", key)
+		}
+		fds[i] = uintptr(fd)
+	}
+	return fds, nil
+}
+
+// einhornEnv returns the environment variables of Einhorn for the worker whose
+// listeners are at the file descriptors from firstFD.
+func einhornEnv(listenerCount, firstFD int, sockPath string) []string {
+	env := []string{envEinhornFDCount + "=" + strconv.Itoa(listenerCount)}
+	for i := 0; i < listenerCount; i++ {
+		env = append(env, envEinhornFDPrefix+strconv.Itoa(i)+"="+strconv.Itoa(firstFD+i))
+	}
+	env = append(env, envEinhornMasterPID+"="+strconv.Itoa(os.Getpid()))
+	env = append(env, envEinhornSockPath+"="+sockPath)
+	return env
+}
+
+// sendEinhornAck sends the ACK of this process to Einhorn.
+func sendEinhornAck() error {
+	data, err := json.Marshal(einhornMessage{Command: einhornAckCommand, PID: os.Getpid()})
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if v, ok := os.LookupEnv(envEinhornSockFD); ok {
+		fd, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid %s; %w", envEinhornSockFD, err)
+		}
+		_, err = os.NewFile(uintptr(fd), "einhorn").Write(data)
+		return err
+	}
+	path := os.Getenv(envEinhornSockPath)
+	if path == "" {
+		return errors.New("no command socket of Einhorn is passed to this process")
+	}
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	_, err = c.Write(data)
+	return err
+}
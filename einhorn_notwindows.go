@@ -0,0 +1,120 @@
+//go:build !windows
+
+package serverstarter
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// startEinhornSocket listens on the command socket for the ACKs from the workers
+// written for Einhorn, and returns the function to stop it.
+func (s *Starter) startEinhornSocket() (stop func(), err error) {
+	dir, err := ioutil.TempDir("", "serverstarter-einhorn-")
+	if err != nil {
+		return nil, fmt.Errorf("error in startEinhornSocket after creating directory; %w", err)
+	}
+	path := filepath.Join(dir, "einhorn.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("error in startEinhornSocket after listening; %w", err)
+	}
+	s.einhornSockPath = path
+	go s.serveEinhornSocket(l)
+	return func() {
+		l.Close()
+		os.RemoveAll(dir)
+	}, nil
+}
+
+// serveEinhornSocket accepts the connections to the command socket until it is closed.
+func (s *Starter) serveEinhornSocket(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go s.handleEinhornConn(c)
+	}
+}
+
+// handleEinhornConn reads the messages from the connection to the command socket,
+// which are JSON objects terminated by a newline with '%' and newlines escaped
+// with the URL encoding, and relays the ACKs to the workers.
+func (s *Starter) handleEinhornConn(c net.Conn) {
+	defer c.Close()
+	sc := bufio.NewScanner(c)
+	for sc.Scan() {
+		var msg einhornMessage
+		line, err := url.PathUnescape(sc.Text())
+		if err == nil {
+			err = json.Unmarshal([]byte(line), &msg)
+		}
+		if err != nil || msg.Command != einhornAckCommand {
+			s.out.eprintf("ignored unsupported message on Einhorn command socket: %q\n", sc.Text())
+			continue
+		}
+		w := s.takeEinhornWorker(msg.PID)
+		if w == nil {
+			s.out.eprintf("ignored ACK from unknown worker pid=%d\n", msg.PID)
+			continue
+		}
+		s.out.printf("received ACK from worker: %s\n", w.label())
+		w.relayAck()
+	}
+}
+
+// registerEinhornWorker registers the worker w for receiving its ACK, and
+// unregisters the workers which have exited without sending the ACK.
+func (s *Starter) registerEinhornWorker(w *worker) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.einhornWorkers == nil {
+		s.einhornWorkers = make(map[int]*worker)
+	}
+	for pid, other := range s.einhornWorkers {
+		if !other.waitingAck() {
+			delete(s.einhornWorkers, pid)
+		}
+	}
+	s.einhornWorkers[w.pid()] = w
+}
+
+// takeEinhornWorker unregisters and returns the worker with the pid, or nil
+// if it is not registered.
+func (s *Starter) takeEinhornWorker(pid int) *worker {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w := s.einhornWorkers[pid]
+	delete(s.einhornWorkers, pid)
+	return w
+}
+
+// relayAck sends ready to the master on behalf of the worker which sent the ACK
+// of Einhorn, through the end of the socket to the master kept for the worker.
+func (w *worker) relayAck() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.ackW == nil {
+		return
+	}
+	if _, err := w.ackW.Write([]byte{readyByte}); err != nil {
+		w.out.eprintf("failed to relay ACK from worker: %s; %v\n", w.label(), err)
+	}
+	w.ackW.Close()
+	w.ackW = nil
+}
+
+// waitingAck returns whether the master is waiting for the ACK from the worker.
+func (w *worker) waitingAck() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.ackW != nil
+}
@@ -0,0 +1,127 @@
+package serverstarter
+
+import (
+	"fmt"
+	"path"
+	"sort"
+)
+
+// SetExtraEnv sets the environment variables which the master adds to
+// the environment of worker processes, for example deployment metadata like
+// a release ID or a hash of the configuration. They override the environment
+// variables of the master with the same keys.
+//
+// The environment variables which the master sets for passing file descriptors
+// and other information, such as LISTEN_FDS and SERVERSTARTER_GENERATION,
+// cannot be overridden and the ones with the same keys in env are ignored.
+func SetExtraEnv(env map[string]string) Option {
+	return func(s *Starter) {
+		s.extraEnvMap = env
+	}
+}
+
+// SetExtraEnvFunc sets the function which the master calls every time it starts
+// a worker to get the environment variables added to the environment of the worker.
+// The generation number of the worker is passed to fn (see Starter.Generation).
+// The environment variables returned from fn override the ones set by SetExtraEnv.
+// If fn returns an error, the master fails to start the worker.
+func SetExtraEnvFunc(fn func(generation int) (map[string]string, error)) Option {
+	return func(s *Starter) {
+		s.extraEnvFunc = fn
+	}
+}
+
+// SetEnvAllowlist sets the patterns of the keys of the environment variables of
+// the master which are passed to worker processes. Only the environment variables
+// whose keys match any of the patterns are passed. The patterns are in the syntax
+// of path.Match, for example "LANG", "LC_*" or "APP_*".
+// If no SetEnvAllowlist is called, all environment variables are passed
+// except the ones denied by SetEnvDenylist.
+//
+// The environment variables which the master sets and the ones set by SetExtraEnv
+// and SetExtraEnvFunc are not filtered.
+func SetEnvAllowlist(patterns []string) Option {
+	return func(s *Starter) {
+		s.envAllowlist = patterns
+	}
+}
+
+// SetEnvDenylist sets the patterns of the keys of the environment variables of
+// the master which are not passed to worker processes, for example "*_SECRET"
+// or "AWS_*". The patterns are in the syntax of path.Match. The denylist takes
+// precedence over the allowlist set by SetEnvAllowlist.
+//
+// The environment variables which the master sets and the ones set by SetExtraEnv
+// and SetExtraEnvFunc are not filtered.
+func SetEnvDenylist(patterns []string) Option {
+	return func(s *Starter) {
+		s.envDenylist = patterns
+	}
+}
+
+// envPassed returns whether the environment variable of the master with
+// the key is passed to the worker.
+func (s *Starter) envPassed(key string) (bool, error) {
+	denied, err := matchAny(s.envDenylist, key)
+	if err != nil {
+		return false, fmt.Errorf("invalid pattern in env denylist; %w", err)
+	}
+	if denied {
+		return false, nil
+	}
+	if s.envAllowlist == nil {
+		return true, nil
+	}
+	allowed, err := matchAny(s.envAllowlist, key)
+	if err != nil {
+		return false, fmt.Errorf("invalid pattern in env allowlist; %w", err)
+	}
+	return allowed, nil
+}
+
+// matchAny returns whether name matches any of the patterns.
+func matchAny(patterns []string, name string) (bool, error) {
+	for _, pattern := range patterns {
+		matched, err := path.Match(pattern, name)
+		if err != nil {
+			return false, err
+		}
+		if matched {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// extraEnv returns the environment variables set by SetExtraEnv, SetExtraEnvFunc
+// and WorkerSpec.Env for the worker of the generation in slot in the form "key=value"
+// sorted by the keys.
+func (s *Starter) extraEnv(slot *workerSlot, generation int) ([]string, error) {
+	merged := make(map[string]string, len(s.extraEnvMap))
+	for k, v := range s.extraEnvMap {
+		merged[k] = v
+	}
+	if s.extraEnvFunc != nil {
+		env, err := s.extraEnvFunc(generation)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range env {
+			merged[k] = v
+		}
+	}
+	for k, v := range slot.spec.Env {
+		merged[k] = v
+	}
+
+	keys := make([]string, 0, len(merged))
+	for k := range merged {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	env := make([]string, len(keys))
+	for i, k := range keys {
+		env[i] = k + "=" + merged[k]
+	}
+	return env, nil
+}
@@ -0,0 +1,123 @@
+//go:build !windows
+
+package serverstarter
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestEnvPassed(t *testing.T) {
+	testCases := []struct {
+		allow []string
+		deny  []string
+		key   string
+		want  bool
+	}{
+		{key: "APP_NAME", want: true},
+		{allow: []string{}, key: "APP_NAME", want: false},
+		{allow: []string{"APP_*"}, key: "APP_NAME", want: true},
+		{allow: []string{"APP_*"}, key: "LANG", want: false},
+		{allow: []string{"LANG", "LC_*"}, key: "LC_ALL", want: true},
+		{deny: []string{"*_SECRET"}, key: "APP_SECRET", want: false},
+		{deny: []string{"*_SECRET"}, key: "APP_NAME", want: true},
+		{allow: []string{"APP_*"}, deny: []string{"*_SECRET"}, key: "APP_SECRET", want: false},
+		{allow: []string{"APP_SECRET"}, deny: []string{"APP_SECRET"}, key: "APP_SECRET", want: false},
+		{allow: []string{"*"}, deny: []string{"AWS_*"}, key: "AWS_REGION", want: false},
+	}
+	for _, c := range testCases {
+		s := New(SetEnvAllowlist(c.allow), SetEnvDenylist(c.deny))
+		got, err := s.envPassed(c.key)
+		if err != nil {
+			t.Errorf("unexpected error for allow=%q, deny=%q, key=%s; %v", c.allow, c.deny, c.key, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("result mismatch for allow=%q, deny=%q, key=%s, got=%v, want=%v", c.allow, c.deny, c.key, got, c.want)
+		}
+	}
+}
+
+func TestEnvPassedInvalidPattern(t *testing.T) {
+	for _, opt := range []Option{SetEnvAllowlist([]string{"["}), SetEnvDenylist([]string{"["})} {
+		s := New(opt)
+		if _, err := s.envPassed("APP_NAME"); err == nil {
+			t.Error("error must be returned for invalid pattern")
+		}
+	}
+}
+
+func TestBuildEnvFilter(t *testing.T) {
+	inherited := map[string]string{
+		"APP_NAME":                 "app",
+		"APP_SECRET":               "secret",
+		"LANG":                     "C",
+		"LISTEN_FDS":               "9",
+		"SERVERSTARTER_GENERATION": "7",
+	}
+	for k, v := range inherited {
+		old, ok := os.LookupEnv(k)
+		os.Setenv(k, v)
+		k := k
+		t.Cleanup(func() {
+			if ok {
+				os.Setenv(k, old)
+			} else {
+				os.Unsetenv(k)
+			}
+		})
+	}
+	// NOTE: The variables which the master sets are always passed with the
+	// values set by the master, whatever the allowlist and the denylist are.
+	set := []string{"LISTEN_FDS=1", "SERVERSTARTER_GENERATION=2"}
+	extraEnv := map[string]string{"RELEASE": "v1", "LISTEN_FDS": "5"}
+
+	testCases := []struct {
+		allow []string
+		deny  []string
+		want  []string
+	}{
+		{want: []string{"APP_NAME", "APP_SECRET", "LANG"}},
+		{deny: []string{"*_SECRET"}, want: []string{"APP_NAME", "LANG"}},
+		{allow: []string{"APP_*"}, want: []string{"APP_NAME", "APP_SECRET"}},
+		{allow: []string{"APP_*"}, deny: []string{"*_SECRET"}, want: []string{"APP_NAME"}},
+		{allow: []string{"LANG"}, deny: []string{"LANG"}},
+		{deny: []string{"*"}},
+		{allow: []string{"NOMATCH"}},
+		{allow: []string{"NOMATCH"}, deny: []string{"LISTEN_FDS", "SERVERSTARTER_*", "RELEASE"}},
+	}
+	for _, c := range testCases {
+		s := New(SetEnvAllowlist(c.allow), SetEnvDenylist(c.deny), SetExtraEnv(extraEnv))
+		slots, err := s.newWorkerSlots()
+		if err != nil {
+			t.Fatal(err)
+		}
+		env, err := s.buildEnv(slots[0], 2, set)
+		if err != nil {
+			t.Fatalf("failed to build env for allow=%q, deny=%q; %v", c.allow, c.deny, err)
+		}
+
+		values := make(map[string][]string)
+		for _, v := range env {
+			k := envKey(v)
+			values[k] = append(values[k], v[len(k)+1:])
+		}
+		wantValues := map[string][]string{
+			"LISTEN_FDS":               {"1"},
+			"SERVERSTARTER_GENERATION": {"2"},
+			"RELEASE":                  {"v1"},
+		}
+		for _, k := range c.want {
+			wantValues[k] = []string{inherited[k]}
+		}
+		for k := range inherited {
+			if !reflect.DeepEqual(values[k], wantValues[k]) {
+				t.Errorf("%s mismatch for allow=%q, deny=%q, got=%q, want=%q", k, c.allow, c.deny, values[k], wantValues[k])
+			}
+		}
+		if got, want := values["RELEASE"], wantValues["RELEASE"]; !reflect.DeepEqual(got, want) {
+			t.Errorf("RELEASE mismatch for allow=%q, deny=%q, got=%q, want=%q", c.allow, c.deny, got, want)
+		}
+	}
+}
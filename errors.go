@@ -0,0 +1,64 @@
+package serverstarter
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The errors returned from the functions and the methods of this package.
+// They are wrapped with the context, so use errors.Is to check them.
+var (
+	// ErrNotWorker is returned from the methods for the worker, such as SendReady,
+	// when this process is not started by the master, or the pipe to the master
+	// is passed to another process, for example the parent process of this
+	// process is a wrapper which forks it.
+	ErrNotWorker = errors.New("no pipe to master is passed to this process")
+
+	// ErrReadyNotSent is returned from the methods for the worker which must be
+	// called after SendReady, such as SendWarm and Heartbeat, when they are called
+	// before it.
+	ErrReadyNotSent = errors.New("must be called after SendReady")
+
+	// ErrPipeClosed is returned from the methods for the worker after the pipe
+	// to the master is closed because SendReady failed.
+	ErrPipeClosed = errors.New("pipe to master is already closed")
+
+	// ErrReadyTimeout is returned from Upgrader.Upgrade when the new process
+	// does not call Upgrader.Ready in UpgraderOptions.ReadyTimeout.
+	ErrReadyTimeout = errors.New("timed out waiting for ready")
+
+	// ErrUnsupported is returned when an option or a function is not supported
+	// on this platform.
+	ErrUnsupported = errors.New("not supported on this platform")
+
+	// ErrIncompatibleOptions is returned from RunMaster when the options which
+	// cannot be used together are set.
+	ErrIncompatibleOptions = errors.New("cannot be used together")
+)
+
+// WorkerStartError is the error when a new worker started by the master fails to
+// get ready, for example it exits before sending ready, in which case the master
+// kills the worker if it is still running. It is returned from RunMaster when
+// the master exits because of it, and set to ReloadResult.Err.
+// Use errors.As to get it.
+type WorkerStartError struct {
+	// PID is the process ID of the worker.
+	PID int
+	// Name is the name of the worker program set by AddWorker.
+	Name string
+	// ExitCode is the exit code of the worker, or -1 if the worker was killed
+	// or terminated by a signal.
+	ExitCode int
+	// Err is the reason why the worker did not get ready.
+	Err error
+	// exitErr is the error which describes the exit of the worker.
+	exitErr error
+}
+
+func (e *WorkerStartError) Error() string {
+	return fmt.Sprintf("new worker pid=%d did not get ready; %v; %v", e.PID, e.Err, e.exitErr)
+}
+
+func (e *WorkerStartError) Unwrap() error {
+	return e.Err
+}
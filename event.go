@@ -0,0 +1,171 @@
+package serverstarter
+
+import "time"
+
+// EventType is the type of an Event.
+type EventType string
+
+const (
+	// EventWorkerStarted is emitted when the master starts a worker.
+	EventWorkerStarted EventType = "worker_started"
+
+	// EventWorkerReady is emitted when the initial worker or the new worker in
+	// a reload gets ready. Elapsed is the duration since the worker started.
+	EventWorkerReady EventType = "worker_ready"
+
+	// EventWorkerExited is emitted when a worker exits without being stopped by
+	// the master, for example when it crashes.
+	EventWorkerExited EventType = "worker_exited"
+
+	// EventReloadStarted is emitted when the master starts reloading a worker.
+	// PID and Generation are of the old worker.
+	EventReloadStarted EventType = "reload_started"
+
+	// EventReloadSucceeded is emitted when the new worker replaced the old worker
+	// in a reload. PID and Generation are of the new worker, and Elapsed is
+	// the duration of the reload.
+	EventReloadSucceeded EventType = "reload_succeeded"
+
+	// EventReloadFailed is emitted when the new worker fails to start or to get ready
+	// on SIGHUP. The old worker keeps running in this case.
+	EventReloadFailed EventType = "reload_failed"
+
+	// EventOldWorkerExited is emitted when the old worker exits after the master
+	// sends the graceful shutdown signal on SIGHUP. It is not emitted when the
+	// drain policy decides DrainContinue.
+	EventOldWorkerExited EventType = "old_worker_exited"
+
+	// EventDrainProgress is emitted when the old worker reports the number of
+	// in-flight connections with SendDrainProgress while it is shutting down gracefully.
+	EventDrainProgress EventType = "drain_progress"
+)
+
+// Event is an event which happens in the master.
+type Event struct {
+	// Type is the type of the event.
+	Type EventType
+
+	// Time is the time when the event happened.
+	Time time.Time
+
+	// PID is the process ID of the worker which the event is about.
+	PID int
+
+	// Worker is the name of the worker program set by AddWorker which the event is about.
+	Worker string
+
+	// Generation is the generation number of the worker which the event is about.
+	// It is 0 if it is unknown.
+	Generation int
+
+	// Forced is true if the old worker did not exit gracefully and was killed
+	// with SIGKILL. It is used for EventOldWorkerExited.
+	Forced bool
+
+	// Elapsed is the duration since the master sent the graceful shutdown signal
+	// for EventOldWorkerExited and EventDrainProgress, the duration since the
+	// worker started for EventWorkerReady, and the duration of the reload for
+	// EventReloadSucceeded.
+	Elapsed time.Duration
+
+	// ActiveConns is the number of in-flight connections reported by the old worker.
+	// It is used for EventDrainProgress.
+	ActiveConns int
+
+	// Err is the error of the event if any, for example the error returned from
+	// waiting for the worker to exit.
+	Err error
+}
+
+// SetEventHandler sets the function which is called for events in the master.
+// The handler is called in the goroutine running RunMaster, so it should not block long.
+func SetEventHandler(handler func(Event)) Option {
+	return func(s *Starter) {
+		s.eventHandler = handler
+	}
+}
+
+// Stats is the statistics of the master.
+type Stats struct {
+	// GracefulShutdowns is the number of old workers which exited
+	// gracefully after reloads.
+	GracefulShutdowns int
+
+	// ForcedShutdowns is the number of old workers which were killed with SIGKILL
+	// after reloads.
+	ForcedShutdowns int
+
+	// LastShutdownForced is true if the old worker in the last reload was killed
+	// with SIGKILL.
+	LastShutdownForced bool
+
+	// Reloading is true if a reload is in progress.
+	Reloading bool
+
+	// ReloadQueued is true if a reload command from the control socket is
+	// queued until the reload in progress finishes.
+	ReloadQueued bool
+
+	// TimeToReady is the histogram of the durations from starting workers
+	// to receiving ready from them, for the initial workers and the new workers
+	// in reloads.
+	TimeToReady DurationHistogram
+
+	// OldWorkerExit is the histogram of the durations from sending the graceful
+	// shutdown signal to old workers to their exits in reloads.
+	OldWorkerExit DurationHistogram
+
+	// ReloadDuration is the histogram of the durations of successful reloads.
+	ReloadDuration DurationHistogram
+}
+
+// Stats returns the statistics of the master.
+// It is safe to call Stats from another goroutine while RunMaster is running.
+func (s *Starter) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := s.stats
+	stats.Reloading = s.busy
+	stats.ReloadQueued = s.queuedReload != nil
+	stats.TimeToReady = stats.TimeToReady.clone()
+	stats.OldWorkerExit = stats.OldWorkerExit.clone()
+	stats.ReloadDuration = stats.ReloadDuration.clone()
+	return stats
+}
+
+// emit updates the statistics for the event and calls the event handler.
+func (s *Starter) emit(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	s.mu.Lock()
+	switch e.Type {
+	case EventOldWorkerExited:
+		if e.Forced {
+			s.stats.ForcedShutdowns++
+		} else {
+			s.stats.GracefulShutdowns++
+		}
+		s.stats.LastShutdownForced = e.Forced
+		s.stats.OldWorkerExit.observe(e.Elapsed)
+	case EventWorkerReady:
+		s.stats.TimeToReady.observe(e.Elapsed)
+	case EventReloadSucceeded:
+		s.stats.ReloadDuration.observe(e.Elapsed)
+	}
+	s.mu.Unlock()
+
+	if s.webhook != nil && isWebhookEvent(e.Type) {
+		s.webhook.notify(e)
+	}
+	if s.journal != nil {
+		if err := s.journal.sendEvent(e); err != nil {
+			s.out.eprintf("failed to send event to journal: %v\n", err)
+		}
+	}
+	if s.eventHandler != nil {
+		s.eventHandler(e)
+	}
+	s.runEventHook(e)
+}
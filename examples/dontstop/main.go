@@ -19,9 +19,10 @@ func main() {
 	startDelay := flag.Duration("start-delay", 0, "delay duration before start accepting requests")
 	handleDelay := flag.Duration("handle-delay", 0, "delay duration for handling each request")
 	//shutdownTimeout := flag.Duration("shutdown-timeout", 5*time.Second, "shutdown timeout")
+	childShutdownWaitTimeout := flag.Duration("child-shutdown-wait-timeout", 10*time.Second, "timeout for waiting the old worker to shutdown before killing it")
 	flag.Parse()
 
-	starter := serverstarter.New(serverstarter.SetChildShutdownWaitTimeout(10 * time.Second))
+	starter := serverstarter.New(serverstarter.SetChildShutdownWaitTimeout(*childShutdownWaitTimeout))
 	if starter.IsMaster() {
 		l, err := net.Listen("tcp", *addr)
 		if err != nil {
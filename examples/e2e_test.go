@@ -0,0 +1,249 @@
+//go:build e2e && !windows
+
+// Package examples_test runs the example servers as subprocesses and tests
+// the reload machinery end to end.
+//
+// Run the tests with:
+//
+//	go test -tags e2e ./examples/
+package examples_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// binDir is the directory of the example binaries built in TestMain.
+var binDir string
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "serverstarter-e2e-")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create temporary directory; %v\n", err)
+		os.Exit(1)
+	}
+	binDir = dir
+
+	code := 1
+	if err := buildExamples(); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to build examples; %v\n", err)
+	} else {
+		code = m.Run()
+	}
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func buildExamples() error {
+	for _, name := range []string{"simple", "graceserver", "dontstop"} {
+		cmd := exec.Command("go", "build", "-o", filepath.Join(binDir, name), "./"+name)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("error in buildExamples after building %s; %v", name, err)
+		}
+	}
+	return nil
+}
+
+// server is an example server running as a subprocess.
+type server struct {
+	t     *testing.T
+	cmd   *exec.Cmd
+	addr  string
+	lines chan string
+}
+
+// startServer starts the example binary with args followed by the flag
+// for the listen address.
+func startServer(t *testing.T, name, addrFlag string, args ...string) *server {
+	t.Helper()
+	addr := freeAddr(t)
+	args = append(args, addrFlag, addr)
+	cmd := exec.Command(filepath.Join(binDir, name), args...)
+	// NOTE: We start the master in a new process group, so that we can kill
+	// the master and its workers at once in the cleanup.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	pr, pw := io.Pipe()
+	cmd.Stdout = pw
+	cmd.Stderr = pw
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	srv := &server{t: t, cmd: cmd, addr: addr, lines: make(chan string, 100)}
+	go func() {
+		defer close(srv.lines)
+		sc := bufio.NewScanner(pr)
+		for sc.Scan() {
+			t.Logf("%s: %s", name, sc.Text())
+			srv.lines <- sc.Text()
+		}
+	}()
+	var once sync.Once
+	t.Cleanup(func() {
+		once.Do(func() {
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+			cmd.Wait()
+			pw.Close()
+		})
+	})
+	return srv
+}
+
+// freeAddr returns a local TCP address which is not used now.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// waitLine waits for a line of the output which contains substr and returns the line.
+func (s *server) waitLine(substr string, timeout time.Duration) string {
+	s.t.Helper()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case line, ok := <-s.lines:
+			if !ok {
+				s.t.Fatalf("output closed before a line containing %q", substr)
+			}
+			if strings.Contains(line, substr) {
+				return line
+			}
+		case <-timer.C:
+			s.t.Fatalf("timeout waiting for a line containing %q", substr)
+		}
+	}
+}
+
+func (s *server) signal(sig syscall.Signal) {
+	s.t.Helper()
+	if err := s.cmd.Process.Signal(sig); err != nil {
+		s.t.Fatal(err)
+	}
+}
+
+// get sends a request to the server and returns the response body.
+func (s *server) get() string {
+	s.t.Helper()
+	client := &http.Client{
+		Timeout:   5 * time.Second,
+		Transport: &http.Transport{DisableKeepAlives: true},
+	}
+	resp, err := client.Get("http://" + s.addr + "/")
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return string(body)
+}
+
+// waitExit waits for the master to exit and returns the error from exec.Cmd.Wait.
+func (s *server) waitExit(timeout time.Duration) error {
+	s.t.Helper()
+	errC := make(chan error, 1)
+	go func() { errC <- s.cmd.Wait() }()
+	select {
+	case err := <-errC:
+		return err
+	case <-time.After(timeout):
+		s.t.Fatal("timeout waiting for master to exit")
+		return nil
+	}
+}
+
+// workerPID returns the process ID of the worker in the response.
+func workerPID(t *testing.T, response string) int {
+	t.Helper()
+	i := strings.Index(response, "pid ")
+	if i == -1 {
+		t.Fatalf("pid not found in response %q", response)
+	}
+	var pid int
+	if _, err := fmt.Sscanf(response[i:], "pid %d", &pid); err != nil {
+		t.Fatalf("invalid pid in response %q; %v", response, err)
+	}
+	return pid
+}
+
+// waitProcessExit waits for the process to exit and to be reaped by the master.
+func waitProcessExit(t *testing.T, pid int, timeout time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for syscall.Kill(pid, 0) != syscall.ESRCH {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for process pid=%d to exit", pid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// testReload starts a server and checks that a SIGHUP replaces the worker
+// and a SIGTERM stops the master.
+func testReload(t *testing.T, srv *server) {
+	srv.waitLine("received ready from initial worker", 10*time.Second)
+	oldPID := workerPID(t, srv.get())
+
+	srv.signal(syscall.SIGHUP)
+	srv.waitLine("received ready from new worker", 10*time.Second)
+	// NOTE: The old worker may accept connections until it closes the listener
+	// after receiving the graceful shutdown signal.
+	waitProcessExit(t, oldPID, 10*time.Second)
+	if pid := workerPID(t, srv.get()); pid == oldPID {
+		t.Errorf("response from old worker pid=%d after reload", pid)
+	}
+
+	srv.signal(syscall.SIGTERM)
+	srv.waitLine("stopped child process, exiting.", 10*time.Second)
+	if err := srv.waitExit(10 * time.Second); err != nil {
+		t.Errorf("master exited with error; %v", err)
+	}
+}
+
+func TestSimple(t *testing.T) {
+	srv := startServer(t, "simple", "-addr")
+	testReload(t, srv)
+}
+
+func TestGraceserver(t *testing.T) {
+	srv := startServer(t, "graceserver", "-http", "-https", "", "-pidfile", "")
+	testReload(t, srv)
+}
+
+func TestDontstopKilledAfterTimeout(t *testing.T) {
+	srv := startServer(t, "dontstop", "-addr", "-child-shutdown-wait-timeout", "500ms")
+	srv.waitLine("received ready from initial worker", 10*time.Second)
+	oldPID := workerPID(t, srv.get())
+
+	srv.signal(syscall.SIGHUP)
+	srv.waitLine("do nothing after receving sigterm", 10*time.Second)
+	line := srv.waitLine("did not exit gracefully and was killed", 10*time.Second)
+	if want := fmt.Sprintf("old worker pid=%d ", oldPID); !strings.Contains(line, want) {
+		t.Errorf("unexpected killed worker: %s", line)
+	}
+	waitProcessExit(t, oldPID, 10*time.Second)
+	if pid := workerPID(t, srv.get()); pid == oldPID {
+		t.Errorf("response from old worker pid=%d after reload", pid)
+	}
+}
@@ -78,18 +78,17 @@ func main() {
 	}
 
 	log.Printf("worker pid=%d started.", pid)
-	listeners, err = starter.Listeners()
-	if err != nil {
-		log.Fatalf("failed to get listeners, pid=%d, err=%v", pid, err)
-	}
-	i := 0
 	if *httpAddr != "" {
-		httpLn = listeners[i]
-		i++
+		httpLn, err = starter.ListenerFor("tcp", *httpAddr)
+		if err != nil {
+			log.Fatalf("failed to get http listener, pid=%d, err=%v", pid, err)
+		}
 	}
 	if *httpsAddr != "" {
-		httpsLn = listeners[i]
-		i++
+		httpsLn, err = starter.ListenerFor("tcp", *httpsAddr)
+		if err != nil {
+			log.Fatalf("failed to get https listener, pid=%d, err=%v", pid, err)
+		}
 	}
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
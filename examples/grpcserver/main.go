@@ -0,0 +1,58 @@
+// Command grpcserver is an example gRPC server which is restarted gracefully
+// by serverstarter.
+//
+// Each worker serves the gRPC health service on the inherited listener with
+// ServeGRPC, which reports SERVING to health checks when the worker gets ready
+// and NOT_SERVING when the worker starts shutting down. Send a SIGHUP to the
+// master to reload the worker, and check the health with grpc-health-probe:
+//
+//	grpc-health-probe -addr=127.0.0.1:50051
+//
+// This example has its own go.mod since grpc requires a newer Go than
+// serverstarter does.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+
+	"github.com/hnakamur/serverstarter"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:50051", "server listen address")
+	flag.Parse()
+
+	starter := serverstarter.New()
+	// Listen binds the address in the master and returns the inherited
+	// listener for the address in the worker.
+	l, err := starter.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatalf("failed to listen %s; %v", *addr, err)
+	}
+	if starter.IsMaster() {
+		log.Printf("master pid=%d start RunMaster", os.Getpid())
+		if err := starter.RunMaster(l); err != nil {
+			log.Fatalf("failed to run master; %v", err)
+		}
+		return
+	}
+
+	srv := grpc.NewServer()
+	healthSrv := health.NewServer()
+	healthpb.RegisterHealthServer(srv, healthSrv)
+	reflection.Register(srv)
+	// NOTE: Register your services here.
+
+	log.Printf("worker pid=%d grpc server start Serve", os.Getpid())
+	if err := starter.ServeGRPC(context.Background(), srv, healthSrv, l); err != nil {
+		log.Fatalf("failed to serve; %v", err)
+	}
+	log.Printf("exiting pid=%d", os.Getpid())
+}
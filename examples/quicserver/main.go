@@ -0,0 +1,152 @@
+// Command quicserver is an example HTTP/3 server which is restarted gracefully
+// by serverstarter.
+//
+// The master binds a UDP socket with ListenPacket and passes it to workers with
+// RunMasterWith. Each worker serves HTTP/3 with quic-go on the inherited socket.
+// Send a SIGHUP to the master to reload the worker.
+//
+// This example has its own go.mod since quic-go requires a newer Go than
+// serverstarter does.
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"flag"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/hnakamur/serverstarter"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:8443", "server listen address")
+	certFile := flag.String("cert", "", "TLS certificate file (a self-signed certificate is used if empty)")
+	keyFile := flag.String("key", "", "TLS key file")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 5*time.Second, "shutdown timeout")
+	flag.Parse()
+
+	starter := serverstarter.New()
+	// ListenPacket binds the address in the master and returns the inherited
+	// UDP socket for the address in the worker.
+	pc, err := starter.ListenPacket("udp", *addr)
+	if err != nil {
+		log.Fatalf("failed to listen %s; %v", *addr, err)
+	}
+	if starter.IsMaster() {
+		log.Printf("master pid=%d start RunMasterWith", os.Getpid())
+		if err := starter.RunMasterWith(serverstarter.Inheritance{
+			PacketConns: []net.PacketConn{pc},
+		}); err != nil {
+			log.Fatalf("failed to run master; %v", err)
+		}
+		return
+	}
+
+	tlsConf, err := tlsConfig(*certFile, *keyFile)
+	if err != nil {
+		log.Fatalf("failed to load TLS config; %v", err)
+	}
+
+	// NOTE: During the overlap window of a reload, the old and the new workers
+	// read from the same UDP socket, so a packet may be delivered to the worker
+	// which does not have the connection. The connection IDs are tagged with
+	// the generation, and no StatelessResetKey is set so that such a packet is
+	// dropped instead of resetting the connection of the other worker.
+	generation := starter.Generation()
+	tr := &quic.Transport{
+		Conn:                  pc,
+		ConnectionIDGenerator: connIDGenerator{serverstarter.ConnIDGenerator{Generation: generation}},
+	}
+	ln, err := tr.ListenEarly(http3.ConfigureTLSConfig(tlsConf), &quic.Config{})
+	if err != nil {
+		log.Fatalf("failed to listen QUIC; %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "response from pid %d, generation %d.\n", os.Getpid(), generation)
+	})
+	srv := &http3.Server{Handler: mux}
+
+	done := make(chan struct{})
+	go func() {
+		sigterm := make(chan os.Signal, 1)
+		signal.Notify(sigterm, syscall.SIGTERM)
+		<-sigterm
+		log.Printf("received sigterm")
+
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("cannot gracefully shut down the server: %v", err)
+		}
+		close(done)
+	}()
+
+	if err := starter.SendReady(); err != nil {
+		log.Printf("failed to send ready: %v", err)
+	}
+	log.Printf("worker pid=%d http3 server start Serve", os.Getpid())
+	if err := srv.ServeListener(ln); err != nil && err != http.ErrServerClosed {
+		log.Printf("http3 server Serve: %v", err)
+	}
+	<-done
+	log.Printf("exiting pid=%d", os.Getpid())
+}
+
+// connIDGenerator adapts serverstarter.ConnIDGenerator to quic.ConnectionIDGenerator.
+type connIDGenerator struct {
+	serverstarter.ConnIDGenerator
+}
+
+func (g connIDGenerator) GenerateConnectionID() (quic.ConnectionID, error) {
+	id, err := g.ConnIDGenerator.GenerateConnectionID()
+	if err != nil {
+		return quic.ConnectionID{}, err
+	}
+	return quic.ConnectionIDFromBytes(id), nil
+}
+
+// tlsConfig returns the TLS config with the certificate in the files, or with
+// a self-signed certificate if certFile is empty.
+func tlsConfig(certFile, keyFile string) (*tls.Config, error) {
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}, nil
+}
@@ -2,10 +2,10 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
-	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -23,24 +23,27 @@ func main() {
 	flag.Parse()
 
 	starter := serverstarter.New()
+	// Listen binds the address in the master and returns the inherited
+	// listener for the address in the worker.
+	l, err := starter.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatalf("failed to listen %s; %v", *addr, err)
+	}
 	if starter.IsMaster() {
-		l, err := net.Listen("tcp", *addr)
-		if err != nil {
-			log.Fatalf("failed to listen %s; %v", *addr, err)
-		}
 		log.Printf("master pid=%d start RunMaster", os.Getpid())
 		if err = starter.RunMaster(l); err != nil {
-			log.Fatalf("failed to run master; %v", err)
+			log.Printf("failed to run master; %v", err)
+			// NOTE: Exit with the exit status of the worker so that process
+			// managers like systemd can see why the worker exited.
+			var exitErr *serverstarter.WorkerExitError
+			if errors.As(err, &exitErr) && exitErr.ExitStatus() > 0 {
+				os.Exit(exitErr.ExitStatus())
+			}
+			os.Exit(1)
 		}
 		return
 	}
 
-	listeners, err := starter.Listeners()
-	if err != nil {
-		log.Fatalf("failed to get listeners; %v", err)
-	}
-	l := listeners[0]
-
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		if *handleDelay > 0 {
 			time.Sleep(*handleDelay)
@@ -0,0 +1,52 @@
+package serverstarter
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"syscall"
+)
+
+// WorkerExitError is the error which RunMaster returns when the master exits
+// because a worker exited abnormally, so that the caller can exit with the exit
+// status of the worker. Use errors.As to get it from the error returned from RunMaster.
+type WorkerExitError struct {
+	// PID is the process ID of the worker.
+	PID int
+	// Name is the name of the worker program set by AddWorker.
+	Name string
+	// ExitCode is the exit code of the worker, or -1 if the worker was
+	// terminated by a signal.
+	ExitCode int
+	// Signal is the signal which terminated the worker, or zero if the worker exited.
+	Signal syscall.Signal
+	// Err is the error returned from waiting for the worker.
+	Err error
+}
+
+func (e *WorkerExitError) Error() string {
+	if e.Signal != 0 {
+		return fmt.Sprintf("worker pid=%d was terminated by signal %q", e.PID, e.Signal)
+	}
+	// NOTE: The error other than *exec.ExitError, for example the one from
+	// failing to wait for the worker, is not obvious from the exit code.
+	var exitErr *exec.ExitError
+	if e.Err != nil && !errors.As(e.Err, &exitErr) {
+		return fmt.Sprintf("worker pid=%d exited with exit code %d; %v", e.PID, e.ExitCode, e.Err)
+	}
+	return fmt.Sprintf("worker pid=%d exited with exit code %d", e.PID, e.ExitCode)
+}
+
+func (e *WorkerExitError) Unwrap() error {
+	return e.Err
+}
+
+// ExitStatus returns the exit status for the master to exit with, which is the
+// exit code of the worker, or 128 plus the signal number if the worker was
+// terminated by a signal like shells do.
+func (e *WorkerExitError) ExitStatus() int {
+	if e.Signal != 0 {
+		return 128 + int(e.Signal)
+	}
+	return e.ExitCode
+}
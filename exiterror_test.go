@@ -0,0 +1,26 @@
+package serverstarter
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestWorkerExitErrorMessage(t *testing.T) {
+	waitErr := errors.New("wait: no child processes")
+	testCases := []struct {
+		err  *WorkerExitError
+		want string
+	}{
+		{err: &WorkerExitError{PID: 10, ExitCode: 3}, want: "worker pid=10 exited with exit code 3"},
+		{err: &WorkerExitError{PID: 10, ExitCode: -1, Err: waitErr}, want: "worker pid=10 exited with exit code -1; wait: no child processes"},
+	}
+	for _, c := range testCases {
+		if got := c.err.Error(); got != c.want {
+			t.Errorf("message mismatch, got=%q, want=%q", got, c.want)
+		}
+	}
+	var err error = &WorkerExitError{PID: 10, ExitCode: -1, Err: waitErr}
+	if !errors.Is(err, waitErr) {
+		t.Errorf("error must wrap %v", waitErr)
+	}
+}
@@ -0,0 +1,83 @@
+package serverstarter
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+const (
+	// envExtraFDs is the environment variable name for passing the extra file
+	// descriptor count to the worker process.
+	envExtraFDs = "SERVERSTARTER_EXTRA_FDS"
+	// envExtraFDNames is the environment variable name for passing the names
+	// of the extra files to the worker process in a JSON array.
+	envExtraFDNames = "SERVERSTARTER_EXTRA_FD_NAMES"
+)
+
+// SetExtraFiles sets the files which the master passes to worker processes
+// in addition to the listeners, for example pre-opened log files, shared memory
+// or netlink sockets. The worker gets them with ExtraFiles in the same order.
+//
+// The files are passed at the file descriptors following the ones for the listeners.
+// The master does not close the files, so the caller must keep them open
+// while the master is running.
+func SetExtraFiles(files []*os.File) Option {
+	return func(s *Starter) {
+		s.extraFiles = files
+	}
+}
+
+// ExtraFiles returns the files set by SetExtraFiles in the master
+// if this is called by the worker process. The names of the files are same as
+// the ones in the master.
+// It returns nil when this is called by the master process.
+//
+// The files are created on the first call in the process and the same files are
+// returned after that.
+func (s *Starter) ExtraFiles() ([]*os.File, error) {
+	if s.IsMaster() {
+		return nil, nil
+	}
+	if _, ok := lookupWorkerEnv(envExtraFDs); !ok {
+		return nil, nil
+	}
+
+	inherited.mu.Lock()
+	defer inherited.mu.Unlock()
+	if inherited.extraFiles != nil {
+		return inherited.extraFiles, nil
+	}
+	fds, err := s.inheritedFDsLocked()
+	if err != nil {
+		return nil, fmt.Errorf("error in ExtraFiles after getting inherited file descriptors; %w", err)
+	}
+	names, err := extraFileNames()
+	if err != nil {
+		return nil, fmt.Errorf("error in ExtraFiles after getting extra file names; %w", err)
+	}
+	files := make([]*os.File, len(fds.extras))
+	for i, fd := range fds.extras {
+		name := "extra" + strconv.Itoa(i)
+		if i < len(names) {
+			name = names[i]
+		}
+		files[i] = os.NewFile(fd, name)
+	}
+	inherited.extraFiles = files
+	return files, nil
+}
+
+// extraFileNames returns the names of the extra files passed from the master.
+func extraFileNames() ([]string, error) {
+	v, ok := lookupWorkerEnv(envExtraFDNames)
+	if !ok {
+		return nil, nil
+	}
+	var names []string
+	if err := json.Unmarshal([]byte(v), &names); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
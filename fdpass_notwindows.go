@@ -0,0 +1,262 @@
+//go:build !windows
+
+package serverstarter
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// fdsPerMessage is the maximum number of file descriptors sent in a message,
+// which is less than SCM_MAX_FD of Linux.
+const fdsPerMessage = 200
+
+// writeFrame writes data prefixed with its size.
+func writeFrame(w io.Writer, data []byte) error {
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(data)))
+	_, err := w.Write(append(size[:], data...))
+	return err
+}
+
+// readFrame reads data written by writeFrame.
+func readFrame(r io.Reader) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// sendFDs sends the file descriptors with SCM_RIGHTS in messages of a byte.
+func sendFDs(conn *net.UnixConn, fds []int) error {
+	for len(fds) > 0 {
+		n := len(fds)
+		if n > fdsPerMessage {
+			n = fdsPerMessage
+		}
+		if _, _, err := conn.WriteMsgUnix([]byte{0}, syscall.UnixRights(fds[:n]...), nil); err != nil {
+			return err
+		}
+		fds = fds[n:]
+	}
+	return nil
+}
+
+// msgReader is a unix socket which file descriptors can be received from.
+type msgReader interface {
+	ReadMsgUnix(b, oob []byte) (n, oobn, flags int, addr *net.UnixAddr, err error)
+}
+
+// receiveFDs receives count file descriptors sent by sendFDs.
+// The received file descriptors have the close-on-exec flag.
+func receiveFDs(conn msgReader, count int) ([]int, error) {
+	var fds []int
+	buf := make([]byte, 1)
+	oob := make([]byte, syscall.CmsgSpace(4*fdsPerMessage))
+	for len(fds) < count {
+		_, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+		if err != nil {
+			closeFDs(fds)
+			return nil, err
+		}
+		received, err := parseRights(oob[:oobn])
+		fds = append(fds, received...)
+		if err != nil {
+			closeFDs(fds)
+			return nil, err
+		}
+		if len(received) == 0 {
+			closeFDs(fds)
+			return nil, errors.New("message without file descriptors")
+		}
+	}
+	if len(fds) != count {
+		closeFDs(fds)
+		return nil, fmt.Errorf("received %d file descriptors, want %d", len(fds), count)
+	}
+	for _, fd := range fds {
+		closeOnExec(uintptr(fd))
+	}
+	return fds, nil
+}
+
+// parseRights returns the file descriptors in the socket control messages.
+func parseRights(oob []byte) ([]int, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	var fds []int
+	for _, msg := range msgs {
+		rights, err := syscall.ParseUnixRights(&msg)
+		if err != nil {
+			return fds, err
+		}
+		fds = append(fds, rights...)
+	}
+	return fds, nil
+}
+
+func closeFDs(fds []int) {
+	for _, fd := range fds {
+		syscall.Close(fd)
+	}
+}
+
+// socketPair returns a pair of connected unix stream sockets.
+// Both of them have the close-on-exec flag.
+//
+// NOTE: The parent one is made non-blocking before wrapped with os.File, since
+// net.FileConn in sendFDsToWorker makes it non-blocking anyway and os.File
+// must know it to use the poller.
+func socketPair() (parent, child *os.File, err error) {
+	syscall.ForkLock.RLock()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err == nil {
+		syscall.CloseOnExec(fds[0])
+		syscall.CloseOnExec(fds[1])
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := syscall.SetNonblock(fds[0], true); err != nil {
+		syscall.Close(fds[0])
+		syscall.Close(fds[1])
+		return nil, nil, err
+	}
+	return os.NewFile(uintptr(fds[0]), "fdSocketParent"), os.NewFile(uintptr(fds[1]), "fdSocketChild"), nil
+}
+
+// unixConn returns the connection for the socket file f.
+// The returned connection uses a duplicated file descriptor, so it must be
+// closed separately from f.
+func unixConn(f *os.File) (*net.UnixConn, error) {
+	c, err := net.FileConn(f)
+	if err != nil {
+		return nil, err
+	}
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		c.Close()
+		return nil, errors.New("not a unix socket")
+	}
+	return uc, nil
+}
+
+// sendFDsToWorker sends the header and the file descriptors to the worker over
+// the socket when SetPassFDsOverSocket is used.
+func sendFDsToWorker(sock *os.File, listeners, packetConns, sctp, extras, logs []*os.File) error {
+	conn, err := unixConn(sock)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	data, err := json.Marshal(fdHeader{
+		Listeners:   len(listeners),
+		PacketConns: len(packetConns),
+		SCTP:        len(sctp),
+		Extras:      len(extras),
+		Logs:        len(logs),
+	})
+	if err != nil {
+		return err
+	}
+	if err := writeFrame(conn, data); err != nil {
+		return err
+	}
+	fds := make([]int, 0, len(listeners)+len(packetConns)+len(sctp)+len(extras)+len(logs))
+	for _, files := range [][]*os.File{listeners, packetConns, sctp, extras, logs} {
+		for _, f := range files {
+			fds = append(fds, int(f.Fd()))
+		}
+	}
+	return sendFDs(conn, fds)
+}
+
+// receiveFDsFromMaster receives the header and the file descriptors from
+// the master over the socket whose file descriptor is fdStr.
+//
+// NOTE: We use the file descriptor with system calls directly instead of
+// wrapping it with os.File, since the file descriptor is also used for sending
+// messages to the master and an os.File closes it when garbage collected.
+func receiveFDsFromMaster(fdStr string) (*inheritedFDs, error) {
+	fd, err := strconv.Atoi(fdStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid file descriptor of socket %q; %w", fdStr, err)
+	}
+	closeOnExec(uintptr(fd))
+	r := fdReader(fd)
+	data, err := readFrame(r)
+	if err != nil {
+		return nil, fmt.Errorf("error in receiveFDsFromMaster after receiving header; %w", err)
+	}
+	var h fdHeader
+	if err := json.Unmarshal(data, &h); err != nil {
+		return nil, fmt.Errorf("error in receiveFDsFromMaster after decoding header; %w", err)
+	}
+	received, err := receiveFDs(r, h.Listeners+h.PacketConns+h.SCTP+h.Extras+h.Logs)
+	if err != nil {
+		return nil, fmt.Errorf("error in receiveFDsFromMaster after receiving file descriptors; %w", err)
+	}
+	fds := make([]uintptr, len(received))
+	for i, fd := range received {
+		fds[i] = uintptr(fd)
+	}
+	next := func(count int) []uintptr {
+		s := fds[:count]
+		fds = fds[count:]
+		return s
+	}
+	return &inheritedFDs{
+		listeners:   next(h.Listeners),
+		packetConns: next(h.PacketConns),
+		sctp:        next(h.SCTP),
+		extras:      next(h.Extras),
+		logs:        next(h.Logs),
+	}, nil
+}
+
+// fdReader reads a socket file descriptor with system calls.
+type fdReader int
+
+func (r fdReader) Read(p []byte) (int, error) {
+	for {
+		n, err := syscall.Read(int(r), p)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			return 0, io.EOF
+		}
+		return n, nil
+	}
+}
+
+func (r fdReader) ReadMsgUnix(b, oob []byte) (n, oobn, flags int, addr *net.UnixAddr, err error) {
+	for {
+		n, oobn, flags, _, err = syscall.Recvmsg(int(r), b, oob, 0)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err == nil && n == 0 && oobn == 0 {
+		err = io.EOF
+	}
+	return n, oobn, flags, nil, err
+}
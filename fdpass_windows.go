@@ -0,0 +1,8 @@
+package serverstarter
+
+import "fmt"
+
+// receiveFDsFromMaster returns an error on Windows, since SetPassFDsOverSocket is not supported.
+func receiveFDsFromMaster(fdStr string) (*inheritedFDs, error) {
+	return nil, fmt.Errorf("passing file descriptors over socket is %w", ErrUnsupported)
+}
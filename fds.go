@@ -0,0 +1,331 @@
+package serverstarter
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/hnakamur/serverstarter/internal/testhook"
+)
+
+// envFDSocket is the environment variable name for passing the file descriptor
+// of the socket over which the master passes the file descriptors to the worker
+// when SetPassFDsOverSocket is used.
+const envFDSocket = "SERVERSTARTER_FD_SOCKET"
+
+// envFirstFD is the environment variable name for passing the file descriptor
+// for the ready notification when SetFirstFD is used.
+const envFirstFD = "SERVERSTARTER_FIRST_FD"
+
+// envMasterPID is the environment variable name for passing the process ID of
+// the master, which the worker checks before using the inherited file descriptors
+// like LISTEN_PID of systemd.
+//
+// NOTE: The master cannot set the process ID of the worker since it is not known
+// before starting the worker, so the worker compares it with its parent process ID.
+// The worker sets it to 0 after taking the file descriptors.
+const envMasterPID = "SERVERSTARTER_MASTER_PID"
+
+// SetFirstFD sets the file descriptor number at which the master places the pipe
+// for the ready notification in worker processes. The listeners, the extra files
+// and the log files follow it. The file descriptors between the standard error
+// and n are closed in worker processes.
+// It is useful when the runtime or the wrapper of the worker already reserves
+// low file descriptors. n must be 3 or larger.
+// If no SetFirstFD is called, the default value is 3.
+func SetFirstFD(n int) Option {
+	return func(s *Starter) {
+		s.firstFD = n
+	}
+}
+
+// SetPassFDsOverSocket makes the master pass the listeners, the extra files and
+// the log files to the worker over a unix socketpair with SCM_RIGHTS, instead of
+// placing them at the fixed file descriptors following the one for the ready
+// notification. The worker gets the file descriptor of the socket from the
+// environment variable SERVERSTARTER_FD_SOCKET and uses the socket for the ready
+// notification too, so the worker does not depend on the fixed file descriptor
+// numbers which other libraries or wrappers may occupy.
+//
+// This option is not supported on Windows.
+func SetPassFDsOverSocket(enabled bool) Option {
+	return func(s *Starter) {
+		s.passFDsOverSocket = enabled
+	}
+}
+
+// inheritedFDs is the file descriptors which the worker inherits from the master.
+type inheritedFDs struct {
+	listeners   []uintptr
+	packetConns []uintptr
+	sctp        []uintptr
+	extras      []uintptr
+	logs        []uintptr
+}
+
+// fdHeader is the header which the master sends before the file descriptors
+// over the socket when SetPassFDsOverSocket is used.
+type fdHeader struct {
+	Listeners   int `json:"listeners"`
+	PacketConns int `json:"packet_conns"`
+	SCTP        int `json:"sctp"`
+	Extras      int `json:"extras"`
+	Logs        int `json:"logs"`
+}
+
+// inherited is the file descriptors and the listeners passed from the master.
+// They are shared by all Starters in the process, since the file descriptors
+// are passed to the process only once.
+var inherited struct {
+	mu          sync.Mutex
+	fds         *inheritedFDs
+	listeners   []net.Listener
+	packetConns []net.PacketConn
+	sctp        []*os.File
+	extraFiles  []*os.File
+	logWriters  []io.Writer
+}
+
+// inheritedFDs returns the file descriptors passed from the master.
+// They are received from the socket or calculated from the counts in
+// the environment variables on the first call, and reused after that.
+//
+// It returns an error wrapping ErrNotWorker if they are passed to another process,
+// for example the parent process of this process is a wrapper which forks it.
+func (s *Starter) inheritedFDs() (*inheritedFDs, error) {
+	inherited.mu.Lock()
+	defer inherited.mu.Unlock()
+	return s.inheritedFDsLocked()
+}
+
+func (s *Starter) inheritedFDsLocked() (*inheritedFDs, error) {
+	if inherited.fds != nil {
+		return inherited.fds, nil
+	}
+	if err := s.passedToThisProcess(); err != nil {
+		return nil, err
+	}
+	var fds *inheritedFDs
+	var err error
+	if v, ok := lookupWorkerEnv(envFDSocket); ok {
+		fds, err = receiveFDsFromMaster(v)
+	} else if s.startedByServerStarter() {
+		fds = &inheritedFDs{}
+		fds.listeners, err = parseServerStarterPort(os.Getenv(envServerStarterPort))
+	} else if s.startedByEinhorn() {
+		fds = &inheritedFDs{}
+		fds.listeners, err = einhornFDs()
+	} else {
+		fds, err = s.positionalFDs()
+	}
+	if err != nil {
+		return nil, err
+	}
+	inherited.fds = fds
+	return fds, nil
+}
+
+var (
+	passedOnce sync.Once
+	passedErr  error
+)
+
+// workerEnv is the environment variables which describe the file descriptors
+// passed from the master. They are removed from the environment when the worker
+// uses the file descriptors first, so that the processes started by the worker
+// do not inherit them, and the worker reads them from here after that.
+var workerEnv struct {
+	mu sync.Mutex
+	// saved is the values of the removed environment variables, which are nil
+	// for the ones which were not set. It is nil before they are removed.
+	saved map[string]*string
+}
+
+func init() {
+	testhook.ResetWorker = resetInherited
+}
+
+// resetInherited forgets the file descriptors and the listeners passed from
+// the master, for serverstartertest which sets up the worker environment more
+// than once in a process. The listeners and the files already returned are
+// left open for their users.
+func resetInherited() {
+	inherited.mu.Lock()
+	defer inherited.mu.Unlock()
+	inherited.fds = nil
+	inherited.listeners = nil
+	inherited.packetConns = nil
+	inherited.sctp = nil
+	inherited.extraFiles = nil
+	inherited.logWriters = nil
+	passedOnce = sync.Once{}
+	passedErr = nil
+	workerEnv.mu.Lock()
+	workerEnv.saved = nil
+	workerEnv.mu.Unlock()
+}
+
+// passedToThisProcess returns nil if the file descriptors are passed from
+// the master to this process, or an error wrapping ErrNotWorker otherwise.
+// It returns nil if the master does not pass its process ID for compatibility
+// with older versions.
+//
+// On the first call, it removes the environment variables which describe
+// the file descriptors from the environment of this process.
+func (s *Starter) passedToThisProcess() error {
+	passedOnce.Do(func() {
+		if _, ok := os.LookupEnv(envRlimitTrampoline); ok {
+			passedErr = fmt.Errorf("this process is started as the trampoline for SetWorkerRlimits, "+
+				"but RunTrampoline is not called in main of the master program; %w", ErrNotWorker)
+			return
+		}
+		v, ok := os.LookupEnv(envMasterPID)
+		if !ok {
+			s.removeWorkerEnv()
+			return
+		}
+		pid, err := strconv.Atoi(v)
+		switch {
+		case err != nil || pid == 0:
+			passedErr = fmt.Errorf("file descriptors passed from master are already taken by another process; %w", ErrNotWorker)
+		case pid != os.Getppid():
+			passedErr = fmt.Errorf("file descriptors are passed from master pid=%d to its child but parent process is pid=%d, "+
+				"the worker must be executed in place of the process started by the master; %w", pid, os.Getppid(), ErrNotWorker)
+		default:
+			s.removeWorkerEnv()
+		}
+
+		// NOTE: The file descriptors must not be used again after this process
+		// executes another program, which has the same process IDs and environment
+		// variables but not the file descriptors with the close-on-exec flag.
+		os.Setenv(envMasterPID, "0")
+	})
+	return passedErr
+}
+
+// removeWorkerEnv removes the environment variables which describe the file
+// descriptors passed from the master and saves them to workerEnv.
+func (s *Starter) removeWorkerEnv() {
+	workerEnv.mu.Lock()
+	defer workerEnv.mu.Unlock()
+	if workerEnv.saved != nil {
+		return
+	}
+	workerEnv.saved = make(map[string]*string)
+	for _, key := range []string{s.envListenFDs, envPacketFDs, envSCTPFDs, envExtraFDs, envExtraFDNames,
+		envLogFDs, envFDSocket, envFDManifest, envFirstFD} {
+		var saved *string
+		if v, ok := os.LookupEnv(key); ok {
+			saved = &v
+			os.Unsetenv(key)
+		}
+		workerEnv.saved[key] = saved
+	}
+}
+
+// lookupWorkerEnv is same as os.LookupEnv except that it returns the value
+// saved in workerEnv for the environment variable removed by removeWorkerEnv.
+func lookupWorkerEnv(key string) (string, bool) {
+	workerEnv.mu.Lock()
+	defer workerEnv.mu.Unlock()
+	if saved, ok := workerEnv.saved[key]; ok {
+		if saved == nil {
+			return "", false
+		}
+		return *saved, true
+	}
+	return os.LookupEnv(key)
+}
+
+// positionalFDs returns the file descriptors placed at the fixed numbers
+// following the one for the ready notification.
+func (s *Starter) positionalFDs() (*inheritedFDs, error) {
+	v, _ := lookupWorkerEnv(s.envListenFDs)
+	listenerCount, err := strconv.Atoi(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listener count; %w", err)
+	}
+	packetConnCount, err := envCount(envPacketFDs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid packet connection count; %w", err)
+	}
+	sctpCount, err := envCount(envSCTPFDs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SCTP listener count; %w", err)
+	}
+	extraCount, err := envCount(envExtraFDs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid extra file count; %w", err)
+	}
+	logCount, err := envCount(envLogFDs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid log file count; %w", err)
+	}
+	first, err := firstFD()
+	if err != nil {
+		return nil, err
+	}
+	fd := first + 1
+	next := func(count int) []uintptr {
+		fds := make([]uintptr, count)
+		for i := range fds {
+			fds[i] = fd
+			fd++
+		}
+		return fds
+	}
+	return &inheritedFDs{
+		listeners:   next(listenerCount),
+		packetConns: next(packetConnCount),
+		sctp:        next(sctpCount),
+		extras:      next(extraCount),
+		logs:        next(logCount),
+	}, nil
+}
+
+// envCount returns the count in the environment variable, or zero if it is not set.
+func envCount(key string) (int, error) {
+	v, ok := lookupWorkerEnv(key)
+	if !ok {
+		return 0, nil
+	}
+	return strconv.Atoi(v)
+}
+
+// masterFD returns the file descriptor for sending messages to the master.
+// It returns an error wrapping ErrNotWorker if this process is not started by
+// the master, since the file descriptor at the position of the pipe may be
+// opened for another purpose then.
+func (s *Starter) masterFD() (uintptr, error) {
+	if s.IsMaster() {
+		return 0, fmt.Errorf("environment variable %s is not set; %w", s.envListenFDs, ErrNotWorker)
+	}
+	if err := s.passedToThisProcess(); err != nil {
+		return 0, err
+	}
+	if v, ok := lookupWorkerEnv(envFDSocket); ok {
+		fd, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, fmt.Errorf("invalid file descriptor of socket %q; %w", v, err)
+		}
+		return uintptr(fd), nil
+	}
+	return firstFD()
+}
+
+// firstFD returns the file descriptor for the ready notification set by SetFirstFD
+// in the master.
+func firstFD() (uintptr, error) {
+	v, ok := lookupWorkerEnv(envFirstFD)
+	if !ok {
+		return stdFdCount, nil
+	}
+	fd, err := strconv.Atoi(v)
+	if err != nil || fd < stdFdCount {
+		return 0, fmt.Errorf("invalid first file descriptor %q", v)
+	}
+	return uintptr(fd), nil
+}
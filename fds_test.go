@@ -0,0 +1,594 @@
+//go:build !windows
+
+package serverstarter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func init() {
+	helpers["fds"] = fdsHelper
+}
+
+// fdsDirEnv is the environment variable for the directory in which the master
+// of fdsHelper creates the extra file and the log file passed to the worker.
+const fdsDirEnv = "SERVERSTARTER_TEST_FDS_DIR"
+
+// passFDsOverSocketEnv is the environment variable which makes the master of
+// fdsHelper use SetPassFDsOverSocket if it is set.
+const passFDsOverSocketEnv = "SERVERSTARTER_TEST_PASS_FDS_OVER_SOCKET"
+
+// firstFDEnv is the environment variable for the file descriptor number which
+// the master of fdsHelper sets with SetFirstFD.
+const firstFDEnv = "SERVERSTARTER_TEST_FIRST_FD"
+
+// forkingWrapperEnv is the environment variable which makes the master of
+// fdsHelper start the worker with a wrapper which forks it instead of executing it.
+const forkingWrapperEnv = "SERVERSTARTER_TEST_FORKING_WRAPPER"
+
+// unixListenerEnv is the environment variable which makes the master of fdsHelper
+// also listen on a unix domain socket in the directory set by fdsDirEnv.
+const unixListenerEnv = "SERVERSTARTER_TEST_UNIX_LISTENER"
+
+// runMasterWithEnv is the environment variable which makes the master of
+// fdsHelper pass a UDP connection, an SCTP listener and the extra file with
+// RunMasterWith.
+const runMasterWithEnv = "SERVERSTARTER_TEST_RUN_MASTER_WITH"
+
+// fdsHelper runs a master which passes a listener, an extra file and a log file,
+// and a worker which writes to the files, writes its process ID to the connections
+// and exits on SIGTERM.
+func fdsHelper() {
+	dir := os.Getenv(fdsDirEnv)
+	var opts []Option
+	if os.Getenv(passFDsOverSocketEnv) != "" {
+		opts = append(opts, SetPassFDsOverSocket(true))
+	}
+	if n, err := strconv.Atoi(os.Getenv(firstFDEnv)); err == nil {
+		opts = append(opts, SetFirstFD(n))
+	}
+	if os.Getenv(forkingWrapperEnv) != "" {
+		// NOTE: The shell does not execute the worker in place of itself since
+		// it runs another command after that.
+		opts = append(opts, SetWorkerWrapper([]string{"sh", "-c", `"$@"; exit $?`, "sh"}))
+	}
+	opts = append(opts, SetLogFiles([]string{filepath.Join(dir, "log")}), SetListenerNames([]string{"web"}))
+	s := New(opts...)
+	if s.IsMaster() {
+		extra, err := os.OpenFile(filepath.Join(dir, "extra"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to open extra file; %v\n", err)
+			os.Exit(1)
+		}
+		defer extra.Close()
+		if os.Getenv(runMasterWithEnv) == "" {
+			SetExtraFiles([]*os.File{extra})(s)
+		}
+		l, err := s.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to listen; %v\n", err)
+			os.Exit(1)
+		}
+		listeners := []net.Listener{l}
+		if os.Getenv(unixListenerEnv) != "" {
+			ul, err := s.Listen("unix", filepath.Join(dir, "unix.sock"))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to listen; %v\n", err)
+				os.Exit(1)
+			}
+			listeners = append(listeners, ul)
+		}
+		if os.Getenv(runMasterWithEnv) != "" {
+			pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to listen; %v\n", err)
+				os.Exit(1)
+			}
+			// NOTE: We pass a TCP listener as an SCTP listener since the kernel
+			// may not support SCTP, and the master passes any listening socket
+			// which implements syscall.Conn.
+			sl, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to listen; %v\n", err)
+				os.Exit(1)
+			}
+			err = s.RunMasterWith(Inheritance{
+				Listeners:         listeners,
+				ListenerNames:     []string{"api"},
+				PacketConns:       []net.PacketConn{pc},
+				PacketConnNames:   []string{"dns"},
+				SCTPListeners:     []syscall.Conn{sl.(*net.TCPListener)},
+				SCTPListenerNames: []string{"assoc"},
+				Files:             []*os.File{extra},
+			})
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to run master; %v\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+		if err := s.RunMaster(listeners...); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to run master; %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	sigterm := make(chan os.Signal, 1)
+	signal.Notify(sigterm, syscall.SIGTERM)
+	listeners, err := s.Listeners()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to get listeners; %v\n", err)
+		os.Exit(1)
+	}
+	extras, err := s.ExtraFiles()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to get extra files; %v\n", err)
+		os.Exit(1)
+	}
+	logs, err := s.LogWriters()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to get log writers; %v\n", err)
+		os.Exit(1)
+	}
+	if os.Getenv(unixListenerEnv) != "" {
+		tcp, err := s.TCPListeners()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to get TCP listeners; %v\n", err)
+			os.Exit(1)
+		}
+		unix, err := s.UnixListeners()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to get unix listeners; %v\n", err)
+			os.Exit(1)
+		}
+		path := filepath.Join(dir, "unix.sock")
+		tl, err := s.TCPListenerFor("tcp", listeners[0].Addr().String())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to get TCP listener; %v\n", err)
+			os.Exit(1)
+		}
+		ul, err := s.UnixListenerFor("unix", path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to get unix listener; %v\n", err)
+			os.Exit(1)
+		}
+		_, err = s.TCPListenerFor("unix", path)
+		fmt.Printf("fds typed: tcp=%d, unix=%d, tcpFor=%v, unixFor=%v, mismatch=%v\n",
+			len(tcp), len(unix), tl == listeners[0], ul == listeners[1], err)
+	}
+	if os.Getenv(runMasterWithEnv) != "" {
+		in, err := s.Inherited()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to get inherited; %v\n", err)
+			os.Exit(1)
+		}
+		for _, pc := range in.PacketConns {
+			go func(pc net.PacketConn) {
+				buf := make([]byte, 512)
+				for {
+					_, addr, err := pc.ReadFrom(buf)
+					if err != nil {
+						return
+					}
+					pc.WriteTo([]byte(strconv.Itoa(os.Getpid())), addr)
+				}
+			}(pc)
+		}
+		if len(in.PacketConns) > 0 {
+			fmt.Printf("fds packet conn: addr=%s\n", in.PacketConns[0].LocalAddr())
+		}
+		sctp, err := s.SCTPListeners()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to get SCTP listeners; %v\n", err)
+			os.Exit(1)
+		}
+		m, err := s.Manifest()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to get manifest; %v\n", err)
+			os.Exit(1)
+		}
+		if e, ok := m.Lookup("assoc"); ok && len(sctp) > 0 {
+			fmt.Printf("fds sctp: listeners=%d, cached=%v, addr=%s, manifest=%s, fd=%v\n", len(sctp), len(in.SCTPListeners) == 1 && in.SCTPListeners[0] == sctp[0],
+				sockAddrString(int(sctp[0].Fd())), e.Address, e.FD == sctp[0].Fd())
+		}
+	}
+	// NOTE: Another Starter gets the same listeners and files.
+	other := New()
+	listeners2, _ := other.Listeners()
+	extras2, _ := other.ExtraFiles()
+	logs2, _ := other.LogWriters()
+	fmt.Printf("fds cached: listeners=%v, extras=%v, logs=%v\n",
+		len(listeners2) == 1 && listeners2[0] == listeners[0],
+		len(extras2) == 1 && extras2[0] == extras[0],
+		len(logs2) == 1 && logs2[0] == logs[0])
+	for _, f := range extras {
+		fmt.Fprintf(f, "extra written by worker pid=%d\n", os.Getpid())
+	}
+	for _, w := range logs {
+		fmt.Fprintf(w, "log written by worker pid=%d\n", os.Getpid())
+	}
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				fmt.Fprintf(c, "%d", os.Getpid())
+				c.Close()
+			}
+		}(l)
+	}
+	m, err := s.Manifest()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to get manifest; %v\n", err)
+		os.Exit(1)
+	}
+	entries := make([]string, len(m))
+	for i, e := range m {
+		entries[i] = fmt.Sprintf("%s,%s,%s", e.Type, e.Network, e.Name)
+	}
+	fmt.Printf("fds manifest: %s\n", strings.Join(entries, " "))
+	if e, ok := m.Lookup("web"); ok {
+		// NOTE: We check the file descriptor in the manifest is the listener.
+		port := 0
+		if sa, ok := getsockname(e.FD).(*syscall.SockaddrInet4); ok {
+			port = sa.Port
+		}
+		fmt.Printf("fds manifest web: port=%d\n", port)
+		if os.Getenv(firstFDEnv) != "" {
+			ready, _ := lookupWorkerEnv(envFirstFD)
+			fmt.Printf("fds first fd: ready=%s, listener=%d\n", ready, e.FD)
+		}
+	}
+	// NOTE: The processes started by the worker must not inherit the environment
+	// variables for the file descriptors.
+	out, err := exec.Command("env").Output()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to run env; %v\n", err)
+		os.Exit(1)
+	}
+	var childEnv []string
+	for _, v := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if strings.HasPrefix(v, "LISTEN_") || strings.HasPrefix(v, "SERVERSTARTER_") && !strings.HasPrefix(v, "SERVERSTARTER_TEST_") {
+			childEnv = append(childEnv, v)
+		}
+	}
+	sort.Strings(childEnv)
+	fmt.Printf("fds child env: %s\n", strings.Join(childEnv, " "))
+	fmt.Printf("fds worker is master: %v\n", s.IsMaster())
+	addr := ""
+	if len(listeners) > 0 {
+		addr = listeners[0].Addr().String()
+	}
+	fmt.Printf("fds worker: pid=%d, listeners=%d, extras=%d, logs=%d, addr=%s\n",
+		os.Getpid(), len(listeners), len(extras), len(logs), addr)
+	if err := s.SendReady(); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to send ready; %v\n", err)
+		os.Exit(1)
+	}
+	<-sigterm
+}
+
+// getsockname returns the local address of the socket fd, or nil if it fails.
+func getsockname(fd uintptr) syscall.Sockaddr {
+	sa, _ := syscall.Getsockname(int(fd))
+	return sa
+}
+
+// fdsWorker is the worker of fdsHelper parsed from the line it prints.
+type fdsWorker struct {
+	pid                     int
+	listeners, extras, logs int
+	addr                    string
+}
+
+// waitFDsWorker waits for the worker of fdsHelper to print the file descriptors
+// it got.
+func (p *helperProcess) waitFDsWorker() fdsWorker {
+	p.t.Helper()
+	line := p.waitLine("fds worker: ", 10*time.Second)
+	var w fdsWorker
+	if _, err := fmt.Sscanf(line, "fds worker: pid=%d, listeners=%d, extras=%d, logs=%d, addr=%s",
+		&w.pid, &w.listeners, &w.extras, &w.logs, &w.addr); err != nil {
+		p.t.Fatalf("unexpected line %q; %v", line, err)
+	}
+	return w
+}
+
+// dialWorker connects to addr and returns the process ID written by the worker.
+func dialWorker(t *testing.T, addr string) int {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	data, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(string(data))
+	if err != nil {
+		t.Fatalf("unexpected response %q; %v", data, err)
+	}
+	return pid
+}
+
+func TestRunMasterPassFDsOverSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serverstarter-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := startHelper(t, "fds", fdsDirEnv+"="+dir, passFDsOverSocketEnv+"=1")
+	w := p.waitFDsWorker()
+	if w.listeners != 1 || w.extras != 1 || w.logs != 1 {
+		t.Errorf("file counts mismatch, got listeners=%d, extras=%d, logs=%d, want 1 for each", w.listeners, w.extras, w.logs)
+	}
+	// NOTE: The worker sends ready over the socket too.
+	p.waitLine("received ready from initial worker", 10*time.Second)
+	if got := dialWorker(t, w.addr); got != w.pid {
+		t.Errorf("connection accepted by unexpected process, got=%d, want=%d", got, w.pid)
+	}
+	p.signal(syscall.SIGTERM)
+	if err := p.wait(); err != nil {
+		t.Errorf("master exited with error; %v", err)
+	}
+
+	for name, want := range map[string]string{
+		"extra": fmt.Sprintf("extra written by worker pid=%d\n", w.pid),
+		"log":   fmt.Sprintf("log written by worker pid=%d\n", w.pid),
+	} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), want) {
+			t.Errorf("%s file mismatch, got=%q, want=%q", name, data, want)
+		}
+	}
+}
+
+func TestWorkerManifest(t *testing.T) {
+	for _, overSocket := range []bool{false, true} {
+		t.Run(fmt.Sprintf("overSocket=%v", overSocket), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "serverstarter-test-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			env := []string{fdsDirEnv + "=" + dir}
+			if overSocket {
+				env = append(env, passFDsOverSocketEnv+"=1")
+			}
+			p := startHelper(t, "fds", env...)
+			line := p.waitLine("fds manifest: ", 10*time.Second)
+			want := fmt.Sprintf("fds manifest: tcp,tcp,web file,,%s file,,%s",
+				filepath.Join(dir, "extra"), filepath.Join(dir, "log"))
+			if line != want {
+				t.Errorf("manifest mismatch,\n got=%q,\nwant=%q", line, want)
+			}
+			line = p.waitLine("fds manifest web: ", 10*time.Second)
+			w := p.waitFDsWorker()
+			_, port, err := net.SplitHostPort(w.addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := "fds manifest web: port=" + port; line != want {
+				t.Errorf("listener in manifest mismatch, got=%q, want=%q", line, want)
+			}
+
+			p.signal(syscall.SIGTERM)
+			if err := p.wait(); err != nil {
+				t.Errorf("master exited with error; %v", err)
+			}
+		})
+	}
+}
+
+func TestRunMasterFirstFD(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serverstarter-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := startHelper(t, "fds", fdsDirEnv+"="+dir, firstFDEnv+"=10")
+	if line, want := p.waitLine("fds first fd: ", 10*time.Second), "fds first fd: ready=10, listener=11"; line != want {
+		t.Errorf("file descriptors mismatch, got=%q, want=%q", line, want)
+	}
+	w := p.waitFDsWorker()
+	if w.listeners != 1 || w.extras != 1 || w.logs != 1 {
+		t.Errorf("file counts mismatch, got listeners=%d, extras=%d, logs=%d, want 1 for each", w.listeners, w.extras, w.logs)
+	}
+	p.waitLine("received ready from initial worker", 10*time.Second)
+	if got := dialWorker(t, w.addr); got != w.pid {
+		t.Errorf("connection accepted by unexpected process, got=%d, want=%d", got, w.pid)
+	}
+	p.signal(syscall.SIGTERM)
+	if err := p.wait(); err != nil {
+		t.Errorf("master exited with error; %v", err)
+	}
+}
+
+func TestRunMasterInvalidFirstFD(t *testing.T) {
+	s := New(SetFirstFD(2), SetOutput(ioutil.Discard))
+	if err := s.RunMaster(); err == nil || !strings.Contains(err.Error(), "invalid first file descriptor 2") {
+		t.Errorf("unexpected error; %v", err)
+	}
+}
+
+func TestWorkerRemovesFDEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serverstarter-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := startHelper(t, "fds", fdsDirEnv+"="+dir)
+	line := p.waitLine("fds child env: ", 10*time.Second)
+	for _, key := range []string{"LISTEN_FDS=", envExtraFDs + "=", envExtraFDNames + "=", envLogFDs + "=", envFDManifest + "="} {
+		if strings.Contains(line, key) {
+			t.Errorf("child process of worker inherited %s: %s", key, line)
+		}
+	}
+	if !strings.Contains(line, envMasterPID+"=0") {
+		t.Errorf("child process of worker did not inherit %s=0: %s", envMasterPID, line)
+	}
+	if line, want := p.waitLine("fds worker is master: ", 10*time.Second), "fds worker is master: false"; line != want {
+		t.Errorf("worker mismatch, got=%q, want=%q", line, want)
+	}
+	w := p.waitFDsWorker()
+	if w.listeners != 1 || w.extras != 1 || w.logs != 1 {
+		t.Errorf("file counts mismatch, got listeners=%d, extras=%d, logs=%d, want 1 for each", w.listeners, w.extras, w.logs)
+	}
+	p.waitLine("received ready from initial worker", 10*time.Second)
+
+	p.signal(syscall.SIGTERM)
+	if err := p.wait(); err != nil {
+		t.Errorf("master exited with error; %v", err)
+	}
+}
+
+func TestWorkerForkedByWrapper(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serverstarter-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := startHelper(t, "fds", fdsDirEnv+"="+dir, forkingWrapperEnv+"=1")
+	line := p.waitLine("failed to get listeners; ", 10*time.Second)
+	if !strings.Contains(line, fmt.Sprintf("passed from master pid=%d to its child", p.cmd.Process.Pid)) {
+		t.Errorf("unexpected error: %s", line)
+	}
+	if err := p.wait(); err == nil {
+		t.Error("master exited without error")
+	}
+}
+
+func TestWorkerCachesInherited(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serverstarter-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := startHelper(t, "fds", fdsDirEnv+"="+dir)
+	if line, want := p.waitLine("fds cached: ", 10*time.Second), "fds cached: listeners=true, extras=true, logs=true"; line != want {
+		t.Errorf("cached mismatch, got=%q, want=%q", line, want)
+	}
+	p.waitLine("received ready from initial worker", 10*time.Second)
+
+	p.signal(syscall.SIGTERM)
+	if err := p.wait(); err != nil {
+		t.Errorf("master exited with error; %v", err)
+	}
+}
+
+func TestWorkerTypedListeners(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serverstarter-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := startHelper(t, "fds", fdsDirEnv+"="+dir, unixListenerEnv+"=1")
+	line := p.waitLine("fds typed: ", 10*time.Second)
+	want := "fds typed: tcp=1, unix=1, tcpFor=true, unixFor=true, mismatch=error in TCPListenerFor; inherited listener for network=unix, addr=" +
+		filepath.Join(dir, "unix.sock") + " is not a TCP listener"
+	if line != want {
+		t.Errorf("typed listeners mismatch,\n got=%q,\nwant=%q", line, want)
+	}
+	p.waitLine("received ready from initial worker", 10*time.Second)
+
+	p.signal(syscall.SIGTERM)
+	if err := p.wait(); err != nil {
+		t.Errorf("master exited with error; %v", err)
+	}
+}
+
+func TestRunMasterWith(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serverstarter-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := startHelper(t, "fds", fdsDirEnv+"="+dir, runMasterWithEnv+"=1")
+	line := p.waitLine("fds packet conn: ", 10*time.Second)
+	var packetAddr string
+	if _, err := fmt.Sscanf(line, "fds packet conn: addr=%s", &packetAddr); err != nil {
+		t.Fatalf("unexpected line %q; %v", line, err)
+	}
+	line = p.waitLine("fds sctp: ", 10*time.Second)
+	var sctpAddr string
+	if _, err := fmt.Sscanf(line, "fds sctp: listeners=1, cached=true, addr=%s", &sctpAddr); err != nil {
+		t.Fatalf("unexpected line %q; %v", line, err)
+	}
+	sctpAddr = strings.TrimSuffix(sctpAddr, ",")
+	if want := fmt.Sprintf("fds sctp: listeners=1, cached=true, addr=%s, manifest=%s, fd=true", sctpAddr, sctpAddr); sctpAddr == "" || line != want {
+		t.Errorf("SCTP listener mismatch,\n got=%q,\nwant=%q", line, want)
+	}
+	line = p.waitLine("fds manifest: ", 10*time.Second)
+	want := fmt.Sprintf("fds manifest: tcp,tcp,api udp,udp,dns sctp,sctp,assoc file,,%s file,,%s",
+		filepath.Join(dir, "extra"), filepath.Join(dir, "log"))
+	if line != want {
+		t.Errorf("manifest mismatch,\n got=%q,\nwant=%q", line, want)
+	}
+	w := p.waitFDsWorker()
+	if w.listeners != 1 || w.extras != 1 || w.logs != 1 {
+		t.Errorf("file counts mismatch, got listeners=%d, extras=%d, logs=%d, want 1 for each", w.listeners, w.extras, w.logs)
+	}
+	p.waitLine("received ready from initial worker", 10*time.Second)
+	if got := dialWorker(t, w.addr); got != w.pid {
+		t.Errorf("connection accepted by unexpected process, got=%d, want=%d", got, w.pid)
+	}
+
+	c, err := net.Dial("udp", packetAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 512)
+	n, err := c.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(buf[:n]), strconv.Itoa(w.pid); got != want {
+		t.Errorf("packet replied by unexpected process, got=%s, want=%s", got, want)
+	}
+
+	p.signal(syscall.SIGTERM)
+	if err := p.wait(); err != nil {
+		t.Errorf("master exited with error; %v", err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "extra"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("extra written by worker pid=%d\n", w.pid); string(data) != want {
+		t.Errorf("extra file mismatch, got=%q, want=%q", data, want)
+	}
+}
@@ -0,0 +1,301 @@
+// Package gracenet provides the API of github.com/facebookgo/grace/gracenet
+// on top of serverstarter, so that a program using the archived gracenet can
+// migrate to serverstarter by changing the import path.
+//
+// A process started by the serverstarter master gets the listeners from
+// the master, and StartProcess asks the master to reload the workers.
+// The only change needed for such a process is to call Net.Ready when it starts
+// serving, since the master waits for it before treating the worker as ready.
+//
+// A process started without the master works in the same way as with gracenet:
+// it inherits the listeners at the file descriptors from 3 whose count is in
+// the environment variable LISTEN_FDS, and StartProcess starts a new process of
+// the same executable with the listeners passed in the same way.
+package gracenet
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hnakamur/serverstarter"
+)
+
+const (
+	// envCountKey is the environment variable for the number of the inherited
+	// listeners, which is the same as gracenet.
+	envCountKey = "LISTEN_FDS"
+	// envMasterPID is the environment variable which the serverstarter master
+	// sets for the workers.
+	envMasterPID = "SERVERSTARTER_MASTER_PID"
+	// firstFD is the file descriptor of the first inherited listener.
+	firstFD = 3
+)
+
+// Net provides the family of Listen functions and maintains the associated
+// state. Typically you will have only one Net per application.
+// The zero value is ready to use.
+type Net struct {
+	mu        sync.Mutex
+	starter   *serverstarter.Starter
+	inherited []net.Listener
+	loaded    bool
+	active    []net.Listener
+}
+
+// underMaster returns whether this process is a worker of the serverstarter master.
+func underMaster() bool {
+	return os.Getenv(envMasterPID) != ""
+}
+
+// starterLocked returns the serverstarter.Starter for this process.
+func (n *Net) starterLocked() *serverstarter.Starter {
+	if n.starter == nil {
+		n.starter = serverstarter.New()
+	}
+	return n.starter
+}
+
+// inheritLocked loads the listeners inherited from the parent process which
+// is not the serverstarter master.
+func (n *Net) inheritLocked() error {
+	if n.loaded {
+		return nil
+	}
+	n.loaded = true
+	v := os.Getenv(envCountKey)
+	if v == "" {
+		return nil
+	}
+	count, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("found invalid count value: %s=%s", envCountKey, v)
+	}
+	for fd := firstFD; fd < firstFD+count; fd++ {
+		file := os.NewFile(uintptr(fd), "listener")
+		l, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("error inheriting socket fd %d: %s", fd, err)
+		}
+		n.inherited = append(n.inherited, l)
+	}
+	return nil
+}
+
+// takeInheritedLocked returns the inherited listener whose address is the same
+// as addr and removes it from the inherited ones, or nil if none matches.
+func (n *Net) takeInheritedLocked(addr net.Addr) (net.Listener, error) {
+	if underMaster() {
+		s := n.starterLocked()
+		l, err := s.ListenerFor(addr.Network(), addr.String())
+		if err != nil {
+			// NOTE: We bind a new listener like gracenet if none matches.
+			return nil, nil
+		}
+		for _, a := range n.active {
+			if a == l {
+				return nil, nil
+			}
+		}
+		return l, nil
+	}
+	if err := n.inheritLocked(); err != nil {
+		return nil, err
+	}
+	for i, l := range n.inherited {
+		if l == nil || !isSameAddr(l.Addr(), addr) {
+			continue
+		}
+		n.inherited[i] = nil
+		return l, nil
+	}
+	return nil, nil
+}
+
+// Listen announces on the local network address laddr. The network net must be
+// a stream-oriented network: "tcp", "tcp4", "tcp6", "unix" or "unixpacket". It
+// returns an inherited net.Listener for the matching network and address, or
+// creates a new one using net.Listen.
+func (n *Net) Listen(nett, laddr string) (net.Listener, error) {
+	switch nett {
+	default:
+		return nil, net.UnknownNetworkError(nett)
+	case "tcp", "tcp4", "tcp6":
+		addr, err := net.ResolveTCPAddr(nett, laddr)
+		if err != nil {
+			return nil, err
+		}
+		return n.ListenTCP(nett, addr)
+	case "unix", "unixpacket":
+		addr, err := net.ResolveUnixAddr(nett, laddr)
+		if err != nil {
+			return nil, err
+		}
+		return n.ListenUnix(nett, addr)
+	}
+}
+
+// ListenTCP announces on the local network address laddr. The network net must
+// be: "tcp", "tcp4" or "tcp6". It returns an inherited net.Listener for the
+// matching network and address, or creates a new one using net.ListenTCP.
+func (n *Net) ListenTCP(nett string, laddr *net.TCPAddr) (*net.TCPListener, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	l, err := n.takeInheritedLocked(laddr)
+	if err != nil {
+		return nil, err
+	}
+	if l != nil {
+		tl, ok := l.(*net.TCPListener)
+		if !ok {
+			return nil, fmt.Errorf("inherited listener for %s is not a TCP listener", laddr)
+		}
+		n.active = append(n.active, tl)
+		return tl, nil
+	}
+	tl, err := net.ListenTCP(nett, laddr)
+	if err != nil {
+		return nil, err
+	}
+	n.active = append(n.active, tl)
+	return tl, nil
+}
+
+// ListenUnix announces on the local network address laddr. The network net
+// must be a: "unix" or "unixpacket". It returns an inherited net.Listener for
+// the matching network and address, or creates a new one using net.ListenUnix.
+func (n *Net) ListenUnix(nett string, laddr *net.UnixAddr) (*net.UnixListener, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	l, err := n.takeInheritedLocked(laddr)
+	if err != nil {
+		return nil, err
+	}
+	if l != nil {
+		ul, ok := l.(*net.UnixListener)
+		if !ok {
+			return nil, fmt.Errorf("inherited listener for %s is not a unix domain socket listener", laddr)
+		}
+		n.active = append(n.active, ul)
+		return ul, nil
+	}
+	ul, err := net.ListenUnix(nett, laddr)
+	if err != nil {
+		return nil, err
+	}
+	// NOTE: The socket file must be kept for the new process when this process exits.
+	ul.SetUnlinkOnClose(false)
+	n.active = append(n.active, ul)
+	return ul, nil
+}
+
+// activeListeners returns a snapshot copy of the active listeners.
+func (n *Net) activeListeners() []net.Listener {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]net.Listener(nil), n.active...)
+}
+
+// Ready notifies the serverstarter master that this process is ready to serve.
+// It does nothing if this process is not started by the master.
+func (n *Net) Ready() error {
+	if !underMaster() {
+		return nil
+	}
+	n.mu.Lock()
+	s := n.starterLocked()
+	n.mu.Unlock()
+	return s.SendReady()
+}
+
+// StartProcess starts a new process passing it the active listeners. It
+// doesn't fork, but starts a new process using the same environment and
+// arguments as when it was originally started. This allows for a newly
+// deployed binary to be started. It returns the pid of the newly started
+// process when successful.
+//
+// If this process is started by the serverstarter master, it asks the master
+// to reload the workers instead and returns the process ID of the master.
+func (n *Net) StartProcess() (int, error) {
+	if underMaster() {
+		n.mu.Lock()
+		s := n.starterLocked()
+		n.mu.Unlock()
+		if err := s.RequestReload(); err != nil {
+			return 0, err
+		}
+		return os.Getppid(), nil
+	}
+
+	listeners := n.activeListeners()
+	files := make([]*os.File, len(listeners))
+	for i, l := range listeners {
+		f, err := l.(interface {
+			File() (*os.File, error)
+		}).File()
+		if err != nil {
+			closeFiles(files[:i])
+			return 0, err
+		}
+		files[i] = f
+	}
+	defer closeFiles(files)
+
+	argv0, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return 0, err
+	}
+	var env []string
+	for _, v := range os.Environ() {
+		if !strings.HasPrefix(v, envCountKey+"=") {
+			env = append(env, v)
+		}
+	}
+	env = append(env, fmt.Sprintf("%s=%d", envCountKey, len(listeners)))
+
+	cmd := exec.Command(argv0, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = env
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return 0, fmt.Errorf("failed to start process %s: %s", argv0, err)
+	}
+	return cmd.Process.Pid, nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// isSameAddr returns whether the addresses are the same, where the unspecified
+// IP addresses are regarded as the same as no IP address.
+func isSameAddr(a1, a2 net.Addr) bool {
+	if a1.Network() != a2.Network() {
+		return false
+	}
+	a1s, a2s := a1.String(), a2.String()
+	if a1s == a2s {
+		return true
+	}
+
+	// NOTE: This allows for ipv6 vs ipv4 local addresses to compare as equal.
+	// This scenario is common when listening on localhost.
+	const ipv6prefix = "[::]"
+	a1s = strings.TrimPrefix(a1s, ipv6prefix)
+	a2s = strings.TrimPrefix(a2s, ipv6prefix)
+	const ipv4prefix = "0.0.0.0"
+	a1s = strings.TrimPrefix(a1s, ipv4prefix)
+	a2s = strings.TrimPrefix(a2s, ipv4prefix)
+	return a1s == a2s
+}
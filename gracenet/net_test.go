@@ -0,0 +1,156 @@
+//go:build !windows
+
+package gracenet
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// helperAddrEnv is the environment variable for the address on which the test
+// binary listens as a helper instead of running tests.
+const helperAddrEnv = "GRACENET_TEST_HELPER_ADDR"
+
+func TestMain(m *testing.M) {
+	if addr := os.Getenv(helperAddrEnv); addr != "" {
+		runHelper(addr)
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runHelper listens on addr, writes its process ID to the connections and
+// starts a new process and exits on SIGUSR2 like gracehttp.
+func runHelper(addr string) {
+	var n Net
+	l, err := n.Listen("tcp", addr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to listen; %v\n", err)
+		os.Exit(1)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(c, "%d", os.Getpid())
+			c.Close()
+		}
+	}()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2, syscall.SIGTERM)
+	fmt.Printf("ready: pid=%d, inherited=%v\n", os.Getpid(), os.Getenv(envCountKey) != "")
+	if <-signals == syscall.SIGUSR2 {
+		pid, err := n.StartProcess()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to start process; %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("started new process: pid=%d\n", pid)
+	}
+	l.Close()
+}
+
+func TestStartProcess(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Env = append(os.Environ(), helperAddrEnv+"="+addr)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+	lines := bufio.NewScanner(stdout)
+	nextLine := func() string {
+		if !lines.Scan() {
+			t.Fatalf("helper exited; %v", lines.Err())
+		}
+		return lines.Text()
+	}
+
+	if got, want := nextLine(), fmt.Sprintf("ready: pid=%d, inherited=false", cmd.Process.Pid); got != want {
+		t.Fatalf("unexpected line: got %q, want %q", got, want)
+	}
+	if err := cmd.Process.Signal(syscall.SIGUSR2); err != nil {
+		t.Fatal(err)
+	}
+	var newPID int
+	if _, err := fmt.Sscanf(nextLine(), "started new process: pid=%d", &newPID); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Kill(newPID, syscall.SIGKILL)
+	if got, want := nextLine(), fmt.Sprintf("ready: pid=%d, inherited=true", newPID); got != want {
+		t.Fatalf("unexpected line: got %q, want %q", got, want)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Errorf("old process exited with error; %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(c)
+		c.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// NOTE: The connection may be accepted by the old process before it closes the listener.
+		if strings.TrimSpace(string(data)) == strconv.Itoa(newPID) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("connection is not accepted by new process pid=%d", newPID)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestIsSameAddr(t *testing.T) {
+	testCases := []struct {
+		a1, a2 string
+		want   bool
+	}{
+		{":8080", ":8080", true},
+		{"0.0.0.0:8080", ":8080", true},
+		{"[::]:8080", ":8080", true},
+		{"127.0.0.1:8080", ":8080", false},
+		{":8080", ":8081", false},
+	}
+	for _, tc := range testCases {
+		a1, err := net.ResolveTCPAddr("tcp", tc.a1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a2, err := net.ResolveTCPAddr("tcp", tc.a2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := isSameAddr(a1, a2); got != tc.want {
+			t.Errorf("isSameAddr(%s, %s) = %v, want %v", tc.a1, tc.a2, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package serverstarter
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// GRPCServer is the interface of a gRPC server used by ServeGRPC, which
+// *grpc.Server of google.golang.org/grpc implements.
+type GRPCServer interface {
+	Serve(l net.Listener) error
+	GracefulStop()
+	Stop()
+}
+
+// GRPCHealth is the interface of a gRPC health service used by ServeGRPC,
+// which *health.Server of google.golang.org/grpc/health implements.
+type GRPCHealth interface {
+	// Shutdown sets all serving status to NOT_SERVING.
+	Shutdown()
+	// Resume sets all serving status to SERVING.
+	Resume()
+}
+
+// ServeGRPC serves srv on the listeners in the worker and stops it gracefully
+// on the graceful shutdown signal from the master.
+//
+// It sets the status of health to NOT_SERVING before serving, and sends ready
+// to the master after setting it to SERVING, so that the health checks and
+// the master agree on when the worker is ready. On the shutdown signal, it sets
+// the status to NOT_SERVING so that load balancers stop sending new requests,
+// and calls GracefulStop of srv. If the master passes the shutdown timeout,
+// it calls Stop of srv when GracefulStop does not finish before the timeout.
+//
+// health may be nil. It returns when srv is stopped or ctx is done.
+func (s *Starter) ServeGRPC(ctx context.Context, srv GRPCServer, health GRPCHealth, listeners ...net.Listener) error {
+	sig, err := shutdownSignal()
+	if err != nil {
+		return fmt.Errorf("error in ServeGRPC after getting shutdown signal; %w", err)
+	}
+	if sig == 0 {
+		sig = syscall.SIGTERM
+	}
+	var timeout time.Duration
+	if v, ok := os.LookupEnv(envShutdownTimeout); ok {
+		if timeout, err = time.ParseDuration(v); err != nil {
+			return fmt.Errorf("error in ServeGRPC after getting invalid shutdown timeout; %w", err)
+		}
+	}
+	// NOTE: We start handling the signal before sending ready, so that the signal
+	// sent right after the worker gets ready is not lost.
+	sigC := make(chan os.Signal, 1)
+	signal.Notify(sigC, sig)
+	defer signal.Stop(sigC)
+
+	if health != nil {
+		health.Shutdown()
+	}
+	errC := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			errC <- srv.Serve(l)
+		}(l)
+	}
+	if health != nil {
+		health.Resume()
+	}
+	if err := s.SendReady(); err != nil {
+		srv.Stop()
+		return fmt.Errorf("error in ServeGRPC after sending ready; %w", err)
+	}
+
+	select {
+	case <-sigC:
+	case err := <-errC:
+		srv.Stop()
+		return fmt.Errorf("error in ServeGRPC after serving; %w", err)
+	case <-ctx.Done():
+		srv.Stop()
+		return ctx.Err()
+	}
+
+	if health != nil {
+		health.Shutdown()
+	}
+	stopped := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(stopped)
+	}()
+	var timeoutC <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutC = timer.C
+	}
+	select {
+	case <-stopped:
+	case <-timeoutC:
+		fmt.Fprintf(os.Stderr, "gRPC server did not stop gracefully in %s, stopping\n", timeout)
+		srv.Stop()
+		<-stopped
+	}
+	return nil
+}
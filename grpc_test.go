@@ -0,0 +1,206 @@
+//go:build !windows
+
+package serverstarter
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeGRPCServer is a GRPCServer whose Serve returns after it is stopped.
+// If hang is true, GracefulStop does not finish until Stop is called, like
+// the server with a long running request.
+type fakeGRPCServer struct {
+	hang bool
+
+	mu       sync.Mutex
+	calls    []string
+	stopC    chan struct{}
+	stopOnce sync.Once
+}
+
+func newFakeGRPCServer(hang bool) *fakeGRPCServer {
+	return &fakeGRPCServer{hang: hang, stopC: make(chan struct{})}
+}
+
+func (s *fakeGRPCServer) record(call string) {
+	s.mu.Lock()
+	s.calls = append(s.calls, call)
+	s.mu.Unlock()
+}
+
+func (s *fakeGRPCServer) Calls() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.calls...)
+}
+
+func (s *fakeGRPCServer) stop() {
+	s.stopOnce.Do(func() { close(s.stopC) })
+}
+
+func (s *fakeGRPCServer) Serve(l net.Listener) error {
+	<-s.stopC
+	return nil
+}
+
+func (s *fakeGRPCServer) GracefulStop() {
+	s.record("GracefulStop")
+	if !s.hang {
+		s.stop()
+	}
+	<-s.stopC
+}
+
+func (s *fakeGRPCServer) Stop() {
+	s.record("Stop")
+	s.stop()
+}
+
+// fakeGRPCHealth is a GRPCHealth which records the calls.
+type fakeGRPCHealth struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (h *fakeGRPCHealth) Shutdown() {
+	h.mu.Lock()
+	h.calls = append(h.calls, "Shutdown")
+	h.mu.Unlock()
+}
+
+func (h *fakeGRPCHealth) Resume() {
+	h.mu.Lock()
+	h.calls = append(h.calls, "Resume")
+	h.mu.Unlock()
+}
+
+func (h *fakeGRPCHealth) Calls() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string(nil), h.calls...)
+}
+
+// serveFakeGRPC runs ServeGRPC for srv in a worker whose shutdown signal is
+// SIGUSR1 and shutdown timeout is timeout, and returns the channel of the error
+// returned by ServeGRPC after the worker sends ready.
+func serveFakeGRPC(t *testing.T, ctx context.Context, srv GRPCServer, health GRPCHealth, timeout time.Duration) <-chan error {
+	t.Helper()
+	os.Setenv(envShutdownSignal, strconv.Itoa(int(syscall.SIGUSR1)))
+	os.Setenv(envShutdownTimeout, timeout.String())
+	t.Cleanup(func() {
+		os.Unsetenv(envShutdownSignal)
+		os.Unsetenv(envShutdownTimeout)
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	// NOTE: We use a pipe in place of the one to the master.
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		r.Close()
+		w.Close()
+	})
+	s := New()
+	s.readyPipeW = w
+
+	errC := make(chan error, 1)
+	go func() {
+		errC <- s.ServeGRPC(ctx, srv, health, l)
+	}()
+	readyC := make(chan error, 1)
+	go func() {
+		_, err := r.Read(make([]byte, 1))
+		readyC <- err
+	}()
+	select {
+	case err := <-readyC:
+		if err != nil {
+			t.Fatalf("failed to read ready; %v", err)
+		}
+	case err := <-errC:
+		t.Fatalf("ServeGRPC returned before sending ready; %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeGRPC did not send ready")
+	}
+	return errC
+}
+
+// waitServeGRPC waits for ServeGRPC to return and returns its error.
+func waitServeGRPC(t *testing.T, errC <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-errC:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeGRPC did not return")
+	}
+	return nil
+}
+
+func TestServeGRPCGracefulStop(t *testing.T) {
+	srv := newFakeGRPCServer(false)
+	health := &fakeGRPCHealth{}
+	errC := serveFakeGRPC(t, context.Background(), srv, health, time.Minute)
+	if got, want := health.Calls(), []string{"Shutdown", "Resume"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("health calls before shutdown mismatch, got=%v, want=%v", got, want)
+	}
+
+	syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+	if err := waitServeGRPC(t, errC); err != nil {
+		t.Errorf("ServeGRPC returned error; %v", err)
+	}
+	if got, want := srv.Calls(), []string{"GracefulStop"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("server calls mismatch, got=%v, want=%v", got, want)
+	}
+	if got, want := health.Calls(), []string{"Shutdown", "Resume", "Shutdown"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("health calls mismatch, got=%v, want=%v", got, want)
+	}
+}
+
+func TestServeGRPCStopAfterTimeout(t *testing.T) {
+	srv := newFakeGRPCServer(true)
+	timeout := 100 * time.Millisecond
+	errC := serveFakeGRPC(t, context.Background(), srv, nil, timeout)
+
+	start := time.Now()
+	syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+	if err := waitServeGRPC(t, errC); err != nil {
+		t.Errorf("ServeGRPC returned error; %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < timeout {
+		t.Errorf("server was stopped before shutdown timeout, elapsed=%s, timeout=%s", elapsed, timeout)
+	}
+	if got, want := srv.Calls(), []string{"GracefulStop", "Stop"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("server calls mismatch, got=%v, want=%v", got, want)
+	}
+}
+
+func TestServeGRPCContextDone(t *testing.T) {
+	srv := newFakeGRPCServer(false)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errC := serveFakeGRPC(t, ctx, srv, nil, time.Minute)
+
+	cancel()
+	if err := waitServeGRPC(t, errC); !errors.Is(err, context.Canceled) {
+		t.Errorf("error mismatch, got=%v, want=%v", err, context.Canceled)
+	}
+	if got, want := srv.Calls(), []string{"Stop"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("server calls mismatch, got=%v, want=%v", got, want)
+	}
+}
@@ -0,0 +1,164 @@
+//go:build !windows
+
+package serverstarter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// helperEnv is the environment variable for the name of the helper which the
+// test binary runs as the master and the worker instead of running tests.
+const helperEnv = "SERVERSTARTER_TEST_HELPER"
+
+// helpers are the functions run by the test binary started by startHelper.
+// Each helper is run as both the master and the worker.
+var helpers = map[string]func(){}
+
+func TestMain(m *testing.M) {
+	// NOTE: The test binary is the master program of the helpers.
+	if err := RunTrampoline(); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to run trampoline; %v\n", err)
+		os.Exit(127)
+	}
+	if name := os.Getenv(helperEnv); name != "" {
+		helper, ok := helpers[name]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "unknown helper %q\n", name)
+			os.Exit(2)
+		}
+		helper()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// helperProcess is a master process started by startHelper.
+type helperProcess struct {
+	t     testing.TB
+	cmd   *exec.Cmd
+	lines chan string
+}
+
+// startHelper starts the test binary as the master running the helper.
+func startHelper(t testing.TB, name string, env ...string) *helperProcess {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Env = append(os.Environ(), helperEnv+"="+name)
+	cmd.Env = append(cmd.Env, env...)
+	// NOTE: We start the master in a new process group, so that we can kill
+	// the master and its workers at once in the cleanup.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	p := &helperProcess{t: t, cmd: cmd, lines: make(chan string, 100)}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		readLines(stdout, p.lines)
+	}()
+	go func() {
+		defer wg.Done()
+		readLines(io.TeeReader(stderr, os.Stderr), p.lines)
+	}()
+	go func() {
+		wg.Wait()
+		close(p.lines)
+	}()
+	t.Cleanup(func() {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		if cmd.ProcessState == nil {
+			cmd.Wait()
+		}
+	})
+	return p
+}
+
+func readLines(r io.Reader, lines chan<- string) {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		lines <- sc.Text()
+	}
+}
+
+// waitLine waits for a line of the stdout or stderr of the master which contains substr
+// and returns the line.
+func (p *helperProcess) waitLine(substr string, timeout time.Duration) string {
+	p.t.Helper()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case line, ok := <-p.lines:
+			if !ok {
+				p.t.Fatalf("master exited before printing a line containing %q", substr)
+			}
+			if strings.Contains(line, substr) {
+				return line
+			}
+		case <-timer.C:
+			p.t.Fatalf("timeout waiting for a line containing %q", substr)
+		}
+	}
+}
+
+// waitLines waits for the lines which contain each of substrs in any order, since
+// the lines of the stdout and the stderr may be interleaved, and returns the
+// lines in the order of substrs.
+func (p *helperProcess) waitLines(timeout time.Duration, substrs ...string) []string {
+	p.t.Helper()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	found := make([]string, len(substrs))
+	remaining := len(substrs)
+	for remaining > 0 {
+		select {
+		case line, ok := <-p.lines:
+			if !ok {
+				p.t.Fatalf("master exited before printing lines containing %q", substrs)
+			}
+			for i, substr := range substrs {
+				if found[i] == "" && strings.Contains(line, substr) {
+					found[i] = line
+					remaining--
+					break
+				}
+			}
+		case <-timer.C:
+			p.t.Fatalf("timeout waiting for lines containing %q", substrs)
+		}
+	}
+	return found
+}
+
+func (p *helperProcess) signal(sig syscall.Signal) {
+	p.t.Helper()
+	if err := p.cmd.Process.Signal(sig); err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+// wait waits for the master to exit and returns the error from exec.Cmd.Wait.
+func (p *helperProcess) wait() error {
+	for range p.lines {
+	}
+	return p.cmd.Wait()
+}
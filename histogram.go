@@ -0,0 +1,79 @@
+package serverstarter
+
+import (
+	"fmt"
+	"time"
+)
+
+// defaultHistogramBounds are the upper bounds of the buckets of the histograms in Stats.
+var defaultHistogramBounds = []time.Duration{
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+	time.Minute,
+	2 * time.Minute,
+}
+
+// DurationHistogram is a histogram of durations with fixed buckets, which can be
+// exported as a histogram metric, for example of Prometheus.
+type DurationHistogram struct {
+	// Bounds are the upper bounds of the buckets in ascending order.
+	Bounds []time.Duration
+
+	// Counts are the numbers of the observed durations in the buckets, which are
+	// not cumulative. Counts[i] is the number of durations d where
+	// Bounds[i-1] < d <= Bounds[i], and the last element is the number of
+	// durations larger than all Bounds, so len(Counts) is len(Bounds)+1.
+	Counts []uint64
+
+	// Count is the total number of the observed durations.
+	Count uint64
+
+	// Sum is the sum of the observed durations.
+	Sum time.Duration
+
+	// Max is the maximum of the observed durations.
+	Max time.Duration
+}
+
+// observe adds the duration d to h.
+func (h *DurationHistogram) observe(d time.Duration) {
+	if h.Bounds == nil {
+		h.Bounds = defaultHistogramBounds
+		h.Counts = make([]uint64, len(h.Bounds)+1)
+	}
+	i := 0
+	for i < len(h.Bounds) && d > h.Bounds[i] {
+		i++
+	}
+	h.Counts[i]++
+	h.Count++
+	h.Sum += d
+	if d > h.Max {
+		h.Max = d
+	}
+}
+
+// clone returns a copy of h which does not share the counts.
+func (h DurationHistogram) clone() DurationHistogram {
+	h.Counts = append([]uint64(nil), h.Counts...)
+	return h
+}
+
+// Mean returns the mean of the observed durations, or 0 if no duration is observed.
+func (h DurationHistogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+// String returns the summary of h in the form "count=3 mean=1.2s max=1.5s".
+func (h DurationHistogram) String() string {
+	return fmt.Sprintf("count=%d mean=%s max=%s", h.Count, h.Mean(), h.Max)
+}
@@ -0,0 +1,43 @@
+package serverstarter
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDurationHistogram(t *testing.T) {
+	var h DurationHistogram
+	for _, d := range []time.Duration{50 * time.Millisecond, 100 * time.Millisecond, 3 * time.Second, 5 * time.Minute} {
+		h.observe(d)
+	}
+	if want := []uint64{2, 0, 0, 0, 0, 1, 0, 0, 0, 0, 1}; !reflect.DeepEqual(h.Counts, want) {
+		t.Errorf("counts mismatch, got=%v, want=%v", h.Counts, want)
+	}
+	if h.Count != 4 || h.Max != 5*time.Minute {
+		t.Errorf("unexpected histogram: %s", h)
+	}
+	if got, want := h.Mean(), (50*time.Millisecond+100*time.Millisecond+3*time.Second+5*time.Minute)/4; got != want {
+		t.Errorf("mean mismatch, got=%s, want=%s", got, want)
+	}
+}
+
+func TestStatusResponse(t *testing.T) {
+	s := New()
+	s.emit(Event{Type: EventWorkerReady, Elapsed: time.Second})
+	s.emit(Event{Type: EventWorkerReady, Elapsed: 2 * time.Second})
+	stats := s.Stats()
+	stats.TimeToReady.Counts[0] = 100
+	if s.Stats().TimeToReady.Counts[0] == 100 {
+		t.Error("counts of histogram in stats must not be shared")
+	}
+
+	resp := s.statusResponse()
+	if want := " time_to_ready_count=2 time_to_ready_mean=1.5s time_to_ready_max=2s "; !strings.Contains(resp, want) {
+		t.Errorf("status response %q does not contain %q", resp, want)
+	}
+	if want := " old_worker_exit_count=0 old_worker_exit_mean=0s old_worker_exit_max=0s "; !strings.Contains(resp, want) {
+		t.Errorf("status response %q does not contain %q", resp, want)
+	}
+}
@@ -0,0 +1,116 @@
+package serverstarter
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SetEventHook sets the command which the master runs on events of type t,
+// like the hook scripts of runit. For example, the hooks below can be used for
+// warming caches and registering the worker to a load balancer, and for alerting.
+//
+//   - EventReloadStarted: before the master starts a new worker on a reload.
+//   - EventWorkerReady: after a worker gets ready.
+//   - EventOldWorkerExited: after the old worker exits on a reload.
+//   - EventWorkerExited: after a worker crashes.
+//
+// command is the program and its arguments. The data of the event are passed
+// to the command with the environment variables below in addition to those of
+// the master. The variables for the fields not set in the event are not passed.
+//
+//   - SERVERSTARTER_EVENT: the type of the event.
+//   - SERVERSTARTER_MASTER_PID: the process ID of the master.
+//   - SERVERSTARTER_WORKER_PID: the process ID of the worker.
+//   - SERVERSTARTER_WORKER_NAME: the name of the worker set by AddWorker.
+//   - SERVERSTARTER_WORKER_GENERATION: the generation number of the worker.
+//   - SERVERSTARTER_ELAPSED: the elapsed duration of the event, for example 1.5s.
+//   - SERVERSTARTER_ERROR: the error of the event.
+//
+// The master waits for the command to exit before going on, so that a hook
+// for EventReloadStarted finishes before the new worker starts. The command is
+// killed if it does not exit within the timeout set by SetEventHookTimeout.
+// The failure of the command is logged and does not affect the master.
+func SetEventHook(t EventType, command []string) Option {
+	return func(s *Starter) {
+		if s.eventHooks == nil {
+			s.eventHooks = make(map[EventType][]string)
+		}
+		s.eventHooks[t] = command
+	}
+}
+
+// SetEventHookTimeout sets the timeout for the commands set by SetEventHook.
+// The default value is 30 seconds.
+func SetEventHookTimeout(timeout time.Duration) Option {
+	return func(s *Starter) {
+		s.eventHookTimeout = timeout
+	}
+}
+
+// runEventHook runs the command set by SetEventHook for the event e if any.
+func (s *Starter) runEventHook(e Event) {
+	command := s.eventHooks[e.Type]
+	if len(command) == 0 {
+		return
+	}
+	start := time.Now()
+	if err := s.runHookCommand(command, eventHookEnv(e)); err != nil {
+		s.out.eprintf("hook for event %s failed: %v\n", e.Type, err)
+		return
+	}
+	s.out.printf("ran hook for event %s, elapsed=%s\n", e.Type, time.Since(start))
+}
+
+// runHookCommand runs command with the environment variables env added, and
+// kills it if it does not exit within the timeout set by SetEventHookTimeout.
+func (s *Starter) runHookCommand(command, env []string) error {
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := startCommand(cmd); err != nil {
+		return fmt.Errorf("error in runHookCommand after starting command; %w", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- waitCommand(cmd)
+	}()
+	timer := time.NewTimer(s.eventHookTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		cmd.Process.Kill()
+		<-done
+		return fmt.Errorf("killed hook command pid=%d since it did not exit within %s", cmd.Process.Pid, s.eventHookTimeout)
+	}
+}
+
+// eventHookEnv returns the environment variables for the event e passed to the
+// command set by SetEventHook.
+func eventHookEnv(e Event) []string {
+	env := []string{
+		"SERVERSTARTER_EVENT=" + string(e.Type),
+		"SERVERSTARTER_MASTER_PID=" + strconv.Itoa(os.Getpid()),
+		"SERVERSTARTER_WORKER_PID=" + strconv.Itoa(e.PID),
+	}
+	if e.Worker != "" {
+		env = append(env, "SERVERSTARTER_WORKER_NAME="+e.Worker)
+	}
+	if e.Generation != 0 {
+		env = append(env, "SERVERSTARTER_WORKER_GENERATION="+strconv.Itoa(e.Generation))
+	}
+	if e.Elapsed != 0 {
+		env = append(env, "SERVERSTARTER_ELAPSED="+e.Elapsed.String())
+	}
+	if e.Err != nil {
+		// NOTE: Environment variables cannot contain NUL characters.
+		env = append(env, "SERVERSTARTER_ERROR="+strings.Replace(e.Err.Error(), "\x00", "", -1))
+	}
+	return env
+}
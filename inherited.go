@@ -0,0 +1,137 @@
+package serverstarter
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	// envShutdownSignal is the environment variable name for passing the signal
+	// number which the master sends to the worker for graceful shutdown.
+	envShutdownSignal = "SERVERSTARTER_SHUTDOWN_SIGNAL"
+	// envShutdownTimeout is the environment variable name for passing the duration
+	// which the master waits for the worker to shutdown gracefully.
+	envShutdownTimeout = "SERVERSTARTER_SHUTDOWN_TIMEOUT"
+)
+
+// Inherited is what the worker process inherits from the master.
+type Inherited struct {
+	// Listeners are the listeners passed from the master in the same order
+	// as the ones passed to RunMaster.
+	Listeners []net.Listener
+
+	// PacketConns are the packet connections passed from the master in the same
+	// order as Inheritance.PacketConns passed to RunMasterWith.
+	PacketConns []net.PacketConn
+
+	// SCTPListeners are the files of the SCTP listeners passed from the master.
+	// See Starter.SCTPListeners.
+	SCTPListeners []*os.File
+
+	// Files are the files set by SetExtraFiles in the master.
+	Files []*os.File
+
+	// Names are the names of Files, which are the names of the files
+	// in the master.
+	Names []string
+
+	// LogWriters are the writers for the log files set by SetLogFiles
+	// in the master.
+	LogWriters []io.Writer
+
+	// Manifest describes the file descriptors of Listeners, Files and LogWriters.
+	// See Starter.Manifest.
+	Manifest FDManifest
+
+	// Generation is the generation number of the worker. See Starter.Generation.
+	Generation int
+
+	// ShutdownSignal is the signal which the master sends to the worker
+	// for graceful shutdown.
+	ShutdownSignal syscall.Signal
+
+	// ShutdownTimeout is the duration which the master waits for the worker to
+	// shutdown gracefully after sending ShutdownSignal before killing it.
+	// It is zero if the master uses the drain policy set by SetDrainPolicy,
+	// since the duration is decided dynamically in that case.
+	ShutdownTimeout time.Duration
+}
+
+// Inherited returns what this process inherits from the master if this is
+// called by the worker process. It returns nil when this is called by the
+// master process.
+//
+// Inherited gets all of them in one call, so new code should use it instead of
+// calling Listeners, ExtraFiles, LogWriters and Generation separately.
+// The listeners and files are created on the first call and the same ones are
+// returned after that.
+func (s *Starter) Inherited() (*Inherited, error) {
+	if s.IsMaster() {
+		return nil, nil
+	}
+
+	listeners, err := s.Listeners()
+	if err != nil {
+		return nil, fmt.Errorf("error in Inherited after getting listeners; %w", err)
+	}
+	packetConns, err := s.PacketConns()
+	if err != nil {
+		return nil, fmt.Errorf("error in Inherited after getting packet connections; %w", err)
+	}
+	sctpListeners, err := s.SCTPListeners()
+	if err != nil {
+		return nil, fmt.Errorf("error in Inherited after getting SCTP listeners; %w", err)
+	}
+	files, err := s.ExtraFiles()
+	if err != nil {
+		return nil, fmt.Errorf("error in Inherited after getting extra files; %w", err)
+	}
+	logWriters, err := s.LogWriters()
+	if err != nil {
+		return nil, fmt.Errorf("error in Inherited after getting log writers; %w", err)
+	}
+	manifest, err := s.Manifest()
+	if err != nil {
+		return nil, fmt.Errorf("error in Inherited after getting manifest; %w", err)
+	}
+	in := &Inherited{
+		Manifest:      manifest,
+		Listeners:     listeners,
+		PacketConns:   packetConns,
+		SCTPListeners: sctpListeners,
+		Files:         files,
+		LogWriters:    logWriters,
+		Generation:    s.Generation(),
+	}
+	for _, f := range files {
+		in.Names = append(in.Names, f.Name())
+	}
+	if in.ShutdownSignal, err = shutdownSignal(); err != nil {
+		return nil, fmt.Errorf("error in Inherited after getting shutdown signal; %w", err)
+	}
+	if v, ok := os.LookupEnv(envShutdownTimeout); ok {
+		if in.ShutdownTimeout, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("error in Inherited after getting invalid shutdown timeout; %w", err)
+		}
+	}
+	return in, nil
+}
+
+// shutdownSignal returns the signal which the master sends to the worker for
+// graceful shutdown. It returns zero if the environment variable is not set.
+func shutdownSignal() (syscall.Signal, error) {
+	v, ok := os.LookupEnv(envShutdownSignal)
+	if !ok {
+		return 0, nil
+	}
+	sig, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid shutdown signal %q; %w", v, err)
+	}
+	return syscall.Signal(sig), nil
+}
@@ -0,0 +1,22 @@
+package serverstarter
+
+// SetInitMode makes the master suitable for running as PID 1 in a container.
+// In the init mode, the master
+//
+//   - reaps all zombie processes re-parented to it, like SetChildSubreaper,
+//   - sends the signal set by SetGracefulShutdownSignalToChild instead of SIGTERM
+//     to the workers when it receives a SIGTERM or a SIGINT from the orchestrator,
+//     so that the workers shut down gracefully, and
+//   - forwards the signals which it does not use to the workers, which are
+//     SIGWINCH, SIGUSR1 unless SetLogFiles is used, and SIGUSR2 unless
+//     SetControlFile, SetMasterUpgrade or SetNginxSignals is used.
+//
+// NOTE: The kernel does not deliver signals with the default action to PID 1,
+// so the signals not handled by the master are ignored in a container.
+//
+// This option is supported only on Linux.
+func SetInitMode() Option {
+	return func(s *Starter) {
+		s.initMode = true
+	}
+}
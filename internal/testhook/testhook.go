@@ -0,0 +1,8 @@
+// Package testhook provides the hooks of serverstarter for serverstartertest,
+// which must not be a part of the public API of serverstarter.
+package testhook
+
+// ResetWorker forgets the state of the worker cached in this process, such as
+// the file descriptors passed from the master, so that the next Starter reads
+// the environment again. It is set by serverstarter.
+var ResetWorker func()
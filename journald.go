@@ -0,0 +1,146 @@
+package serverstarter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// journalSocket is the path of the socket of systemd-journald for the native protocol.
+const journalSocket = "/run/systemd/journal/socket"
+
+// Priorities of journal entries, which are same as the syslog severities.
+const (
+	journalPriorityErr  = 3
+	journalPriorityInfo = 6
+)
+
+// SetJournald makes the master send its human-readable messages to the systemd
+// journal instead of the output set by SetOutput, with identifier as the
+// SYSLOG_IDENTIFIER field. The master connects to the journal when RunMaster
+// is called, so this option is useful only when running under systemd.
+//
+// The master also sends the events passed to the handler set by SetEventHandler
+// to the journal with the structured fields below, so that journalctl -o json
+// shows the restart history of workers:
+//
+//   - EVENT: the type of the event, for example worker_started.
+//   - WORKER_PID: the process ID of the worker.
+//   - WORKER_NAME: the name of the worker set by AddWorker if any.
+//   - GENERATION: the generation number of the worker if known.
+//   - ELAPSED, ACTIVE_CONNS, FORCED and ERROR: the other fields of the event if set.
+//
+// This option cannot be used with SetSyslog.
+func SetJournald(identifier string) Option {
+	return func(s *Starter) {
+		s.journaldIdentifier = identifier
+	}
+}
+
+// journal is a connection to systemd-journald.
+type journal struct {
+	conn       *net.UnixConn
+	identifier string
+}
+
+// journalField is a field of a journal entry.
+type journalField struct {
+	name  string
+	value string
+}
+
+// dialJournal connects to systemd-journald listening on the socket at path.
+func dialJournal(path, identifier string) (*journal, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journal{conn: conn, identifier: identifier}, nil
+}
+
+// Info sends the message m with the priority info.
+func (j *journal) Info(m string) error {
+	return j.send(journalPriorityInfo, strings.TrimSuffix(m, "\n"), nil)
+}
+
+// Err sends the message m with the priority err.
+func (j *journal) Err(m string) error {
+	return j.send(journalPriorityErr, strings.TrimSuffix(m, "\n"), nil)
+}
+
+// Close closes the connection.
+func (j *journal) Close() error {
+	return j.conn.Close()
+}
+
+// sendEvent sends the event e with the structured fields.
+func (j *journal) sendEvent(e Event) error {
+	fields := []journalField{
+		{"EVENT", string(e.Type)},
+		{"WORKER_PID", strconv.Itoa(e.PID)},
+	}
+	msg := fmt.Sprintf("event %s: pid=%d", e.Type, e.PID)
+	if e.Worker != "" {
+		fields = append(fields, journalField{"WORKER_NAME", e.Worker})
+		msg += ", name=" + e.Worker
+	}
+	if e.Generation != 0 {
+		fields = append(fields, journalField{"GENERATION", strconv.Itoa(e.Generation)})
+		msg += ", generation=" + strconv.Itoa(e.Generation)
+	}
+	if e.Elapsed != 0 {
+		fields = append(fields, journalField{"ELAPSED", e.Elapsed.String()})
+	}
+	if e.Type == EventDrainProgress {
+		fields = append(fields, journalField{"ACTIVE_CONNS", strconv.Itoa(e.ActiveConns)})
+	}
+	if e.Forced {
+		fields = append(fields, journalField{"FORCED", "1"})
+	}
+	priority := journalPriorityInfo
+	if e.Err != nil {
+		fields = append(fields, journalField{"ERROR", e.Err.Error()})
+		msg += ", err=" + e.Err.Error()
+	}
+	if e.Type == EventReloadFailed || (e.Type == EventWorkerExited && e.Err != nil) {
+		priority = journalPriorityErr
+	}
+	return j.send(priority, msg, fields)
+}
+
+// send sends a journal entry with the message and the fields.
+//
+// NOTE: Messages larger than the maximum datagram size are not supported,
+// since they must be passed in a memfd which we do not bother with.
+func (j *journal) send(priority int, msg string, fields []journalField) error {
+	var buf bytes.Buffer
+	appendJournalField(&buf, "MESSAGE", msg)
+	appendJournalField(&buf, "PRIORITY", strconv.Itoa(priority))
+	appendJournalField(&buf, "SYSLOG_IDENTIFIER", j.identifier)
+	for _, f := range fields {
+		appendJournalField(&buf, f.name, f.value)
+	}
+	_, err := j.conn.Write(buf.Bytes())
+	return err
+}
+
+// appendJournalField appends the field in the native journal protocol to buf.
+// The value which contains newlines is serialized in the binary form.
+func appendJournalField(buf *bytes.Buffer, name, value string) {
+	buf.WriteString(name)
+	if !strings.Contains(value, "\n") {
+		buf.WriteByte('=')
+		buf.WriteString(value)
+		buf.WriteByte('\n')
+		return
+	}
+	buf.WriteByte('\n')
+	var size [8]byte
+	binary.LittleEndian.PutUint64(size[:], uint64(len(value)))
+	buf.Write(size[:])
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
@@ -0,0 +1,74 @@
+//go:build !windows
+
+package serverstarter
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestJournalSendEvent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serverstarter-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal.sock")
+	conn, err := net.ListenPacket("unixgram", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	j, err := dialJournal(path, "myapp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	testCases := []struct {
+		send func() error
+		want string
+	}{
+		{
+			send: func() error {
+				return j.sendEvent(Event{Type: EventWorkerStarted, PID: 123, Worker: "web", Generation: 4})
+			},
+			want: "MESSAGE=event worker_started: pid=123, name=web, generation=4\n" +
+				"PRIORITY=6\nSYSLOG_IDENTIFIER=myapp\n" +
+				"EVENT=worker_started\nWORKER_PID=123\nWORKER_NAME=web\nGENERATION=4\n",
+		},
+		{
+			send: func() error {
+				return j.sendEvent(Event{Type: EventWorkerExited, PID: 123, Generation: 4, Err: errors.New("exit status 1")})
+			},
+			want: "MESSAGE=event worker_exited: pid=123, generation=4, err=exit status 1\n" +
+				"PRIORITY=3\nSYSLOG_IDENTIFIER=myapp\n" +
+				"EVENT=worker_exited\nWORKER_PID=123\nGENERATION=4\nERROR=exit status 1\n",
+		},
+		{
+			send: func() error { return j.Err("a\nb\n") },
+			want: "MESSAGE\n\x03\x00\x00\x00\x00\x00\x00\x00a\nb\n" +
+				"PRIORITY=3\nSYSLOG_IDENTIFIER=myapp\n",
+		},
+	}
+	buf := make([]byte, 4096)
+	for _, tc := range testCases {
+		if err := tc.send(); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(buf[:n]); got != tc.want {
+			t.Errorf("journal entry mismatch, got=%q, want=%q", got, tc.want)
+		}
+	}
+}
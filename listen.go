@@ -0,0 +1,253 @@
+package serverstarter
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"syscall"
+)
+
+// ListenOptions is the options for binding a listener in Listen and ListenWithOptions.
+// These options are used only when a new socket is bound, and they are ignored
+// when an inherited listener is returned in the worker.
+type ListenOptions struct {
+	// ReusePort enables SO_REUSEPORT on the socket, so that it can be bound
+	// to the address which another socket is already bound with SO_REUSEPORT.
+	ReusePort bool
+
+	// SocketOptions is the integer socket options set on the socket before
+	// binding it, for example TCPDeferAccept, TCPFastOpen or IPTransparent.
+	// Use EnsureSocketOptions in the worker to set them again if they are lost.
+	SocketOptions []SocketOption
+
+	// Control is called after creating the socket but before binding it,
+	// in the same way as net.ListenConfig.Control. It can be used to set
+	// arbitrary socket options such as TCP_DEFER_ACCEPT or IP_FREEBIND,
+	// which are kept on the socket inherited by workers across restarts.
+	Control func(network, address string, c syscall.RawConn) error
+}
+
+// SetListenOptions sets the options for binding a listener in Listen.
+func SetListenOptions(opts ListenOptions) Option {
+	return func(s *Starter) {
+		s.listenOptions = opts
+	}
+}
+
+// Listen returns a listener for the network and address.
+//
+// If this process is a worker, it returns the listener passed from the master
+// whose address matches network and addr. Otherwise it binds a new listener
+// with the options set by SetListenOptions, so the same code path can be used
+// in the master, in the worker and in a process which is run without the master
+// (for example in development or tests).
+//
+// If this process is the new master started by the master upgrade set by
+// SetMasterUpgrade, it returns the listener handed over from the old master.
+//
+// For a unix domain socket, addr can be a name in the abstract namespace
+// starting with '@' on Linux, which has no socket file. For a path, it removes
+// the socket file left by the previous master if no process listens on it. The socket file is kept while the master
+// is running even if the listener is closed in workers, and RunMaster removes
+// it on exit.
+func (s *Starter) Listen(network, addr string) (net.Listener, error) {
+	return s.ListenWithOptions(network, addr, s.listenOptions)
+}
+
+// ListenWithOptions is same as Listen except that it binds a new listener with opts
+// instead of the options set by SetListenOptions.
+func (s *Starter) ListenWithOptions(network, addr string, opts ListenOptions) (net.Listener, error) {
+	if s.IsMaster() {
+		if l, err := s.upgradedListener(network, addr); l != nil || err != nil {
+			return l, err
+		}
+		if network == "unix" || network == "unixpacket" {
+			if isAbstractUnixSocket(addr) && !abstractUnixSocketSupported {
+				return nil, fmt.Errorf("error in ListenWithOptions; abstract unix domain socket %s is not supported on this platform", addr)
+			}
+			if err := removeStaleUnixSocketFile(&s.out, network, addr); err != nil {
+				return nil, fmt.Errorf("error in ListenWithOptions after removing stale unix domain socket file; %w", err)
+			}
+		}
+		lc := net.ListenConfig{Control: opts.control}
+		return lc.Listen(context.Background(), network, addr)
+	}
+
+	l, err := s.ListenerFor(network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("error in ListenWithOptions after looking up inherited listener; %w", err)
+	}
+	return l, nil
+}
+
+// control sets the socket options to the socket before it is bound.
+func (o ListenOptions) control(network, address string, c syscall.RawConn) error {
+	if o.ReusePort {
+		var sockErr error
+		if err := c.Control(func(fd uintptr) {
+			sockErr = setReusePort(fd)
+		}); err != nil {
+			return err
+		}
+		if sockErr != nil {
+			return sockErr
+		}
+	}
+	if len(o.SocketOptions) > 0 {
+		var sockErr error
+		if err := c.Control(func(fd uintptr) {
+			for _, opt := range o.SocketOptions {
+				if sockErr = setSocketOption(fd, opt); sockErr != nil {
+					return
+				}
+			}
+		}); err != nil {
+			return err
+		}
+		if sockErr != nil {
+			return sockErr
+		}
+	}
+	if o.Control != nil {
+		return o.Control(network, address, c)
+	}
+	return nil
+}
+
+// ListenerFor returns the listener passed from the master whose address matches
+// network and addr. Unlike indexing the result of Listeners, this does not
+// depend on the order nor the number of listeners the master binds.
+//
+// It returns an error if no inherited listener matches, and returns nil when
+// this is called by the master process.
+func (s *Starter) ListenerFor(network, addr string) (net.Listener, error) {
+	if s.IsMaster() {
+		return nil, nil
+	}
+
+	listeners, err := s.Listeners()
+	if err != nil {
+		return nil, fmt.Errorf("error in ListenerFor after getting inherited listeners; %w", err)
+	}
+	for _, l := range listeners {
+		if addrMatches(network, addr, l.Addr()) {
+			return l, nil
+		}
+	}
+	return nil, fmt.Errorf("error in ListenerFor after failing to find inherited listener for network=%s, addr=%s", network, addr)
+}
+
+// TCPListeners returns the TCP listeners passed from the master in the same
+// order as Listeners, skipping the listeners of other types. It returns nil
+// when this is called by the master process.
+func (s *Starter) TCPListeners() ([]*net.TCPListener, error) {
+	listeners, err := s.Listeners()
+	if err != nil {
+		return nil, fmt.Errorf("error in TCPListeners after getting inherited listeners; %w", err)
+	}
+	var tcpListeners []*net.TCPListener
+	for _, l := range listeners {
+		if tl, ok := l.(*net.TCPListener); ok {
+			tcpListeners = append(tcpListeners, tl)
+		}
+	}
+	return tcpListeners, nil
+}
+
+// UnixListeners returns the unix domain socket listeners passed from the master
+// in the same order as Listeners, skipping the listeners of other types.
+// It returns nil when this is called by the master process.
+func (s *Starter) UnixListeners() ([]*net.UnixListener, error) {
+	listeners, err := s.Listeners()
+	if err != nil {
+		return nil, fmt.Errorf("error in UnixListeners after getting inherited listeners; %w", err)
+	}
+	var unixListeners []*net.UnixListener
+	for _, l := range listeners {
+		if ul, ok := l.(*net.UnixListener); ok {
+			unixListeners = append(unixListeners, ul)
+		}
+	}
+	return unixListeners, nil
+}
+
+// TCPListenerFor is same as ListenerFor except that it returns the TCP listener.
+// It returns an error if the listener is not a TCP listener.
+func (s *Starter) TCPListenerFor(network, addr string) (*net.TCPListener, error) {
+	l, err := s.ListenerFor(network, addr)
+	if err != nil || l == nil {
+		return nil, err
+	}
+	tl, ok := l.(*net.TCPListener)
+	if !ok {
+		return nil, fmt.Errorf("error in TCPListenerFor; inherited listener for network=%s, addr=%s is not a TCP listener", network, addr)
+	}
+	return tl, nil
+}
+
+// UnixListenerFor is same as ListenerFor except that it returns the unix domain
+// socket listener. It returns an error if the listener is not a unix domain
+// socket listener.
+func (s *Starter) UnixListenerFor(network, addr string) (*net.UnixListener, error) {
+	l, err := s.ListenerFor(network, addr)
+	if err != nil || l == nil {
+		return nil, err
+	}
+	ul, ok := l.(*net.UnixListener)
+	if !ok {
+		return nil, fmt.Errorf("error in UnixListenerFor; inherited listener for network=%s, addr=%s is not a unix domain socket listener", network, addr)
+	}
+	return ul, nil
+}
+
+// addrMatches returns whether the address a of a listener is the one
+// which is created by calling net.Listen with network and addr.
+func addrMatches(network, addr string, a net.Addr) bool {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		got, ok := a.(*net.TCPAddr)
+		if !ok {
+			return false
+		}
+		want, err := net.ResolveTCPAddr(network, addr)
+		if err != nil {
+			return false
+		}
+		if got.Port != want.Port {
+			return false
+		}
+		if want.IP == nil || want.IP.IsUnspecified() {
+			return got.IP == nil || got.IP.IsUnspecified()
+		}
+		return got.IP.Equal(want.IP)
+	case "udp", "udp4", "udp6":
+		got, ok := a.(*net.UDPAddr)
+		if !ok {
+			return false
+		}
+		want, err := net.ResolveUDPAddr(network, addr)
+		if err != nil {
+			return false
+		}
+		if got.Port != want.Port {
+			return false
+		}
+		if want.IP == nil || want.IP.IsUnspecified() {
+			return got.IP == nil || got.IP.IsUnspecified()
+		}
+		return got.IP.Equal(want.IP)
+	case "unix", "unixpacket", "unixgram":
+		got, ok := a.(*net.UnixAddr)
+		if !ok || got.Net != network {
+			return false
+		}
+		// NOTE: The name of an abstract socket is not a path.
+		if isAbstractUnixSocket(addr) {
+			return got.Name == addr
+		}
+		return filepath.Clean(got.Name) == filepath.Clean(addr)
+	default:
+		return false
+	}
+}
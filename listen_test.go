@@ -0,0 +1,185 @@
+//go:build !windows
+
+package serverstarter
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func init() {
+	helpers["listen"] = listenHelper
+}
+
+// listenDirEnv is the environment variable for the directory in which the master
+// of listenHelper listens on a unix domain socket.
+const listenDirEnv = "SERVERSTARTER_TEST_LISTEN_DIR"
+
+// listenHelper runs a master which binds two TCP listeners and a unix domain
+// socket listener with Listen, and a worker which looks up the inherited listeners
+// with Listen in the reverse order, prints their indexes in Listeners and exits
+// on SIGTERM.
+func listenHelper() {
+	path := filepath.Join(os.Getenv(listenDirEnv), "listen.sock")
+	s := New()
+	if s.IsMaster() {
+		var listeners []net.Listener
+		for _, addr := range []string{"127.0.0.1:0", "127.0.0.1:0"} {
+			l, err := s.Listen("tcp", addr)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to listen; %v\n", err)
+				os.Exit(1)
+			}
+			listeners = append(listeners, l)
+		}
+		l, err := s.Listen("unix", path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to listen; %v\n", err)
+			os.Exit(1)
+		}
+		listeners = append(listeners, l)
+		if err := s.RunMaster(listeners...); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to run master; %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	sigterm := make(chan os.Signal, 1)
+	signal.Notify(sigterm, syscall.SIGTERM)
+	listeners, err := s.Listeners()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to get listeners; %v\n", err)
+		os.Exit(1)
+	}
+	indexOf := func(l net.Listener) int {
+		for i, l2 := range listeners {
+			if l2 == l {
+				return i
+			}
+		}
+		return -1
+	}
+	var indexes []string
+	for i := len(listeners) - 1; i >= 0; i-- {
+		a := listeners[i].Addr()
+		l, err := s.Listen(a.Network(), a.String())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to listen; %v\n", err)
+			os.Exit(1)
+		}
+		indexes = append(indexes, strconv.Itoa(indexOf(l)))
+	}
+	// NOTE: The worker must not bind a new socket for the address which
+	// the master does not pass.
+	_, tcpErr := s.Listen("tcp", "127.0.0.1:1")
+	_, unixErr := s.Listen("unix", path+".unknown")
+	_, networkErr := s.Listen("unixgram", path)
+	fmt.Printf("listen worker: count=%d, indexes=%s, unknownTCP=%v, unknownUnix=%v, unknownNetwork=%v\n",
+		len(listeners), strings.Join(indexes, ","), tcpErr != nil, unixErr != nil, networkErr != nil)
+	if err := s.SendReady(); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to send ready; %v\n", err)
+		os.Exit(1)
+	}
+	<-sigterm
+}
+
+func TestListenRemovesStaleUnixSocketFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serverstarter-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stale.sock")
+
+	// NOTE: We leave the socket file like the master which crashed.
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+
+	var buf bytes.Buffer
+	s := New(SetOutput(&buf))
+	l, err = s.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("failed to listen on stale unix domain socket file; %v", err)
+	}
+	l.Close()
+	if want := "removing stale unix domain socket file " + path + "\n"; !strings.Contains(buf.String(), want) {
+		t.Errorf("output %q does not contain %q", buf.String(), want)
+	}
+}
+
+func TestListenInheritsByAddress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serverstarter-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := startHelper(t, "listen", listenDirEnv+"="+dir)
+	line := p.waitLine("listen worker: ", 10*time.Second)
+	if want := "listen worker: count=3, indexes=2,1,0, unknownTCP=true, unknownUnix=true, unknownNetwork=true"; line != want {
+		t.Errorf("inherited listeners mismatch,\n got=%q,\nwant=%q", line, want)
+	}
+	p.waitLine("received ready from initial worker", 10*time.Second)
+
+	p.signal(syscall.SIGTERM)
+	if err := p.wait(); err != nil {
+		t.Errorf("master exited with error; %v", err)
+	}
+}
+
+func TestListenWithoutMaster(t *testing.T) {
+	s := New()
+	l, err := s.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen without master; %v", err)
+	}
+	defer l.Close()
+	if l, err := s.ListenerFor("tcp", l.Addr().String()); l != nil || err != nil {
+		t.Errorf("ListenerFor must return nil without master, got=%v, %v", l, err)
+	}
+}
+
+func TestAddrMatches(t *testing.T) {
+	testCases := []struct {
+		network string
+		addr    string
+		a       net.Addr
+		want    bool
+	}{
+		{network: "tcp", addr: "127.0.0.1:8080", a: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8080}, want: true},
+		{network: "tcp", addr: "127.0.0.1:8081", a: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8080}, want: false},
+		{network: "tcp", addr: "127.0.0.2:8080", a: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8080}, want: false},
+		{network: "tcp", addr: ":8080", a: &net.TCPAddr{IP: net.IPv6unspecified, Port: 8080}, want: true},
+		{network: "tcp", addr: ":8080", a: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8080}, want: false},
+		{network: "tcp", addr: "127.0.0.1:8080", a: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8080}, want: false},
+		{network: "udp", addr: "127.0.0.1:53", a: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}, want: true},
+		{network: "udp", addr: "127.0.0.1:53", a: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}, want: false},
+		{network: "unix", addr: "/run/app.sock", a: &net.UnixAddr{Name: "/run/app.sock", Net: "unix"}, want: true},
+		{network: "unix", addr: "/run//app.sock", a: &net.UnixAddr{Name: "/run/app.sock", Net: "unix"}, want: true},
+		{network: "unix", addr: "/run/other.sock", a: &net.UnixAddr{Name: "/run/app.sock", Net: "unix"}, want: false},
+		{network: "unixpacket", addr: "/run/app.sock", a: &net.UnixAddr{Name: "/run/app.sock", Net: "unix"}, want: false},
+		{network: "unix", addr: "@app", a: &net.UnixAddr{Name: "@app", Net: "unix"}, want: true},
+		{network: "unix", addr: "@app", a: &net.UnixAddr{Name: "@other", Net: "unix"}, want: false},
+		{network: "ip", addr: "127.0.0.1", a: &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}, want: false},
+	}
+	for _, c := range testCases {
+		if got := addrMatches(c.network, c.addr, c.a); got != c.want {
+			t.Errorf("result mismatch for network=%s, addr=%s, a=%s, got=%v, want=%v", c.network, c.addr, c.a, got, c.want)
+		}
+	}
+}
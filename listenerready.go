@@ -0,0 +1,57 @@
+package serverstarter
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// SetWaitListenersReady makes the master treat the worker as ready when the
+// worker sends ready for each of the listeners at indexes with SendListenerReady,
+// in addition to when the worker sends ready with SendReady. The indexes are
+// the ones of the listeners returned by Listeners in the worker. If no indexes
+// are passed, the master waits for all the listeners of the worker.
+//
+// This is useful for large workers which bring up endpoints at different speeds.
+// If no SetWaitListenersReady is called, the master waits only for SendReady.
+func SetWaitListenersReady(indexes ...int) Option {
+	return func(s *Starter) {
+		s.waitListenersReady = true
+		s.readyListenerIndexes = indexes
+	}
+}
+
+// SendListenerReady sends ready notification for the listener at index of the
+// listeners returned by Listeners from child to parent.
+// See SetWaitListenersReady.
+func (s *Starter) SendListenerReady(index int) error {
+	if index < 0 {
+		return errors.New("index must not be negative")
+	}
+	var v [4]byte
+	binary.BigEndian.PutUint32(v[:], uint32(index))
+	if err := s.sendMessage(listenerReadyByte, v[:]...); err != nil {
+		return fmt.Errorf("failed to send listener ready to parent; %w", err)
+	}
+	return nil
+}
+
+// pendingReadyListeners returns the set of the indexes of the listeners which
+// the master waits for before treating the worker in slot as ready.
+// It returns nil if SetWaitListenersReady is not used.
+func (s *Starter) pendingReadyListeners(slot *workerSlot) map[int]bool {
+	if !s.waitListenersReady {
+		return nil
+	}
+	pending := make(map[int]bool)
+	if len(s.readyListenerIndexes) == 0 {
+		for i := range slot.listenerFiles {
+			pending[i] = true
+		}
+	} else {
+		for _, i := range s.readyListenerIndexes {
+			pending[i] = true
+		}
+	}
+	return pending
+}
@@ -0,0 +1,218 @@
+package serverstarter
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// envLogFDs is the environment variable name for passing the log file descriptor
+// count to the worker process.
+const envLogFDs = "SERVERSTARTER_LOG_FDS"
+
+// logFlushTimeout is the maximum duration which the master waits for the data
+// in the pipes for the log files to be written to the files before exiting.
+const logFlushTimeout = time.Second
+
+// SetLogFiles sets the paths of the log files which the master opens and shares
+// with worker processes. Workers get the writers for the log files with LogWriters.
+//
+// The master reopens the log files when it receives a SIGUSR1, so log rotation tools
+// can rename the files and send a SIGUSR1 to the master instead of restarting workers.
+// Since workers of all generations write to the same pipes and the master writes
+// the data to the current files, workers never write to the renamed files after
+// the master reopens them.
+//
+// This option is not supported on Windows.
+func SetLogFiles(paths []string) Option {
+	return func(s *Starter) {
+		s.logFilePaths = paths
+	}
+}
+
+// LogWriters returns the writers for the log files set by SetLogFiles in the master
+// in the same order if this is called by the worker process.
+// It returns nil when this is called by the master process.
+//
+// Each write to the returned writers is written to the log file without being
+// interleaved with writes from other workers if it is not larger than PIPE_BUF
+// (4096 bytes on Linux), so a log line should be written with a single call.
+//
+// The writers are created on the first call in the process and the same writers
+// are returned after that.
+func (s *Starter) LogWriters() ([]io.Writer, error) {
+	if s.IsMaster() {
+		return nil, nil
+	}
+	if _, ok := lookupWorkerEnv(envLogFDs); !ok {
+		return nil, nil
+	}
+
+	inherited.mu.Lock()
+	defer inherited.mu.Unlock()
+	if inherited.logWriters != nil {
+		return inherited.logWriters, nil
+	}
+	fds, err := s.inheritedFDsLocked()
+	if err != nil {
+		return nil, fmt.Errorf("error in LogWriters after getting inherited file descriptors; %w", err)
+	}
+	writers := make([]io.Writer, len(fds.logs))
+	for i, fd := range fds.logs {
+		// NOTE: We do not want the pipes to be inherited by processes which
+		// the worker starts, since the master waits for all writers to close
+		// the pipes before exiting.
+		closeOnExec(fd)
+		writers[i] = os.NewFile(fd, "log"+strconv.Itoa(i))
+	}
+	inherited.logWriters = writers
+	return writers, nil
+}
+
+// logFile is a log file which the master writes the data from workers to.
+// Workers write to the pipe instead of the file, so that the master can
+// reopen the file without notifying workers.
+type logFile struct {
+	out   *output
+	path  string
+	pipeR *os.File
+	pipeW *os.File
+	done  chan struct{}
+
+	// mu protects the field below.
+	mu   sync.Mutex
+	file *os.File
+}
+
+// openLogFile opens the log file at path and starts copying the data written
+// to the pipe to the file. If pipeR and pipeW are nil, a new pipe is created.
+// Otherwise they are used as the pipe, for example the one handed over from
+// the old master.
+func openLogFile(out *output, path string, pipeR, pipeW *os.File) (*logFile, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error in openLogFile after opening log file; %w", err)
+	}
+	if pipeR == nil {
+		pipeR, pipeW, err = os.Pipe()
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("pipe failed in openLogFile; %w", err)
+		}
+	}
+	f := &logFile{out: out, path: path, pipeR: pipeR, pipeW: pipeW, done: make(chan struct{}), file: file}
+	go f.copy()
+	return f, nil
+}
+
+func (f *logFile) copy() {
+	defer close(f.done)
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := f.pipeR.Read(buf)
+		if n > 0 {
+			f.mu.Lock()
+			if _, err := f.file.Write(buf[:n]); err != nil && !errors.Is(err, os.ErrClosed) {
+				f.out.eprintf("failed to write to log file %s: %v\n", f.path, err)
+			}
+			f.mu.Unlock()
+		}
+		if err == io.EOF || errors.Is(err, os.ErrClosed) {
+			return
+		} else if err != nil {
+			f.out.eprintf("failed to read from log pipe for %s: %v\n", f.path, err)
+			return
+		}
+	}
+}
+
+// reopen opens the log file at the path again and replaces the current file with it.
+func (f *logFile) reopen() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("error in reopen after opening log file; %w", err)
+	}
+	f.mu.Lock()
+	old := f.file
+	f.file = file
+	f.mu.Unlock()
+	return old.Close()
+}
+
+// close closes the log file after writing the data which has been written
+// to the pipe. It waits until all workers close the pipe or logFlushTimeout
+// elapses, since workers may not have exited when the master exits with an error.
+func (f *logFile) close() {
+	f.pipeW.Close()
+	select {
+	case <-f.done:
+	case <-time.After(logFlushTimeout):
+	}
+	f.pipeR.Close()
+	f.mu.Lock()
+	f.file.Close()
+	f.mu.Unlock()
+}
+
+// openLogFiles opens the log files set by SetLogFiles. If this process is
+// the new master started by a master upgrade, the pipes handed over from
+// the old master are used for the log files of the same paths.
+func (s *Starter) openLogFiles() error {
+	state, err := s.inheritedMasterState()
+	if err != nil {
+		return err
+	}
+	for _, path := range s.logFilePaths {
+		var pipeR, pipeW *os.File
+		if state != nil {
+			for _, lf := range state.LogFiles {
+				if lf.Path == path {
+					pipeR = os.NewFile(uintptr(lf.ReadFD), "logPipeR")
+					pipeW = os.NewFile(uintptr(lf.WriteFD), "logPipeW")
+					closeOnExec(uintptr(lf.ReadFD))
+					closeOnExec(uintptr(lf.WriteFD))
+					break
+				}
+			}
+		}
+		f, err := openLogFile(&s.out, path, pipeR, pipeW)
+		if err != nil {
+			s.closeLogFiles()
+			return err
+		}
+		s.logFiles = append(s.logFiles, f)
+	}
+	return nil
+}
+
+// reopenLogFiles reopens all log files. It continues to reopen the rest
+// of the files even if it fails to reopen a file.
+func (s *Starter) reopenLogFiles() {
+	for _, f := range s.logFiles {
+		if err := f.reopen(); err != nil {
+			s.out.eprintf("failed to reopen log file %s: %v\n", f.path, err)
+			continue
+		}
+		s.out.printf("reopened log file %s\n", f.path)
+	}
+}
+
+func (s *Starter) closeLogFiles() {
+	for _, f := range s.logFiles {
+		f.close()
+	}
+	s.logFiles = nil
+}
+
+// logPipes returns the write ends of the pipes for the log files.
+func (s *Starter) logPipes() []*os.File {
+	pipes := make([]*os.File, len(s.logFiles))
+	for i, f := range s.logFiles {
+		pipes[i] = f.pipeW
+	}
+	return pipes
+}
@@ -0,0 +1,161 @@
+package serverstarter
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+)
+
+// envFDManifest is the environment variable name for passing the manifest of
+// the inherited file descriptors to the worker process in a JSON array.
+const envFDManifest = "SERVERSTARTER_FD_MANIFEST"
+
+// FDType is the type of an inherited file descriptor.
+type FDType string
+
+const (
+	// FDTypeTCP is the type of a TCP listener.
+	FDTypeTCP FDType = "tcp"
+	// FDTypeUnix is the type of a unix domain socket listener or packet connection.
+	FDTypeUnix FDType = "unix"
+	// FDTypeUDP is the type of a UDP packet connection.
+	FDTypeUDP FDType = "udp"
+	// FDTypeSCTP is the type of an SCTP listener.
+	FDTypeSCTP FDType = "sctp"
+	// FDTypeFile is the type of a file set by SetExtraFiles or a log file
+	// set by SetLogFiles.
+	FDTypeFile FDType = "file"
+)
+
+// FDEntry is an entry of the manifest of the inherited file descriptors.
+type FDEntry struct {
+	// FD is the file descriptor in the worker process.
+	FD uintptr `json:"-"`
+	// Type is the type of the file descriptor.
+	Type FDType `json:"type"`
+	// Network is the network of the socket, for example "tcp4" or "unix".
+	// It is empty for files.
+	Network string `json:"network,omitempty"`
+	// Address is the local address of the socket. It is empty for files.
+	// The address of a unix domain socket in the abstract namespace starts with '@'.
+	Address string `json:"address,omitempty"`
+	// Name is the name set by SetListenerNames or Inheritance for listeners,
+	// packet connections and SCTP listeners, the name of the file for the files set by SetExtraFiles
+	// and the path for the log files.
+	Name string `json:"name,omitempty"`
+}
+
+// FDManifest is the manifest of the file descriptors which the worker inherits
+// from the master, in the order of the listeners, the packet connections,
+// the SCTP listeners, the extra files and the log files.
+type FDManifest []FDEntry
+
+// Lookup returns the entry with the name.
+func (m FDManifest) Lookup(name string) (FDEntry, bool) {
+	for _, e := range m {
+		if e.Name == name {
+			return e, true
+		}
+	}
+	return FDEntry{}, false
+}
+
+// SetListenerNames sets the names of the listeners passed to RunMaster in the same
+// order, which are shown to the worker in the manifest returned by Manifest.
+func SetListenerNames(names []string) Option {
+	return func(s *Starter) {
+		s.listenerNames = names
+	}
+}
+
+// Manifest returns the manifest of the file descriptors passed from the master
+// if this is called by the worker process. The manifest describes the type,
+// the address and the name of each file descriptor, so that the worker can find
+// the file descriptors without depending on their order.
+// It returns nil when this is called by the master process or the master does
+// not pass the manifest.
+func (s *Starter) Manifest() (FDManifest, error) {
+	if s.IsMaster() {
+		return nil, nil
+	}
+	v, ok := lookupWorkerEnv(envFDManifest)
+	if !ok {
+		return nil, nil
+	}
+	var m FDManifest
+	if err := json.Unmarshal([]byte(v), &m); err != nil {
+		return nil, fmt.Errorf("error in Manifest after decoding manifest; %w", err)
+	}
+	fds, err := s.inheritedFDs()
+	if err != nil {
+		return nil, fmt.Errorf("error in Manifest after getting inherited file descriptors; %w", err)
+	}
+	var all []uintptr
+	all = append(all, fds.listeners...)
+	all = append(all, fds.packetConns...)
+	all = append(all, fds.sctp...)
+	all = append(all, fds.extras...)
+	all = append(all, fds.logs...)
+	if len(m) != len(all) {
+		return nil, fmt.Errorf("error in Manifest; manifest has %d entries for %d file descriptors", len(m), len(all))
+	}
+	for i := range m {
+		m[i].FD = all[i]
+	}
+	return m, nil
+}
+
+// fdManifest returns the manifest for the worker program in slot.
+func (s *Starter) fdManifest(slot *workerSlot) FDManifest {
+	var m FDManifest
+	for _, index := range slot.listenerIndexes {
+		addr := s.listeners[index].Addr()
+		e := FDEntry{
+			Type:    addrFDType(addr),
+			Network: addr.Network(),
+			Address: addr.String(),
+		}
+		if index < len(s.listenerNames) {
+			e.Name = s.listenerNames[index]
+		}
+		m = append(m, e)
+	}
+	for i, c := range s.packetConns {
+		addr := c.LocalAddr()
+		e := FDEntry{
+			Type:    addrFDType(addr),
+			Network: addr.Network(),
+			Address: addr.String(),
+		}
+		if i < len(s.packetConnNames) {
+			e.Name = s.packetConnNames[i]
+		}
+		m = append(m, e)
+	}
+	for i, addr := range s.sctpAddrs {
+		e := FDEntry{Type: FDTypeSCTP, Network: "sctp", Address: addr}
+		if i < len(s.sctpNames) {
+			e.Name = s.sctpNames[i]
+		}
+		m = append(m, e)
+	}
+	for _, f := range s.extraFiles {
+		m = append(m, FDEntry{Type: FDTypeFile, Name: f.Name()})
+	}
+	for _, f := range s.logFiles {
+		m = append(m, FDEntry{Type: FDTypeFile, Name: f.path})
+	}
+	return m
+}
+
+// addrFDType returns the type of the socket for addr.
+func addrFDType(addr net.Addr) FDType {
+	switch addr.(type) {
+	case *net.UnixAddr:
+		return FDTypeUnix
+	case *net.UDPAddr:
+		return FDTypeUDP
+	default:
+		return FDTypeTCP
+	}
+}
@@ -0,0 +1,35 @@
+package serverstarter
+
+// SetNginxSignals makes the master handle the signals in the same way as
+// the master of nginx and unicorn upgrades the workers:
+//
+//   - On a SIGUSR2, the master starts a new generation of the workers alongside
+//     the old generation, and both generations serve until the old one is retired.
+//     If a new worker fails to start or to get ready, the new generation is
+//     stopped and the old generation keeps running.
+//   - On a SIGQUIT, the master gracefully stops the old generation as in a reload.
+//     If there is no old generation, the master stops the workers and exits.
+//     The workers of the old generation which exit before that are not restarted.
+//   - On a SIGHUP, the master forwards the signal to the workers of both generations
+//     so that they reload their configuration, instead of reloading the workers.
+//
+// The control command "reload" still reloads the workers. It cannot be used
+// with SetMasterUpgrade or SetControlFile, since they also use SIGUSR2.
+//
+// This option is not supported on Windows.
+func SetNginxSignals(enabled bool) Option {
+	return func(s *Starter) {
+		s.nginxSignals = enabled
+	}
+}
+
+// hasOldGeneration returns whether the old generation of the workers started
+// before the last SIGUSR2 with SetNginxSignals is running.
+func (s *Starter) hasOldGeneration() bool {
+	for _, slot := range s.slots {
+		if slot.oldChild != nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+//go:build !windows
+
+package serverstarter
+
+import "fmt"
+
+// startNewGeneration starts a new worker for each slot on a SIGUSR2 with
+// SetNginxSignals, and keeps the current workers running as the old generation
+// after all the new workers get ready. If a new worker fails to start or to get
+// ready, the new workers are killed and the current workers are kept.
+func (s *Starter) startNewGeneration() {
+	if s.hasOldGeneration() {
+		s.out.printf("ignored SIGUSR2 since old generation is still running, send SIGQUIT to retire it first\n")
+		return
+	}
+	s.setBusy(true)
+	defer s.setBusy(false)
+
+	s.out.printf("starting new generation of workers\n")
+	var started []*worker
+	for _, slot := range s.slots {
+		w, err := s.startNewGenerationWorker(slot)
+		if err != nil {
+			for _, started := range started {
+				s.killWorker(started)
+			}
+			s.out.eprintf("failed to start new generation, keeping old generation: %v\n", err)
+			return
+		}
+		started = append(started, w)
+	}
+	for i, slot := range s.slots {
+		slot.oldChild = slot.child
+		slot.child = started[i]
+	}
+	s.out.printf("started new generation of workers, send SIGQUIT to retire old generation\n")
+}
+
+// startNewGenerationWorker starts a new worker for slot and waits for it to get ready.
+func (s *Starter) startNewGenerationWorker(slot *workerSlot) (*worker, error) {
+	w, err := s.spawnWorker(slot)
+	if err != nil {
+		return nil, fmt.Errorf("error in startNewGeneration after starting new worker; %w", err)
+	}
+	s.out.printf("started new worker: %s\n", w.label())
+	if err := s.traced("serverstarter.wait_ready", w.pid(), w.waitReady); err != nil {
+		return nil, fmt.Errorf("error in startNewGeneration after waiting ready from new worker; %w", s.workerStartFailed(w, err))
+	}
+	s.out.printf("received ready from new worker: %s\n", w.label())
+	s.emitWorkerReady(w)
+	return w, nil
+}
+
+// retireOldGeneration stops the workers of the old generation gracefully on
+// a SIGQUIT with SetNginxSignals.
+func (s *Starter) retireOldGeneration() error {
+	s.setBusy(true)
+	defer s.setBusy(false)
+
+	s.out.printf("retiring old generation of workers\n")
+	for _, slot := range s.slots {
+		old := slot.oldChild
+		if old == nil {
+			continue
+		}
+		slot.oldChild = nil
+		if err := s.signalChild(old, s.gracefulShutdownSignalToChild); err != nil {
+			// NOTE: The old worker may have exited already.
+			s.out.eprintf("failed to send signal %q to old worker pid=%d: %v\n", s.gracefulShutdownSignalToChild, old.pid(), err)
+		}
+		if err := s.drainOldWorkerTraced(old); err != nil {
+			return fmt.Errorf("error in RunMaster after sending signal %q to old worker pid=%d; %w", s.gracefulShutdownSignalToChild, old.pid(), err)
+		}
+		s.out.printf("retired old worker: %s\n", old.label())
+	}
+	s.out.printf("retired old generation of workers\n")
+	return nil
+}
+
+// oldWorkerExited forgets the worker of the old generation in slot which exited
+// before a SIGQUIT with SetNginxSignals. It is not restarted since the worker
+// of the new generation serves in its place.
+func (s *Starter) oldWorkerExited(slot *workerSlot, err error) {
+	old := slot.oldChild
+	slot.oldChild = nil
+	s.emitWorkerExited(old, err)
+	if err != nil {
+		s.out.eprintf("old worker exited err=%v, not restarting: %s\n", err, old.label())
+	} else {
+		s.out.printf("old worker exited without err, not restarting: %s\n", old.label())
+	}
+}
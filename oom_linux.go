@@ -0,0 +1,16 @@
+package serverstarter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+)
+
+// setOOMScoreAdj sets the OOM score adjustment of the process.
+func setOOMScoreAdj(pid, score int) error {
+	path := fmt.Sprintf("/proc/%d/oom_score_adj", pid)
+	if err := ioutil.WriteFile(path, []byte(strconv.Itoa(score)), 0); err != nil {
+		return fmt.Errorf("error in setOOMScoreAdj after writing %s; %w", path, err)
+	}
+	return nil
+}
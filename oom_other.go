@@ -0,0 +1,9 @@
+//go:build !linux
+
+package serverstarter
+
+import "fmt"
+
+func setOOMScoreAdj(pid, score int) error {
+	return fmt.Errorf("setting OOM score adjustment of a worker is %w", ErrUnsupported)
+}
@@ -0,0 +1,94 @@
+package serverstarter
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// SetOutput sets the writer to which the master writes its human-readable
+// messages, including the error messages. When this option is not called,
+// the master writes messages to os.Stdout and error messages to os.Stderr.
+//
+// The master serializes writes to w, so w does not need to be safe for
+// concurrent use. The output of workers is not affected.
+func SetOutput(w io.Writer) Option {
+	return func(s *Starter) {
+		s.out.w = w
+	}
+}
+
+// logBackend is the destination of messages other than the writer, for example
+// *syslog.Writer for SetSyslog and *journal for SetJournald.
+type logBackend interface {
+	Info(m string) error
+	Err(m string) error
+	Close() error
+}
+
+// output writes the human-readable messages of the master.
+type output struct {
+	mu sync.Mutex
+	// w is the writer set by SetOutput. If it is nil, messages are written to
+	// os.Stdout and error messages are written to os.Stderr.
+	w io.Writer
+	// backend is the connection to the syslog server set by SetSyslog or
+	// the journal set by SetJournald. If it is not nil, messages are sent to it
+	// instead of w.
+	backend logBackend
+}
+
+// printf writes a message.
+func (o *output) printf(format string, a ...interface{}) {
+	o.write(false, fmt.Sprintf(format, a...))
+}
+
+// eprintf writes an error message.
+func (o *output) eprintf(format string, a ...interface{}) {
+	o.write(true, fmt.Sprintf(format, a...))
+}
+
+func (o *output) write(isErr bool, msg string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.backend != nil {
+		var err error
+		if isErr {
+			err = o.backend.Err(msg)
+		} else {
+			err = o.backend.Info(msg)
+		}
+		// NOTE: We fall back to the writer so that the message is not lost.
+		if err == nil {
+			return
+		}
+	}
+	w := o.w
+	if w == nil {
+		if isErr {
+			w = os.Stderr
+		} else {
+			w = os.Stdout
+		}
+	}
+	io.WriteString(w, msg)
+}
+
+// setBackend sets the backend to which messages are sent.
+func (o *output) setBackend(b logBackend) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.backend = b
+}
+
+// closeBackend closes the backend and makes messages written to the writer
+// after that.
+func (o *output) closeBackend() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.backend != nil {
+		o.backend.Close()
+		o.backend = nil
+	}
+}
@@ -0,0 +1,155 @@
+package serverstarter
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// envPacketFDs is the environment variable name for passing the packet
+// connection file descriptor count to the worker process.
+const envPacketFDs = "SERVERSTARTER_PACKET_FDS"
+
+// Inheritance is the set of the sockets and files which the master passes to
+// worker processes with RunMasterWith.
+//
+// The worker gets them in the order of the listeners, the packet connections,
+// the SCTP listeners, the extra files and the log files set by SetLogFiles, and the manifest
+// returned by Starter.Manifest describes each of them.
+type Inheritance struct {
+	// Listeners are the listeners passed to workers like the ones passed to RunMaster.
+	Listeners []net.Listener
+
+	// ListenerNames are the names of Listeners in the same order.
+	// They override the names set by SetListenerNames if not nil.
+	ListenerNames []string
+
+	// PacketConns are the packet connections passed to workers, for example
+	// UDP sockets. The worker gets them with Starter.PacketConns.
+	// The new master started by SetMasterUpgrade or SetTakeoverSocket gets
+	// them from ListenPacket.
+	PacketConns []net.PacketConn
+
+	// PacketConnNames are the names of PacketConns in the same order.
+	PacketConnNames []string
+
+	// SCTPListeners are the listening SCTP sockets passed to workers, for example
+	// the listeners created by a third-party SCTP package which implement
+	// syscall.Conn. The worker gets them with Starter.SCTPListeners.
+	// They are not handed over to the new master by SetTakeoverSocket, and
+	// they cannot be used with SetMasterUpgrade.
+	SCTPListeners []syscall.Conn
+
+	// SCTPListenerNames are the names of SCTPListeners in the same order.
+	SCTPListenerNames []string
+
+	// Files are the files passed to workers. They override the files set by
+	// SetExtraFiles if not nil. The worker gets them with Starter.ExtraFiles.
+	Files []*os.File
+}
+
+// PacketConns returns the packet connections passed from the master if this is
+// called by the worker process. It returns nil when this is called by the master
+// process.
+//
+// The packet connections are created on the first call in the process and
+// the same ones are returned after that.
+func (s *Starter) PacketConns() ([]net.PacketConn, error) {
+	if s.IsMaster() {
+		return nil, nil
+	}
+	if _, ok := lookupWorkerEnv(envPacketFDs); !ok {
+		return nil, nil
+	}
+
+	inherited.mu.Lock()
+	defer inherited.mu.Unlock()
+	if inherited.packetConns == nil {
+		fds, err := s.inheritedFDsLocked()
+		if err != nil {
+			return nil, fmt.Errorf("error in PacketConns after getting inherited file descriptors; %w", err)
+		}
+		conns := make([]net.PacketConn, len(fds.packetConns))
+		for i, fd := range fds.packetConns {
+			file := os.NewFile(fd, "packetconn")
+			c, err := net.FilePacketConn(file)
+			if err != nil {
+				for _, c := range conns[:i] {
+					c.Close()
+				}
+				return nil, fmt.Errorf("error in PacketConns after failing to create packet connection; %w", err)
+			}
+			conns[i] = c
+		}
+		inherited.packetConns = conns
+	}
+	// NOTE: We return a copy so that the caller cannot modify the cached one.
+	return append([]net.PacketConn(nil), inherited.packetConns...), nil
+}
+
+// ListenPacket returns a packet connection for the network and address, for example
+// a UDP socket for QUIC. It is the counterpart of Listen for packet connections.
+//
+// If this process is a worker, it returns the packet connection passed from
+// the master whose address matches network and addr. Otherwise it binds a new
+// packet connection with the options set by SetListenOptions. The master must
+// pass the packet connections to workers with Inheritance.PacketConns.
+//
+// If this process is the new master started by SetMasterUpgrade or
+// SetTakeoverSocket, it returns the packet connection handed over from the old master.
+func (s *Starter) ListenPacket(network, addr string) (net.PacketConn, error) {
+	if s.IsMaster() {
+		if c, err := s.upgradedPacketConn(network, addr); c != nil || err != nil {
+			return c, err
+		}
+		lc := net.ListenConfig{Control: s.listenOptions.control}
+		return lc.ListenPacket(context.Background(), network, addr)
+	}
+
+	c, err := s.PacketConnFor(network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("error in ListenPacket after looking up inherited packet connection; %w", err)
+	}
+	return c, nil
+}
+
+// PacketConnFor returns the packet connection passed from the master whose
+// address matches network and addr.
+//
+// It returns an error if no inherited packet connection matches, and returns nil
+// when this is called by the master process.
+func (s *Starter) PacketConnFor(network, addr string) (net.PacketConn, error) {
+	if s.IsMaster() {
+		return nil, nil
+	}
+
+	conns, err := s.PacketConns()
+	if err != nil {
+		return nil, fmt.Errorf("error in PacketConnFor after getting inherited packet connections; %w", err)
+	}
+	for _, c := range conns {
+		if addrMatches(network, addr, c.LocalAddr()) {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("error in PacketConnFor after failing to find inherited packet connection for network=%s, addr=%s", network, addr)
+}
+
+// UDPConns returns the UDP connections passed from the master in the same
+// order as PacketConns, skipping the packet connections of other types.
+// It returns nil when this is called by the master process.
+func (s *Starter) UDPConns() ([]*net.UDPConn, error) {
+	conns, err := s.PacketConns()
+	if err != nil {
+		return nil, fmt.Errorf("error in UDPConns after getting inherited packet connections; %w", err)
+	}
+	var udpConns []*net.UDPConn
+	for _, c := range conns {
+		if uc, ok := c.(*net.UDPConn); ok {
+			udpConns = append(udpConns, uc)
+		}
+	}
+	return udpConns, nil
+}
@@ -0,0 +1,11 @@
+package serverstarter
+
+import "syscall"
+
+// pdeathsigSupported is whether the parent death signal is supported on this platform.
+const pdeathsigSupported = true
+
+// setPdeathsig sets the signal which the worker process receives when the master dies.
+func setPdeathsig(attr *syscall.SysProcAttr, sig syscall.Signal) {
+	attr.Pdeathsig = sig
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package serverstarter
+
+import "syscall"
+
+// pdeathsigSupported is whether the parent death signal is supported on this platform.
+const pdeathsigSupported = false
+
+func setPdeathsig(attr *syscall.SysProcAttr, sig syscall.Signal) {}
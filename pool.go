@@ -0,0 +1,147 @@
+package serverstarter
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// envWorkerIndex is the environment variable for the index of the worker in
+// the pool set by SetWorkerCount.
+const envWorkerIndex = "SERVERSTARTER_WORKER_INDEX"
+
+// SetWorkerCount sets the number of workers which the master runs for each
+// worker program. The workers are supervised, restarted and reloaded
+// independently, and are named "NAME-INDEX" after the name of the worker program,
+// or "worker-INDEX" if it has no name, where INDEX is from 0 to n-1, so a single
+// worker can be reloaded with the control command "reload NAME-INDEX".
+// The index is passed to the worker as the environment variable
+// SERVERSTARTER_WORKER_INDEX (see Starter.WorkerIndex).
+//
+// By default all workers share all listeners. Use SetShardPolicy to pass
+// specific listeners to specific workers.
+// If n is 1 or less, the master runs a single worker for each worker program.
+func SetWorkerCount(n int) Option {
+	return func(s *Starter) {
+		s.workerCount = n
+	}
+}
+
+// ShardPolicy assigns the listeners to the workers in the pool set by SetWorkerCount.
+type ShardPolicy interface {
+	// Shard returns the indexes of the listeners passed to RunMaster which are
+	// passed to the worker at index of count workers. listeners is the indexes of
+	// the listeners of the worker program, which are all listeners unless
+	// WorkerSpec.Listeners or WorkerSpec.ListenerGroup is set.
+	Shard(index, count int, listeners []int) []int
+}
+
+// ShardPolicyFunc is an adapter to allow the use of an ordinary function as a ShardPolicy.
+type ShardPolicyFunc func(index, count int, listeners []int) []int
+
+// Shard calls f(index, count, listeners).
+func (f ShardPolicyFunc) Shard(index, count int, listeners []int) []int {
+	return f(index, count, listeners)
+}
+
+// RoundRobinShardPolicy returns a ShardPolicy which passes the i-th listener of
+// the worker program to the worker at index i modulo the number of workers,
+// so that each listener is served by a dedicated set of workers.
+func RoundRobinShardPolicy() ShardPolicy {
+	return ShardPolicyFunc(func(index, count int, listeners []int) []int {
+		shard := []int{}
+		for i, listener := range listeners {
+			if i%count == index {
+				shard = append(shard, listener)
+			}
+		}
+		return shard
+	})
+}
+
+// SetShardPolicy sets the policy to assign the listeners to the workers in
+// the pool set by SetWorkerCount, for example to run one worker per NUMA node
+// for each port. The policy is applied once when RunMaster starts, and the
+// assignments are kept across reloads and restarts of the workers.
+// The listeners added with the control command "listen" or RequestListen
+// are not passed to the workers with assigned listeners.
+func SetShardPolicy(policy ShardPolicy) Option {
+	return func(s *Starter) {
+		s.shardPolicy = policy
+	}
+}
+
+// SetReusePortPool sets whether the master binds a socket with SO_REUSEPORT
+// for each worker in the pools set by SetWorkerCount, instead of passing one
+// socket shared by the workers, for each TCP listener passed to RunMaster.
+// The kernel balances the connections among the sockets, which avoids
+// the thundering herd of the workers accepting on one busy socket.
+// The sockets are kept by the master across reloads and restarts of the workers,
+// so the connections queued on the socket of a worker which exits are accepted
+// by the worker started in its place.
+//
+// The listeners passed to RunMaster must be bound with SO_REUSEPORT, for example
+// by Listen with ListenOptions.ReusePort set by SetListenOptions, and the other
+// options set by SetListenOptions are applied to the sockets for the workers.
+// The unix domain socket listeners are shared by the workers, and no listener
+// can be added with the control command "listen" nor RequestListen.
+//
+// This option is not supported on Windows.
+func SetReusePortPool(enabled bool) Option {
+	return func(s *Starter) {
+		s.reusePortPool = enabled
+	}
+}
+
+// WorkerIndex returns the index of the worker in the pool set by SetWorkerCount,
+// which the master passes as the environment variable SERVERSTARTER_WORKER_INDEX.
+// It returns 0 if this is called by the master process or SetWorkerCount is not used.
+func (s *Starter) WorkerIndex() int {
+	if s.IsMaster() {
+		return 0
+	}
+	index, err := strconv.Atoi(os.Getenv(envWorkerIndex))
+	if err != nil {
+		return 0
+	}
+	return index
+}
+
+// poolWorkerName returns the name of the worker at index in the pool of
+// the worker program with the name.
+func poolWorkerName(name string, index int) string {
+	if name == "" {
+		name = "worker"
+	}
+	return name + "-" + strconv.Itoa(index)
+}
+
+// poolSlots returns the worker slots for the pool of the worker program in slot.
+func (s *Starter) poolSlots(slot *workerSlot) ([]*workerSlot, error) {
+	if s.workerCount <= 1 {
+		return []*workerSlot{slot}, nil
+	}
+	slots := make([]*workerSlot, s.workerCount)
+	for i := range slots {
+		pooled := *slot
+		pooled.spec.Name = poolWorkerName(slot.spec.Name, i)
+		pooled.poolIndex = i
+		pooled.listenerFiles = append([]*os.File{}, slot.listenerFiles...)
+		pooled.listenerIndexes = append([]int{}, slot.listenerIndexes...)
+		if s.shardPolicy != nil {
+			shard := s.shardPolicy.Shard(i, s.workerCount, pooled.listenerIndexes)
+			pooled.listenerIndexes = append([]int{}, shard...)
+			pooled.listenerFiles = make([]*os.File, len(shard))
+			for j, index := range shard {
+				if index < 0 || index >= len(s.listenerFiles) {
+					return nil, fmt.Errorf("invalid listener index %d in shard for worker %q", index, pooled.spec.Name)
+				}
+				pooled.listenerFiles[j] = s.listenerFiles[index]
+			}
+			// NOTE: Setting Listeners keeps the assignment when listeners are added.
+			pooled.spec.Listeners = pooled.listenerIndexes
+		}
+		slots[i] = &pooled
+	}
+	return slots, nil
+}
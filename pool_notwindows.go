@@ -0,0 +1,52 @@
+//go:build !windows
+
+package serverstarter
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// bindReusePortSockets replaces the TCP listeners shared by the workers in
+// the pools set by SetWorkerCount with the sockets bound to the same addresses
+// for each worker, when SetReusePortPool is enabled.
+//
+// NOTE: The first worker passed a listener keeps the original one, since
+// the kernel distributes the connections to all sockets bound to the address,
+// and the connections to a socket which no worker accepts on would be stuck.
+func (s *Starter) bindReusePortSockets() error {
+	if !s.reusePortPool || s.workerCount <= 1 {
+		return nil
+	}
+	opts := s.listenOptions
+	opts.ReusePort = true
+	lc := net.ListenConfig{Control: opts.control}
+	used := make(map[int]bool)
+	for _, slot := range s.slots {
+		for j, index := range slot.listenerIndexes {
+			addr, ok := s.listeners[index].Addr().(*net.TCPAddr)
+			if !ok {
+				continue
+			}
+			if !used[index] {
+				used[index] = true
+				continue
+			}
+			l, err := lc.Listen(context.Background(), addr.Network(), addr.String())
+			if err != nil {
+				return fmt.Errorf("error in bindReusePortSockets after binding socket at %s for worker %q; %w", addr, slot.spec.Name, err)
+			}
+			files, err := listenerFiles([]net.Listener{l})
+			// NOTE: The master keeps the duplicated file, not the listener.
+			l.Close()
+			if err != nil {
+				return fmt.Errorf("error in bindReusePortSockets after getting file from listener; %w", err)
+			}
+			s.reusePortFiles = append(s.reusePortFiles, files[0])
+			slot.listenerFiles[j] = files[0]
+		}
+	}
+	s.out.printf("bound %d SO_REUSEPORT sockets for worker pools\n", len(s.reusePortFiles))
+	return nil
+}
@@ -0,0 +1,164 @@
+package serverstarter
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// processRSSSupported is whether processRSS is supported on this platform.
+const processRSSSupported = true
+
+// clockTicksPerSecond is the value of USER_HZ, which is 100 on all
+// architectures supported by Go.
+const clockTicksPerSecond = 100
+
+// processCPUTime returns the user and system CPU time consumed by the process.
+func processCPUTime(pid int) (time.Duration, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	// NOTE: The second field comm is enclosed in parentheses and may contain
+	// spaces, so we split the fields after the last ')'.
+	i := bytes.LastIndexByte(data, ')')
+	if i == -1 {
+		return 0, fmt.Errorf("unexpected format of /proc/%d/stat", pid)
+	}
+	fields := bytes.Fields(data[i+1:])
+	// utime and stime are the 14th and 15th fields, which are the 12th and
+	// 13th after comm.
+	if len(fields) < 13 {
+		return 0, fmt.Errorf("unexpected format of /proc/%d/stat", pid)
+	}
+	utime, err := strconv.ParseInt(string(fields[11]), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	stime, err := strconv.ParseInt(string(fields[12]), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(utime+stime) * time.Second / clockTicksPerSecond, nil
+}
+
+// processTCPConns returns the number of the established TCP connections of
+// the process, which are the sockets in /proc/<pid>/fd listed with the state
+// ESTABLISHED in /proc/<pid>/net/tcp and /proc/<pid>/net/tcp6.
+func processTCPConns(pid int) (int, error) {
+	fdDir := fmt.Sprintf("/proc/%d/fd", pid)
+	names, err := readDirNames(fdDir)
+	if err != nil {
+		return 0, err
+	}
+	inodes := make(map[string]bool)
+	for _, name := range names {
+		link, err := os.Readlink(fdDir + "/" + name)
+		// NOTE: The file descriptor may be closed after reading the directory.
+		if err != nil {
+			continue
+		}
+		if strings.HasPrefix(link, "socket:[") && strings.HasSuffix(link, "]") {
+			inodes[link[len("socket:["):len(link)-1]] = true
+		}
+	}
+	if len(inodes) == 0 {
+		return 0, nil
+	}
+
+	count := 0
+	for _, table := range []string{"tcp", "tcp6"} {
+		data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/net/%s", pid, table))
+		if err != nil {
+			// NOTE: tcp6 does not exist if IPv6 is disabled.
+			if os.IsNotExist(err) {
+				continue
+			}
+			return 0, err
+		}
+		lines := bytes.Split(data, []byte("\n"))
+		// NOTE: The first line is the header. st and inode are the 4th and
+		// 10th fields, and st of ESTABLISHED is 01.
+		for _, line := range lines[1:] {
+			fields := bytes.Fields(line)
+			if len(fields) >= 10 && string(fields[3]) == "01" && inodes[string(fields[9])] {
+				count++
+			}
+		}
+	}
+	return count, nil
+}
+
+// readDirNames returns the names of the entries in the directory.
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdirnames(-1)
+}
+
+// processRSS returns the resident set size of the process in bytes.
+func processRSS(pid int) (uint64, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/statm", pid))
+	if err != nil {
+		return 0, err
+	}
+	// resident is the 2nd field in pages.
+	fields := bytes.Fields(data)
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("unexpected format of /proc/%d/statm", pid)
+	}
+	pages, err := strconv.ParseUint(string(fields[1]), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return pages * uint64(os.Getpagesize()), nil
+}
+
+// processStartTime returns the start time of the process in clock ticks after
+// the system boot, which identifies the process together with the process ID.
+func processStartTime(pid int) (uint64, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	i := bytes.LastIndexByte(data, ')')
+	if i == -1 {
+		return 0, fmt.Errorf("unexpected format of /proc/%d/stat", pid)
+	}
+	fields := bytes.Fields(data[i+1:])
+	// starttime is the 22nd field, which is the 20th after comm.
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("unexpected format of /proc/%d/stat", pid)
+	}
+	return strconv.ParseUint(string(fields[19]), 10, 64)
+}
+
+// processParentAndState returns the parent process ID and the state of the process.
+func processParentAndState(pid int) (ppid int, state byte, err error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, 0, err
+	}
+	i := bytes.LastIndexByte(data, ')')
+	if i == -1 {
+		return 0, 0, fmt.Errorf("unexpected format of /proc/%d/stat", pid)
+	}
+	fields := bytes.Fields(data[i+1:])
+	// state and ppid are the 3rd and 4th fields, which are the 1st and
+	// 2nd after comm.
+	if len(fields) < 2 || len(fields[0]) != 1 {
+		return 0, 0, fmt.Errorf("unexpected format of /proc/%d/stat", pid)
+	}
+	ppid, err = strconv.Atoi(string(fields[1]))
+	if err != nil {
+		return 0, 0, err
+	}
+	return ppid, fields[0][0], nil
+}
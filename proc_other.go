@@ -0,0 +1,27 @@
+//go:build !linux
+
+package serverstarter
+
+import (
+	"errors"
+	"time"
+)
+
+// processRSSSupported is whether processRSS is supported on this platform.
+const processRSSSupported = false
+
+func processCPUTime(pid int) (time.Duration, error) {
+	return 0, errors.New("CPU time of a process is not available on this platform")
+}
+
+func processTCPConns(pid int) (int, error) {
+	return 0, errors.New("TCP connections of a process are not available on this platform")
+}
+
+func processRSS(pid int) (uint64, error) {
+	return 0, errors.New("RSS of a process is not available on this platform")
+}
+
+func processStartTime(pid int) (uint64, error) {
+	return 0, errors.New("start time of a process is not available on this platform")
+}
@@ -0,0 +1,77 @@
+package serverstarter
+
+import (
+	"os"
+	"os/exec"
+)
+
+// Process is a worker process started by a ProcessRunner.
+type Process interface {
+	// Pid returns the process ID of the worker.
+	Pid() int
+	// Signal sends sig to the worker.
+	Signal(sig os.Signal) error
+	// Wait waits for the worker to exit. It returns nil if the worker exits
+	// with the status 0, and an error otherwise. The exit code is got from
+	// the error if it has the method ExitCode() int like *exec.ExitError.
+	// It is called only once for a Process.
+	Wait() error
+}
+
+// ProcessRunner starts the worker processes for the master.
+type ProcessRunner interface {
+	// Start starts the worker for cmd, which is prepared by the master with
+	// the arguments, the environment variables and the files for the worker,
+	// and returns the started process. The first non-nil file in cmd.ExtraFiles
+	// is the socket for the messages from the worker to the master.
+	Start(cmd *exec.Cmd) (Process, error)
+}
+
+// SetProcessRunner sets the runner which starts the worker processes, for example
+// a fake one in tests of the signal handling and the restart logic of the master
+// (see serverstartertest.FakeRunner). The master sends signals to the workers
+// with Process.Signal, instead of the system call with the process ID, when
+// the runner is set, so SetSignalWorkerProcessGroup has no effect.
+// If no SetProcessRunner is called, the master starts the workers with exec.Cmd.
+//
+// This option is not supported on Windows.
+func SetProcessRunner(r ProcessRunner) Option {
+	return func(s *Starter) {
+		s.processRunner = r
+	}
+}
+
+// runner returns the ProcessRunner for starting the workers.
+func (s *Starter) runner() ProcessRunner {
+	if s.processRunner != nil {
+		return s.processRunner
+	}
+	return execRunner{}
+}
+
+// execRunner is the ProcessRunner which starts the workers with exec.Cmd.
+type execRunner struct{}
+
+func (execRunner) Start(cmd *exec.Cmd) (Process, error) {
+	if err := startCommand(cmd); err != nil {
+		return nil, err
+	}
+	return cmdProcess{cmd: cmd}, nil
+}
+
+// cmdProcess is the Process for a worker started with exec.Cmd.
+type cmdProcess struct {
+	cmd *exec.Cmd
+}
+
+func (p cmdProcess) Pid() int {
+	return p.cmd.Process.Pid
+}
+
+func (p cmdProcess) Signal(sig os.Signal) error {
+	return p.cmd.Process.Signal(sig)
+}
+
+func (p cmdProcess) Wait() error {
+	return waitCommand(p.cmd)
+}
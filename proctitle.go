@@ -0,0 +1,31 @@
+package serverstarter
+
+import "fmt"
+
+// SetProcessTitle sets the name used in the process titles of the master and
+// workers, so that operators can tell them apart in the output of ps even when
+// they run the same command line.
+//
+// The master starts workers with the first command line argument (argv[0]) set to
+// "<name>: worker gen=<generation>", or "<name>: worker name=<name of the worker>
+// gen=<generation>" for a worker added by AddWorker. If SetWorkerWrapper is used,
+// it is set to the wrapper instead. Note that os.Args[0] in the worker is the title,
+// so the worker should use os.Executable to get the path of the executable.
+//
+// On Linux, the master also sets its command name shown by ps -e and top to
+// "<name>: master". The command name is truncated to 15 bytes by the kernel.
+// The command line of the master is left as it is, since strings in os.Args,
+// including flag values parsed from it, share the memory with the command line.
+func SetProcessTitle(name string) Option {
+	return func(s *Starter) {
+		s.processTitle = name
+	}
+}
+
+// workerProcessTitle returns the process title of the worker w.
+func (s *Starter) workerProcessTitle(w *worker) string {
+	if w.slot != nil && w.slot.spec.Name != "" {
+		return fmt.Sprintf("%s: worker name=%s gen=%d", s.processTitle, w.slot.spec.Name, w.generation)
+	}
+	return fmt.Sprintf("%s: worker gen=%d", s.processTitle, w.generation)
+}
@@ -0,0 +1,12 @@
+package serverstarter
+
+import "io/ioutil"
+
+// setProcessTitle sets the command name of this process.
+//
+// NOTE: We write the name to /proc/self/comm instead of calling prctl(PR_SET_NAME),
+// since prctl sets the name of the calling thread only and goroutines are not
+// bound to the main thread.
+func setProcessTitle(title string) error {
+	return ioutil.WriteFile("/proc/self/comm", []byte(title), 0)
+}
@@ -0,0 +1,5 @@
+//go:build !linux
+
+package serverstarter
+
+func setProcessTitle(title string) error { return nil }
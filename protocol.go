@@ -0,0 +1,152 @@
+package serverstarter
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// protocolVersion is the version of the framed message protocol between
+// the master and workers.
+//
+// A framed message consists of frameByte, the version, the message type, the
+// length of the payload in 2 bytes big endian and the payload. The message
+// types are the same bytes as the ones of the legacy protocol, in which a
+// message is the type byte followed by a fixed size payload. The master accepts
+// both, since the worker binary may be older than the master after a reload.
+// The master tells its version to workers with envProtocolVersion, and workers
+// started by an older master which does not set it use the legacy protocol.
+const protocolVersion = 1
+
+// envProtocolVersion is the environment variable name for passing the version
+// of the message protocol which the master supports to workers.
+const envProtocolVersion = "SERVERSTARTER_PROTOCOL_VERSION"
+
+// maxPayloadLen is the maximum length of the payload of a framed message.
+const maxPayloadLen = 1<<16 - 1
+
+// legacyPayloadLen returns the length of the payload of the message of typ in
+// the legacy protocol.
+func legacyPayloadLen(typ byte) int {
+	switch typ {
+	case drainByte, listenerReadyByte:
+		return 4
+	}
+	return 0
+}
+
+// appendFrame appends the framed message of typ with payload to b.
+func appendFrame(b []byte, typ byte, payload []byte) []byte {
+	b = append(b, frameByte, protocolVersion, typ, 0, 0)
+	binary.BigEndian.PutUint16(b[len(b)-2:], uint16(len(payload)))
+	return append(b, payload...)
+}
+
+// readMessage reads a message of the framed or the legacy protocol from r and
+// returns its type and payload.
+func readMessage(r io.Reader) (typ byte, payload []byte, err error) {
+	var b [1]byte
+	if _, err := r.Read(b[:]); err != nil {
+		return 0, nil, err
+	}
+	if b[0] != frameByte {
+		payload = make([]byte, legacyPayloadLen(b[0]))
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return 0, nil, err
+		}
+		return b[0], payload, nil
+	}
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	if header[0] == 0 {
+		return 0, nil, errors.New("invalid protocol version 0 in framed message")
+	}
+	payload = make([]byte, binary.BigEndian.Uint16(header[2:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[1], payload, nil
+}
+
+// masterProtocolVersion returns the version of the message protocol which
+// the master supports, or zero if the master supports only the legacy one.
+func masterProtocolVersion() int {
+	v, err := strconv.Atoi(os.Getenv(envProtocolVersion))
+	if err != nil {
+		return 0
+	}
+	return v
+}
+
+// sendMessage sends the message of typ with payload to the master in the framed
+// protocol if the master supports it, or in the legacy protocol otherwise.
+func (s *Starter) sendMessage(typ byte, payload ...byte) error {
+	if typ == readyByte && s.startedByEinhorn() {
+		return sendEinhornAck()
+	}
+	if masterProtocolVersion() < 1 {
+		if len(payload) != legacyPayloadLen(typ) {
+			return fmt.Errorf("message %q is not supported by the master", typ)
+		}
+		return s.sendToMaster(append([]byte{typ}, payload...)...)
+	}
+	if len(payload) > maxPayloadLen {
+		return fmt.Errorf("payload of message %q is too long; %d bytes", typ, len(payload))
+	}
+	return s.sendToMaster(appendFrame(nil, typ, payload)...)
+}
+
+// Heartbeat sends a heartbeat to the master and waits for the reply until
+// timeout, so that the worker can detect the master got stuck or died.
+// It returns an error if no reply is received in time.
+//
+// It must be called after SendReady. It needs the master of this version or
+// later. It must not be called concurrently with another Heartbeat, but
+// the other messages can be sent while it waits for the reply.
+func (s *Starter) Heartbeat(timeout time.Duration) error {
+	pipe := s.readyPipe()
+	if pipe == nil {
+		return fmt.Errorf("Heartbeat %w", ErrReadyNotSent)
+	}
+	if err := s.sendMessage(heartbeatByte); err != nil {
+		return fmt.Errorf("failed to send heartbeat to parent; %w", err)
+	}
+	// NOTE: We read the reply without pipeMu so that the messages can be sent
+	// from other goroutines while waiting for the reply.
+	if err := pipe.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return fmt.Errorf("failed to set deadline for heartbeat reply; %w", err)
+	}
+	typ, _, err := readMessage(pipe)
+	if err != nil {
+		return fmt.Errorf("failed to receive heartbeat reply from parent; %w", err)
+	}
+	if typ != heartbeatByte {
+		return fmt.Errorf("unexpected message %q from parent instead of heartbeat reply", typ)
+	}
+	return nil
+}
+
+// SendMetadata sends the metadata of the worker, for example the version of
+// its configuration, to the master, which logs it.
+//
+// It must be called after SendReady. It needs the master of this version or
+// later. The key must not be empty nor contain "=".
+func (s *Starter) SendMetadata(key, value string) error {
+	if s.readyPipe() == nil {
+		return fmt.Errorf("SendMetadata %w", ErrReadyNotSent)
+	}
+	if key == "" || strings.Contains(key, "=") {
+		return fmt.Errorf("invalid metadata key %q", key)
+	}
+	if err := s.sendMessage(metadataByte, []byte(key+"="+value)...); err != nil {
+		return fmt.Errorf("failed to send metadata to parent; %w", err)
+	}
+	return nil
+}
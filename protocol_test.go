@@ -0,0 +1,47 @@
+package serverstarter
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestReadMessage(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write([]byte{readyByte})
+	buf.Write([]byte{drainByte, 0, 0, 0, 3})
+	buf.Write(appendFrame(nil, metadataByte, []byte("config=v1")))
+	buf.Write(appendFrame(nil, warmByte, nil))
+
+	testCases := []struct {
+		typ     byte
+		payload string
+	}{
+		{typ: readyByte, payload: ""},
+		{typ: drainByte, payload: "\x00\x00\x00\x03"},
+		{typ: metadataByte, payload: "config=v1"},
+		{typ: warmByte, payload: ""},
+	}
+	for _, tc := range testCases {
+		typ, payload, err := readMessage(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if typ != tc.typ || string(payload) != tc.payload {
+			t.Errorf("message mismatch, got=%q %q, want=%q %q", typ, payload, tc.typ, tc.payload)
+		}
+	}
+	if _, _, err := readMessage(&buf); err != io.EOF {
+		t.Errorf("unexpected error at end; %v", err)
+	}
+}
+
+func TestSendReadyWithoutMaster(t *testing.T) {
+	// NOTE: The test process is not started by the master, so SendReady must
+	// not write to the file descriptor at the position of the pipe.
+	s := New()
+	if err := s.SendReady(); !errors.Is(err, ErrNotWorker) {
+		t.Errorf("error mismatch, got=%v, want=%v", err, ErrNotWorker)
+	}
+}
@@ -0,0 +1,68 @@
+package serverstarter
+
+import (
+	"crypto/rand"
+	"errors"
+)
+
+// ConnIDGenerator generates QUIC connection IDs tagged with the generation
+// number of the worker, which can be used for routing packets during the
+// overlap window of a reload.
+//
+// Since the old and the new workers read from the same UDP socket passed from
+// the master, a packet of a connection may be delivered to the worker which does
+// not have the connection. With the connection IDs generated by ConnIDGenerator,
+// the worker can tell from ConnIDGeneration whether a packet belongs to another
+// generation, and drop it instead of replying with a stateless reset which kills
+// the connection. The client retransmits the packet, which is likely delivered
+// to the right worker.
+//
+// Its methods have the same signatures as the ones of ConnectionIDGenerator in
+// quic-go except that connection IDs are byte slices, so it can be adapted
+// with a small wrapper.
+type ConnIDGenerator struct {
+	// Generation is the generation number of the worker. See Starter.Generation.
+	Generation int
+	// Length is the length of connection IDs, which must be between 1 and 20.
+	// If zero, 8 is used.
+	Length int
+}
+
+// GenerateConnectionID returns a new connection ID whose first byte is the
+// lower 8 bits of the generation number and the rest is random.
+func (g ConnIDGenerator) GenerateConnectionID() ([]byte, error) {
+	n := g.ConnectionIDLen()
+	if n < 1 || n > 20 {
+		return nil, errors.New("invalid connection ID length")
+	}
+	id := make([]byte, n)
+	if _, err := rand.Read(id[1:]); err != nil {
+		return nil, err
+	}
+	id[0] = byte(g.Generation)
+	return id, nil
+}
+
+// ConnectionIDLen returns the length of connection IDs.
+func (g ConnIDGenerator) ConnectionIDLen() int {
+	if g.Length == 0 {
+		return 8
+	}
+	return g.Length
+}
+
+// ConnIDGeneration returns the lower 8 bits of the generation number of the worker
+// which generated the connection ID with ConnIDGenerator.
+func ConnIDGeneration(id []byte) (generation byte, ok bool) {
+	if len(id) == 0 {
+		return 0, false
+	}
+	return id[0], true
+}
+
+// IsOwnConnID returns whether the connection ID is generated by ConnIDGenerator
+// in the worker of the generation.
+func IsOwnConnID(id []byte, generation int) bool {
+	g, ok := ConnIDGeneration(id)
+	return ok && g == byte(generation)
+}
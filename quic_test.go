@@ -0,0 +1,71 @@
+package serverstarter
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestConnIDGenerator(t *testing.T) {
+	testCases := []struct {
+		gen     ConnIDGenerator
+		wantLen int
+		wantGen byte
+	}{
+		{gen: ConnIDGenerator{Generation: 3}, wantLen: 8, wantGen: 3},
+		{gen: ConnIDGenerator{Generation: 258, Length: 1}, wantLen: 1, wantGen: 2},
+		{gen: ConnIDGenerator{Generation: 1, Length: 20}, wantLen: 20, wantGen: 1},
+	}
+	for _, c := range testCases {
+		if got := c.gen.ConnectionIDLen(); got != c.wantLen {
+			t.Errorf("length mismatch for %+v, got=%d, want=%d", c.gen, got, c.wantLen)
+		}
+		id, err := c.gen.GenerateConnectionID()
+		if err != nil {
+			t.Fatalf("failed to generate connection ID for %+v; %v", c.gen, err)
+		}
+		if len(id) != c.wantLen {
+			t.Errorf("connection ID length mismatch for %+v, got=%d, want=%d", c.gen, len(id), c.wantLen)
+		}
+		if g, ok := ConnIDGeneration(id); !ok || g != c.wantGen {
+			t.Errorf("generation mismatch for %+v, got=%d, %v, want=%d, true", c.gen, g, ok, c.wantGen)
+		}
+		if !IsOwnConnID(id, c.gen.Generation) {
+			t.Errorf("connection ID %x is not own for %+v", id, c.gen)
+		}
+		if IsOwnConnID(id, c.gen.Generation+1) {
+			t.Errorf("connection ID %x is own for next generation of %+v", id, c.gen)
+		}
+	}
+
+	// NOTE: The bytes other than the generation are random.
+	g := ConnIDGenerator{Generation: 1}
+	id1, err := g.GenerateConnectionID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, err := g.GenerateConnectionID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(id1, id2) {
+		t.Errorf("connection IDs must be random, got %x twice", id1)
+	}
+}
+
+func TestConnIDGeneratorInvalidLength(t *testing.T) {
+	for _, n := range []int{-1, 21} {
+		g := ConnIDGenerator{Length: n}
+		if id, err := g.GenerateConnectionID(); err == nil {
+			t.Errorf("error must be returned for length %d, got %x", n, id)
+		}
+	}
+}
+
+func TestConnIDGenerationEmpty(t *testing.T) {
+	if g, ok := ConnIDGeneration(nil); ok {
+		t.Errorf("generation must not be found in empty connection ID, got=%d", g)
+	}
+	if IsOwnConnID(nil, 0) {
+		t.Error("empty connection ID must not be own")
+	}
+}
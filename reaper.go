@@ -0,0 +1,57 @@
+package serverstarter
+
+import (
+	"os/exec"
+	"sync"
+)
+
+// spawned is the set of the processes started by the master. The reaper for
+// SetChildSubreaper must not reap them, since exec.Cmd.Wait waits for them.
+var spawned = struct {
+	mu   sync.Mutex
+	pids map[int]bool
+}{pids: make(map[int]bool)}
+
+// SetChildSubreaper makes the master a child subreaper with PR_SET_CHILD_SUBREAPER,
+// so that the descendants of workers, for example helper processes spawned by
+// a worker, are re-parented to the master instead of init when their parents
+// exit. The master reaps them when they exit, so that zombies do not accumulate
+// across many reloads.
+//
+// This option is supported only on Linux.
+func SetChildSubreaper() Option {
+	return func(s *Starter) {
+		s.childSubreaper = true
+	}
+}
+
+// startCommand starts cmd and registers its process so that the reaper does not
+// reap it. The reaper does not run while the process is started, since it may
+// exit before it is registered.
+func startCommand(cmd *exec.Cmd) error {
+	spawned.mu.Lock()
+	defer spawned.mu.Unlock()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	spawned.pids[cmd.Process.Pid] = true
+	return nil
+}
+
+// waitCommand waits for cmd started by startCommand to exit and unregisters
+// its process.
+func waitCommand(cmd *exec.Cmd) error {
+	err := cmd.Wait()
+	spawned.mu.Lock()
+	delete(spawned.pids, cmd.Process.Pid)
+	spawned.mu.Unlock()
+	return err
+}
+
+// registerProcess registers the process which is a child of the master but
+// not started by startCommand, for example a worker adopted after a master upgrade.
+func registerProcess(pid int) {
+	spawned.mu.Lock()
+	spawned.pids[pid] = true
+	spawned.mu.Unlock()
+}
@@ -0,0 +1,80 @@
+package serverstarter
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// prSetChildSubreaper is PR_SET_CHILD_SUBREAPER which is not defined in the syscall package.
+const prSetChildSubreaper = 36
+
+// startReaper makes the master a child subreaper and starts reaping the
+// re-parented descendants of workers on SIGCHLD. It returns the function
+// to stop reaping.
+func startReaper(out *output) (stop func(), err error) {
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetChildSubreaper, 1, 0); errno != 0 {
+		return nil, fmt.Errorf("error in startReaper after setting child subreaper; %w", errno)
+	}
+	sigchld := make(chan os.Signal, 1)
+	signal.Notify(sigchld, syscall.SIGCHLD)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-sigchld:
+				reapOrphans(out)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(sigchld)
+		close(done)
+		wg.Wait()
+	}, nil
+}
+
+// reapOrphans reaps the exited processes which are re-parented to the master.
+//
+// NOTE: We cannot wait for any child with wait4(-1), since it would steal
+// the exit status of the workers from exec.Cmd.Wait. Instead we look for
+// the zombie children in /proc and reap only the ones not started by the master.
+func reapOrphans(out *output) {
+	spawned.mu.Lock()
+	defer spawned.mu.Unlock()
+
+	dir, err := os.Open("/proc")
+	if err != nil {
+		out.eprintf("failed to open /proc for reaping orphaned processes: %v\n", err)
+		return
+	}
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		out.eprintf("failed to read /proc for reaping orphaned processes: %v\n", err)
+		return
+	}
+	self := os.Getpid()
+	for _, name := range names {
+		pid, err := strconv.Atoi(name)
+		if err != nil || spawned.pids[pid] {
+			continue
+		}
+		ppid, state, err := processParentAndState(pid)
+		if err != nil || ppid != self || state != 'Z' {
+			continue
+		}
+		var status syscall.WaitStatus
+		if wpid, err := syscall.Wait4(pid, &status, syscall.WNOHANG, nil); err == nil && wpid == pid {
+			out.printf("reaped orphaned process pid=%d, status=%d\n", pid, status.ExitStatus())
+		}
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package serverstarter
+
+import "fmt"
+
+func startReaper(out *output) (stop func(), err error) {
+	return nil, fmt.Errorf("child subreaper is %w", ErrUnsupported)
+}
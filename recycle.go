@@ -0,0 +1,136 @@
+package serverstarter
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// recycleRetryInterval is the interval after which the master tries to recycle
+// the worker again when the reload for recycling it fails.
+const recycleRetryInterval = time.Minute
+
+// rssCheckInterval is the interval at which the master samples the RSS of
+// workers for SetMaxWorkerRSS.
+const rssCheckInterval = time.Second
+
+// SetMaxWorkerLifetime makes the master reload a worker gracefully after it
+// has run for d, like max-age of gunicorn. This mitigates slow memory leaks of
+// workers and keeps the reload path exercised.
+//
+// A random jitter up to 10% of d is added for each worker, so that the workers
+// of multiple masters started at the same time are not reloaded at once.
+// If the reload fails and the old worker is kept, the master tries again after
+// a minute.
+func SetMaxWorkerLifetime(d time.Duration) Option {
+	return func(s *Starter) {
+		s.maxWorkerLifetime = d
+	}
+}
+
+// SetMaxWorkerRSS makes the master sample the resident set size (RSS) of workers
+// every second and reload a worker gracefully when its RSS exceeds limit bytes
+// for d or longer. This restarts leaky workers without an external cron job
+// which sends SIGHUP.
+//
+// If the reload fails and the old worker is kept, the master tries again after
+// a minute.
+//
+// This option is supported only on Linux.
+func SetMaxWorkerRSS(limit uint64, d time.Duration) Option {
+	return func(s *Starter) {
+		s.maxWorkerRSS = limit
+		s.maxWorkerRSSDuration = d
+	}
+}
+
+// setRetireTime sets the time when the master recycles the worker w for
+// SetMaxWorkerLifetime.
+func (s *Starter) setRetireTime(w *worker) {
+	if s.maxWorkerLifetime <= 0 {
+		return
+	}
+	var jitter time.Duration
+	if n := int64(s.maxWorkerLifetime / 10); n > 0 {
+		jitter = time.Duration(rand.Int63n(n))
+	}
+	w.retireAt = w.startedAt.Add(s.maxWorkerLifetime + jitter)
+	w.retireReason = fmt.Sprintf("reached max lifetime %s", s.maxWorkerLifetime)
+}
+
+// RequestRecycle asks the master to replace this worker with a new one with
+// the graceful reload, for example after the worker has served its budget of
+// requests like max_requests of gunicorn. The worker should keep serving until
+// it receives the graceful shutdown signal as usual.
+//
+// It must be called after SendReady. If the reload fails and the old worker is
+// kept, the master recycles the worker again after a minute.
+func (s *Starter) RequestRecycle() error {
+	if s.readyPipe() == nil {
+		return fmt.Errorf("RequestRecycle %w", ErrReadyNotSent)
+	}
+	if err := s.sendMessage(recycleByte); err != nil {
+		return fmt.Errorf("failed to send recycle request to parent; %w", err)
+	}
+	return nil
+}
+
+// requestRecycle makes the master recycle the worker w as soon as possible
+// for RequestRecycle.
+func (w *worker) requestRecycle() {
+	w.out.printf("received recycle request from worker: %s\n", w.label())
+	w.retireAt = time.Now()
+	w.retireReason = "requested by worker"
+}
+
+// nextRetiringSlot returns the slot whose worker should be recycled first for
+// SetMaxWorkerLifetime or RequestRecycle, or nil if there is none.
+func (s *Starter) nextRetiringSlot() *workerSlot {
+	var next *workerSlot
+	for _, slot := range s.slots {
+		if slot.child.retireAt.IsZero() {
+			continue
+		}
+		if next == nil || slot.child.retireTime().Before(next.child.retireTime()) {
+			next = slot
+		}
+	}
+	return next
+}
+
+// retireTime returns the time when the master recycles the worker w for
+// SetMaxWorkerLifetime or RequestRecycle, which is postponed while recycling is held after a
+// failed reload.
+func (w *worker) retireTime() time.Time {
+	if w.retireAt.Before(w.recycleHeldUntil) {
+		return w.recycleHeldUntil
+	}
+	return w.retireAt
+}
+
+// checkWorkerRSS samples the RSS of workers for SetMaxWorkerRSS and returns
+// the slot whose worker should be recycled and the reason, or nil if there is
+// none.
+func (s *Starter) checkWorkerRSS() (*workerSlot, string) {
+	now := time.Now()
+	for _, slot := range s.slots {
+		w := slot.child
+		rss, err := processRSS(w.pid())
+		if err != nil {
+			s.out.eprintf("failed to get RSS of worker %s; %v\n", w.label(), err)
+			continue
+		}
+		if rss <= s.maxWorkerRSS {
+			w.rssExceededSince = time.Time{}
+			continue
+		}
+		if w.rssExceededSince.IsZero() {
+			w.rssExceededSince = now
+		}
+		if now.Sub(w.rssExceededSince) >= s.maxWorkerRSSDuration && !now.Before(w.recycleHeldUntil) {
+			reason := fmt.Sprintf("RSS %d bytes exceeded %d bytes for %s", rss, s.maxWorkerRSS, now.Sub(w.rssExceededSince))
+			return slot, reason
+		}
+	}
+	return nil, ""
+}
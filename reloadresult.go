@@ -0,0 +1,89 @@
+package serverstarter
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ReloadResult is the result of reloading a worker.
+type ReloadResult struct {
+	// Worker is the name of the worker program set by AddWorker.
+	Worker string
+	// OldPID is the process ID of the old worker.
+	OldPID int
+	// NewPID is the process ID of the new worker, or zero if the reload failed.
+	NewPID int
+	// StartedAt is the time when the reload started.
+	StartedAt time.Time
+	// Duration is the time from starting the reload to the exit of the old
+	// worker, or to the failure.
+	Duration time.Duration
+	// Err is the error if the reload failed.
+	Err error
+}
+
+// String returns the result in the "key=value" form used in the response to
+// the reload command from the control socket.
+func (r ReloadResult) String() string {
+	var b strings.Builder
+	if r.Worker != "" {
+		fmt.Fprintf(&b, "worker=%s ", r.Worker)
+	}
+	fmt.Fprintf(&b, "old_pid=%d", r.OldPID)
+	if r.NewPID != 0 {
+		fmt.Fprintf(&b, " new_pid=%d", r.NewPID)
+	}
+	fmt.Fprintf(&b, " duration=%s", r.Duration.Round(time.Millisecond))
+	return b.String()
+}
+
+// LastReload returns the results of the most recent reload, one for each worker
+// program reloaded, or nil if no reload has been done. Deploy scripts can use
+// this, or the last-reload command of the control socket, to verify that the
+// reload after sending SIGHUP succeeded.
+// It is safe to call LastReload from another goroutine while RunMaster is running.
+func (s *Starter) LastReload() []ReloadResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]ReloadResult(nil), s.lastReload...)
+}
+
+// setLastReload sets the results of the most recent reload.
+func (s *Starter) setLastReload(results []ReloadResult) {
+	s.mu.Lock()
+	s.lastReload = append([]ReloadResult(nil), results...)
+	s.mu.Unlock()
+}
+
+// lastReloadResponse returns the response to the last-reload command, which is
+// same as the response to the reload command with the start time of the reload
+// after "ok" or "error:".
+func (s *Starter) lastReloadResponse() string {
+	results := s.LastReload()
+	if len(results) == 0 {
+		return "error: no reload has been done"
+	}
+	resp := reloadResponse(results)
+	i := strings.IndexByte(resp, ' ')
+	return resp[:i] + " started_at=" + results[0].StartedAt.Format(time.RFC3339Nano) + resp[i:]
+}
+
+// reloadResponse returns the response to the reload command for the results.
+// It is "ok" followed by the results, or "error: " followed by the first failed
+// result and its error.
+func reloadResponse(results []ReloadResult) string {
+	if len(results) == 0 {
+		return "error: reload canceled"
+	}
+	for _, r := range results {
+		if r.Err != nil {
+			return fmt.Sprintf("error: %s; %v", r, r.Err)
+		}
+	}
+	parts := make([]string, len(results))
+	for i, r := range results {
+		parts[i] = r.String()
+	}
+	return "ok " + strings.Join(parts, " ")
+}
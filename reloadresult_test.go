@@ -0,0 +1,58 @@
+package serverstarter
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReloadResponse(t *testing.T) {
+	testCases := []struct {
+		results []ReloadResult
+		want    string
+	}{
+		{
+			results: nil,
+			want:    "error: reload canceled",
+		},
+		{
+			results: []ReloadResult{{OldPID: 10, NewPID: 20, Duration: 1502 * time.Millisecond}},
+			want:    "ok old_pid=10 new_pid=20 duration=1.502s",
+		},
+		{
+			results: []ReloadResult{
+				{Worker: "web", OldPID: 10, NewPID: 20, Duration: time.Second},
+				{Worker: "queue", OldPID: 11, NewPID: 21, Duration: 2 * time.Second},
+			},
+			want: "ok worker=web old_pid=10 new_pid=20 duration=1s worker=queue old_pid=11 new_pid=21 duration=2s",
+		},
+		{
+			results: []ReloadResult{
+				{Worker: "web", OldPID: 10, NewPID: 20, Duration: time.Second},
+				{Worker: "queue", OldPID: 11, Duration: 12 * time.Millisecond, Err: errors.New("worker exited")},
+			},
+			want: "error: worker=queue old_pid=11 duration=12ms; worker exited",
+		},
+	}
+	for _, tc := range testCases {
+		if got := reloadResponse(tc.results); got != tc.want {
+			t.Errorf("result mismatch, got=%q, want=%q", got, tc.want)
+		}
+	}
+}
+
+func TestLastReloadResponse(t *testing.T) {
+	s := New()
+	if got, want := s.lastReloadResponse(), "error: no reload has been done"; got != want {
+		t.Errorf("response mismatch, got=%q, want=%q", got, want)
+	}
+
+	startedAt := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	s.setLastReload([]ReloadResult{{OldPID: 10, StartedAt: startedAt, Duration: 12 * time.Millisecond, Err: errors.New("exit status 1")}})
+	if got, want := s.lastReloadResponse(), "error: started_at=2024-01-02T15:04:05Z old_pid=10 duration=12ms; exit status 1"; got != want {
+		t.Errorf("response mismatch, got=%q, want=%q", got, want)
+	}
+	if results := s.LastReload(); len(results) != 1 || results[0].OldPID != 10 {
+		t.Errorf("unexpected last reload: %v", results)
+	}
+}
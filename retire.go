@@ -0,0 +1,39 @@
+package serverstarter
+
+import (
+	"fmt"
+)
+
+// SendRetiring notifies the master that the worker is going to exit
+// intentionally, for example after it detects a fatal but clean condition.
+// The master starts the replacement right away, and the exit of the worker is
+// not treated as a crash.
+//
+// It must be called after SendReady. The worker should keep serving until it
+// finishes its in-flight work and then exit by itself. After the replacement
+// gets ready, the master waits for the worker to exit like the old worker in
+// a reload, so the worker is killed if it does not exit in time.
+func (s *Starter) SendRetiring() error {
+	if s.readyPipe() == nil {
+		return fmt.Errorf("SendRetiring %w", ErrReadyNotSent)
+	}
+	if err := s.sendMessage(retireByte); err != nil {
+		return fmt.Errorf("failed to send retirement notice to parent; %w", err)
+	}
+	return nil
+}
+
+// setRetiring records the worker sent the retirement notice with SendRetiring.
+func (w *worker) setRetiring() {
+	w.mu.Lock()
+	w.retiring = true
+	w.mu.Unlock()
+}
+
+// isRetiring returns whether the worker sent the retirement notice with
+// SendRetiring.
+func (w *worker) isRetiring() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.retiring
+}
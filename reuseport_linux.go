@@ -0,0 +1,4 @@
+package serverstarter
+
+// soReusePort is SO_REUSEPORT which is not defined in the syscall package for linux.
+const soReusePort = 0xf
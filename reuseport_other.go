@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package serverstarter
+
+import "fmt"
+
+func setReusePort(fd uintptr) error {
+	return fmt.Errorf("SO_REUSEPORT is %w", ErrUnsupported)
+}
@@ -0,0 +1,16 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package serverstarter
+
+import (
+	"os"
+	"syscall"
+)
+
+func setReusePort(fd uintptr) error {
+	err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	if err != nil {
+		return os.NewSyscallError("setsockopt SO_REUSEPORT", err)
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package serverstarter
+
+import "os"
+
+// envRlimitTrampoline is the environment variable for the configuration of
+// the trampoline, which sets the resource limits of the worker and executes it.
+const envRlimitTrampoline = "SERVERSTARTER_RLIMIT_TRAMPOLINE"
+
+// RunTrampoline executes the worker after setting its resource limits if this
+// process is started by the master as the trampoline for SetWorkerRlimits, and
+// returns nil without doing anything otherwise.
+//
+// The master program which uses SetWorkerRlimits must call RunTrampoline at
+// the beginning of main, since the master starts its own executable in place
+// of the worker so that no code of the worker runs with the limits of the master.
+// If this process is the trampoline, RunTrampoline returns only if it fails,
+// and the caller should exit with a non-zero status then, for example:
+//
+//	func main() {
+//		if err := serverstarter.RunTrampoline(); err != nil {
+//			log.Fatal(err)
+//		}
+//		...
+//	}
+func RunTrampoline() error {
+	v, ok := os.LookupEnv(envRlimitTrampoline)
+	if !ok {
+		return nil
+	}
+	return execRlimitTrampoline(v)
+}
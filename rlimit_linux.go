@@ -0,0 +1,133 @@
+package serverstarter
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// rlimitTrampoline is the configuration of the trampoline.
+type rlimitTrampoline struct {
+	Path       string                `json:"path"`
+	Rlimits    []trampolineRlimit    `json:"rlimits"`
+	Chroot     string                `json:"chroot,omitempty"`
+	Credential *trampolineCredential `json:"credential,omitempty"`
+	Pdeathsig  syscall.Signal        `json:"pdeathsig,omitempty"`
+	MasterPID  int                   `json:"masterPID"`
+}
+
+type trampolineRlimit struct {
+	Resource int    `json:"resource"`
+	Cur      uint64 `json:"cur"`
+	Max      uint64 `json:"max"`
+}
+
+type trampolineCredential struct {
+	UID    uint32   `json:"uid"`
+	GID    uint32   `json:"gid"`
+	Groups []uint32 `json:"groups"`
+}
+
+// useRlimitTrampoline makes cmd start the executable of the master as
+// the trampoline, which sets the resource limits set by SetWorkerRlimits before
+// executing the worker, so that no code of the worker runs with the limits of
+// the master.
+//
+// NOTE: The trampoline also changes the root directory and the credential in
+// place of cmd.SysProcAttr, since the executable of the master may not exist
+// under the new root directory, and raising the hard limits needs the privilege
+// of the master.
+func (s *Starter) useRlimitTrampoline(cmd *exec.Cmd) error {
+	t := rlimitTrampoline{
+		Path:      cmd.Path,
+		Pdeathsig: s.workerPdeathsig,
+		MasterPID: os.Getpid(),
+	}
+	for resource, l := range s.workerRlimits {
+		t.Rlimits = append(t.Rlimits, trampolineRlimit{Resource: resource, Cur: l.cur, Max: l.max})
+	}
+	attr := cmd.SysProcAttr
+	t.Chroot, attr.Chroot = attr.Chroot, ""
+	if c := attr.Credential; c != nil {
+		t.Credential = &trampolineCredential{UID: c.Uid, GID: c.Gid, Groups: c.Groups}
+		attr.Credential = nil
+	}
+	data, err := json.Marshal(t)
+	if err != nil {
+		return fmt.Errorf("error in useRlimitTrampoline after encoding configuration; %w", err)
+	}
+	// NOTE: /proc/self/exe is resolved in the forked process, so it is
+	// the executable of the master even if the file is replaced.
+	cmd.Path = "/proc/self/exe"
+	cmd.Env = append(cmd.Env, envRlimitTrampoline+"="+string(data))
+	return nil
+}
+
+// execRlimitTrampoline sets the resource limits, changes the root directory and
+// the credential, and executes the worker with the configuration of the trampoline.
+// It returns only if it fails.
+func execRlimitTrampoline(config string) error {
+	var t rlimitTrampoline
+	if err := json.Unmarshal([]byte(config), &t); err != nil {
+		return fmt.Errorf("error in rlimit trampoline after decoding configuration; %w", err)
+	}
+	for _, l := range t.Rlimits {
+		// NOTE: syscall.Setrlimit also makes syscall.Exec keep RLIMIT_NOFILE
+		// instead of restoring the original one.
+		if err := syscall.Setrlimit(l.Resource, &syscall.Rlimit{Cur: l.Cur, Max: l.Max}); err != nil {
+			return fmt.Errorf("error in rlimit trampoline after setting resource limit %d; %w", l.Resource, err)
+		}
+	}
+	if t.Chroot != "" {
+		if err := syscall.Chroot(t.Chroot); err != nil {
+			return fmt.Errorf("error in rlimit trampoline after changing root directory; %w", err)
+		}
+		if err := syscall.Chdir("/"); err != nil {
+			return fmt.Errorf("error in rlimit trampoline after changing working directory; %w", err)
+		}
+	}
+
+	// NOTE: We change the credential of only this thread with the raw system
+	// calls like the child process forked by os/exec, since this thread executes
+	// the worker and the other threads are terminated by execve(2).
+	runtime.LockOSThread()
+	if c := t.Credential; c != nil {
+		var groups unsafe.Pointer
+		if len(c.Groups) > 0 {
+			groups = unsafe.Pointer(&c.Groups[0])
+		}
+		if _, _, errno := syscall.RawSyscall(sysSetgroups, uintptr(len(c.Groups)), uintptr(groups), 0); errno != 0 {
+			return fmt.Errorf("error in rlimit trampoline after setting groups; %w", os.NewSyscallError("setgroups", errno))
+		}
+		if _, _, errno := syscall.RawSyscall(sysSetgid, uintptr(c.GID), 0, 0); errno != 0 {
+			return fmt.Errorf("error in rlimit trampoline after setting group ID; %w", os.NewSyscallError("setgid", errno))
+		}
+		if _, _, errno := syscall.RawSyscall(sysSetuid, uintptr(c.UID), 0, 0); errno != 0 {
+			return fmt.Errorf("error in rlimit trampoline after setting user ID; %w", os.NewSyscallError("setuid", errno))
+		}
+	}
+	if t.Pdeathsig != 0 {
+		// NOTE: The parent death signal is cleared when the credential is changed.
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, syscall.PR_SET_PDEATHSIG, uintptr(t.Pdeathsig), 0); errno != 0 {
+			return fmt.Errorf("error in rlimit trampoline after setting parent death signal; %w", os.NewSyscallError("prctl", errno))
+		}
+		if os.Getppid() != t.MasterPID {
+			return fmt.Errorf("master pid=%d exited", t.MasterPID)
+		}
+	}
+
+	env := make([]string, 0, len(os.Environ()))
+	for _, v := range os.Environ() {
+		if envKey(v) != envRlimitTrampoline {
+			env = append(env, v)
+		}
+	}
+	if err := syscall.Exec(t.Path, os.Args, env); err != nil {
+		return fmt.Errorf("error in rlimit trampoline after executing %s; %w", t.Path, err)
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+//go:build !windows
+
+package serverstarter
+
+import "syscall"
+
+// SetWorkerRlimits sets the resource limits of worker processes.
+// The keys of rlimits are resources such as syscall.RLIMIT_NOFILE and syscall.RLIMIT_AS.
+// This can be used to give workers limits independent of the master's limits,
+// for example a high RLIMIT_NOFILE or a bounded RLIMIT_AS.
+//
+// The limits are applied before the worker is executed, by the executable of
+// the master which is started in place of the worker and executes the worker
+// after setting the limits. So the master needs the privilege to raise the hard
+// limits, and the master program must call RunTrampoline at the beginning of main.
+// This option is supported only on Linux.
+func SetWorkerRlimits(rlimits map[int]syscall.Rlimit) Option {
+	return func(s *Starter) {
+		s.workerRlimits = make(map[int]rlimit, len(rlimits))
+		for resource, l := range rlimits {
+			s.workerRlimits[resource] = rlimit{cur: uint64(l.Cur), max: uint64(l.Max)}
+		}
+	}
+}
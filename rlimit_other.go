@@ -0,0 +1,16 @@
+//go:build !linux
+
+package serverstarter
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+func (s *Starter) useRlimitTrampoline(cmd *exec.Cmd) error {
+	return fmt.Errorf("setting resource limits of a worker is %w", ErrUnsupported)
+}
+
+func execRlimitTrampoline(config string) error {
+	return fmt.Errorf("rlimit trampoline is %w", ErrUnsupported)
+}
@@ -0,0 +1,37 @@
+package serverstarter
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestRunTrampolineNotTrampoline(t *testing.T) {
+	if err := RunTrampoline(); err != nil {
+		t.Errorf("RunTrampoline must do nothing if this process is not the trampoline; %v", err)
+	}
+}
+
+func TestRunTrampolineInvalidConfig(t *testing.T) {
+	os.Setenv(envRlimitTrampoline, "{")
+	defer os.Unsetenv(envRlimitTrampoline)
+	if err := RunTrampoline(); err == nil {
+		t.Error("error must be returned for invalid configuration")
+	}
+}
+
+func TestWorkerWithoutRunTrampoline(t *testing.T) {
+	os.Setenv(envRlimitTrampoline, "{}")
+	resetInherited()
+	defer func() {
+		os.Unsetenv(envRlimitTrampoline)
+		resetInherited()
+	}()
+	s := New()
+	if err := s.passedToThisProcess(); !errors.Is(err, ErrNotWorker) {
+		t.Errorf("error mismatch, got=%v, want=%v", err, ErrNotWorker)
+	}
+	if _, ok := os.LookupEnv(envMasterPID); ok {
+		t.Errorf("environment variable %s must not be set", envMasterPID)
+	}
+}
@@ -0,0 +1,246 @@
+package serverstarter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRunMasterWorkerPdeathsig(t *testing.T) {
+	p := startHelper(t, "simple", workerPdeathsigEnv+"=1")
+	pid := p.waitWorkerPID()
+	p.waitLine("received ready from initial worker", 10*time.Second)
+
+	if err := p.cmd.Process.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	p.cmd.Wait()
+	waitProcessDead(t, pid, 10*time.Second)
+}
+
+func TestRunMasterDetachedWorkers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serverstarter-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "workers.json")
+
+	p := startHelper(t, "simple", detachedStateFileEnv+"="+stateFile)
+	pid := p.waitWorkerPID()
+	// NOTE: The worker is not killed in the cleanup of the helper since it is
+	// in another process group.
+	defer syscall.Kill(pid, syscall.SIGKILL)
+	p.waitLine("received ready from initial worker", 10*time.Second)
+
+	if err := p.cmd.Process.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	p.cmd.Wait()
+	time.Sleep(100 * time.Millisecond)
+	if err := syscall.Kill(pid, 0); err != nil {
+		t.Fatalf("detached worker pid=%d did not survive master; %v", pid, err)
+	}
+
+	p2 := startHelper(t, "simple", detachedStateFileEnv+"="+stateFile)
+	p2.waitLine(fmt.Sprintf("stopping orphaned worker pid=%d left by previous master", pid), 10*time.Second)
+	waitProcessDead(t, pid, 10*time.Second)
+
+	p2.signal(syscall.SIGTERM)
+	if err := p2.wait(); err != nil {
+		t.Errorf("master exited with error; %v", err)
+	}
+	if _, err := os.Stat(stateFile); !os.IsNotExist(err) {
+		t.Errorf("state file is not removed; %v", err)
+	}
+}
+
+func TestRunMasterChildSubreaper(t *testing.T) {
+	p := startHelper(t, "simple", childSubreaperEnv+"=1")
+	p.waitLine("received ready from initial worker", 10*time.Second)
+	p.waitLine("reaped orphaned process", 10*time.Second)
+
+	p.signal(syscall.SIGTERM)
+	if err := p.wait(); err != nil {
+		t.Errorf("master exited with error; %v", err)
+	}
+}
+
+func TestRunMasterInitMode(t *testing.T) {
+	p := startHelper(t, "simple", initModeEnv+"=1")
+	p.waitLine("received ready from initial worker", 10*time.Second)
+
+	p.signal(syscall.SIGWINCH)
+	p.waitLine(`forwarding signal "window changed" to worker`, 10*time.Second)
+
+	// NOTE: The worker is killed by SIGINT since it does not handle it,
+	// which shows the master sends the graceful shutdown signal.
+	p.signal(syscall.SIGTERM)
+	err := p.wait()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 128+int(syscall.SIGINT) {
+		t.Errorf("master exit status mismatch, got=%v, want=exit status %d", err, 128+int(syscall.SIGINT))
+	}
+}
+
+func TestRunMasterSignalWorkerProcessGroup(t *testing.T) {
+	p := startHelper(t, "simple", processGroupEnv+"=1")
+	line := p.waitLine("helper started: pid=", 10*time.Second)
+	var pid int
+	if _, err := fmt.Sscanf(line[strings.Index(line, "pid="):], "pid=%d,", &pid); err != nil {
+		t.Fatalf("failed to parse helper pid from %q; %v", line, err)
+	}
+	defer syscall.Kill(pid, syscall.SIGKILL)
+	p.waitLine("received ready from initial worker", 10*time.Second)
+
+	p.signal(syscall.SIGTERM)
+	if err := p.wait(); err != nil {
+		t.Errorf("master exited with error; %v", err)
+	}
+	waitProcessDead(t, pid, 10*time.Second)
+}
+
+func TestRunMasterProcessTitle(t *testing.T) {
+	p := startHelper(t, "simple", processTitleEnv+"=myapp")
+	pid := p.waitWorkerPID()
+	p.waitLine("received ready from initial worker", 10*time.Second)
+
+	comm, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/comm", p.cmd.Process.Pid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(comm), "myapp: master\n"; got != want {
+		t.Errorf("master command name mismatch, got=%q, want=%q", got, want)
+	}
+	cmdline, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.SplitN(string(cmdline), "\x00", 2)[0], "myapp: worker gen=1"; got != want {
+		t.Errorf("worker title mismatch, got=%q, want=%q", got, want)
+	}
+
+	p.signal(syscall.SIGTERM)
+	if err := p.wait(); err != nil {
+		t.Errorf("master exited with error; %v", err)
+	}
+}
+
+func TestRunMasterMaxWorkerRSS(t *testing.T) {
+	p := startHelper(t, "simple", maxWorkerRSSEnv+"=1")
+	p.waitLine("received ready from initial worker", 10*time.Second)
+	line := p.waitLine("recycling worker pid=", 10*time.Second)
+	if !strings.Contains(line, "exceeded 1 bytes for ") {
+		t.Errorf("unexpected recycling reason: %s", line)
+	}
+	p.waitLine("finished recycling worker", 10*time.Second)
+
+	p.signal(syscall.SIGTERM)
+	if err := p.wait(); err != nil {
+		t.Errorf("master exited with error; %v", err)
+	}
+}
+
+// waitWorkerPID waits for the worker of simpleHelper to start and returns its
+// process ID.
+func (p *helperProcess) waitWorkerPID() int {
+	p.t.Helper()
+	line := p.waitLine("worker started: pid=", 10*time.Second)
+	var pid int
+	if _, err := fmt.Sscanf(line[strings.Index(line, "pid="):], "pid=%d,", &pid); err != nil {
+		p.t.Fatalf("failed to parse worker pid from %q; %v", line, err)
+	}
+	return pid
+}
+
+// waitProcessDead waits for the process to exit. A zombie process is regarded
+// as exited, since the init process may not reap the orphaned process soon.
+func waitProcessDead(t *testing.T, pid int, timeout time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+		if err != nil {
+			return
+		}
+		if i := bytes.LastIndexByte(data, ')'); i != -1 && bytes.HasPrefix(data[i+1:], []byte(" Z")) {
+			return
+		}
+		if time.Now().After(deadline) {
+			syscall.Kill(pid, syscall.SIGKILL)
+			t.Fatalf("timeout waiting for process pid=%d to exit", pid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRunMasterReusePortPool(t *testing.T) {
+	p := startHelper(t, "simple", reusePortPoolEnv+"=1")
+	lines := p.waitLines(10*time.Second, "worker index=0", "worker index=1",
+		"received ready from initial worker: pid=", "received ready from initial worker: pid=")
+	fields0 := strings.Split(lines[0], ", ")
+	fields1 := strings.Split(lines[1], ", ")
+	if fields0[1] != fields1[1] {
+		t.Errorf("workers listen on different addresses: %q, %q", lines[0], lines[1])
+	}
+	if !strings.HasPrefix(fields0[2], "socket=socket:") || fields0[2] == fields1[2] {
+		t.Errorf("workers do not have their own sockets: %q, %q", lines[0], lines[1])
+	}
+
+	p.signal(syscall.SIGTERM)
+	if err := p.wait(); err != nil {
+		t.Errorf("master exited with error; %v", err)
+	}
+}
+
+func TestProcessTCPConns(t *testing.T) {
+	before, err := processTCPConns(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	sc, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	// NOTE: Both ends of the connection are in this process.
+	got, err := processTCPConns(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != before+2 {
+		t.Errorf("TCP connection count mismatch, got=%d, want=%d", got, before+2)
+	}
+}
+
+func TestRunMasterWorkerRlimits(t *testing.T) {
+	p := startHelper(t, "simple", workerRlimitNofileEnv+"=321")
+	// NOTE: The limit must be applied before the package of the worker is initialized.
+	p.waitLine("worker initial RLIMIT_NOFILE max=321", 10*time.Second)
+	p.waitLine("received ready from initial worker", 10*time.Second)
+
+	p.signal(syscall.SIGTERM)
+	if err := p.wait(); err != nil {
+		t.Errorf("master exited with error; %v", err)
+	}
+}
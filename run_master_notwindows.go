@@ -3,11 +3,16 @@
 package serverstarter
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
+	"reflect"
 	"strconv"
 	"strings"
 	"syscall"
@@ -20,173 +25,2084 @@ import (
 // If the master process receives a SIGHUP, it starts a new worker and stop the old worker
 // by sending a signal set by SetGracefulShutdownSignalToChild.
 // If the master process receives a SIGINT or a SIGTERM, it sends the SIGTERM to the worker
-// and exists.
+// and exists. If it receives a SIGINT or a SIGTERM again while waiting for the
+// worker to exit, it kills the worker with SIGKILL and exits immediately.
+// If the master process receives a SIGQUIT, it forwards the signal to the worker,
+// which makes a Go worker print the goroutine dump to stderr and exit, and
+// the worker is restarted.
+// If the control file is set with SetControlFile, the master process also handles
+// a SIGUSR2 by reading a command from the control file.
+// If the control socket is set with SetControlSocket, the master process also
+// executes commands received from the control socket. Commands received during
+// a reload are queued or rejected according to SetControlBusyPolicy.
+// If the log files are set with SetLogFiles, the master process reopens them
+// on a SIGUSR1.
+// If the master upgrade is enabled with SetMasterUpgrade, the master process
+// re-executes itself on a SIGUSR2 keeping the listeners and the workers.
+// If the nginx-style signals are enabled with SetNginxSignals, the master process
+// handles SIGUSR2, SIGQUIT and SIGHUP in the same way as nginx instead.
+// If the takeover socket is set with SetTakeoverSocket, the master process
+// takes over the listeners from the running master, and hands over them to
+// a new master later.
+// If the new worker fails to start or to get ready, the master keeps the old worker.
+// If the master process receives a SIGHUP before the initial worker gets ready,
+// it starts a reload after the initial worker gets ready.
+// SIGHUPs received while a reload is in progress are merged into it, and
+// SetReloadDebounce merges SIGHUPs sent in quick succession.
+//
+// If the worker programs are added with AddWorker, the master runs a worker for each
+// of them. They are restarted independently, and reloaded one by one on a SIGHUP.
+//
+// RunMaster can be called without listeners to supervise workers which do not
+// serve on sockets, for example queue consumers. The workers are notified,
+// started, reloaded and stopped in the same way, and Listeners returns an empty
+// slice in the workers.
 func (s *Starter) RunMaster(listeners ...net.Listener) error {
+	return s.runMaster(listeners)
+}
+
+// RunMasterWith is same as RunMaster except that the master passes the listeners,
+// the packet connections and the files in in to workers.
+func (s *Starter) RunMasterWith(in Inheritance) error {
+	if in.ListenerNames != nil {
+		s.listenerNames = in.ListenerNames
+	}
+	s.packetConns = in.PacketConns
+	s.packetConnNames = in.PacketConnNames
+	s.sctpListeners = in.SCTPListeners
+	s.sctpNames = in.SCTPListenerNames
+	if in.Files != nil {
+		s.extraFiles = in.Files
+	}
+	return s.runMaster(in.Listeners)
+}
+
+func (s *Starter) runMaster(listeners []net.Listener) error {
+	if s.masterUpgrade && s.controlFile != "" {
+		return fmt.Errorf("error in RunMaster; SetMasterUpgrade and SetControlFile %w since both use SIGUSR2", ErrIncompatibleOptions)
+	}
+	if s.masterUpgrade && len(s.sctpListeners) > 0 {
+		return fmt.Errorf("error in RunMaster; SetMasterUpgrade and SCTP listeners %w since SCTP listeners are not handed over to the new master", ErrIncompatibleOptions)
+	}
+	if s.masterUpgrade && len(s.extraFiles) > 0 {
+		return fmt.Errorf("error in RunMaster; SetMasterUpgrade and extra files %w since extra files are not handed over to the new master", ErrIncompatibleOptions)
+	}
+	if s.masterUpgrade && s.reusePortPool {
+		return fmt.Errorf("error in RunMaster; SetMasterUpgrade and SetReusePortPool %w since the sockets of the pool are not handed over to the new master", ErrIncompatibleOptions)
+	}
+	if s.nginxSignals && (s.masterUpgrade || s.controlFile != "") {
+		return fmt.Errorf("error in RunMaster; SetNginxSignals and SetMasterUpgrade or SetControlFile %w since they use SIGUSR2", ErrIncompatibleOptions)
+	}
+	if s.workerPdeathsig != 0 && !pdeathsigSupported {
+		return fmt.Errorf("error in RunMaster; SetWorkerPdeathsig is %w", ErrUnsupported)
+	}
+	if s.workerPdeathsig != 0 && s.detachedStateFile != "" {
+		return fmt.Errorf("error in RunMaster; SetWorkerPdeathsig and SetDetachedWorkers %w", ErrIncompatibleOptions)
+	}
+	if s.maxWorkerRSS > 0 && !processRSSSupported {
+		return fmt.Errorf("error in RunMaster; SetMaxWorkerRSS is %w", ErrUnsupported)
+	}
+	if s.dialSyslog != nil && s.journaldIdentifier != "" {
+		return fmt.Errorf("error in RunMaster; SetSyslog and SetJournald %w", ErrIncompatibleOptions)
+	}
+	if s.serverStarterEnv && s.passFDsOverSocket {
+		return fmt.Errorf("error in RunMaster; SetServerStarterEnv and SetPassFDsOverSocket %w", ErrIncompatibleOptions)
+	}
+	if s.einhornEnv && s.passFDsOverSocket {
+		return fmt.Errorf("error in RunMaster; SetEinhornEnv and SetPassFDsOverSocket %w", ErrIncompatibleOptions)
+	}
+	if s.firstFD < stdFdCount {
+		return fmt.Errorf("error in RunMaster; invalid first file descriptor %d set by SetFirstFD", s.firstFD)
+	}
+	if s.dialSyslog != nil {
+		w, err := s.dialSyslog()
+		if err != nil {
+			return fmt.Errorf("error in RunMaster after connecting to syslog; %w", err)
+		}
+		s.out.setBackend(w)
+		defer s.out.closeBackend()
+	}
+	if s.journaldIdentifier != "" {
+		j, err := dialJournal(journalSocket, s.journaldIdentifier)
+		if err != nil {
+			return fmt.Errorf("error in RunMaster after connecting to journal; %w", err)
+		}
+		s.journal = j
+		s.out.setBackend(j)
+		defer func() {
+			s.journal = nil
+			s.out.closeBackend()
+		}()
+	}
+	if s.webhookURL != "" {
+		s.webhook = s.startWebhook()
+		defer func() {
+			s.webhook.close()
+			s.webhook = nil
+		}()
+	}
+	if s.processTitle != "" {
+		if err := setProcessTitle(s.processTitle + ": master"); err != nil {
+			return fmt.Errorf("error in RunMaster after setting process title; %w", err)
+		}
+	}
 	s.listeners = listeners
+	handedOver := false
+	s.unixSocketFiles = s.createdUnixSocketFiles(keepUnixSocketFiles(listeners))
+	defer func() {
+		// NOTE: The new master keeps using the socket files after handing over.
+		if !handedOver {
+			removeUnixSocketFiles(&s.out, s.unixSocketFiles)
+		}
+	}()
+	// NOTE: We get the files from listeners only once and reuse them for all workers,
+	// instead of duplicating file descriptors for each worker, since it is costly
+	// when there are many listeners.
+	files, err := listenerFiles(listeners)
+	if err != nil {
+		return fmt.Errorf("error in RunMaster after getting files from listeners; %w", err)
+	}
+	s.listenerFiles = files
+	// NOTE: The listeners added by the control command "listen" are closed too.
+	defer func() { closeFiles(s.listenerFiles) }()
+	if s.packetConnFiles, err = packetConnFiles(s.packetConns); err != nil {
+		return fmt.Errorf("error in RunMaster after getting files from packet connections; %w", err)
+	}
+	defer closeFiles(s.packetConnFiles)
+	if s.sctpFiles, s.sctpAddrs, err = sctpListenerFiles(s.sctpListeners); err != nil {
+		return fmt.Errorf("error in RunMaster after getting files from SCTP listeners; %w", err)
+	}
+	defer closeFiles(s.sctpFiles)
+
+	if s.slots, err = s.newWorkerSlots(); err != nil {
+		return fmt.Errorf("error in RunMaster after preparing workers; %w", err)
+	}
+	defer func() { closeFiles(s.reusePortFiles) }()
+	if err := s.bindReusePortSockets(); err != nil {
+		return fmt.Errorf("error in RunMaster after binding sockets for workers; %w", err)
+	}
+	if s.einhornEnv {
+		stop, err := s.startEinhornSocket()
+		if err != nil {
+			return fmt.Errorf("error in RunMaster after starting Einhorn command socket; %w", err)
+		}
+		defer stop()
+	}
+
 	wd, err := os.Getwd()
 	if err != nil {
-		return fmt.Errorf("error in RunMaster after failing to get working directory; %v", err)
+		return fmt.Errorf("error in RunMaster after failing to get working directory; %w", err)
+	}
+	s.workingDirectory = wd
+
+	if err := s.openLogFiles(); err != nil {
+		return fmt.Errorf("error in RunMaster after opening log files; %w", err)
+	}
+	defer s.closeLogFiles()
+
+	signals := make(chan os.Signal, 1)
+	// NOTE: The signals SIGKILL and SIGSTOP may not be caught by a program.
+	// https://golang.org/pkg/os/signal/#hdr-Types_of_signals
+	handledSignals := []os.Signal{syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT}
+	if s.controlFile != "" || s.masterUpgrade || s.nginxSignals {
+		handledSignals = append(handledSignals, syscall.SIGUSR2)
+	}
+	if len(s.logFiles) > 0 {
+		handledSignals = append(handledSignals, syscall.SIGUSR1)
+	}
+	handledSignals = append(handledSignals, s.forwardedSignals()...)
+	// NOTE: We start handling signals before starting the initial worker,
+	// so that signals received before the initial worker gets ready are not lost.
+	signal.Notify(signals, handledSignals...)
+	defer signal.Stop(signals)
+	s.signals = signals
+
+	var controlRequests chan controlRequest
+	var controlSrv *controlServer
+	if s.controlSocket != "" {
+		controlSrv, err = s.startControlServer()
+		if err != nil {
+			return fmt.Errorf("error in RunMaster after starting control server; %w", err)
+		}
+		defer controlSrv.close()
+		controlRequests = controlSrv.requests
+		s.controlRequests = controlRequests
+	}
+
+	if s.detachedStateFile != "" {
+		if err := s.loadOrphanedWorkers(); err != nil {
+			return fmt.Errorf("error in RunMaster after loading orphaned workers; %w", err)
+		}
+	}
+	if err := s.adoptWorkers(); err != nil {
+		return fmt.Errorf("error in RunMaster after adopting workers from old master; %w", err)
+	}
+	defer func() {
+		// NOTE: The running master aborts the takeover if this master fails before finishing it.
+		if s.takeoverConn != nil {
+			s.takeoverConn.Close()
+			s.takeoverConn = nil
+		}
+	}()
+	// NOTE: If this master takes over from a running master, we bind the takeover
+	// socket only after finishing the takeover, so that the running master stays
+	// reachable on it if this master fails before that.
+	var takeoverSrv *takeoverServer
+	defer func() {
+		if takeoverSrv != nil {
+			takeoverSrv.close(handedOver)
+		}
+	}()
+	if s.takeoverSocket != "" && s.takeoverConn == nil {
+		if takeoverSrv, err = s.startTakeoverServer(); err != nil {
+			return fmt.Errorf("error in RunMaster after starting takeover server; %w", err)
+		}
+	}
+	// NOTE: We start the reaper after adopting workers, so that it does not
+	// reap the adopted workers.
+	if s.childSubreaper || s.initMode {
+		stopReaper, err := startReaper(&s.out)
+		if err != nil {
+			return fmt.Errorf("error in RunMaster after starting reaper; %w", err)
+		}
+		defer stopReaper()
+	}
+	for i, slot := range s.slots {
+		if slot.child != nil {
+			continue
+		}
+		slot.child, err = s.startWorker(slot)
+		if err != nil {
+			for _, started := range s.slots[:i] {
+				s.killWorker(started.child)
+			}
+			return fmt.Errorf("error in RunMaster after starting worker; %w", err)
+		}
+		s.out.printf("started initial worker: %s\n", slot.child.label())
+	}
+
+	reloadQueued, exit, err := s.waitInitialReady(signals, controlRequests)
+	if exit || err != nil {
+		return err
+	}
+	s.stopOrphanedWorkers()
+	if reloadQueued {
+		s.out.printf("start queued reload\n")
+		_, err := s.reload()
+		next := s.mergeSignalsDuringReload()
+		if err != nil {
+			return fmt.Errorf("error in RunMaster after starting queued reload; %w", err)
+		}
+		if next != nil {
+			if exit, err := s.handleSignal(next); exit || err != nil {
+				return err
+			}
+		}
+	}
+	if s.takeoverConn != nil {
+		if err := s.finishTakeover(); err != nil {
+			for _, slot := range s.slots {
+				s.killWorker(slot.child)
+			}
+			return fmt.Errorf("error in RunMaster after finishing takeover; %w", err)
+		}
+		// NOTE: We keep serving without the takeover socket if we fail to bind it,
+		// since the old master is already stopping its workers.
+		if takeoverSrv, err = s.startTakeoverServer(); err != nil {
+			s.out.eprintf("failed to start takeover server after taking over: %v\n", err)
+		}
+	}
+	// NOTE: We accept takeovers and recycle workers only after the initial
+	// workers get ready.
+	s.takeoverServer = takeoverSrv
+	s.recycleWorkers = true
+	if s.maxWorkerRSS > 0 {
+		ticker := time.NewTicker(rssCheckInterval)
+		defer ticker.Stop()
+		s.rssCheckC = ticker.C
+	}
+
+	for {
+		e := s.waitMasterEvent(signals, controlRequests)
+		switch {
+		case e.signal != nil:
+			if exit, err := s.handleSignal(e.signal); exit || err != nil {
+				return err
+			}
+
+		case e.request != nil:
+			if exit, err := s.handleControlRequest(*e.request); exit || err != nil {
+				return err
+			}
+
+		case e.takeover != nil:
+			s.handOver(e.takeover)
+			handedOver = true
+			if controlSrv != nil {
+				// NOTE: The new master listens on the same path.
+				controlSrv.keepSocketFile()
+			}
+			return nil
+
+		case e.recycle:
+			if err := s.recycleWorker(e.slot, e.reason); err != nil {
+				return err
+			}
+
+		case e.checkRSS:
+			if slot, reason := s.checkWorkerRSS(); slot != nil {
+				if err := s.recycleWorker(slot, reason); err != nil {
+					return err
+				}
+			}
+
+		case e.oldExited:
+			s.oldWorkerExited(e.slot, e.err)
+
+		case e.message:
+			child := e.slot.child
+			if !e.ok {
+				child.msgC = nil
+				continue
+			}
+			switch e.msg {
+			case warmByte:
+				s.out.printf("received warm from worker: %s, elapsed=%s\n", child.label(), time.Since(child.startedAt))
+			case recycleByte:
+				child.requestRecycle()
+			case retireByte:
+				s.out.printf("received retirement notice from worker: %s\n", child.label())
+				if err := s.replaceRetiringWorker(e.slot); err != nil {
+					return err
+				}
+			case reloadRequestByte:
+				s.out.printf("received reload request from worker: %s\n", child.label())
+				if _, exit, err := s.reloadOnSignal(); exit || err != nil {
+					return err
+				}
+			case listenRequestByte:
+				s.handleListenRequests(child)
+			}
+
+		case e.slot.child.isRetiring():
+			if err := s.restartRetiredWorker(e.slot); err != nil {
+				return err
+			}
+
+		default:
+			err := e.err
+			s.emitWorkerExited(e.slot.child, err)
+			if s.noRestartExitCode != 0 && exitCode(err) == s.noRestartExitCode {
+				s.out.eprintf("child process exited with exit code %d, not restarting child: %s.\n", s.noRestartExitCode, e.slot.child.label())
+				s.slots = removeSlot(s.slots, e.slot)
+				if len(s.slots) == 0 {
+					return fmt.Errorf("error in RunMaster after worker exited not to be restarted; %w", newWorkerExitError(e.slot.child, err))
+				}
+				continue
+			}
+			if err != nil {
+				s.out.eprintf("child process exited err=%v, restarting child: %s.\n", err, e.slot.child.label())
+			} else {
+				s.out.printf("child process exited without err, restarting child: %s.\n", e.slot.child.label())
+			}
+			// always restart child process
+			e.slot.child, err = s.startWorker(e.slot)
+			if err != nil {
+				s.slots = removeSlot(s.slots, e.slot)
+				s.stopAll(syscall.SIGTERM)
+				return fmt.Errorf("error in RunMaster after restarting worker; %w", err)
+			}
+			s.out.printf("restarted worker: %s\n", e.slot.child.label())
+		}
+	}
+}
+
+// masterEvent is an event which the master waits for in waitMasterEvent.
+// Exactly one of signal, request, takeover, message, exit of the old worker and
+// exit of the worker is set.
+type masterEvent struct {
+	signal   os.Signal
+	request  *controlRequest
+	takeover *net.UnixConn
+	slot     *workerSlot
+	// recycle is true if the worker in slot should be recycled for the reason.
+	recycle bool
+	reason  string
+	// checkRSS is true if the RSS of workers should be checked for SetMaxWorkerRSS.
+	checkRSS bool
+	// message is true if msg is received from the worker in slot or ok is false
+	// when the pipe is closed.
+	message bool
+	msg     byte
+	ok      bool
+	// oldExited is true if the worker of the old generation in slot kept by
+	// SetNginxSignals exited with err.
+	oldExited bool
+	// err is the error from waiting the worker in slot to exit,
+	// if neither signal, request nor message is set.
+	err error
+}
+
+// waitMasterEvent returns the signal or the control request deferred during
+// a reload if any, or waits for a signal, a control request, a takeover request from
+// a new master, a worker to be recycled, a tick to check RSS of workers, a message from a worker or an exit of a worker.
+func (s *Starter) waitMasterEvent(signals <-chan os.Signal, controlRequests <-chan controlRequest) masterEvent {
+	if len(s.deferredSignals) > 0 {
+		sig := s.deferredSignals[0]
+		s.deferredSignals = s.deferredSignals[1:]
+		return masterEvent{signal: sig}
+	}
+	if len(s.deferredRequests) > 0 {
+		req := s.deferredRequests[0]
+		s.deferredRequests = s.deferredRequests[1:]
+		return masterEvent{request: &req}
+	}
+	// NOTE: We use reflect.Select since the number of workers is dynamic.
+	var takeoverRequests chan *net.UnixConn
+	if s.takeoverServer != nil {
+		takeoverRequests = s.takeoverServer.requests
+	}
+	var retireC <-chan time.Time
+	var retiring *workerSlot
+	if s.recycleWorkers {
+		if retiring = s.nextRetiringSlot(); retiring != nil {
+			timer := time.NewTimer(time.Until(retiring.child.retireTime()))
+			defer timer.Stop()
+			retireC = timer.C
+		}
+	}
+	cases := make([]reflect.SelectCase, 5, 5+2*len(s.slots))
+	cases[0] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(signals)}
+	cases[1] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(controlRequests)}
+	cases[2] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(takeoverRequests)}
+	cases[3] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(retireC)}
+	cases[4] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(s.rssCheckC)}
+	for _, slot := range s.slots {
+		cases = append(cases,
+			reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(slot.child.msgC)},
+			reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(slot.child.waitErrC)})
+	}
+	// NOTE: The cases for the exits of the old generation follow the ones for the slots.
+	var oldSlots []*workerSlot
+	for _, slot := range s.slots {
+		if slot.oldChild != nil {
+			oldSlots = append(oldSlots, slot)
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(slot.oldChild.waitErrC)})
+		}
+	}
+
+	chosen, v, ok := reflect.Select(cases)
+	switch chosen {
+	case 0:
+		return masterEvent{signal: v.Interface().(os.Signal)}
+	case 1:
+		req := v.Interface().(controlRequest)
+		return masterEvent{request: &req}
+	case 2:
+		return masterEvent{takeover: v.Interface().(*net.UnixConn)}
+	case 3:
+		return masterEvent{slot: retiring, recycle: true, reason: retiring.child.retireReason}
+	case 4:
+		return masterEvent{checkRSS: true}
+	}
+	if n := 5 + 2*len(s.slots); chosen >= n {
+		err, _ := v.Interface().(error)
+		return masterEvent{slot: oldSlots[chosen-n], oldExited: true, err: err}
+	}
+	slot := s.slots[(chosen-5)/2]
+	if (chosen-5)%2 == 0 {
+		e := masterEvent{slot: slot, message: true, ok: ok}
+		if ok {
+			e.msg = byte(v.Uint())
+		}
+		return e
+	}
+	err, _ := v.Interface().(error)
+	return masterEvent{slot: slot, err: err}
+}
+
+// waitInitialReady waits for the initial workers to send ready while handling signals.
+//
+// A SIGHUP received in the meantime is not applied immediately, since replacing the worker
+// which is not ready yet only makes the startup slower. Instead a reload is queued and
+// the caller should do it after the initial worker gets ready. Multiple SIGHUPs are merged
+// into one reload. A SIGINT or a SIGTERM stops the initial worker and makes the master exit.
+func (s *Starter) waitInitialReady(signals <-chan os.Signal, controlRequests <-chan controlRequest) (reloadQueued, exit bool, err error) {
+	queueReload := func() {
+		if reloadQueued {
+			s.out.printf("received SIGHUP before initial worker is ready, merged with queued reload\n")
+		} else {
+			s.out.printf("received SIGHUP before initial worker is ready, queued reload\n")
+		}
+		reloadQueued = true
+	}
+	handleSignal := func(sig os.Signal) (exit bool, err error) {
+		if s.isForwardedSignal(sig) {
+			s.forwardSignal(sig.(syscall.Signal))
+			return false, nil
+		}
+		switch {
+		case sig == syscall.SIGHUP && s.nginxSignals:
+			s.forwardSignal(syscall.SIGHUP)
+		case sig == syscall.SIGHUP:
+			queueReload()
+		case sig == syscall.SIGINT, sig == syscall.SIGTERM, sig == syscall.SIGQUIT && s.nginxSignals:
+			return true, s.stop(sig)
+		case sig == syscall.SIGUSR1:
+			s.reopenLogFiles()
+		case sig == syscall.SIGQUIT:
+			s.forwardSignal(syscall.SIGQUIT)
+		}
+		return false, nil
+	}
+	handleCommand := func(command string) (resp string, exit bool, err error) {
+		switch commandName(command) {
+		case "reload":
+			if dryRun, _ := reloadArgs(command); dryRun {
+				return "error: initial worker is not ready yet", false, nil
+			}
+			queueReload()
+		case "stop":
+			return "ok", true, s.stop(syscall.SIGTERM)
+		case "checksum":
+			s.setExpectedBinaryChecksum(commandArg(command))
+		case "status":
+			resp := s.statusResponse()
+			s.out.printf("status: %s\n", resp)
+			return resp, false, nil
+		case "last-reload":
+			resp := s.lastReloadResponse()
+			s.out.printf("last reload: %s\n", resp)
+			return resp, false, nil
+		case "listen":
+			return s.listenCommand(command), false, nil
+		case "reload-group", "unlisten":
+			return "error: initial worker is not ready yet", false, nil
+		}
+		return "ok", false, nil
+	}
+
+	pending := 0
+	for _, slot := range s.slots {
+		if !slot.ready {
+			pending++
+		}
+	}
+	if pending == 0 {
+		return false, false, nil
+	}
+	for {
+		e := s.waitMasterEvent(signals, controlRequests)
+		switch {
+		case e.signal == syscall.SIGUSR2 && (s.masterUpgrade || s.nginxSignals):
+			s.out.printf("ignored SIGUSR2 before initial worker is ready\n")
+
+		case e.signal == syscall.SIGUSR2:
+			command, err := s.readControlFile()
+			if err != nil {
+				s.out.eprintf("ignored SIGUSR2 after failing to read control command: %v\n", err)
+				continue
+			}
+			s.out.printf("received control command %q\n", command)
+			if _, exit, err := handleCommand(command); exit || err != nil {
+				return false, exit, err
+			}
+
+		case e.signal != nil:
+			if exit, err := handleSignal(e.signal); exit || err != nil {
+				return false, exit, err
+			}
+
+		case e.request != nil:
+			req := *e.request
+			s.out.printf("received control command %q from control socket\n", req.command)
+			resp, exit, err := handleCommand(req.command)
+			if err != nil {
+				resp = "error: " + err.Error()
+			}
+			req.result <- resp
+			if exit || err != nil {
+				return false, exit, err
+			}
+
+		case e.oldExited:
+			s.oldWorkerExited(e.slot, e.err)
+
+		case e.message:
+			if e.slot.ready {
+				switch {
+				case !e.ok:
+					e.slot.child.msgC = nil
+				case e.msg == recycleByte:
+					e.slot.child.requestRecycle()
+				case e.msg == reloadRequestByte:
+					s.out.printf("received reload request from worker: %s\n", e.slot.child.label())
+					queueReload()
+				case e.msg == listenRequestByte:
+					s.handleListenRequests(e.slot.child)
+				}
+				continue
+			}
+			if err := e.slot.child.checkReady(e.msg, e.ok); err != nil {
+				return false, false, fmt.Errorf("error in RunMaster after waiting ready from initial worker %s; %w", e.slot.child.label(), err)
+			}
+			s.out.printf("received ready from initial worker: %s\n", e.slot.child.label())
+			s.emitWorkerReady(e.slot.child)
+			e.slot.ready = true
+			pending--
+			if pending == 0 {
+				return reloadQueued, false, nil
+			}
+
+		case e.slot.child.isRetiring():
+			if err := s.restartRetiredWorker(e.slot); err != nil {
+				return false, false, err
+			}
+			e.slot.ready = false
+			pending++
+
+		default:
+			s.emitWorkerExited(e.slot.child, e.err)
+			err := fmt.Errorf("initial worker %s exited; %w", e.slot.child.label(), newWorkerExitError(e.slot.child, e.err))
+			s.slots = removeSlot(s.slots, e.slot)
+			s.stopAll(syscall.SIGTERM)
+			return false, false, fmt.Errorf("error in RunMaster after waiting ready from initial worker; %w", err)
+		}
+	}
+}
+
+// handleSignal handles a signal received by the master.
+// It returns true if the master should exit.
+func (s *Starter) handleSignal(sig os.Signal) (exit bool, err error) {
+	if s.isForwardedSignal(sig) {
+		s.forwardSignal(sig.(syscall.Signal))
+		return false, nil
+	}
+	if s.nginxSignals {
+		switch sig {
+		case syscall.SIGHUP:
+			s.forwardSignal(syscall.SIGHUP)
+			return false, nil
+		case syscall.SIGQUIT:
+			if !s.hasOldGeneration() {
+				return true, s.stop(sig)
+			}
+			return false, s.retireOldGeneration()
+		case syscall.SIGUSR2:
+			s.startNewGeneration()
+			return false, nil
+		}
+	}
+	switch sig {
+	case syscall.SIGHUP:
+		_, exit, err := s.reloadOnSignal()
+		return exit, err
+	case syscall.SIGINT, syscall.SIGTERM:
+		return true, s.stop(sig)
+	case syscall.SIGUSR1:
+		s.reopenLogFiles()
+	case syscall.SIGQUIT:
+		s.forwardSignal(syscall.SIGQUIT)
+	case syscall.SIGUSR2:
+		if s.masterUpgrade {
+			if err := s.upgradeMaster(); err != nil {
+				s.out.eprintf("master upgrade failed, keeping current master: %v\n", err)
+			}
+			return false, nil
+		}
+		command, err := s.readControlFile()
+		if err != nil {
+			s.out.eprintf("ignored SIGUSR2 after failing to read control command: %v\n", err)
+			return false, nil
+		}
+		s.out.printf("received control command %q\n", command)
+		_, exit, err := s.handleCommand(command)
+		return exit, err
+	}
+	return false, nil
+}
+
+// signalChild sends sig to the worker w with the ProcessRunner set by
+// SetProcessRunner, or with signalWorker otherwise.
+func (s *Starter) signalChild(w *worker, sig syscall.Signal) error {
+	if s.processRunner != nil {
+		return w.process.Signal(sig)
+	}
+	return s.signalWorker(w.pid(), sig)
+}
+
+// signalWorker sends sig to the worker with pid, or to the process group of
+// the worker if SetSignalWorkerProcessGroup is set.
+func (s *Starter) signalWorker(pid int, sig syscall.Signal) error {
+	if s.signalWorkerProcessGroup {
+		return syscall.Kill(-pid, sig)
+	}
+	return syscall.Kill(pid, sig)
+}
+
+// forwardedSignals returns the signals which the master forwards to the workers
+// in the init mode set by SetInitMode.
+func (s *Starter) forwardedSignals() []os.Signal {
+	if !s.initMode {
+		return nil
+	}
+	sigs := []os.Signal{syscall.SIGWINCH}
+	if len(s.logFiles) == 0 {
+		sigs = append(sigs, syscall.SIGUSR1)
+	}
+	if s.controlFile == "" && !s.masterUpgrade && !s.nginxSignals {
+		sigs = append(sigs, syscall.SIGUSR2)
+	}
+	return sigs
+}
+
+// isForwardedSignal returns whether sig is forwarded to the workers.
+func (s *Starter) isForwardedSignal(sig os.Signal) bool {
+	for _, forwarded := range s.forwardedSignals() {
+		if sig == forwarded {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardSignal sends sig to the workers, including the old generation kept
+// by SetNginxSignals.
+func (s *Starter) forwardSignal(sig syscall.Signal) {
+	for _, w := range s.runningWorkers() {
+		pid := w.pid()
+		s.out.printf("forwarding signal %q to worker pid=%d\n", sig, pid)
+		if err := w.process.Signal(sig); err != nil {
+			s.out.eprintf("failed to forward signal %q to worker pid=%d: %v\n", sig, pid, err)
+		}
+	}
+}
+
+// runningWorkers returns the workers in the slots and the workers of the old
+// generation kept by SetNginxSignals.
+func (s *Starter) runningWorkers() []*worker {
+	var workers []*worker
+	for _, slot := range s.slots {
+		workers = append(workers, slot.child)
+		if slot.oldChild != nil {
+			workers = append(workers, slot.oldChild)
+		}
+	}
+	return workers
+}
+
+// reloadOnSignal reloads the workers on a SIGHUP and returns the results.
+// It returns true if the master should exit.
+func (s *Starter) reloadOnSignal() (results []ReloadResult, exit bool, err error) {
+	next := s.waitReloadDebounce()
+	if next == syscall.SIGINT || next == syscall.SIGTERM {
+		s.out.printf("received %v while waiting to start reload, canceled reload\n", next)
+		exit, err := s.handleSignal(next)
+		return nil, exit, err
+	}
+	results, err = s.reload()
+	pending := []os.Signal{next, s.mergeSignalsDuringReload()}
+	if err != nil {
+		return results, true, fmt.Errorf("error in RunMaster after receiving SIGHUP; %w", err)
+	}
+	for _, sig := range pending {
+		if sig == nil {
+			continue
+		}
+		if exit, err := s.handleSignal(sig); exit || err != nil {
+			return results, exit, err
+		}
+	}
+	return results, false, nil
+}
+
+// handleCommand executes a command from the control file or the control socket
+// and returns the response for the control socket.
+// It returns true if the master should exit.
+func (s *Starter) handleCommand(command string) (resp string, exit bool, err error) {
+	switch commandName(command) {
+	case "reload":
+		dryRun, name := reloadArgs(command)
+		slots := s.slots
+		if name != "" {
+			// NOTE: The slot is removed when the worker exits with the exit code
+			// set by SetNoRestartExitCode, while the name is still valid.
+			slot := s.findSlot(name)
+			if slot == nil {
+				s.out.eprintf("failed to reload worker %s: worker is not running\n", name)
+				return "error: worker " + name + " is not running", false, nil
+			}
+			slots = []*workerSlot{slot}
+		}
+		if dryRun {
+			for _, slot := range slots {
+				if err := s.dryRunReload(slot); err != nil {
+					s.out.eprintf("dry run reload failed: %v\n", err)
+					return "error: " + err.Error(), false, nil
+				}
+			}
+			return "ok", false, nil
+		}
+		if name == "" {
+			results, exit, err := s.reloadOnSignal()
+			return reloadResponse(results), exit, err
+		}
+		result, err := s.reloadSlot(slots[0])
+		s.setLastReload([]ReloadResult{result})
+		if err != nil {
+			return "", true, fmt.Errorf("error in RunMaster after receiving command %q; %w", command, err)
+		}
+		return reloadResponse([]ReloadResult{result}), false, nil
+	case "stop":
+		exit, err := s.handleSignal(syscall.SIGTERM)
+		return "ok", exit, err
+	case "checksum":
+		s.setExpectedBinaryChecksum(commandArg(command))
+	case "status":
+		resp := s.statusResponse()
+		s.out.printf("status: %s\n", resp)
+		return resp, false, nil
+	case "last-reload":
+		resp := s.lastReloadResponse()
+		s.out.printf("last reload: %s\n", resp)
+		return resp, false, nil
+	case "listen":
+		return s.listenCommand(command), false, nil
+	case "reload-group":
+		return s.reloadGroup(commandArg(command))
+	case "unlisten":
+		return s.unlistenCommand(command)
+	}
+	return "ok", false, nil
+}
+
+// reloadGroup reloads the workers serving the listener group with the name one
+// by one and returns the response for the control command "reload-group".
+func (s *Starter) reloadGroup(name string) (resp string, exit bool, err error) {
+	slots := s.groupSlots(name)
+	if len(slots) == 0 {
+		return "error: no worker serves listener group " + name, false, nil
+	}
+	s.out.printf("reloading workers serving listener group %s\n", name)
+	var results []ReloadResult
+	for _, slot := range slots {
+		result, err := s.reloadSlot(slot)
+		results = append(results, result)
+		if err != nil {
+			s.setLastReload(results)
+			return "", true, fmt.Errorf("error in RunMaster after reloading listener group %s; %w", name, err)
+		}
+	}
+	s.setLastReload(results)
+	s.out.printf("finished reloading listener group %s\n", name)
+	return reloadResponse(results), false, nil
+}
+
+// dryRunReload starts a new worker and stops it after it gets ready,
+// while keeping the old worker running. It returns an error if the new worker
+// fails to start or to get ready.
+func (s *Starter) dryRunReload(slot *workerSlot) error {
+	s.setBusy(true)
+	defer s.setBusy(false)
+
+	if s.reloadValidationArgs != nil {
+		if err := s.validateWorker(slot); err != nil {
+			return fmt.Errorf("error in dryRunReload after validating new worker; %w", err)
+		}
+	}
+	newChild, err := s.startWorker(slot)
+	if err != nil {
+		return fmt.Errorf("error in dryRunReload after starting new worker; %w", err)
+	}
+	s.out.printf("started new worker for dry run: %s\n", newChild.label())
+	if err := newChild.waitReady(); err != nil {
+		return fmt.Errorf("error in dryRunReload after waiting ready from new worker; %w", s.workerStartFailed(newChild, err))
+	}
+	s.out.printf("received ready from new worker for dry run: %s\n", newChild.label())
+
+	if err := s.stopDryRunWorker(newChild); err != nil {
+		return fmt.Errorf("error in dryRunReload after stopping new worker pid=%d; %w", newChild.pid(), err)
+	}
+	s.out.printf("stopped new worker for dry run: %s\n", newChild.label())
+	return nil
+}
+
+// stopDryRunWorker stops the worker started for a dry run with the graceful shutdown
+// signal, and kills it if it does not exit within the timeout set by
+// SetChildShutdownWaitTimeout.
+func (s *Starter) stopDryRunWorker(w *worker) error {
+	if err := s.signalChild(w, s.gracefulShutdownSignalToChild); err != nil {
+		return err
+	}
+	timer := time.NewTimer(s.childShutdownWaitTimeout)
+	defer timer.Stop()
+	select {
+	case <-w.waitErrC:
+		return nil
+	case <-timer.C:
+		s.out.eprintf("new worker for dry run %s did not exit gracefully and was killed\n", w.label())
+		s.killWorker(w)
+		return nil
+	}
+}
+
+// setExpectedBinaryChecksum sets the expected checksum of the worker binary.
+// An empty checksum clears it.
+func (s *Starter) setExpectedBinaryChecksum(checksum string) {
+	s.expectedBinaryChecksum = checksum
+	if checksum == "" {
+		s.out.printf("cleared expected checksum of worker binary\n")
+	} else {
+		s.out.printf("set expected checksum of worker binary to %s\n", checksum)
+	}
+}
+
+// waitReloadDebounce waits for the duration set by SetReloadDebounce and merges
+// SIGHUPs received in the meantime. It stops waiting and returns the signal
+// if it receives another signal.
+func (s *Starter) waitReloadDebounce() os.Signal {
+	if s.reloadDebounce <= 0 || s.signals == nil {
+		return nil
+	}
+	timer := time.NewTimer(s.reloadDebounce)
+	defer timer.Stop()
+	merged := 0
+	defer func() {
+		if merged > 0 {
+			s.out.printf("merged %d SIGHUPs received while waiting to start reload\n", merged)
+		}
+	}()
+	for {
+		select {
+		case sig := <-s.signals:
+			if sig != syscall.SIGHUP {
+				return sig
+			}
+			merged++
+		case <-timer.C:
+			return nil
+		}
+	}
+}
+
+// mergeSignalsDuringReload drops SIGHUPs received while a reload was in progress,
+// since they are merged into the reload, and reports the reload finished.
+// It returns the first other signal received during the reload, which is left
+// for the caller to handle.
+//
+// NOTE: Without this, each SIGHUP queued during a reload would start another
+// full reload just after the current one.
+func (s *Starter) mergeSignalsDuringReload() os.Signal {
+	merged := 0
+	var next os.Signal
+loop:
+	for {
+		select {
+		case sig := <-s.signals:
+			if sig != syscall.SIGHUP {
+				next = sig
+				break loop
+			}
+			merged++
+		default:
+			break loop
+		}
+	}
+	if merged > 0 {
+		s.out.printf("received %d SIGHUPs during reload, merged with reload in progress\n", merged)
+	}
+	s.out.printf("finished reload\n")
+	return next
+}
+
+// reload reloads the workers one by one and returns the results.
+func (s *Starter) reload() ([]ReloadResult, error) {
+	var results []ReloadResult
+	for _, slot := range s.slots {
+		result, err := s.reloadSlot(slot)
+		results = append(results, result)
+		if err != nil {
+			s.setLastReload(results)
+			return results, err
+		}
+	}
+	s.setLastReload(results)
+	return results, nil
+}
+
+// reloadSlot reloads the worker in slot and returns the result. It returns
+// an error only if the master should exit.
+func (s *Starter) reloadSlot(slot *workerSlot) (result ReloadResult, err error) {
+	start := time.Now()
+	old := slot.child
+	ctx, span := s.startSpan("serverstarter.reload")
+	span.SetAttribute("worker", slot.spec.Name)
+	span.SetAttribute("old_pid", old.pid())
+	s.reloadCtx = ctx
+	defer func() {
+		s.reloadCtx = nil
+		endReloadSpan(span, result, err)
+	}()
+	s.emit(Event{
+		Type:       EventReloadStarted,
+		PID:        old.pid(),
+		Worker:     slot.spec.Name,
+		Generation: old.generation,
+	})
+	err = s.replaceWorker(slot)
+	result = ReloadResult{
+		Worker:    slot.spec.Name,
+		OldPID:    old.pid(),
+		StartedAt: start,
+		Duration:  time.Since(start),
+	}
+	if slot.child != old {
+		result.NewPID = slot.child.pid()
+	}
+	var failure *reloadFailure
+	switch {
+	case errors.As(err, &failure):
+		result.Err = failure.err
+		if !failure.fatal {
+			return result, nil
+		}
+		return result, fmt.Errorf("error in reload of worker %s; %w", old.label(), failure.err)
+	case err != nil:
+		result.Err = err
+	case slot.child == old:
+		// NOTE: The new worker exited before sending warm and the old
+		// worker is kept.
+		result.Err = errors.New("new worker exited before sending warm")
+	default:
+		s.emit(Event{
+			Type:       EventReloadSucceeded,
+			PID:        slot.child.pid(),
+			Worker:     slot.spec.Name,
+			Generation: slot.child.generation,
+			Elapsed:    result.Duration,
+		})
+	}
+	return result, err
+}
+
+// replaceWorker starts a new worker and stops the old worker after the new worker gets ready.
+//
+// If the new worker fails to start or to get ready, the reload fails and
+// the old worker keeps running.
+func (s *Starter) replaceWorker(slot *workerSlot) error {
+	s.setBusy(true)
+	defer s.setBusy(false)
+
+	if s.reloadValidationArgs != nil {
+		if err := s.validateWorker(slot); err != nil {
+			return s.reloadFailed(slot, 0, fmt.Errorf("error in reload after validating new worker; %w", err))
+		}
+	}
+
+	if s.reloadStrategy == ReloadStopOldFirst {
+		return s.reloadSlotStopOldFirst(slot)
+	}
+
+	newChild, err := s.spawnWorker(slot)
+	if err != nil {
+		return s.reloadFailed(slot, 0, fmt.Errorf("error in reload after starting new worker; %w", err))
+	}
+	s.out.printf("started new worker: %s\n", newChild.label())
+
+	if err := s.traced("serverstarter.wait_ready", newChild.pid(), newChild.waitReady); err != nil {
+		err = fmt.Errorf("error in reload after waiting ready from new worker; %w", s.workerStartFailed(newChild, err))
+		return s.reloadFailed(slot, newChild.pid(), err)
+	}
+	s.out.printf("received ready from new worker: %s\n", newChild.label())
+	s.emitWorkerReady(newChild)
+
+	if s.keepOldUntilWarmTimeout > 0 && !s.waitWarm(newChild) {
+		// NOTE: We keep the old worker as a hot fallback.
+		return nil
+	}
+
+	if s.newWorkerProbation > 0 {
+		if err := waitNewWorkerRunning(newChild, s.newWorkerProbation, "probation"); err != nil {
+			return s.reloadFailed(slot, newChild.pid(), fmt.Errorf("error in reload after waiting probation of new worker pid=%d; %w", newChild.pid(), err))
+		}
+		s.out.printf("new worker passed probation: %s\n", newChild.label())
+	}
+
+	if s.reloadOverlap > 0 {
+		s.out.printf("both old and new workers accept during overlap window: old %s, new %s, duration=%s\n", slot.child.label(), newChild.label(), s.reloadOverlap)
+		if err := waitNewWorkerRunning(newChild, s.reloadOverlap, "overlap window"); err != nil {
+			return s.reloadFailed(slot, newChild.pid(), fmt.Errorf("error in reload after waiting overlap window of new worker pid=%d; %w", newChild.pid(), err))
+		}
+	}
+
+	if s.killOldDelay > 0 {
+		s.out.printf("waiting %s before stopping old worker %s\n", s.killOldDelay, slot.child.label())
+		if err := s.waitKillOldDelay(newChild); err != nil {
+			return s.reloadFailed(slot, newChild.pid(), fmt.Errorf("error in reload after waiting kill-old delay of new worker pid=%d; %w", newChild.pid(), err))
+		}
+	}
+
+	oldChildPID := slot.child.pid()
+	if err := s.signalChild(slot.child, s.gracefulShutdownSignalToChild); err != nil {
+		return fmt.Errorf("error in reload after sending signal %q to worker pid=%d; %w", s.gracefulShutdownSignalToChild, oldChildPID, err)
 	}
-	s.workingDirectory = wd
 
-	childCmd, err := s.startProcess()
+	if s.drainingWorkerNice != nil {
+		if err := setNice(oldChildPID, *s.drainingWorkerNice); err != nil {
+			// NOTE: We do NOT return the error here, since this is not
+			// essential for stopping the old worker.
+			s.out.eprintf("failed to set nice value of old worker pid=%d: %v\n", oldChildPID, err)
+		}
+	}
+
+	if err := s.drainOldWorkerTraced(slot.child); err != nil {
+		return fmt.Errorf("error in reload after sending signal %q to worker pid=%d; %w", s.gracefulShutdownSignalToChild, oldChildPID, err)
+	}
+
+	slot.child = newChild
+	return nil
+}
+
+// reloadSlotStopOldFirst stops the old worker in slot gracefully and then
+// starts the new worker for ReloadStopOldFirst.
+func (s *Starter) reloadSlotStopOldFirst(slot *workerSlot) error {
+	oldChildPID := slot.child.pid()
+	s.out.printf("stopping old worker before starting new worker: %s\n", slot.child.label())
+	if err := s.signalChild(slot.child, s.gracefulShutdownSignalToChild); err != nil {
+		return fmt.Errorf("error in reload after sending signal %q to worker pid=%d; %w", s.gracefulShutdownSignalToChild, oldChildPID, err)
+	}
+	if err := s.drainOldWorkerTraced(slot.child); err != nil {
+		return fmt.Errorf("error in reload after sending signal %q to worker pid=%d; %w", s.gracefulShutdownSignalToChild, oldChildPID, err)
+	}
+
+	newChild, err := s.spawnWorker(slot)
 	if err != nil {
-		return fmt.Errorf("error in RunMaster after starting worker; %v", err)
+		return fmt.Errorf("error in reload after starting new worker; %w", err)
+	}
+	s.out.printf("started new worker: %s\n", newChild.label())
+	if err := s.traced("serverstarter.wait_ready", newChild.pid(), newChild.waitReady); err != nil {
+		return fmt.Errorf("error in reload after waiting ready from new worker; %w", s.workerStartFailed(newChild, err))
+	}
+	s.out.printf("received ready from new worker: %s\n", newChild.label())
+	s.emitWorkerReady(newChild)
+	slot.child = newChild
+	return nil
+}
+
+// reloadFailure is the error returned from replaceWorker when the reload fails
+// and it is handled according to the policy set by SetReloadFailurePolicy.
+type reloadFailure struct {
+	err error
+	// fatal is true if the master should exit.
+	fatal bool
+}
+
+func (f *reloadFailure) Error() string {
+	return f.err.Error()
+}
+
+// reloadFailed reports the reload failed with err and returns the reloadFailure
+// for it.
+func (s *Starter) reloadFailed(slot *workerSlot, pid int, err error) error {
+	s.emit(Event{
+		Type:   EventReloadFailed,
+		PID:    pid,
+		Worker: slot.spec.Name,
+		Err:    err,
+	})
+	switch s.reloadFailurePolicy {
+	case ReloadFailureExit:
+		s.out.eprintf("reload failed, exiting with old worker %s left running: %v\n", slot.child.label(), err)
+	case ReloadFailureStopOldAndExit:
+		s.out.eprintf("reload failed, stopping old worker %s and exiting: %v\n", slot.child.label(), err)
+		if stopErr := s.stopAll(syscall.SIGTERM); stopErr != nil {
+			s.out.eprintf("failed to stop old workers: %v\n", stopErr)
+		}
+	default:
+		s.out.eprintf("reload failed, keeping old worker %s: %v\n", slot.child.label(), err)
+		return &reloadFailure{err: err}
 	}
-	childWaitErrC := make(chan error, 1)
-	go waitChild(childCmd, childWaitErrC)
-	fmt.Printf("started initial worker: pid=%d\n", childCmd.Process.Pid)
+	return &reloadFailure{err: err, fatal: true}
+}
 
-	if err := s.waitReady(); err != nil {
-		return fmt.Errorf("error in RunMaster after waiting ready from initial worker; %v", err)
+// killWorker kills the worker with SIGKILL if it is still running and waits for
+// it to exit. It returns the exit status of the worker as an error.
+func (s *Starter) killWorker(w *worker) error {
+	_, span := s.startSpan("serverstarter.kill")
+	span.SetAttribute("pid", w.pid())
+	defer span.End()
+	// NOTE: We ignore the error since the worker may have exited already.
+	s.signalChild(w, syscall.SIGKILL)
+	if err := <-w.waitErrC; err != nil {
+		return fmt.Errorf("worker exited with %w", err)
 	}
-	fmt.Println("received ready from initial worker")
+	return errors.New("worker exited with status 0")
+}
 
-	signals := make(chan os.Signal, 1)
-	// NOTE: The signals SIGKILL and SIGSTOP may not be caught by a program.
-	// https://golang.org/pkg/os/signal/#hdr-Types_of_signals
-	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
-	for {
-		select {
-		case sig := <-signals:
-			switch sig {
-			case syscall.SIGHUP:
-				newChildCmd, err := s.startProcess()
-				if err != nil {
-					return fmt.Errorf("error in RunMaster after starting new worker; %v", err)
-				}
-				// Recreate error channel to ignore error from old child.
-				newChildWaitErrC := make(chan error, 1)
-				go waitChild(newChildCmd, newChildWaitErrC)
-				fmt.Printf("started new worker: pid=%d\n", newChildCmd.Process.Pid)
+// workerStartFailed kills the new worker w which failed to get ready with err
+// if it is still running, and returns the WorkerStartError for it.
+func (s *Starter) workerStartFailed(w *worker, err error) *WorkerStartError {
+	exitErr := s.killWorker(w)
+	return &WorkerStartError{
+		PID:      w.pid(),
+		Name:     w.slot.spec.Name,
+		ExitCode: exitCode(errors.Unwrap(exitErr)),
+		Err:      err,
+		exitErr:  exitErr,
+	}
+}
+
+// stop stops the workers after the master receives sig.
+func (s *Starter) stop(sig os.Signal) error {
+	if err := s.stopAll(sig); err != nil {
+		return err
+	}
+	s.out.printf("stopped child process, exiting.\n")
+	return nil
+}
 
-				if err := s.waitReady(); err != nil {
-					return fmt.Errorf("error in RunMaster after waiting ready; %v", err)
+// stopAll sends SIGTERM, or the graceful shutdown signal in the init mode, to
+// all workers and waits for them to exit.
+// The workers which do not exit within the timeout set by SetMasterShutdownTimeout,
+// or before the master receives a second SIGINT or SIGTERM, are killed with SIGKILL.
+// It returns the first error if any.
+func (s *Starter) stopAll(sig os.Signal) error {
+	stopSig := syscall.SIGTERM
+	if s.initMode {
+		stopSig = s.gracefulShutdownSignalToChild
+	}
+	var firstErr error
+	var stopping []*worker
+	for _, child := range s.runningWorkers() {
+		childPID := child.pid()
+		if err := s.signalChild(child, stopSig); err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("error in RunMaster after sending %v to worker pid=%d after receiving %v; %w", stopSig, childPID, sig, err)
+			}
+			continue
+		}
+		stopping = append(stopping, child)
+	}
+	var timeout <-chan time.Time
+	if s.masterShutdownTimeout > 0 {
+		timer := time.NewTimer(s.masterShutdownTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	signals := s.signals
+	for i, child := range stopping {
+		// NOTE: We do not kill the workers which we already waited for,
+		// since their process IDs may be reused.
+		killRest := func() {
+			for _, w := range stopping[i:] {
+				s.signalChild(w, syscall.SIGKILL)
+			}
+		}
+		var err error
+	wait:
+		for {
+			select {
+			case err = <-child.waitErrC:
+				break wait
+			case <-timeout:
+				timeout = nil
+				s.out.eprintf("workers did not exit within master shutdown timeout %s, killing them\n", s.masterShutdownTimeout)
+				killRest()
+			case sig := <-signals:
+				if sig != syscall.SIGINT && sig != syscall.SIGTERM {
+					continue
 				}
-				fmt.Println("received ready from new worker")
+				signals = nil
+				s.out.eprintf("received %v again during shutdown, killing workers\n", sig)
+				killRest()
+			}
+		}
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("error from child process: %w", newWorkerExitError(child, err))
+		}
+	}
+	s.removeDetachedState()
+	return firstErr
+}
+
+// drainOldWorkerTraced calls drainOldWorker in the span for SetTracer.
+func (s *Starter) drainOldWorkerTraced(old *worker) error {
+	return s.traced("serverstarter.drain_old_worker", old.pid(), func() error {
+		return s.drainOldWorker(old)
+	})
+}
+
+// drainOldWorker waits for the old worker to exit after the graceful shutdown
+// signal is sent to it, following the decisions of the drain policy.
+func (s *Starter) drainOldWorker(old *worker) error {
+	policy := s.drainPolicy
+	if policy == nil {
+		policy = TimeoutDrainPolicy(s.childShutdownWaitTimeout)
+	}
+	pid := old.pid()
+	signaledAt := time.Now()
+	for {
+		stats := DrainStats{
+			PID:     pid,
+			Elapsed: time.Since(signaledAt),
+		}
+		// NOTE: We ignore the error since the CPU time is not available
+		// on some platforms and the worker may have exited just now.
+		stats.CPUTime, _ = processCPUTime(pid)
+		if n, err := processTCPConns(pid); err == nil {
+			stats.TCPConns, stats.TCPConnsCounted = n, true
+		}
+		stats.ActiveConns, stats.ActiveConnsReported = old.reportedActiveConns()
 
-				oldChildPID := childCmd.Process.Pid
-				if err := syscall.Kill(oldChildPID, s.gracefulShutdownSignalToChild); err != nil {
-					return fmt.Errorf("error in RunMaster after sending signal %q to worker pid=%d after receiving SIGHUP; %v", s.gracefulShutdownSignalToChild, oldChildPID, err)
+		decision, next := policy.Decide(stats)
+		switch decision {
+		case DrainWait:
+			timer := time.NewTimer(next)
+			select {
+			case <-old.drainC:
+				timer.Stop()
+				n, _ := old.reportedActiveConns()
+				elapsed := time.Since(signaledAt)
+				s.out.printf("old worker pid=%d reported %d active connections, elapsed=%s\n", pid, n, elapsed)
+				s.emit(Event{
+					Type:        EventDrainProgress,
+					PID:         pid,
+					Worker:      old.slot.spec.Name,
+					Generation:  old.generation,
+					Elapsed:     elapsed,
+					ActiveConns: n,
+				})
+			case err := <-old.waitErrC:
+				timer.Stop()
+				if err != nil {
+					// NOTE: We do NOT return the error here, since we want to
+					// move forward and make the mater process continue running.
+					s.out.eprintf("error in waiting for child to graceful shutdown: %+v\n", err)
 				}
+				s.emit(Event{
+					Type:       EventOldWorkerExited,
+					PID:        pid,
+					Worker:     old.slot.spec.Name,
+					Generation: old.generation,
+					Elapsed:    time.Since(signaledAt),
+					Err:        err,
+				})
+				return nil
+			case <-timer.C:
+			}
+
+		case DrainContinue:
+			s.out.printf("stopped waiting for old worker pid=%d to exit, elapsed=%s\n", pid, stats.Elapsed)
+			return nil
 
-				timer := time.NewTimer(s.childShutdownWaitTimeout)
+		case DrainEscalate:
+			if stats.ActiveConnsReported && stats.ActiveConns == 0 {
+				// NOTE: The old worker which reported no active connections
+				// is about to exit by itself, so we give it a grace period
+				// before killing it and do not count the exit as forced.
+				timer := time.NewTimer(drainedWorkerExitGrace)
 				select {
-				case err := <-childWaitErrC:
+				case err := <-old.waitErrC:
 					timer.Stop()
 					if err != nil {
-						// NOTE: We do NOT return the error here, since we want to
-						// move forward and make the mater process continue running.
-						fmt.Fprintf(os.Stderr, "error in waiting for child to graceful shutdown: %+v\n", err)
+						s.out.eprintf("error in waiting for child to graceful shutdown: %+v\n", err)
 					}
+					s.out.printf("old worker pid=%d exited after reporting no active connections, elapsed=%s\n", pid, time.Since(signaledAt))
+					s.emit(Event{
+						Type:       EventOldWorkerExited,
+						PID:        pid,
+						Worker:     old.slot.spec.Name,
+						Generation: old.generation,
+						Elapsed:    time.Since(signaledAt),
+						Err:        err,
+					})
+					return nil
 				case <-timer.C:
-					if err := syscall.Kill(oldChildPID, syscall.SIGKILL); err != nil {
-						return fmt.Errorf("error in RunMaster after sending signal SIGKILL to worker pid=%d after receiving SIGHUP: %+v", oldChildPID, err)
-					}
-
-					if err := <-childWaitErrC; err != nil {
-						// NOTE: We do NOT return the error here, since we want to
-						// move forward and make the mater process continue running.
-						fmt.Fprintf(os.Stderr, "error in waiting for child to be killed: %+v\n", err)
-					}
 				}
+			}
 
-				childCmd = newChildCmd
-				childWaitErrC = newChildWaitErrC
-
-			case syscall.SIGINT, syscall.SIGTERM:
-				childPID := childCmd.Process.Pid
-				if err := syscall.Kill(childPID, syscall.SIGTERM); err != nil {
-					return fmt.Errorf("error in RunMaster after sending SIGTERM to worker pid=%d after receiving %v; %v", childPID, sig, err)
-				}
-				if err := <-childWaitErrC; err != nil {
-					return fmt.Errorf("error from child process: %s", err)
-				}
-				fmt.Println("stopped child process, exiting.")
-				return nil
+			_, span := s.startSpan("serverstarter.kill")
+			span.SetAttribute("pid", pid)
+			defer span.End()
+			if err := s.signalChild(old, syscall.SIGKILL); err != nil {
+				return fmt.Errorf("error in drainOldWorker after sending signal SIGKILL to worker pid=%d: %+v", pid, err)
 			}
 
-		case err := <-childWaitErrC:
+			err := <-old.waitErrC
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "child process exited err=%v, restarting child.\n", err)
-			} else {
-				fmt.Println("child process exited without err, restarting child.")
+				// NOTE: We do NOT return the error here, since we want to
+				// move forward and make the mater process continue running.
+				s.out.eprintf("error in waiting for child to be killed: %+v\n", err)
 			}
-			// always restart child process
-			childCmd, err = s.startProcess()
+			s.out.eprintf("old worker pid=%d did not exit gracefully and was killed, elapsed=%s\n", pid, time.Since(signaledAt))
+			s.emit(Event{
+				Type:       EventOldWorkerExited,
+				PID:        pid,
+				Worker:     old.slot.spec.Name,
+				Generation: old.generation,
+				Forced:     true,
+				Elapsed:    time.Since(signaledAt),
+				Err:        err,
+			})
+			return nil
+
+		default:
+			return fmt.Errorf("invalid drain decision %d for worker pid=%d", decision, pid)
+		}
+	}
+}
+
+// waitWarm waits for the new worker to send warm while keeping the old worker running.
+// It returns false if the new worker exits before sending warm, and returns true
+// otherwise.
+func (s *Starter) waitWarm(newChild *worker) bool {
+	timer := time.NewTimer(s.keepOldUntilWarmTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case msg, ok := <-newChild.msgC:
+			if !ok {
+				newChild.msgC = nil
+				continue
+			}
+			switch msg {
+			case warmByte:
+				s.out.printf("received warm from new worker: pid=%d, elapsed=%s\n", newChild.pid(), time.Since(newChild.startedAt))
+				return true
+			case recycleByte:
+				newChild.requestRecycle()
+			case reloadRequestByte:
+				s.out.printf("ignored reload request from new worker during reload: pid=%d\n", newChild.pid())
+			case listenRequestByte:
+				s.handleListenRequests(newChild)
+			}
+		case err := <-newChild.waitErrC:
+			s.out.eprintf("new worker pid=%d exited before sending warm, err=%v, keeping old worker.\n", newChild.pid(), err)
+			return false
+		case <-timer.C:
+			s.out.eprintf("timeout waiting warm from new worker: pid=%d, stopping old worker anyway.\n", newChild.pid())
+			return true
+		}
+	}
+}
+
+// waitKillOldDelay waits for the delay set by SetKillOldDelay before stopping
+// the old worker. It returns an error if the new worker exits during the delay.
+// A SIGINT, a SIGTERM or the control command "stop" ends the delay early.
+// The signals other than SIGHUP and the control requests received during
+// the delay are deferred, so that they are handled after the reload.
+func (s *Starter) waitKillOldDelay(newChild *worker) error {
+	timer := time.NewTimer(s.killOldDelay)
+	defer timer.Stop()
+	for {
+		select {
+		case err := <-newChild.waitErrC:
 			if err != nil {
-				return fmt.Errorf("error in RunMaster after restarting worker; %v", err)
+				return fmt.Errorf("new worker exited during kill-old delay with %w", err)
+			}
+			return errors.New("new worker exited during kill-old delay with status 0")
+		case sig := <-s.signals:
+			if sig == syscall.SIGHUP {
+				s.out.printf("received SIGHUP during kill-old delay, merged with reload in progress\n")
+				continue
+			}
+			s.deferredSignals = append(s.deferredSignals, sig)
+			if sig == syscall.SIGINT || sig == syscall.SIGTERM {
+				s.out.printf("received %s during kill-old delay, stopping old worker now\n", sig)
+				return nil
 			}
-			childWaitErrC = make(chan error, 1)
-			go waitChild(childCmd, childWaitErrC)
-			fmt.Printf("restarted worker: pid=%d\n", childCmd.Process.Pid)
+		case req := <-s.controlRequests:
+			s.deferredRequests = append(s.deferredRequests, req)
+			if commandName(req.command) == "stop" {
+				s.out.printf("received control command %q during kill-old delay, stopping old worker now\n", req.command)
+				return nil
+			}
+		case <-timer.C:
+			return nil
 		}
 	}
 }
 
-func (s *Starter) startProcess() (cmd *exec.Cmd, err error) {
-	// This code is based on
-	// https://github.com/facebookgo/grace/blob/4afe952a37a495ae4ac0c1d4ce5f66e91058d149/gracenet/net.go#L201-L248
-	// https://github.com/cloudflare/tableflip/blob/78281f93d0754df1263259949d2468c5d0376dc6/child.go#L20-L76
+// waitNewWorkerRunning waits for the duration d while the new worker is running.
+// It returns an error if the new worker exits during the period.
+func waitNewWorkerRunning(newChild *worker, d time.Duration, period string) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case err := <-newChild.waitErrC:
+		if err != nil {
+			return fmt.Errorf("new worker exited during %s with %w", period, err)
+		}
+		return fmt.Errorf("new worker exited during %s with status 0", period)
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (s *Starter) startWorker(slot *workerSlot) (*worker, error) {
+	w := &worker{
+		out:        &s.out,
+		slot:       slot,
+		generation: s.nextGeneration(),
+		waitErrC:   make(chan error, 1),
+		msgC:       make(chan byte, 2),
+		drainC:     make(chan struct{}, 1),
+	}
+	w.pendingReadyListeners = s.pendingReadyListeners(slot)
+	if s.workerTempDirEnabled {
+		dir, err := ioutil.TempDir(s.workerTempDirParent, "serverstarter-worker-")
+		if err != nil {
+			return nil, fmt.Errorf("error in startWorker after creating temporary directory; %w", err)
+		}
+		w.tempDir = dir
+		if c := s.workerCredential; c != nil {
+			if err := os.Chown(dir, int(c.uid), int(c.gid)); err != nil {
+				w.removeTempDir()
+				return nil, fmt.Errorf("error in startWorker after changing owner of temporary directory; %w", err)
+			}
+		}
+	}
+
+	process, readyR, err := s.startProcess(w)
+	if err != nil {
+		w.removeTempDir()
+		return nil, err
+	}
+	w.process = process
+	w.startedAt = time.Now()
+	s.setRetireTime(w)
+	if err := s.configureWorkerProcess(w.pid()); err != nil {
+		process.Signal(syscall.SIGKILL)
+		process.Wait()
+		readyR.Close()
+		w.closeAck()
+		w.removeTempDir()
+		return nil, fmt.Errorf("error in startWorker after configuring worker pid=%d; %w", w.pid(), err)
+	}
+	w.msgR = readyR
+	if s.einhornEnv {
+		s.registerEinhornWorker(w)
+	}
+	go w.wait()
+	go w.readMessages(readyR)
+	s.recordDetachedWorker(w.pid())
+	s.emit(Event{
+		Type:       EventWorkerStarted,
+		PID:        w.pid(),
+		Worker:     slot.spec.Name,
+		Generation: w.generation,
+	})
+	return w, nil
+}
+
+// spawnWorker starts a new worker for slot in the span for SetTracer.
+func (s *Starter) spawnWorker(slot *workerSlot) (*worker, error) {
+	_, span := s.startSpan("serverstarter.spawn")
+	w, err := s.startWorker(slot)
+	if err == nil {
+		span.SetAttribute("pid", w.pid())
+	}
+	endSpan(span, err)
+	return w, err
+}
+
+// recycleWorker reloads the worker in slot for the reason. If the reload fails
+// and the old worker is kept, the master tries again after recycleRetryInterval.
+// It returns an error only if the master should exit.
+func (s *Starter) recycleWorker(slot *workerSlot, reason string) error {
+	old := slot.child
+	s.out.printf("recycling worker %s: %s\n", old.label(), reason)
+	result, err := s.reloadSlot(slot)
+	s.setLastReload([]ReloadResult{result})
+	if err != nil {
+		return fmt.Errorf("error in RunMaster after recycling worker; %w", err)
+	}
+	if slot.child == old {
+		old.recycleHeldUntil = time.Now().Add(recycleRetryInterval)
+		s.out.printf("kept worker %s, recycling again after %s\n", old.label(), recycleRetryInterval)
+		return nil
+	}
+	s.out.printf("finished recycling worker\n")
+	return nil
+}
+
+// replaceRetiringWorker starts the replacement of the worker in slot which sent
+// the retirement notice with SendRetiring, and waits for the old worker to exit
+// by itself after the replacement gets ready. If the replacement fails to get
+// ready, the old worker is restarted as usual when it exits.
+// It returns an error only if the master should exit.
+func (s *Starter) replaceRetiringWorker(slot *workerSlot) error {
+	s.setBusy(true)
+	defer s.setBusy(false)
+
+	old := slot.child
+	newChild, err := s.spawnWorker(slot)
+	if err != nil {
+		s.out.eprintf("failed to start replacement of retiring worker %s: %v\n", old.label(), err)
+		return nil
+	}
+	s.out.printf("started replacement worker: %s\n", newChild.label())
+	if err := newChild.waitReady(); err != nil {
+		s.out.eprintf("failed to wait ready from replacement worker: %v\n", s.workerStartFailed(newChild, err))
+		return nil
+	}
+	s.out.printf("received ready from replacement worker: %s\n", newChild.label())
+	s.emitWorkerReady(newChild)
+
+	slot.child = newChild
+	if err := s.drainOldWorker(old); err != nil {
+		return fmt.Errorf("error in RunMaster after waiting retiring worker pid=%d to exit; %w", old.pid(), err)
+	}
+	s.out.printf("finished replacing retiring worker\n")
+	return nil
+}
 
-	// These pipes are used for communication between parent and child
-	// readyW is passed to the child, readyR stays with the parent
-	readyR, readyW, err := os.Pipe()
+// restartRetiredWorker starts the replacement of the worker in slot which
+// exited after sending the retirement notice with SendRetiring before its
+// replacement got ready. Unlike a crash, the exit is not reported with
+// EventWorkerExited.
+func (s *Starter) restartRetiredWorker(slot *workerSlot) error {
+	s.out.printf("retiring worker exited, starting replacement: %s\n", slot.child.label())
+	child, err := s.startWorker(slot)
 	if err != nil {
-		return nil, fmt.Errorf("pipe failed in startProcess; %v", err)
+		s.slots = removeSlot(s.slots, slot)
+		s.stopAll(syscall.SIGTERM)
+		return fmt.Errorf("error in RunMaster after starting replacement of retiring worker; %w", err)
 	}
-	s.readyPipeR = readyR
+	slot.child = child
+	s.out.printf("started replacement worker: %s\n", child.label())
+	return nil
+}
+
+// emitWorkerReady emits EventWorkerReady for the worker w.
+func (s *Starter) emitWorkerReady(w *worker) {
+	s.emit(Event{
+		Type:       EventWorkerReady,
+		PID:        w.pid(),
+		Worker:     w.slot.spec.Name,
+		Generation: w.generation,
+		Elapsed:    time.Since(w.startedAt),
+	})
+}
+
+// emitWorkerExited emits EventWorkerExited for the worker w which exited with err.
+func (s *Starter) emitWorkerExited(w *worker, err error) {
+	s.emit(Event{
+		Type:       EventWorkerExited,
+		PID:        w.pid(),
+		Worker:     w.slot.spec.Name,
+		Generation: w.generation,
+		Err:        err,
+	})
+}
 
-	type filer interface {
-		File() (*os.File, error)
+// configureWorkerProcess applies the settings which are applied to a worker
+// process after it is started.
+func (s *Starter) configureWorkerProcess(pid int) error {
+	if s.workerOOMScoreAdj != nil {
+		if err := setOOMScoreAdj(pid, *s.workerOOMScoreAdj); err != nil {
+			return err
+		}
 	}
+	if s.workerNice != nil {
+		if err := setNice(pid, *s.workerNice); err != nil {
+			return err
+		}
+	}
+	if len(s.workerCPUAffinity) > 0 {
+		if err := setCPUAffinity(pid, s.workerCPUAffinity); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Starter) startProcess(w *worker) (process Process, readyR *os.File, err error) {
+	// This code is based on
+	// https://github.com/facebookgo/grace/blob/4afe952a37a495ae4ac0c1d4ce5f66e91058d149/gracenet/net.go#L201-L248
+	// https://github.com/cloudflare/tableflip/blob/78281f93d0754df1263259949d2468c5d0376dc6/child.go#L20-L76
 
-	files := make([]*os.File, 1+len(s.listeners))
-	files[0] = readyW
-	for i, l := range s.listeners {
-		f, err := l.(filer).File()
+	// This socket pair is used for communication between parent and child.
+	// readyW is passed to the child, readyR stays with the parent.
+	// NOTE: The socket is also used for passing the file descriptors if
+	// SetPassFDsOverSocket is set.
+	readyR, readyW, err := socketPair()
+	if err != nil {
+		return nil, nil, fmt.Errorf("socketpair failed in startProcess; %w", err)
+	}
+	defer func() {
 		if err != nil {
-			return nil, fmt.Errorf("error in startProcess after getting file from listener; %v", err)
+			readyR.Close()
+			readyW.Close()
 		}
-		files[1+i] = f
-		defer files[1+i].Close()
+	}()
+
+	// NOTE: The nil files are closed in the worker.
+	files := make([]*os.File, s.firstFD-stdFdCount, s.firstFD-stdFdCount+1+len(w.slot.listenerFiles)+len(s.packetConnFiles)+len(s.sctpFiles)+len(s.extraFiles))
+	files = append(files, readyW)
+	if !s.passFDsOverSocket {
+		files = append(files, w.slot.listenerFiles...)
+		files = append(files, s.packetConnFiles...)
+		files = append(files, s.sctpFiles...)
+		files = append(files, s.extraFiles...)
+		files = append(files, s.logPipes()...)
 	}
 
 	// Use the original binary location. This works with symlinks such that if
 	// the file it points to has been changed we will use the updated symlink.
-	argv0, err := exec.LookPath(os.Args[0])
+	argv0, err := s.workerBinaryPath(w.slot)
 	if err != nil {
-		return nil, fmt.Errorf("error in startProcess after looking path of the original binary location; %v", err)
+		return nil, nil, fmt.Errorf("error in startProcess after looking path of the worker binary location; %w", err)
 	}
+	var checksum string
+	if s.binaryChecksumPolicy != BinaryChecksumOff {
+		if checksum, err = fileChecksum(argv0); err != nil {
+			return nil, nil, fmt.Errorf("error in startProcess after calculating checksum of worker binary; %w", err)
+		}
+		if err = s.verifyBinaryChecksum(argv0, checksum); err != nil {
+			return nil, nil, fmt.Errorf("error in startProcess after verifying checksum of worker binary; %w", err)
+		}
+	}
+	binaryPath := argv0
 
-	// Pass on the environment and replace the old count key with the new one.
-	envListenFDsPrefix := s.envListenFDs + "="
-	var env []string
-	for _, v := range os.Environ() {
-		if !strings.HasPrefix(v, envListenFDsPrefix) {
-			env = append(env, v)
+	env, err := s.workerEnv(w)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error in startProcess after building environment variables; %w", err)
+	}
+
+	args, err := s.workerCommandArgs(w.slot, w.generation)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error in startProcess after getting worker arguments; %w", err)
+	}
+	if len(s.workerWrapper) > 0 {
+		// NOTE: We pass the absolute path of the binary to the wrapper,
+		// since the wrapper may change the working directory.
+		binary, err := filepath.Abs(argv0)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error in startProcess after getting absolute path of the worker binary location; %w", err)
 		}
+		wrapperArgs := make([]string, 0, len(s.workerWrapper)+len(args))
+		wrapperArgs = append(wrapperArgs, s.workerWrapper[1:]...)
+		wrapperArgs = append(wrapperArgs, binary)
+		args = append(wrapperArgs, args...)
+		argv0 = s.workerWrapper[0]
 	}
-	envFDs := strconv.AppendInt([]byte(envListenFDsPrefix), int64(len(s.listeners)), 10)
-	env = append(env, string(envFDs))
 
-	cmd = exec.Command(argv0, os.Args[1:]...)
+	cmd := exec.Command(argv0, args...)
+	if s.processTitle != "" {
+		cmd.Args[0] = s.workerProcessTitle(w)
+	}
 	cmd.Env = env
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
+	if s.workerLogDir != "" {
+		logFile, err := s.openWorkerLogFile(w)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error in startProcess after opening worker log file; %w", err)
+		}
+		// NOTE: The worker has its own copy of the file descriptor after starting.
+		defer logFile.Close()
+		cmd.Stdout = logFile
+		cmd.Stderr = logFile
+	}
 	cmd.ExtraFiles = files
-	err = cmd.Start()
+	cmd.SysProcAttr = s.workerSysProcAttr()
+	if s.workerChroot != "" {
+		// NOTE: The working directory must be changed after chroot, otherwise
+		// the worker would be able to access files outside the new root directory.
+		// The path of the executable must be absolute since it is resolved after that.
+		cmd.Dir = "/"
+		if cmd.Path, err = filepath.Abs(cmd.Path); err != nil {
+			return nil, nil, fmt.Errorf("error in startProcess after getting absolute path of the executable; %w", err)
+		}
+	}
+	if len(s.workerRlimits) > 0 {
+		if err = s.useRlimitTrampoline(cmd); err != nil {
+			return nil, nil, fmt.Errorf("error in startProcess after setting resource limits; %w", err)
+		}
+	}
+	process, err = s.runner().Start(cmd)
 	if err != nil {
-		return nil, fmt.Errorf("error in startProcess after starting worker process; %v", err)
+		return nil, nil, fmt.Errorf("error in startProcess after starting worker process; %w", err)
+	}
+	if s.binaryChecksumPolicy != BinaryChecksumOff {
+		if err = s.verifyBinaryUnchanged(binaryPath, checksum); err != nil {
+			process.Signal(syscall.SIGKILL)
+			process.Wait()
+			return nil, nil, fmt.Errorf("error in startProcess after verifying worker binary pid=%d; %w", process.Pid(), err)
+		}
+		s.out.printf("verified worker binary %s sha256=%s\n", binaryPath, checksum)
+	}
+
+	if s.passFDsOverSocket {
+		if err = sendFDsToWorker(readyR, w.slot.listenerFiles, s.packetConnFiles, s.sctpFiles, s.extraFiles, s.logPipes()); err != nil {
+			process.Signal(syscall.SIGKILL)
+			process.Wait()
+			return nil, nil, fmt.Errorf("error in startProcess after passing file descriptors to worker pid=%d; %w", process.Pid(), err)
+		}
 	}
 
 	// NOTE: This is needed to avoid pipe fd leak.
-	readyW.Close()
+	if s.einhornEnv {
+		w.ackW = readyW
+	} else {
+		readyW.Close()
+	}
+
+	return process, readyR, nil
+}
+
+// workerEnv returns the environment variables for the worker w.
+func (s *Starter) workerEnv(w *worker) ([]string, error) {
+	// Pass on the environment and replace the keys set by the master with the new values.
+	set := []string{
+		s.envListenFDs + "=" + strconv.Itoa(len(w.slot.listenerFiles)),
+		envGeneration + "=" + strconv.Itoa(w.generation),
+	}
+	if len(s.packetConnFiles) > 0 {
+		set = append(set, envPacketFDs+"="+strconv.Itoa(len(s.packetConnFiles)))
+	}
+	if len(s.sctpFiles) > 0 {
+		set = append(set, envSCTPFDs+"="+strconv.Itoa(len(s.sctpFiles)))
+	}
+	if len(s.extraFiles) > 0 {
+		set = append(set, envExtraFDs+"="+strconv.Itoa(len(s.extraFiles)))
+		names := make([]string, len(s.extraFiles))
+		for i, f := range s.extraFiles {
+			names[i] = f.Name()
+		}
+		data, err := json.Marshal(names)
+		if err != nil {
+			return nil, fmt.Errorf("error in workerEnv after encoding extra file names; %w", err)
+		}
+		set = append(set, envExtraFDNames+"="+string(data))
+	}
+	if len(s.logFiles) > 0 {
+		set = append(set, envLogFDs+"="+strconv.Itoa(len(s.logFiles)))
+	}
+	set = append(set, envShutdownSignal+"="+strconv.Itoa(int(s.gracefulShutdownSignalToChild)))
+	if s.drainPolicy == nil {
+		set = append(set, envShutdownTimeout+"="+s.childShutdownWaitTimeout.String())
+	}
+	manifest, err := json.Marshal(s.fdManifest(w.slot))
+	if err != nil {
+		return nil, fmt.Errorf("error in workerEnv after encoding manifest; %w", err)
+	}
+	set = append(set, envFDManifest+"="+string(manifest))
+	if s.passFDsOverSocket {
+		// NOTE: The socket is at the first file descriptor.
+		set = append(set, envFDSocket+"="+strconv.Itoa(s.firstFD))
+	}
+	set = append(set, envMasterPID+"="+strconv.Itoa(os.Getpid()))
+	set = append(set, envProtocolVersion+"="+strconv.Itoa(protocolVersion))
+	if s.firstFD != stdFdCount {
+		set = append(set, envFirstFD+"="+strconv.Itoa(s.firstFD))
+	}
+	if s.workerCount > 1 {
+		set = append(set, envWorkerIndex+"="+strconv.Itoa(w.slot.poolIndex))
+	}
+	if s.serverStarterEnv {
+		addrs := make([]net.Addr, len(w.slot.listenerIndexes))
+		for i, index := range w.slot.listenerIndexes {
+			addrs[i] = s.listeners[index].Addr()
+		}
+		// NOTE: The listeners follow the pipe to the master.
+		set = append(set, envServerStarterPort+"="+serverStarterPort(addrs, s.firstFD+1))
+		set = append(set, envServerStarterGeneration+"="+strconv.Itoa(w.generation))
+	}
+	if s.einhornEnv {
+		// NOTE: The listeners follow the pipe to the master.
+		set = append(set, einhornEnv(len(w.slot.listenerFiles), s.firstFD+1, s.einhornSockPath)...)
+	}
+	if w.tempDir != "" {
+		set = append(set, "TMPDIR="+w.tempDir)
+	}
+	return s.buildEnv(w.slot, w.generation, set)
+}
+
+// buildEnv returns the environment variables for a process of the worker program
+// in slot, which consist of the filtered environment variables of the master,
+// the extra environment variables and set.
+func (s *Starter) buildEnv(slot *workerSlot, generation int, set []string) ([]string, error) {
+	drop := map[string]bool{
+		s.envListenFDs:             true,
+		envExtraFDs:                true,
+		envPacketFDs:               true,
+		envSCTPFDs:                 true,
+		envExtraFDNames:            true,
+		envLogFDs:                  true,
+		envGeneration:              true,
+		envShutdownSignal:          true,
+		envShutdownTimeout:         true,
+		envMasterState:             true,
+		envFDSocket:                true,
+		envFDManifest:              true,
+		envFirstFD:                 true,
+		envMasterPID:               true,
+		envProtocolVersion:         true,
+		envWorkerIndex:             true,
+		envServerStarterPort:       true,
+		envServerStarterGeneration: true,
+	}
+	for _, v := range set {
+		drop[envKey(v)] = true
+	}
+
+	extraEnv, err := s.extraEnv(slot, generation)
+	if err != nil {
+		return nil, fmt.Errorf("error in buildEnv after getting extra environment variables; %w", err)
+	}
+	var extra []string
+	for _, v := range extraEnv {
+		if !drop[envKey(v)] {
+			extra = append(extra, v)
+		}
+	}
+	for _, v := range extra {
+		drop[envKey(v)] = true
+	}
+
+	var env []string
+	for _, v := range os.Environ() {
+		key := envKey(v)
+		if drop[key] || (s.einhornEnv && strings.HasPrefix(key, "EINHORN_")) {
+			continue
+		}
+		passed, err := s.envPassed(key)
+		if err != nil {
+			return nil, fmt.Errorf("error in buildEnv after filtering environment variables; %w", err)
+		}
+		if passed {
+			env = append(env, v)
+		}
+	}
+	env = append(env, extra...)
+	env = append(env, set...)
+	return env, nil
+}
+
+// workerBinaryPath returns the path of the executable of the worker program in slot.
+func (s *Starter) workerBinaryPath(slot *workerSlot) (string, error) {
+	workerBinary := os.Args[0]
+	if slot.spec.Binary != "" {
+		workerBinary = slot.spec.Binary
+	} else if s.workerBinary != "" {
+		workerBinary = s.workerBinary
+	}
+	return exec.LookPath(workerBinary)
+}
+
+// newWorkerExitError returns the error for the exit of the worker w with
+// the error err returned from waiting for it.
+func newWorkerExitError(w *worker, err error) *WorkerExitError {
+	e := &WorkerExitError{PID: w.pid(), Name: w.slot.spec.Name, ExitCode: exitCode(err), Err: err}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			e.Signal = status.Signal()
+		}
+	}
+	return e
+}
+
+// exitCode returns the exit code of the process from the error returned from
+// waiting for it, or -1 if the process did not exit normally.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	// NOTE: *exec.ExitError and the errors of the Process of a ProcessRunner
+	// have ExitCode.
+	var exitErr interface{ ExitCode() int }
+	if !errors.As(err, &exitErr) {
+		return -1
+	}
+	return exitErr.ExitCode()
+}
+
+// envKey returns the key of the environment variable v in the form "key=value".
+func envKey(v string) string {
+	if i := strings.IndexByte(v, '='); i != -1 {
+		return v[:i]
+	}
+	return v
+}
+
+// filer is a socket which has the File method.
+type filer interface {
+	File() (*os.File, error)
+}
+
+// listenerFiles returns the duplicated files of the listeners.
+func listenerFiles(listeners []net.Listener) ([]*os.File, error) {
+	files := make([]*os.File, len(listeners))
+	for i, l := range listeners {
+		fl, ok := l.(filer)
+		if !ok {
+			closeFiles(files[:i])
+			return nil, fmt.Errorf("listener %d of type %T does not have File method", i, l)
+		}
+		f, err := fl.File()
+		if err != nil {
+			closeFiles(files[:i])
+			return nil, fmt.Errorf("error in listenerFiles after getting file from listener; %w", err)
+		}
+		files[i] = f
+	}
+	return files, nil
+}
+
+// packetConnFiles returns the duplicated files of the packet connections.
+func packetConnFiles(conns []net.PacketConn) ([]*os.File, error) {
+	files := make([]*os.File, len(conns))
+	for i, c := range conns {
+		fc, ok := c.(filer)
+		if !ok {
+			closeFiles(files[:i])
+			return nil, fmt.Errorf("packet connection %d of type %T does not have File method", i, c)
+		}
+		f, err := fc.File()
+		if err != nil {
+			closeFiles(files[:i])
+			return nil, fmt.Errorf("error in packetConnFiles after getting file from packet connection; %w", err)
+		}
+		files[i] = f
+	}
+	return files, nil
+}
 
-	return cmd, nil
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
 }
 
-func waitChild(cmd *exec.Cmd, errC chan<- error) {
-	errC <- cmd.Wait()
+// workerSysProcAttr returns the attributes for starting a worker process.
+func (s *Starter) workerSysProcAttr() *syscall.SysProcAttr {
+	attr := &syscall.SysProcAttr{}
+	if c := s.workerCredential; c != nil {
+		attr.Credential = &syscall.Credential{
+			Uid:    c.uid,
+			Gid:    c.gid,
+			Groups: c.groups,
+		}
+	}
+	attr.Chroot = s.workerChroot
+	if s.detachedStateFile != "" {
+		attr.Setsid = true
+	} else if s.signalWorkerProcessGroup {
+		// NOTE: We start the worker in its own process group only with
+		// SetSignalWorkerProcessGroup, since otherwise the worker would not
+		// receive the signals sent to the process group of the master, for
+		// example a SIGINT from the terminal or a SIGKILL from a supervisor.
+		attr.Setpgid = true
+	}
+	if s.workerPdeathsig != 0 {
+		// NOTE: Go starts processes on threads which are never terminated
+		// unless locked with runtime.LockOSThread, so the worker does not
+		// receive the signal when the thread which started it exits.
+		setPdeathsig(attr, s.workerPdeathsig)
+	}
+	return attr
 }
@@ -0,0 +1,1737 @@
+//go:build !windows
+
+package serverstarter
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/syslog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func init() {
+	helpers["simple"] = simpleHelper
+	helpers["manylisteners"] = manyListenersHelper
+}
+
+// readyDelayEnv is the environment variable for the duration which the worker
+// of simpleHelper waits before sending ready.
+const readyDelayEnv = "SERVERSTARTER_TEST_READY_DELAY"
+
+// failReadyFileEnv is the environment variable for the path of the file which
+// makes the worker of simpleHelper exit without sending ready if it exists.
+const failReadyFileEnv = "SERVERSTARTER_TEST_FAIL_READY_FILE"
+
+// crashAfterReadyFileEnv is the environment variable for the path of the file
+// which makes the worker of simpleHelper exit just after sending ready if it exists.
+const crashAfterReadyFileEnv = "SERVERSTARTER_TEST_CRASH_AFTER_READY_FILE"
+
+// noRestartExitCodeEnv is the environment variable for the exit code which
+// the master of simpleHelper sets with SetNoRestartExitCode. The worker exits
+// with it instead of 1 when it crashes after sending ready.
+const noRestartExitCodeEnv = "SERVERSTARTER_TEST_NO_RESTART_EXIT_CODE"
+
+// noListenersEnv is the environment variable which makes the master of
+// simpleHelper run without listeners if it is set.
+const noListenersEnv = "SERVERSTARTER_TEST_NO_LISTENERS"
+
+// probationEnv is the environment variable for the probation period
+// which the master of simpleHelper sets with SetNewWorkerProbation.
+const probationEnv = "SERVERSTARTER_TEST_PROBATION"
+
+// reloadFailurePolicyEnv is the environment variable for the policy which
+// the master of simpleHelper sets with SetReloadFailurePolicy.
+const reloadFailurePolicyEnv = "SERVERSTARTER_TEST_RELOAD_FAILURE_POLICY"
+
+// reloadDebounceEnv is the environment variable for the duration which
+// the master of simpleHelper sets with SetReloadDebounce.
+const reloadDebounceEnv = "SERVERSTARTER_TEST_RELOAD_DEBOUNCE"
+
+// killOldDelayEnv is the environment variable for the delay which the master
+// of simpleHelper sets with SetKillOldDelay.
+const killOldDelayEnv = "SERVERSTARTER_TEST_KILL_OLD_DELAY"
+
+// masterShutdownTimeoutEnv is the environment variable for the timeout which
+// the master of simpleHelper sets with SetMasterShutdownTimeout.
+const masterShutdownTimeoutEnv = "SERVERSTARTER_TEST_MASTER_SHUTDOWN_TIMEOUT"
+
+// ignoreSIGTERMEnv is the environment variable which makes the worker of
+// simpleHelper ignore SIGTERM after sending ready if it is set.
+const ignoreSIGTERMEnv = "SERVERSTARTER_TEST_IGNORE_SIGTERM"
+
+// workerPdeathsigEnv is the environment variable which makes the master of
+// simpleHelper set SIGTERM with SetWorkerPdeathsig if it is set.
+const workerPdeathsigEnv = "SERVERSTARTER_TEST_WORKER_PDEATHSIG"
+
+// detachedStateFileEnv is the environment variable for the state file which
+// the master of simpleHelper sets with SetDetachedWorkers.
+const detachedStateFileEnv = "SERVERSTARTER_TEST_DETACHED_STATE_FILE"
+
+// childSubreaperEnv is the environment variable which makes the master of
+// simpleHelper a child subreaper with SetChildSubreaper, and the worker spawn
+// a process which exits after the worker exits, if it is set.
+const childSubreaperEnv = "SERVERSTARTER_TEST_CHILD_SUBREAPER"
+
+// initModeEnv is the environment variable which makes the master of simpleHelper
+// run in the init mode with SetInitMode and SIGINT for the graceful shutdown
+// signal if it is set.
+const initModeEnv = "SERVERSTARTER_TEST_INIT_MODE"
+
+// processGroupEnv is the environment variable which makes the master of
+// simpleHelper signal the process groups of workers with SetSignalWorkerProcessGroup,
+// and the worker start a helper process, if it is set.
+const processGroupEnv = "SERVERSTARTER_TEST_PROCESS_GROUP"
+
+// processTitleEnv is the environment variable which makes the master of
+// simpleHelper set process titles with SetProcessTitle if it is set.
+const processTitleEnv = "SERVERSTARTER_TEST_PROCESS_TITLE"
+
+// outputFileEnv is the environment variable for the path of the file to which
+// the master of simpleHelper writes its messages with SetOutput.
+const outputFileEnv = "SERVERSTARTER_TEST_OUTPUT_FILE"
+
+// syslogAddrEnv is the environment variable for the address of the unixgram
+// socket to which the master of simpleHelper sends its messages with SetSyslog.
+const syslogAddrEnv = "SERVERSTARTER_TEST_SYSLOG_ADDR"
+
+// workerLogDirEnv is the environment variable for the directory to which
+// the master of simpleHelper redirects the output of workers with SetWorkerLogDir.
+const workerLogDirEnv = "SERVERSTARTER_TEST_WORKER_LOG_DIR"
+
+// webhookURLEnv is the environment variable for the URL to which the master
+// of simpleHelper sends notifications with SetWebhookURL.
+const webhookURLEnv = "SERVERSTARTER_TEST_WEBHOOK_URL"
+
+// eventHooksEnv is the environment variable which makes the master of
+// simpleHelper set hooks with SetEventHook if it is set.
+const eventHooksEnv = "SERVERSTARTER_TEST_EVENT_HOOK"
+
+// tracerEnv is the environment variable which makes the master of simpleHelper
+// print the ended spans with SetTracer if it is set.
+const tracerEnv = "SERVERSTARTER_TEST_TRACER"
+
+// maxWorkerLifetimeEnv is the environment variable for the duration set with
+// SetMaxWorkerLifetime for the master of simpleHelper.
+const maxWorkerLifetimeEnv = "SERVERSTARTER_TEST_MAX_WORKER_LIFETIME"
+
+// maxWorkerRSSEnv is the environment variable for the RSS limit in bytes set
+// with SetMaxWorkerRSS for the master of simpleHelper.
+const maxWorkerRSSEnv = "SERVERSTARTER_TEST_MAX_WORKER_RSS"
+
+// requestRecycleEnv is the environment variable which makes the worker of
+// simpleHelper of the first generation call RequestRecycle after SendReady
+// if it is set.
+const requestRecycleEnv = "SERVERSTARTER_TEST_REQUEST_RECYCLE"
+
+// requestReloadEnv is the environment variable which makes the worker of
+// simpleHelper of the first generation call RequestReload after SendReady
+// if it is set.
+const requestReloadEnv = "SERVERSTARTER_TEST_REQUEST_RELOAD"
+
+// sendRetiringEnv is the environment variable which makes the worker of
+// simpleHelper of the first generation call SendRetiring after SendReady
+// and exit shortly after that if it is set.
+const sendRetiringEnv = "SERVERSTARTER_TEST_SEND_RETIRING"
+
+// heartbeatEnv is the environment variable which makes the worker of
+// simpleHelper send metadata and a heartbeat after SendReady if it is set.
+const heartbeatEnv = "SERVERSTARTER_TEST_HEARTBEAT"
+
+// requestListenEnv is the environment variable which makes the worker of
+// simpleHelper of the first generation call RequestListen and RequestReload
+// after SendReady if it is set.
+const requestListenEnv = "SERVERSTARTER_TEST_REQUEST_LISTEN"
+
+// controlSocketEnv is the environment variable for the path of the control
+// socket set with SetControlSocket for the master of simpleHelper.
+const controlSocketEnv = "SERVERSTARTER_TEST_CONTROL_SOCKET"
+
+// listenerGroupsEnv is the environment variable which makes the master of
+// simpleHelper bind two listeners in the listener groups "public" and "admin"
+// served by the worker programs with the same names if it is set.
+const listenerGroupsEnv = "SERVERSTARTER_TEST_LISTENER_GROUPS"
+
+// workerPoolEnv is the environment variable which makes the master of
+// simpleHelper bind two listeners and run two workers with one listener each
+// if it is set.
+const workerPoolEnv = "SERVERSTARTER_TEST_WORKER_POOL"
+
+// reusePortPoolEnv is the environment variable which makes the master of
+// simpleHelper bind the listener with SO_REUSEPORT and run two workers with
+// a socket each if it is set.
+const reusePortPoolEnv = "SERVERSTARTER_TEST_REUSE_PORT_POOL"
+
+// serverStarterEnvEnv is the environment variable which makes simpleHelper use
+// SetServerStarterEnv and the worker print SERVER_STARTER_PORT if it is set.
+const serverStarterEnvEnv = "SERVERSTARTER_TEST_SERVER_STARTER_ENV"
+
+// einhornEnvEnv is the environment variable which makes simpleHelper use
+// SetEinhornEnv and the worker send the ACK of Einhorn instead of SendReady
+// if it is set.
+const einhornEnvEnv = "SERVERSTARTER_TEST_EINHORN_ENV"
+
+// nginxSignalsEnv is the environment variable which makes simpleHelper use
+// SetNginxSignals and the worker print SIGHUPs if it is set.
+const nginxSignalsEnv = "SERVERSTARTER_TEST_NGINX_SIGNALS"
+
+// workerRlimitNofileEnv is the environment variable for RLIMIT_NOFILE which
+// the master of simpleHelper sets with SetWorkerRlimits, and makes the worker
+// print the limit at the initialization if it is set.
+const workerRlimitNofileEnv = "SERVERSTARTER_TEST_WORKER_RLIMIT_NOFILE"
+
+// listenAddrEnv is the environment variable for the address in the form of
+// ParseListenAddress on which the master of simpleHelper listens instead of
+// a random port, since the new master started by SetMasterUpgrade or
+// SetTakeoverSocket looks up the listener by the address.
+const listenAddrEnv = "SERVERSTARTER_TEST_LISTEN_ADDR"
+
+// masterUpgradeEnv is the environment variable which makes the master of
+// simpleHelper use SetMasterUpgrade if it is set.
+const masterUpgradeEnv = "SERVERSTARTER_TEST_MASTER_UPGRADE"
+
+// takeoverSocketEnv is the environment variable for the path of the socket
+// which the master of simpleHelper sets with SetTakeoverSocket.
+const takeoverSocketEnv = "SERVERSTARTER_TEST_TAKEOVER_SOCKET"
+
+// initialNofile is RLIMIT_NOFILE of this process at the initialization of
+// the package, before the worker code runs.
+var initialNofile = func() syscall.Rlimit {
+	var lim syscall.Rlimit
+	syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim)
+	return lim
+}()
+
+// printTracer is a Tracer which prints the spans when they end.
+type printTracer struct{}
+
+type printSpanKey struct{}
+
+type printSpan struct {
+	name   string
+	parent string
+	attrs  []string
+}
+
+func (printTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	span := &printSpan{name: name}
+	if parent, ok := ctx.Value(printSpanKey{}).(*printSpan); ok {
+		span.parent = parent.name
+	}
+	return context.WithValue(ctx, printSpanKey{}, span), span
+}
+
+func (s *printSpan) SetAttribute(key string, value interface{}) {
+	s.attrs = append(s.attrs, fmt.Sprintf("%s=%v", key, value))
+}
+
+func (s *printSpan) RecordError(err error) {
+	s.attrs = append(s.attrs, fmt.Sprintf("error=%v", err))
+}
+
+func (s *printSpan) End() {
+	fmt.Printf("span ended: name=%s, parent=%s, %s\n", s.name, s.parent, strings.Join(s.attrs, ", "))
+}
+
+// simpleHelper runs a master with a listener, and a worker which sends ready after
+// the delay set by readyDelayEnv and exits on SIGTERM.
+func simpleHelper() {
+	var opts []Option
+	if d, err := time.ParseDuration(os.Getenv(probationEnv)); err == nil {
+		opts = append(opts, SetNewWorkerProbation(d))
+	}
+	if path := os.Getenv(detachedStateFileEnv); path != "" {
+		opts = append(opts, SetDetachedWorkers(path))
+	}
+	if os.Getenv(childSubreaperEnv) != "" {
+		opts = append(opts, SetChildSubreaper())
+	}
+	if os.Getenv(processGroupEnv) != "" {
+		opts = append(opts, SetSignalWorkerProcessGroup())
+	}
+	if path := os.Getenv(outputFileEnv); path != "" {
+		// NOTE: The file must not be truncated, since the worker runs this too.
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to open output file; %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		opts = append(opts, SetOutput(f))
+	}
+	if os.Getenv(tracerEnv) != "" {
+		opts = append(opts, SetTracer(printTracer{}))
+	}
+	if os.Getenv(listenerGroupsEnv) != "" {
+		opts = append(opts,
+			SetListenerGroup("public", 0), SetListenerGroup("admin", 1),
+			AddWorker(WorkerSpec{Name: "public", ListenerGroup: "public"}),
+			AddWorker(WorkerSpec{Name: "admin", ListenerGroup: "admin"}))
+	}
+	if os.Getenv(workerPoolEnv) != "" {
+		opts = append(opts, SetWorkerCount(2), SetShardPolicy(RoundRobinShardPolicy()))
+	}
+	if os.Getenv(reusePortPoolEnv) != "" {
+		opts = append(opts, SetWorkerCount(2), SetReusePortPool(true), SetListenOptions(ListenOptions{ReusePort: true}))
+	}
+	if os.Getenv(serverStarterEnvEnv) != "" {
+		opts = append(opts, SetServerStarterEnv(true))
+	}
+	if os.Getenv(einhornEnvEnv) != "" {
+		opts = append(opts, SetEinhornEnv(true))
+	}
+	if os.Getenv(nginxSignalsEnv) != "" {
+		opts = append(opts, SetNginxSignals(true))
+	}
+	if v := os.Getenv(workerRlimitNofileEnv); v != "" {
+		// NOTE: We use fmt.Sscan since the type of the fields depends on the platform.
+		var lim syscall.Rlimit
+		fmt.Sscan(v+" "+v, &lim.Cur, &lim.Max)
+		opts = append(opts, SetWorkerRlimits(map[int]syscall.Rlimit{syscall.RLIMIT_NOFILE: lim}))
+	}
+	if os.Getenv(masterUpgradeEnv) != "" {
+		opts = append(opts, SetMasterUpgrade(true))
+	}
+	if path := os.Getenv(takeoverSocketEnv); path != "" {
+		opts = append(opts, SetTakeoverSocket(path))
+	}
+	if path := os.Getenv(controlSocketEnv); path != "" {
+		opts = append(opts, SetControlSocket(path))
+	}
+	if d, err := time.ParseDuration(os.Getenv(maxWorkerLifetimeEnv)); err == nil {
+		opts = append(opts, SetMaxWorkerLifetime(d))
+	}
+	if limit, err := strconv.ParseUint(os.Getenv(maxWorkerRSSEnv), 10, 64); err == nil {
+		opts = append(opts, SetMaxWorkerRSS(limit, time.Second))
+	}
+	if os.Getenv(eventHooksEnv) != "" {
+		hook := []string{"sh", "-c", `echo "hook $SERVERSTARTER_EVENT: gen=$SERVERSTARTER_WORKER_GENERATION"`}
+		opts = append(opts, SetEventHook(EventReloadStarted, hook), SetEventHook(EventWorkerReady, hook))
+	}
+	if url := os.Getenv(webhookURLEnv); url != "" {
+		opts = append(opts, SetWebhookURL(url))
+	}
+	if dir := os.Getenv(workerLogDirEnv); dir != "" {
+		opts = append(opts, SetWorkerLogDir(dir, 2))
+	}
+	if addr := os.Getenv(syslogAddrEnv); addr != "" {
+		opts = append(opts, SetSyslog("unixgram", addr, syslog.LOG_DAEMON, "serverstarter-test"))
+	}
+	if title := os.Getenv(processTitleEnv); title != "" {
+		opts = append(opts, SetProcessTitle(title))
+	}
+	if os.Getenv(initModeEnv) != "" {
+		opts = append(opts, SetInitMode(), SetGracefulShutdownSignalToChild(syscall.SIGINT))
+	}
+	if os.Getenv(workerPdeathsigEnv) != "" {
+		opts = append(opts, SetWorkerPdeathsig(syscall.SIGTERM))
+	}
+	if d, err := time.ParseDuration(os.Getenv(killOldDelayEnv)); err == nil {
+		opts = append(opts, SetKillOldDelay(d))
+	}
+	if d, err := time.ParseDuration(os.Getenv(masterShutdownTimeoutEnv)); err == nil {
+		opts = append(opts, SetMasterShutdownTimeout(d))
+	}
+	if d, err := time.ParseDuration(os.Getenv(reloadDebounceEnv)); err == nil {
+		opts = append(opts, SetReloadDebounce(d))
+	}
+	if policy, err := strconv.Atoi(os.Getenv(reloadFailurePolicyEnv)); err == nil {
+		opts = append(opts, SetReloadFailurePolicy(ReloadFailurePolicy(policy)))
+	}
+	crashExitCode := 1
+	if code, err := strconv.Atoi(os.Getenv(noRestartExitCodeEnv)); err == nil {
+		opts = append(opts, SetNoRestartExitCode(code))
+		crashExitCode = code
+	}
+	s := New(opts...)
+	if s.IsMaster() {
+		if os.Getenv(noListenersEnv) != "" {
+			if err := s.RunMaster(); err != nil {
+				fmt.Fprintf(os.Stderr, "failed to run master; %v\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+		listeners := make([]net.Listener, 1)
+		if os.Getenv(listenerGroupsEnv) != "" || os.Getenv(workerPoolEnv) != "" {
+			listeners = make([]net.Listener, 2)
+		}
+		addr := "127.0.0.1:0"
+		if v := os.Getenv(listenAddrEnv); v != "" {
+			addr = v
+		}
+		network, address, err := ParseListenAddress(addr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to parse listen address; %v\n", err)
+			os.Exit(1)
+		}
+		for i := range listeners {
+			l, err := s.Listen(network, address)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to listen; %v\n", err)
+				os.Exit(1)
+			}
+			listeners[i] = l
+		}
+		if err := s.RunMaster(listeners...); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to run master; %v\n", err)
+			var exitErr *WorkerExitError
+			if errors.As(err, &exitErr) && exitErr.ExitStatus() > 0 {
+				os.Exit(exitErr.ExitStatus())
+			}
+			os.Exit(1)
+		}
+		return
+	}
+
+	sigterm := make(chan os.Signal, 1)
+	signal.Notify(sigterm, syscall.SIGTERM)
+	if os.Getenv(nginxSignalsEnv) != "" {
+		sighup := make(chan os.Signal, 1)
+		signal.Notify(sighup, syscall.SIGHUP)
+		go func() {
+			for range sighup {
+				fmt.Printf("worker received SIGHUP: pid=%d\n", os.Getpid())
+			}
+		}()
+	}
+	listeners, err := s.Listeners()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to get listeners; %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("worker started: pid=%d, listeners=%d\n", os.Getpid(), len(listeners))
+	if os.Getenv(workerRlimitNofileEnv) != "" {
+		fmt.Printf("worker initial RLIMIT_NOFILE max=%d\n", initialNofile.Max)
+	}
+	if os.Getenv(workerPoolEnv) != "" {
+		fmt.Printf("worker index=%d, addr=%s\n", s.WorkerIndex(), listeners[0].Addr())
+	}
+	if os.Getenv(serverStarterEnvEnv) != "" {
+		fmt.Printf("worker env: SERVER_STARTER_PORT=%s, gen=%d, addr=%s\n", os.Getenv("SERVER_STARTER_PORT"), s.Generation(), listeners[0].Addr())
+	}
+	if os.Getenv(reusePortPoolEnv) != "" {
+		// NOTE: The link of the file descriptor identifies the socket.
+		socket, _ := os.Readlink("/proc/self/fd/3")
+		fmt.Printf("worker index=%d, addr=%s, socket=%s\n", s.WorkerIndex(), listeners[0].Addr(), socket)
+	}
+	if os.Getenv(processGroupEnv) != "" {
+		cmd := exec.Command("sleep", "30")
+		if err := cmd.Start(); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to start helper process; %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("helper started: pid=%d,\n", cmd.Process.Pid)
+	}
+	if os.Getenv(childSubreaperEnv) != "" {
+		// NOTE: The shell exits at once and leaves sleep as an orphan.
+		cmd := exec.Command("sh", "-c", "sleep 0.2 &")
+		if err := cmd.Run(); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to spawn orphan; %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if path := os.Getenv(failReadyFileEnv); path != "" {
+		if _, err := os.Stat(path); err == nil {
+			os.Exit(1)
+		}
+	}
+	if delay, err := time.ParseDuration(os.Getenv(readyDelayEnv)); err == nil {
+		select {
+		case <-time.After(delay):
+		case <-sigterm:
+			return
+		}
+	}
+	if os.Getenv(einhornEnvEnv) != "" {
+		fmt.Printf("worker einhorn: fds=%s, fd0=%s, addr=%s\n", os.Getenv("EINHORN_FD_COUNT"), os.Getenv("EINHORN_FD_0"), listeners[0].Addr())
+	}
+	if os.Getenv(einhornEnvEnv) != "" && !s.startedByEinhorn() {
+		// NOTE: This acts as a worker written for Einhorn, which sends the ACK instead of ready.
+		if err := sendEinhornAck(); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to send ACK; %v\n", err)
+			os.Exit(1)
+		}
+	} else if err := s.SendReady(); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to send ready; %v\n", err)
+		os.Exit(1)
+	}
+	if os.Getenv(heartbeatEnv) != "" {
+		if err := s.SendMetadata("config", "v1"); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to send metadata; %v\n", err)
+			os.Exit(1)
+		}
+		if err := s.Heartbeat(5 * time.Second); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to send heartbeat; %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("worker received heartbeat reply")
+	}
+	if os.Getenv(requestListenEnv) != "" && s.Generation() == 1 {
+		if err := s.RequestListen("127.0.0.1:0"); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to request listen; %v\n", err)
+			os.Exit(1)
+		}
+		if err := s.RequestReload(); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to request reload; %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if os.Getenv(requestRecycleEnv) != "" && s.Generation() == 1 {
+		if err := s.RequestRecycle(); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to request recycle; %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if os.Getenv(requestReloadEnv) != "" && s.Generation() == 1 {
+		if err := s.RequestReload(); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to request reload; %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if os.Getenv(sendRetiringEnv) != "" && s.Generation() == 1 {
+		if err := s.SendRetiring(); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to send retirement notice; %v\n", err)
+			os.Exit(1)
+		}
+		time.Sleep(500 * time.Millisecond)
+		fmt.Println("worker retired")
+		os.Exit(0)
+	}
+	if path := os.Getenv(crashAfterReadyFileEnv); path != "" {
+		if _, err := os.Stat(path); err == nil {
+			time.Sleep(100 * time.Millisecond)
+			os.Exit(crashExitCode)
+		}
+	}
+	<-sigterm
+	if os.Getenv(ignoreSIGTERMEnv) != "" {
+		fmt.Println("worker ignored SIGTERM")
+		select {}
+	}
+}
+
+const manyListenersCount = 1000
+
+func manyListenersHelper() {
+	s := New()
+	if s.IsMaster() {
+		listeners := make([]net.Listener, manyListenersCount)
+		for i := range listeners {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to listen; %v\n", err)
+				os.Exit(1)
+			}
+			listeners[i] = l
+		}
+		if err := s.RunMaster(listeners...); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to run master; %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	sigterm := make(chan os.Signal, 1)
+	signal.Notify(sigterm, syscall.SIGTERM)
+
+	start := time.Now()
+	listeners, err := s.Listeners()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to get listeners; %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("worker got listeners: count=%d, elapsed=%s\n", len(listeners), time.Since(start))
+	if err := s.SendReady(); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to send ready; %v\n", err)
+		os.Exit(1)
+	}
+	if path := os.Getenv(crashAfterReadyFileEnv); path != "" {
+		if _, err := os.Stat(path); err == nil {
+			time.Sleep(100 * time.Millisecond)
+			os.Exit(1)
+		}
+	}
+	<-sigterm
+}
+
+func TestRunMasterManyListeners(t *testing.T) {
+	p := startHelper(t, "manylisteners")
+	p.waitLine("started initial worker", 10*time.Second)
+	start := time.Now()
+
+	line := p.waitLine("worker got listeners", 10*time.Second)
+	var count int
+	var elapsedStr string
+	if _, err := fmt.Sscanf(line, "worker got listeners: count=%d, elapsed=%s", &count, &elapsedStr); err != nil {
+		t.Fatalf("unexpected line %q; %v", line, err)
+	}
+	if count != manyListenersCount {
+		t.Errorf("listener count mismatch, got=%d, want=%d", count, manyListenersCount)
+	}
+	elapsed, err := time.ParseDuration(elapsedStr)
+	if err != nil {
+		t.Fatalf("unexpected elapsed in line %q; %v", line, err)
+	}
+	if elapsed > time.Second {
+		t.Errorf("Listeners with %d listeners took too long: %s", manyListenersCount, elapsed)
+	}
+
+	p.waitLine("received ready from initial worker", 10*time.Second)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("starting worker with %d listeners took too long: %s", manyListenersCount, elapsed)
+	}
+
+	p.signal(syscall.SIGTERM)
+	if err := p.wait(); err != nil {
+		t.Errorf("master exited with error; %v", err)
+	}
+}
+
+func TestRunMasterSIGHUPBeforeInitialReady(t *testing.T) {
+	p := startHelper(t, "simple", readyDelayEnv+"=500ms")
+	p.waitLine("started initial worker", 10*time.Second)
+
+	p.signal(syscall.SIGHUP)
+	p.waitLine("received SIGHUP before initial worker is ready, queued reload", 10*time.Second)
+	p.signal(syscall.SIGHUP)
+	p.waitLine("received SIGHUP before initial worker is ready, merged with queued reload", 10*time.Second)
+
+	p.waitLine("received ready from initial worker", 10*time.Second)
+	p.waitLine("start queued reload", 10*time.Second)
+	p.waitLine("started new worker", 10*time.Second)
+	p.waitLine("received ready from new worker", 10*time.Second)
+
+	p.signal(syscall.SIGTERM)
+	p.waitLine("stopped child process, exiting.", 10*time.Second)
+	if err := p.wait(); err != nil {
+		t.Errorf("master exited with error; %v", err)
+	}
+}
+
+func TestRunMasterSIGHUPDuringReload(t *testing.T) {
+	p := startHelper(t, "simple", readyDelayEnv+"=500ms")
+	p.waitLine("received ready from initial worker", 10*time.Second)
+
+	p.signal(syscall.SIGHUP)
+	p.waitLine("started new worker", 10*time.Second)
+	p.signal(syscall.SIGHUP)
+	p.waitLine("received ready from new worker", 10*time.Second)
+	p.waitLine("SIGHUPs during reload, merged with reload in progress", 10*time.Second)
+	p.waitLine("finished reload", 10*time.Second)
+
+	p.signal(syscall.SIGTERM)
+	p.waitLine("stopped child process, exiting.", 10*time.Second)
+	if err := p.wait(); err != nil {
+		t.Errorf("master exited with error; %v", err)
+	}
+}
+
+func TestRunMasterReloadDebounce(t *testing.T) {
+	p := startHelper(t, "simple", reloadDebounceEnv+"=500ms")
+	p.waitLine("received ready from initial worker", 10*time.Second)
+
+	p.signal(syscall.SIGHUP)
+	time.Sleep(50 * time.Millisecond)
+	p.signal(syscall.SIGHUP)
+	p.waitLine("merged 1 SIGHUPs received while waiting to start reload", 10*time.Second)
+	p.waitLine("started new worker", 10*time.Second)
+	p.waitLine("finished reload", 10*time.Second)
+
+	p.signal(syscall.SIGTERM)
+	p.waitLine("stopped child process, exiting.", 10*time.Second)
+	if err := p.wait(); err != nil {
+		t.Errorf("master exited with error; %v", err)
+	}
+}
+
+func TestRunMasterShutdownTimeout(t *testing.T) {
+	p := startHelper(t, "simple", masterShutdownTimeoutEnv+"=500ms", ignoreSIGTERMEnv+"=1")
+	p.waitLine("received ready from initial worker", 10*time.Second)
+
+	p.signal(syscall.SIGTERM)
+	p.waitLine("worker ignored SIGTERM", 10*time.Second)
+	p.waitLine("workers did not exit within master shutdown timeout 500ms, killing them", 10*time.Second)
+	err := p.wait()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 128+int(syscall.SIGKILL) {
+		t.Errorf("master exit status mismatch, got=%v, want=exit status %d", err, 128+int(syscall.SIGKILL))
+	}
+}
+
+func TestRunMasterSIGTERMDuringKillOldDelay(t *testing.T) {
+	p := startHelper(t, "simple", killOldDelayEnv+"=1m")
+	p.waitLine("received ready from initial worker", 10*time.Second)
+
+	p.signal(syscall.SIGHUP)
+	p.waitLine("waiting 1m0s before stopping old worker", 10*time.Second)
+	p.signal(syscall.SIGTERM)
+	p.waitLine("received terminated during kill-old delay, stopping old worker now", 10*time.Second)
+	p.waitLine("finished reload", 10*time.Second)
+	if err := p.wait(); err != nil {
+		t.Errorf("master exited with error; %v", err)
+	}
+}
+
+func TestRunMasterUpgrade(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	p := startHelper(t, "simple", masterUpgradeEnv+"=1", listenAddrEnv+"="+addr)
+	line := p.waitLine("worker started: pid=", 10*time.Second)
+	var pid int
+	if _, err := fmt.Sscanf(line, "worker started: pid=%d,", &pid); err != nil {
+		t.Fatalf("unexpected line %q; %v", line, err)
+	}
+	p.waitLine("received ready from initial worker", 10*time.Second)
+
+	p.signal(syscall.SIGUSR2)
+	p.waitLine(fmt.Sprintf("adopted worker from old master: pid=%d", pid), 10*time.Second)
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("listener does not accept after upgrade; %v", err)
+	}
+	c.Close()
+
+	// NOTE: The new master starts a worker with the listener handed over.
+	p.signal(syscall.SIGHUP)
+	p.waitLines(10*time.Second, "worker started: pid=", "finished reload")
+	c, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("listener does not accept after reload; %v", err)
+	}
+	c.Close()
+
+	p.signal(syscall.SIGTERM)
+	if err := p.wait(); err != nil {
+		t.Errorf("master exited with error; %v", err)
+	}
+}
+
+func TestRunMasterUpgradeIncompatibleOptions(t *testing.T) {
+	// NOTE: The SCTP listener may be any listening socket which implements syscall.Conn.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	testCases := []struct {
+		opts []Option
+		in   Inheritance
+	}{
+		{opts: []Option{SetExtraFiles([]*os.File{os.Stderr})}},
+		{opts: []Option{SetReusePortPool(true)}},
+		{in: Inheritance{SCTPListeners: []syscall.Conn{l.(*net.TCPListener)}}},
+	}
+	for i, c := range testCases {
+		s := New(append(c.opts, SetMasterUpgrade(true))...)
+		if err := s.RunMasterWith(c.in); !errors.Is(err, ErrIncompatibleOptions) {
+			t.Errorf("case %d: error mismatch, got=%v, want=%v", i, err, ErrIncompatibleOptions)
+		}
+	}
+}
+
+func TestRunMasterTakeover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serverstarter-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	env := []string{listenAddrEnv + "=" + addr, takeoverSocketEnv + "=" + filepath.Join(dir, "takeover.sock")}
+
+	p1 := startHelper(t, "simple", env...)
+	p1.waitLine("received ready from initial worker", 10*time.Second)
+
+	p2 := startHelper(t, "simple", env...)
+	p2.waitLine(fmt.Sprintf("taking over from running master pid=%d", p1.cmd.Process.Pid), 10*time.Second)
+	p2.waitLine("received ready from initial worker", 10*time.Second)
+	p1.waitLine("handed over to new master, exiting.", 10*time.Second)
+	if err := p1.wait(); err != nil {
+		t.Errorf("old master exited with error; %v", err)
+	}
+	p2.waitLine("old master finished takeover", 10*time.Second)
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("listener does not accept after takeover; %v", err)
+	}
+	c.Close()
+
+	// NOTE: The new master hands over to the next master in turn.
+	p3 := startHelper(t, "simple", env...)
+	p3.waitLine(fmt.Sprintf("taking over from running master pid=%d", p2.cmd.Process.Pid), 10*time.Second)
+	p3.waitLine("received ready from initial worker", 10*time.Second)
+	if err := p2.wait(); err != nil {
+		t.Errorf("old master exited with error; %v", err)
+	}
+
+	p3.signal(syscall.SIGTERM)
+	if err := p3.wait(); err != nil {
+		t.Errorf("master exited with error; %v", err)
+	}
+}
+
+func TestRunMasterTakeoverNewMasterFails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serverstarter-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	failReadyFile := filepath.Join(dir, "fail-ready")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	env := []string{listenAddrEnv + "=" + addr, takeoverSocketEnv + "=" + filepath.Join(dir, "takeover.sock"),
+		failReadyFileEnv + "=" + failReadyFile}
+
+	p1 := startHelper(t, "simple", env...)
+	p1.waitLine("received ready from initial worker", 10*time.Second)
+
+	if err := ioutil.WriteFile(failReadyFile, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	p2 := startHelper(t, "simple", env...)
+	p2.waitLine(fmt.Sprintf("taking over from running master pid=%d", p1.cmd.Process.Pid), 10*time.Second)
+	if err := p2.wait(); err == nil {
+		t.Error("new master exited without error")
+	}
+	p1.waitLine("new master aborted takeover", 10*time.Second)
+
+	// NOTE: The running master is still reachable on the takeover socket.
+	if err := os.Remove(failReadyFile); err != nil {
+		t.Fatal(err)
+	}
+	p3 := startHelper(t, "simple", env...)
+	p3.waitLine(fmt.Sprintf("taking over from running master pid=%d", p1.cmd.Process.Pid), 10*time.Second)
+	p3.waitLine("received ready from initial worker", 10*time.Second)
+	if err := p1.wait(); err != nil {
+		t.Errorf("old master exited with error; %v", err)
+	}
+
+	p3.signal(syscall.SIGTERM)
+	if err := p3.wait(); err != nil {
+		t.Errorf("master exited with error; %v", err)
+	}
+}
+
+func TestRunMasterTakeoverKeepsInheritedUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serverstarter-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	failReadyFile := filepath.Join(dir, "fail-ready")
+	path := filepath.Join(dir, "listener.sock")
+	env := []string{listenAddrEnv + "=" + path, takeoverSocketEnv + "=" + filepath.Join(dir, "takeover.sock"),
+		failReadyFileEnv + "=" + failReadyFile}
+
+	p1 := startHelper(t, "simple", env...)
+	p1.waitLine("received ready from initial worker", 10*time.Second)
+
+	if err := ioutil.WriteFile(failReadyFile, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	p2 := startHelper(t, "simple", env...)
+	p2.waitLine(fmt.Sprintf("taking over from running master pid=%d", p1.cmd.Process.Pid), 10*time.Second)
+	if err := p2.wait(); err == nil {
+		t.Error("new master exited without error")
+	}
+
+	// NOTE: The new master must not remove the socket file which the running
+	// master created and still listens on.
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("unix domain socket of running master is not reachable; %v", err)
+	}
+	c.Close()
+
+	p1.signal(syscall.SIGTERM)
+	if err := p1.wait(); err != nil {
+		t.Errorf("master exited with error; %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file is not removed by master which created it; %v", err)
+	}
+}
+
+func TestRunMasterSecondSIGINTKillsWorker(t *testing.T) {
+	p := startHelper(t, "simple", ignoreSIGTERMEnv+"=1")
+	p.waitLine("received ready from initial worker", 10*time.Second)
+
+	p.signal(syscall.SIGINT)
+	p.waitLine("worker ignored SIGTERM", 10*time.Second)
+	p.signal(syscall.SIGINT)
+	p.waitLine("received interrupt again during shutdown, killing workers", 10*time.Second)
+	if err := p.wait(); err == nil {
+		t.Error("master exited without error")
+	}
+}
+
+func TestRunMasterForwardSIGQUIT(t *testing.T) {
+	p := startHelper(t, "simple")
+	p.waitLine("received ready from initial worker", 10*time.Second)
+
+	p.signal(syscall.SIGQUIT)
+	p.waitLines(10*time.Second, "forwarding signal \"quit\" to worker", "goroutine ")
+	p.waitLines(10*time.Second, "restarted worker", "worker started")
+
+	p.signal(syscall.SIGTERM)
+	if err := p.wait(); err != nil {
+		t.Errorf("master exited with error; %v", err)
+	}
+}
+
+func TestRunMasterOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serverstarter-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "master.log")
+
+	p := startHelper(t, "simple", outputFileEnv+"="+path)
+	p.waitLine("worker started", 10*time.Second)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		data, err := ioutil.ReadFile(path)
+		if err == nil && strings.Contains(string(data), "received ready from initial worker") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for master message in output file, got=%q", data)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	p.signal(syscall.SIGTERM)
+	if err := p.wait(); err != nil {
+		t.Errorf("master exited with error; %v", err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "stopped child process, exiting.") {
+		t.Errorf("shutdown message not written to output file, got=%q", data)
+	}
+}
+
+func TestRunMasterSyslog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serverstarter-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr := filepath.Join(dir, "syslog.sock")
+	conn, err := net.ListenPacket("unixgram", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	p := startHelper(t, "simple", syslogAddrEnv+"="+addr)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	buf := make([]byte, 4096)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("failed to receive syslog message; %v", err)
+		}
+		msg := string(buf[:n])
+		if strings.Contains(msg, "received ready from initial worker") {
+			// NOTE: The priority of LOG_DAEMON|LOG_INFO is 30.
+			if !strings.HasPrefix(msg, "<30>") || !strings.Contains(msg, "serverstarter-test[") {
+				t.Errorf("unexpected syslog message, got=%q", msg)
+			}
+			break
+		}
+	}
+
+	p.signal(syscall.SIGTERM)
+	if err := p.wait(); err != nil {
+		t.Errorf("master exited with error; %v", err)
+	}
+}
+
+func TestRunMasterWorkerLogDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serverstarter-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := startHelper(t, "simple", workerLogDirEnv+"="+dir)
+	p.waitLine("received ready from initial worker", 10*time.Second)
+	for i := 0; i < 2; i++ {
+		p.signal(syscall.SIGHUP)
+		p.waitLine("finished reload", 10*time.Second)
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	if got, want := strings.Join(names, ","), "worker-2.log,worker-3.log"; got != want {
+		t.Errorf("worker log files mismatch, got=%s, want=%s", got, want)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "worker-3.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "worker started: pid=") {
+		t.Errorf("worker output not written to log file, got=%q", data)
+	}
+
+	p.signal(syscall.SIGTERM)
+	if err := p.wait(); err != nil {
+		t.Errorf("master exited with error; %v", err)
+	}
+}
+
+func TestRunMasterWebhook(t *testing.T) {
+	payloads := make(chan webhookPayload, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload webhookPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("failed to decode webhook payload; %v", err)
+		}
+		payloads <- payload
+	}))
+	defer srv.Close()
+
+	p := startHelper(t, "simple", webhookURLEnv+"="+srv.URL)
+	p.waitLine("received ready from initial worker", 10*time.Second)
+	p.signal(syscall.SIGHUP)
+	p.waitLine("finished reload", 10*time.Second)
+	p.signal(syscall.SIGTERM)
+	if err := p.wait(); err != nil {
+		t.Errorf("master exited with error; %v", err)
+	}
+
+	close(payloads)
+	var events []string
+	for payload := range payloads {
+		events = append(events, fmt.Sprintf("%s/%d", payload.Event, payload.Generation))
+		if payload.MasterPID != p.cmd.Process.Pid {
+			t.Errorf("master pid mismatch, got=%d, want=%d", payload.MasterPID, p.cmd.Process.Pid)
+		}
+	}
+	if got, want := strings.Join(events, ","), "reload_started/1,reload_succeeded/2"; got != want {
+		t.Errorf("webhook events mismatch, got=%s, want=%s", got, want)
+	}
+}
+
+func TestRunMasterEventHook(t *testing.T) {
+	p := startHelper(t, "simple", eventHooksEnv+"=1")
+	p.waitLine("hook worker_ready: gen=1", 10*time.Second)
+	p.signal(syscall.SIGHUP)
+	p.waitLine("hook reload_started: gen=1", 10*time.Second)
+	p.waitLine("hook worker_ready: gen=2", 10*time.Second)
+	p.waitLine("finished reload", 10*time.Second)
+
+	p.signal(syscall.SIGTERM)
+	if err := p.wait(); err != nil {
+		t.Errorf("master exited with error; %v", err)
+	}
+}
+
+func TestRunMasterTracer(t *testing.T) {
+	p := startHelper(t, "simple", tracerEnv+"=1")
+	p.waitLine("received ready from initial worker", 10*time.Second)
+	p.signal(syscall.SIGHUP)
+	p.waitLine("span ended: name=serverstarter.spawn, parent=serverstarter.reload, pid=", 10*time.Second)
+	p.waitLine("span ended: name=serverstarter.wait_ready, parent=serverstarter.reload, pid=", 10*time.Second)
+	p.waitLine("span ended: name=serverstarter.drain_old_worker, parent=serverstarter.reload, pid=", 10*time.Second)
+	line := p.waitLine("span ended: name=serverstarter.reload, parent=, worker=, old_pid=", 10*time.Second)
+	if !strings.HasSuffix(line, ", outcome=succeeded") {
+		t.Errorf("unexpected reload span: %s", line)
+	}
+
+	p.signal(syscall.SIGTERM)
+	if err := p.wait(); err != nil {
+		t.Errorf("master exited with error; %v", err)
+	}
+}
+
+func TestRunMasterMaxWorkerLifetime(t *testing.T) {
+	p := startHelper(t, "simple", maxWorkerLifetimeEnv+"=1s")
+	p.waitLine("received ready from initial worker", 10*time.Second)
+	p.waitLine("recycling worker pid=", 10*time.Second)
+	p.waitLine("finished recycling worker", 10*time.Second)
+	p.waitLine("recycling worker pid=", 10*time.Second)
+	p.waitLine("finished recycling worker", 10*time.Second)
+
+	p.signal(syscall.SIGTERM)
+	if err := p.wait(); err != nil {
+		t.Errorf("master exited with error; %v", err)
+	}
+}
+
+func TestRunMasterRequestRecycle(t *testing.T) {
+	p := startHelper(t, "simple", requestRecycleEnv+"=1")
+	p.waitLine("received recycle request from worker: pid=", 10*time.Second)
+	p.waitLine("recycling worker pid=", 10*time.Second)
+	p.waitLine("finished recycling worker", 10*time.Second)
+
+	p.signal(syscall.SIGTERM)
+	if err := p.wait(); err != nil {
+		t.Errorf("master exited with error; %v", err)
+	}
+}
+
+func TestRunMasterRequestReload(t *testing.T) {
+	p := startHelper(t, "simple", requestReloadEnv+"=1")
+	p.waitLine("received reload request from worker: pid=", 10*time.Second)
+	p.waitLine("finished reload", 10*time.Second)
+
+	p.signal(syscall.SIGTERM)
+	if err := p.wait(); err != nil {
+		t.Errorf("master exited with error; %v", err)
+	}
+}
+
+func TestRunMasterSendRetiring(t *testing.T) {
+	p := startHelper(t, "simple", sendRetiringEnv+"=1")
+	p.waitLine("received retirement notice from worker: pid=", 10*time.Second)
+	p.waitLine("received ready from replacement worker: pid=", 10*time.Second)
+	p.waitLine("worker retired", 10*time.Second)
+	p.waitLine("finished replacing retiring worker", 10*time.Second)
+
+	p.signal(syscall.SIGTERM)
+	if err := p.wait(); err != nil {
+		t.Errorf("master exited with error; %v", err)
+	}
+}
+
+func TestRunMasterHeartbeat(t *testing.T) {
+	p := startHelper(t, "simple", heartbeatEnv+"=1")
+	p.waitLine("received metadata from worker: pid=", 10*time.Second)
+	p.waitLine("worker received heartbeat reply", 10*time.Second)
+
+	p.signal(syscall.SIGTERM)
+	if err := p.wait(); err != nil {
+		t.Errorf("master exited with error; %v", err)
+	}
+}
+
+func TestRunMasterRequestListen(t *testing.T) {
+	p := startHelper(t, "simple", requestListenEnv+"=1")
+	p.waitLine("worker started: pid=", 10*time.Second)
+	p.waitLine("added listener 127.0.0.1:", 10*time.Second)
+	line := p.waitLine("worker started: pid=", 10*time.Second)
+	if !strings.HasSuffix(line, ", listeners=2") {
+		t.Errorf("unexpected listeners of new worker: %s", line)
+	}
+	p.waitLine("finished reload", 10*time.Second)
+
+	p.signal(syscall.SIGTERM)
+	if err := p.wait(); err != nil {
+		t.Errorf("master exited with error; %v", err)
+	}
+}
+
+func TestRunMasterListenAndUnlisten(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serverstarter-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "control.sock")
+
+	p := startHelper(t, "simple", controlSocketEnv+"="+path)
+	p.waitLine("received ready from initial worker", 10*time.Second)
+	if got, want := sendControlCommand(t, path, "listen 127.0.0.1:0 extra"), "ok index=1"; got != want {
+		t.Fatalf("response mismatch, got=%q, want=%q", got, want)
+	}
+	if resp := sendControlCommand(t, path, "reload"); !strings.HasPrefix(resp, "ok old_pid=") {
+		t.Fatalf("unexpected response to reload: %q", resp)
+	}
+	if line := p.waitLine("worker started: pid=", 10*time.Second); !strings.HasSuffix(line, ", listeners=2") {
+		t.Errorf("unexpected listeners after listen: %s", line)
+	}
+
+	if resp := sendControlCommand(t, path, "unlisten extra"); !strings.HasPrefix(resp, "ok old_pid=") {
+		t.Fatalf("unexpected response to unlisten: %q", resp)
+	}
+	if line := p.waitLine("worker started: pid=", 10*time.Second); !strings.HasSuffix(line, ", listeners=1") {
+		t.Errorf("unexpected listeners after unlisten: %s", line)
+	}
+	p.waitLine("closed removed listener extra", 10*time.Second)
+
+	p.signal(syscall.SIGTERM)
+	if err := p.wait(); err != nil {
+		t.Errorf("master exited with error; %v", err)
+	}
+}
+
+func TestRunMasterUnlistenClosesListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serverstarter-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "control.sock")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	p := startHelper(t, "simple", controlSocketEnv+"="+path, listenAddrEnv+"="+addr)
+	p.waitLine("received ready from initial worker", 10*time.Second)
+	if got, want := sendControlCommand(t, path, "listen 127.0.0.1:0 extra"), "ok index=1"; got != want {
+		t.Fatalf("response mismatch, got=%q, want=%q", got, want)
+	}
+
+	// NOTE: The listener passed to RunMaster must be closed as well as
+	// its file, otherwise the socket keeps listening.
+	if resp := sendControlCommand(t, path, "unlisten "+addr); !strings.HasPrefix(resp, "ok old_pid=") {
+		t.Fatalf("unexpected response to unlisten: %q", resp)
+	}
+	p.waitLine("closed removed listener "+addr, 10*time.Second)
+	if c, err := net.Dial("tcp", addr); err == nil {
+		c.Close()
+		t.Errorf("removed listener %s is still listening", addr)
+	}
+
+	p.signal(syscall.SIGTERM)
+	if err := p.wait(); err != nil {
+		t.Errorf("master exited with error; %v", err)
+	}
+}
+
+func TestRunMasterUnlistenReloadFails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serverstarter-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "control.sock")
+	failReadyFile := filepath.Join(dir, "fail-ready")
+	extra := filepath.Join(dir, "extra.sock")
+
+	p := startHelper(t, "simple", controlSocketEnv+"="+path, failReadyFileEnv+"="+failReadyFile)
+	p.waitLine("received ready from initial worker", 10*time.Second)
+	if got, want := sendControlCommand(t, path, "listen unix:"+extra+" extra"), "ok index=1"; got != want {
+		t.Fatalf("response mismatch, got=%q, want=%q", got, want)
+	}
+	if resp := sendControlCommand(t, path, "reload"); !strings.HasPrefix(resp, "ok old_pid=") {
+		t.Fatalf("unexpected response to reload: %q", resp)
+	}
+
+	// NOTE: The old worker which keeps running after the reload fails still
+	// accepts on the listener, so it must be put back.
+	if err := ioutil.WriteFile(failReadyFile, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if resp := sendControlCommand(t, path, "unlisten extra"); !strings.HasPrefix(resp, "error: ") {
+		t.Fatalf("unexpected response to unlisten: %q", resp)
+	}
+	p.waitLine("put back listener "+extra, 10*time.Second)
+	c, err := net.Dial("unix", extra)
+	if err != nil {
+		t.Fatalf("listener put back is not reachable; %v", err)
+	}
+	c.Close()
+
+	if err := os.Remove(failReadyFile); err != nil {
+		t.Fatal(err)
+	}
+	if resp := sendControlCommand(t, path, "unlisten extra"); !strings.HasPrefix(resp, "ok old_pid=") {
+		t.Fatalf("unexpected response to unlisten: %q", resp)
+	}
+	if line := p.waitLine("worker started: pid=", 10*time.Second); !strings.HasSuffix(line, ", listeners=1") {
+		t.Errorf("unexpected listeners after unlisten: %s", line)
+	}
+	p.waitLine("closed removed listener extra", 10*time.Second)
+	if _, err := os.Stat(extra); !os.IsNotExist(err) {
+		t.Errorf("socket file of removed listener is not removed; %v", err)
+	}
+
+	p.signal(syscall.SIGTERM)
+	if err := p.wait(); err != nil {
+		t.Errorf("master exited with error; %v", err)
+	}
+}
+
+func TestRunMasterReloadGroup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serverstarter-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "control.sock")
+
+	p := startHelper(t, "simple", controlSocketEnv+"="+path, listenerGroupsEnv+"=1")
+	p.waitLines(10*time.Second, "received ready from initial worker: pid=", "received ready from initial worker: pid=")
+	resp := sendControlCommand(t, path, "reload-group admin")
+	if !strings.HasPrefix(resp, "ok worker=admin old_pid=") || strings.Count(resp, "old_pid=") != 1 {
+		t.Fatalf("unexpected response to reload-group: %q", resp)
+	}
+	line := p.waitLine("started new worker: pid=", 10*time.Second)
+	if !strings.HasSuffix(line, ", name=admin") {
+		t.Errorf("unexpected new worker: %s", line)
+	}
+	p.waitLine("finished reloading listener group admin", 10*time.Second)
+
+	p.signal(syscall.SIGTERM)
+	if err := p.wait(); err != nil {
+		t.Errorf("master exited with error; %v", err)
+	}
+}
+
+func TestRunMasterWorkerPoolSharding(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serverstarter-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "control.sock")
+
+	p := startHelper(t, "simple", controlSocketEnv+"="+path, workerPoolEnv+"=1")
+	lines := p.waitLines(10*time.Second, "worker index=", "worker index=",
+		"received ready from initial worker: pid=", "received ready from initial worker: pid=")
+	addrs := make(map[string]string)
+	for _, line := range lines[:2] {
+		fields := strings.Split(strings.TrimPrefix(line, "worker index="), ", addr=")
+		addrs[fields[0]] = fields[1]
+	}
+	if len(addrs) != 2 || addrs["0"] == addrs["1"] {
+		t.Fatalf("unexpected listener assignment: %v", addrs)
+	}
+
+	resp := sendControlCommand(t, path, "reload worker-1")
+	if !strings.HasPrefix(resp, "ok worker=worker-1 old_pid=") {
+		t.Fatalf("unexpected response to reload: %q", resp)
+	}
+	line := p.waitLine("worker index=", 10*time.Second)
+	if want := "worker index=1, addr=" + addrs["1"]; line != want {
+		t.Errorf("unexpected reloaded worker: got %q, want %q", line, want)
+	}
+
+	p.signal(syscall.SIGTERM)
+	if err := p.wait(); err != nil {
+		t.Errorf("master exited with error; %v", err)
+	}
+}
+
+func TestRunMasterServerStarterEnv(t *testing.T) {
+	p := startHelper(t, "simple", serverStarterEnvEnv+"=1")
+	line := p.waitLine("worker env: ", 10*time.Second)
+	var port, addr string
+	var gen int
+	if _, err := fmt.Sscanf(line, "worker env: SERVER_STARTER_PORT=%s gen=%d, addr=%s", &port, &gen, &addr); err != nil {
+		t.Fatalf("unexpected line %q; %v", line, err)
+	}
+	if want := addr + "=4,"; port != want || gen != 1 {
+		t.Errorf("unexpected environment: port=%q, gen=%d, want port=%q, gen=1", port, gen, want)
+	}
+
+	p.signal(syscall.SIGTERM)
+	if err := p.wait(); err != nil {
+		t.Errorf("master exited with error; %v", err)
+	}
+}
+
+func TestWorkerStartedByServerStarter(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// NOTE: This starts the worker in the same way as start_server of Server::Starter.
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Env = append(os.Environ(), helperEnv+"=simple", serverStarterEnvEnv+"=1",
+		"SERVER_STARTER_PORT="+l.Addr().String()+"=3", "SERVER_STARTER_GENERATION=2")
+	cmd.ExtraFiles = []*os.File{f}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+	var line string
+	for sc := bufio.NewScanner(stdout); sc.Scan(); {
+		if line = sc.Text(); strings.HasPrefix(line, "worker env: ") {
+			break
+		}
+	}
+	if want := "gen=2, addr=" + l.Addr().String(); !strings.HasSuffix(line, want) {
+		t.Errorf("unexpected worker: got %q, want suffix %q", line, want)
+	}
+
+	cmd.Process.Signal(syscall.SIGTERM)
+	if err := cmd.Wait(); err != nil {
+		t.Errorf("worker exited with error; %v", err)
+	}
+}
+
+func TestRunMasterEinhornAck(t *testing.T) {
+	p := startHelper(t, "simple", einhornEnvEnv+"=1")
+	lines := p.waitLines(10*time.Second, "worker einhorn: ", "received ACK from worker: pid=", "received ready from initial worker: pid=")
+	if !strings.HasPrefix(lines[0], "worker einhorn: fds=1, fd0=4, addr=") {
+		t.Errorf("unexpected worker environment: %q", lines[0])
+	}
+
+	p.signal(syscall.SIGTERM)
+	if err := p.wait(); err != nil {
+		t.Errorf("master exited with error; %v", err)
+	}
+}
+
+func TestWorkerStartedByEinhorn(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serverstarter-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sockPath := filepath.Join(dir, "einhorn.sock")
+	sock, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// NOTE: This starts the worker in the same way as Einhorn.
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Env = append(os.Environ(), helperEnv+"=simple", einhornEnvEnv+"=1",
+		"EINHORN_FD_COUNT=1", "EINHORN_FD_0=3", "EINHORN_SOCK_PATH="+sockPath)
+	cmd.ExtraFiles = []*os.File{f}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	c, err := sock.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf(`{"command":"worker:ack","pid":%d}`+"\n", cmd.Process.Pid); line != want {
+		t.Errorf("unexpected ACK: got %q, want %q", line, want)
+	}
+
+	cmd.Process.Signal(syscall.SIGTERM)
+	if err := cmd.Wait(); err != nil {
+		t.Errorf("worker exited with error; %v", err)
+	}
+}
+
+func TestRunMasterNginxSignals(t *testing.T) {
+	p := startHelper(t, "simple", nginxSignalsEnv+"=1")
+	p.waitLine("received ready from initial worker", 10*time.Second)
+
+	p.signal(syscall.SIGHUP)
+	p.waitLines(10*time.Second, "forwarding signal \"hangup\" to worker", "worker received SIGHUP")
+
+	p.signal(syscall.SIGUSR2)
+	p.waitLine("received ready from new worker", 10*time.Second)
+	p.waitLine("started new generation of workers", 10*time.Second)
+	p.signal(syscall.SIGUSR2)
+	p.waitLine("ignored SIGUSR2 since old generation is still running", 10*time.Second)
+
+	p.signal(syscall.SIGQUIT)
+	p.waitLine("retired old worker", 10*time.Second)
+	p.waitLine("retired old generation of workers", 10*time.Second)
+
+	p.signal(syscall.SIGQUIT)
+	p.waitLine("stopped child process, exiting.", 10*time.Second)
+	if err := p.wait(); err != nil {
+		t.Errorf("master exited with error; %v", err)
+	}
+}
+
+func TestRunMasterNginxOldWorkerExits(t *testing.T) {
+	p := startHelper(t, "simple", nginxSignalsEnv+"=1")
+	line := p.waitLine("worker started: pid=", 10*time.Second)
+	var pid int
+	if _, err := fmt.Sscanf(line, "worker started: pid=%d,", &pid); err != nil {
+		t.Fatalf("unexpected line %q; %v", line, err)
+	}
+	p.waitLine("received ready from initial worker", 10*time.Second)
+
+	p.signal(syscall.SIGUSR2)
+	p.waitLine("started new generation of workers", 10*time.Second)
+	syscall.Kill(pid, syscall.SIGKILL)
+	p.waitLine(fmt.Sprintf("old worker exited err=signal: killed, not restarting: pid=%d", pid), 10*time.Second)
+
+	// NOTE: The master exits on a SIGQUIT since no old generation is running.
+	p.signal(syscall.SIGQUIT)
+	p.waitLine("stopped child process, exiting.", 10*time.Second)
+	if err := p.wait(); err != nil {
+		t.Errorf("master exited with error; %v", err)
+	}
+}
+
+func TestRunMasterTakeoverStopsOldGeneration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serverstarter-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	env := []string{nginxSignalsEnv + "=1", listenAddrEnv + "=" + addr, takeoverSocketEnv + "=" + filepath.Join(dir, "takeover.sock")}
+
+	p1 := startHelper(t, "simple", env...)
+	line := p1.waitLine("worker started: pid=", 10*time.Second)
+	var pid int
+	if _, err := fmt.Sscanf(line, "worker started: pid=%d,", &pid); err != nil {
+		t.Fatalf("unexpected line %q; %v", line, err)
+	}
+	p1.waitLine("received ready from initial worker", 10*time.Second)
+	p1.signal(syscall.SIGUSR2)
+	p1.waitLine("started new generation of workers", 10*time.Second)
+
+	p2 := startHelper(t, "simple", env...)
+	p2.waitLine("received ready from initial worker", 10*time.Second)
+	p1.waitLine("handed over to new master, exiting.", 10*time.Second)
+	if err := p1.wait(); err != nil {
+		t.Errorf("old master exited with error; %v", err)
+	}
+	if err := syscall.Kill(pid, 0); err != syscall.ESRCH {
+		t.Errorf("worker of old generation pid=%d is still running after takeover; %v", pid, err)
+	}
+
+	p2.signal(syscall.SIGTERM)
+	if err := p2.wait(); err != nil {
+		t.Errorf("master exited with error; %v", err)
+	}
+}
+
+// sendControlCommand sends the command to the control socket at path and
+// returns the response.
+func sendControlCommand(t *testing.T, path, command string) string {
+	t.Helper()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := fmt.Fprintln(conn, command); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSuffix(resp, "\n")
+}
+
+func TestRunMasterSIGTERMBeforeInitialReady(t *testing.T) {
+	p := startHelper(t, "simple", readyDelayEnv+"=10s")
+	p.waitLine("worker started", 10*time.Second)
+
+	p.signal(syscall.SIGTERM)
+	p.waitLine("stopped child process, exiting.", 10*time.Second)
+	if err := p.wait(); err != nil {
+		t.Errorf("master exited with error; %v", err)
+	}
+}
+
+func TestRunMasterWithoutListeners(t *testing.T) {
+	p := startHelper(t, "simple", noListenersEnv+"=1")
+	p.waitLine("worker started: pid=", 10*time.Second)
+	p.waitLine("received ready from initial worker", 10*time.Second)
+
+	p.signal(syscall.SIGHUP)
+	p.waitLine("started new worker", 10*time.Second)
+	line := p.waitLine("worker started: pid=", 10*time.Second)
+	if !strings.HasSuffix(line, "listeners=0") {
+		t.Errorf("unexpected line %q", line)
+	}
+	p.waitLine("received ready from new worker", 10*time.Second)
+
+	p.signal(syscall.SIGTERM)
+	p.waitLine("stopped child process, exiting.", 10*time.Second)
+	if err := p.wait(); err != nil {
+		t.Errorf("master exited with error; %v", err)
+	}
+}
+
+func TestRunMasterNoRestartExitCode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serverstarter-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	crashFile := filepath.Join(dir, "crash")
+	if err := ioutil.WriteFile(crashFile, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	p := startHelper(t, "simple", crashAfterReadyFileEnv+"="+crashFile, noRestartExitCodeEnv+"=86")
+	p.waitLine("received ready from initial worker", 10*time.Second)
+	p.waitLine("child process exited with exit code 86, not restarting child", 10*time.Second)
+	err = p.wait()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 86 {
+		t.Errorf("master exit status mismatch, got=%v, want=exit status 86", err)
+	}
+}
+
+func TestRunMasterReloadFailsBeforeReady(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serverstarter-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	failReadyFile := filepath.Join(dir, "fail-ready")
+
+	p := startHelper(t, "simple", failReadyFileEnv+"="+failReadyFile)
+	p.waitLine("received ready from initial worker", 10*time.Second)
+
+	if err := ioutil.WriteFile(failReadyFile, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	p.signal(syscall.SIGHUP)
+	line := p.waitLines(10*time.Second, "reload failed, keeping old worker", "finished reload")[0]
+	if !strings.Contains(line, "worker closed the ready pipe without sending ready notification") ||
+		!strings.Contains(line, "exit status 1") {
+		t.Errorf("unexpected reload failure message: %s", line)
+	}
+
+	if err := os.Remove(failReadyFile); err != nil {
+		t.Fatal(err)
+	}
+	p.signal(syscall.SIGHUP)
+	p.waitLine("received ready from new worker", 10*time.Second)
+
+	p.signal(syscall.SIGTERM)
+	if err := p.wait(); err != nil {
+		t.Errorf("master exited with error; %v", err)
+	}
+}
+
+func TestRunMasterReloadFailureStopOldAndExit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serverstarter-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	failReadyFile := filepath.Join(dir, "fail-ready")
+
+	p := startHelper(t, "simple", failReadyFileEnv+"="+failReadyFile,
+		reloadFailurePolicyEnv+"="+strconv.Itoa(int(ReloadFailureStopOldAndExit)))
+	p.waitLine("received ready from initial worker", 10*time.Second)
+
+	if err := ioutil.WriteFile(failReadyFile, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	p.signal(syscall.SIGHUP)
+	p.waitLine("reload failed, stopping old worker", 10*time.Second)
+	if err := p.wait(); err == nil {
+		t.Error("master exited without error")
+	}
+}
+
+func TestRunMasterNewWorkerCrashesDuringProbation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serverstarter-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	crashFile := filepath.Join(dir, "crash")
+
+	p := startHelper(t, "simple", crashAfterReadyFileEnv+"="+crashFile, probationEnv+"=1s")
+	p.waitLine("received ready from initial worker", 10*time.Second)
+
+	if err := ioutil.WriteFile(crashFile, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	p.signal(syscall.SIGHUP)
+	p.waitLine("received ready from new worker", 10*time.Second)
+	line := p.waitLines(10*time.Second, "reload failed, keeping old worker", "finished reload")[0]
+	if !strings.Contains(line, "new worker exited during probation with exit status 1") {
+		t.Errorf("unexpected reload failure message: %s", line)
+	}
+
+	if err := os.Remove(crashFile); err != nil {
+		t.Fatal(err)
+	}
+	p.signal(syscall.SIGHUP)
+	p.waitLine("new worker passed probation", 10*time.Second)
+
+	p.signal(syscall.SIGTERM)
+	if err := p.wait(); err != nil {
+		t.Errorf("master exited with error; %v", err)
+	}
+}
+
+func BenchmarkReloadManyListeners(b *testing.B) {
+	p := startHelper(b, "manylisteners")
+	p.waitLine("received ready from initial worker", 10*time.Second)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.signal(syscall.SIGHUP)
+		p.waitLine("finished reload", 10*time.Second)
+	}
+	b.StopTimer()
+
+	p.signal(syscall.SIGTERM)
+	if err := p.wait(); err != nil {
+		b.Errorf("master exited with error; %v", err)
+	}
+}
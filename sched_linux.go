@@ -0,0 +1,75 @@
+package serverstarter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// setNice sets the nice value of the process.
+//
+// NOTE: On Linux the nice value is a per-thread attribute, so we set it to
+// all threads of the process.
+func setNice(pid, nice int) error {
+	return forEachThread(pid, func(tid int) error {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, nice); err != nil {
+			return os.NewSyscallError("setpriority", err)
+		}
+		return nil
+	})
+}
+
+// cpuSetWords is the number of words for the CPU mask, which supports up to 1024 CPUs
+// in the same way as CPU_SETSIZE of glibc.
+const cpuSetWords = 1024 / 64
+
+// setCPUAffinity sets the CPU affinity mask of the process.
+//
+// NOTE: On Linux the CPU affinity mask is a per-thread attribute, so we set it to
+// all threads of the process.
+func setCPUAffinity(pid int, cpus []int) error {
+	var mask [cpuSetWords]uint64
+	for _, cpu := range cpus {
+		if cpu < 0 || cpu >= cpuSetWords*64 {
+			return fmt.Errorf("invalid CPU number %d for affinity", cpu)
+		}
+		mask[cpu/64] |= 1 << (uint(cpu) % 64)
+	}
+	return forEachThread(pid, func(tid int) error {
+		_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, uintptr(tid),
+			unsafe.Sizeof(mask), uintptr(unsafe.Pointer(&mask)))
+		if errno != 0 {
+			return os.NewSyscallError("sched_setaffinity", errno)
+		}
+		return nil
+	})
+}
+
+// forEachThread calls f with the ID of each thread of the process.
+// A thread which exits in the meantime is ignored.
+func forEachThread(pid int, f func(tid int) error) error {
+	entries, err := ioutil.ReadDir(fmt.Sprintf("/proc/%d/task", pid))
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		tid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		if err := f(tid); err != nil && !isNoSuchProcess(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func isNoSuchProcess(err error) bool {
+	if err, ok := err.(*os.SyscallError); ok {
+		return err.Err == syscall.ESRCH
+	}
+	return false
+}
@@ -0,0 +1,20 @@
+//go:build !linux && !windows
+
+package serverstarter
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+func setNice(pid, nice int) error {
+	if err := syscall.Setpriority(syscall.PRIO_PROCESS, pid, nice); err != nil {
+		return os.NewSyscallError("setpriority", err)
+	}
+	return nil
+}
+
+func setCPUAffinity(pid int, cpus []int) error {
+	return fmt.Errorf("setting CPU affinity of a worker is %w", ErrUnsupported)
+}
@@ -0,0 +1,43 @@
+package serverstarter
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// envSCTPFDs is the environment variable name for passing the SCTP listener
+// file descriptor count to the worker process.
+const envSCTPFDs = "SERVERSTARTER_SCTP_FDS"
+
+// SCTPListeners returns the files of the listening SCTP sockets passed from
+// the master with Inheritance.SCTPListeners if this is called by the worker
+// process. It returns nil when this is called by the master process.
+//
+// Since the standard library does not support SCTP, the worker creates the
+// listeners from the file descriptors of the files with an SCTP package.
+// The files are created on the first call in the process and the same files
+// are returned after that.
+func (s *Starter) SCTPListeners() ([]*os.File, error) {
+	if s.IsMaster() {
+		return nil, nil
+	}
+	if _, ok := lookupWorkerEnv(envSCTPFDs); !ok {
+		return nil, nil
+	}
+
+	inherited.mu.Lock()
+	defer inherited.mu.Unlock()
+	if inherited.sctp == nil {
+		fds, err := s.inheritedFDsLocked()
+		if err != nil {
+			return nil, fmt.Errorf("error in SCTPListeners after getting inherited file descriptors; %w", err)
+		}
+		files := make([]*os.File, len(fds.sctp))
+		for i, fd := range fds.sctp {
+			files[i] = os.NewFile(fd, "sctp"+strconv.Itoa(i))
+		}
+		inherited.sctp = files
+	}
+	return inherited.sctp, nil
+}
@@ -0,0 +1,57 @@
+//go:build !windows
+
+package serverstarter
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// sctpListenerFiles returns the duplicated files of the SCTP listeners and
+// their local addresses.
+func sctpListenerFiles(listeners []syscall.Conn) ([]*os.File, []string, error) {
+	files := make([]*os.File, len(listeners))
+	addrs := make([]string, len(listeners))
+	for i, l := range listeners {
+		rc, err := l.SyscallConn()
+		if err != nil {
+			closeFiles(files[:i])
+			return nil, nil, fmt.Errorf("error in sctpListenerFiles after getting raw connection of SCTP listener %d; %w", i, err)
+		}
+		var fd int
+		var dupErr error
+		if err := rc.Control(func(orig uintptr) {
+			fd, dupErr = dupCloseOnExec(int(orig))
+		}); err != nil {
+			closeFiles(files[:i])
+			return nil, nil, fmt.Errorf("error in sctpListenerFiles after accessing SCTP listener %d; %w", i, err)
+		}
+		if dupErr != nil {
+			closeFiles(files[:i])
+			return nil, nil, fmt.Errorf("error in sctpListenerFiles after duplicating SCTP listener %d; %w", i, dupErr)
+		}
+		files[i] = os.NewFile(uintptr(fd), "sctp"+strconv.Itoa(i))
+		addrs[i] = sockAddrString(fd)
+	}
+	return files, addrs, nil
+}
+
+// sockAddrString returns the local address of the socket fd in the form
+// "host:port", or an empty string if it is not an IP socket.
+func sockAddrString(fd int) string {
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		return ""
+	}
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return net.JoinHostPort(net.IP(sa.Addr[:]).String(), strconv.Itoa(sa.Port))
+	case *syscall.SockaddrInet6:
+		return net.JoinHostPort(net.IP(sa.Addr[:]).String(), strconv.Itoa(sa.Port))
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,89 @@
+//go:build !windows
+
+package serverstarter
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestSCTPListenerFiles(t *testing.T) {
+	// NOTE: We use TCP listeners since the kernel may not support SCTP, and
+	// sctpListenerFiles only needs the listening sockets.
+	var listeners []syscall.Conn
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		listeners = append(listeners, l.(*net.TCPListener))
+		addrs = append(addrs, l.Addr().String())
+	}
+
+	files, gotAddrs, err := sctpListenerFiles(listeners)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFiles(files)
+	if len(files) != len(listeners) || len(gotAddrs) != len(listeners) {
+		t.Fatalf("count mismatch, got files=%d, addrs=%d, want=%d", len(files), len(gotAddrs), len(listeners))
+	}
+	for i, f := range files {
+		if gotAddrs[i] != addrs[i] {
+			t.Errorf("address of listener %d mismatch, got=%s, want=%s", i, gotAddrs[i], addrs[i])
+		}
+		if got := sockAddrString(int(f.Fd())); got != addrs[i] {
+			t.Errorf("address of file %d mismatch, got=%s, want=%s", i, got, addrs[i])
+		}
+		// NOTE: The master passes the files to the workers with ExtraFiles, so
+		// the duplicated files must not leak to the other processes.
+		flags, err := fcntl(f.Fd(), syscall.F_GETFD)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if flags&syscall.FD_CLOEXEC == 0 {
+			t.Errorf("file %d does not have close-on-exec flag", i)
+		}
+	}
+}
+
+func TestSockAddrString(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 is not available; %v", err)
+	}
+	defer pc.Close()
+	rc, err := pc.(*net.UDPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got string
+	rc.Control(func(fd uintptr) {
+		got = sockAddrString(int(fd))
+	})
+	if want := pc.LocalAddr().String(); got != want {
+		t.Errorf("address mismatch, got=%s, want=%s", got, want)
+	}
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+	if got := sockAddrString(fds[0]); got != "" {
+		t.Errorf("address of unix domain socket mismatch, got=%q, want empty", got)
+	}
+}
+
+// fcntl returns the result of the fcntl system call with cmd for fd.
+func fcntl(fd uintptr, cmd int) (int, error) {
+	r, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fd, uintptr(cmd), 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(r), nil
+}
@@ -0,0 +1,444 @@
+//go:build !windows
+
+package serverstartertest
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hnakamur/serverstarter"
+)
+
+// fakeMaster is the master running RunMaster in the test process with
+// a FakeRunner and a control socket.
+type fakeMaster struct {
+	t       *testing.T
+	s       *serverstarter.Starter
+	dir     string
+	control string
+	errC    chan error
+	events  chan serverstarter.Event
+	skipped []serverstarter.Event
+	out     syncBuffer
+}
+
+// syncBuffer is the buffer for the output of the master which can be read
+// while the master writes to it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf strings.Builder
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// startFakeMaster starts RunMaster with r, the control socket and opts.
+func startFakeMaster(t *testing.T, r *FakeRunner, opts ...serverstarter.Option) *fakeMaster {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "serverstarter-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &fakeMaster{t: t, dir: dir, control: filepath.Join(dir, "control.sock"),
+		errC: make(chan error, 1), events: make(chan serverstarter.Event, 1000)}
+	opts = append([]serverstarter.Option{serverstarter.SetProcessRunner(r), serverstarter.SetOutput(&m.out),
+		serverstarter.SetControlSocket(m.control), serverstarter.SetEventHandler(func(e serverstarter.Event) {
+			m.events <- e
+		})}, opts...)
+	m.s = serverstarter.New(opts...)
+	go func() {
+		m.errC <- m.s.RunMaster(l)
+	}()
+	return m
+}
+
+// waitEvent waits for the master to emit the event of typ for the worker program
+// with the name and returns it. The other events are kept for the later calls.
+func (m *fakeMaster) waitEvent(typ serverstarter.EventType, name string) serverstarter.Event {
+	m.t.Helper()
+	for i, e := range m.skipped {
+		if e.Type == typ && e.Worker == name {
+			m.skipped = append(m.skipped[:i], m.skipped[i+1:]...)
+			return e
+		}
+	}
+	timer := time.NewTimer(5 * time.Second)
+	defer timer.Stop()
+	for {
+		select {
+		case e := <-m.events:
+			if e.Type == typ && e.Worker == name {
+				return e
+			}
+			m.skipped = append(m.skipped, e)
+		case <-timer.C:
+			m.t.Fatalf("master did not emit %s for worker %q", typ, name)
+		}
+	}
+}
+
+// waitOutput waits for the master to write the message containing substr
+// n times in total.
+func (m *fakeMaster) waitOutput(substr string, n int) {
+	m.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for strings.Count(m.out.String(), substr) < n {
+		if time.Now().After(deadline) {
+			m.t.Fatalf("master did not write %q %d times, output:\n%s", substr, n, m.out.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// commandAsync sends the command line to the control socket in a new goroutine
+// and returns the channel to which the response is sent.
+func (m *fakeMaster) commandAsync(line string) <-chan string {
+	m.t.Helper()
+	c := m.dial()
+	respC := make(chan string, 1)
+	go func() {
+		defer c.Close()
+		fmt.Fprintln(c, line)
+		resp, err := bufio.NewReader(c).ReadString('\n')
+		if err != nil {
+			respC <- "read error: " + err.Error()
+			return
+		}
+		respC <- strings.TrimSuffix(resp, "\n")
+	}()
+	return respC
+}
+
+// dial connects to the control socket, waiting for the master to listen on it.
+func (m *fakeMaster) dial() net.Conn {
+	m.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c, err := net.Dial("unix", m.control)
+		if err == nil {
+			return c
+		}
+		if time.Now().After(deadline) {
+			m.t.Fatalf("failed to connect to control socket; %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// command sends the command line to the control socket and returns the response.
+func (m *fakeMaster) command(line string) string {
+	m.t.Helper()
+	c := m.dial()
+	defer c.Close()
+	return sendCommand(m.t, c, line)
+}
+
+// sendCommand sends the command line on c and returns the response.
+func sendCommand(t *testing.T, c net.Conn, line string) string {
+	t.Helper()
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := c.Write([]byte(line + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil {
+		t.Fatalf("failed to read response to %q; %v", line, err)
+	}
+	return strings.TrimSuffix(resp, "\n")
+}
+
+// stop stops the master with the control command "stop" and waits for it to exit.
+func (m *fakeMaster) stop() {
+	m.t.Helper()
+	if resp := m.command("stop"); resp != "ok" {
+		m.t.Errorf("unexpected response to stop: %q", resp)
+	}
+	m.wait()
+}
+
+// wait waits for RunMaster to return and checks it returned no error.
+func (m *fakeMaster) wait() {
+	m.t.Helper()
+	select {
+	case err := <-m.errC:
+		if err != nil {
+			m.t.Errorf("master exited with error; %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		m.t.Fatal("master did not exit")
+	}
+}
+
+// workerName returns the name of the worker program of p, which the tests pass
+// as the only argument of the worker program.
+func workerName(p *FakeProcess) string {
+	return p.Cmd.Args[len(p.Cmd.Args)-1]
+}
+
+// addWorkers returns the options adding the worker programs with names, whose
+// only argument is the name.
+func addWorkers(names ...string) []serverstarter.Option {
+	var opts []serverstarter.Option
+	for _, name := range names {
+		opts = append(opts, serverstarter.AddWorker(serverstarter.WorkerSpec{Name: name, Args: []string{name}}))
+	}
+	return opts
+}
+
+func TestControlReloadRemovedWorker(t *testing.T) {
+	r := &FakeRunner{}
+	m := startFakeMaster(t, r, append(addWorkers("web", "batch"), serverstarter.SetNoRestartExitCode(86))...)
+	workers, err := r.WaitStarted(2, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.waitEvent(serverstarter.EventWorkerReady, "web")
+	m.waitEvent(serverstarter.EventWorkerReady, "batch")
+	for _, p := range workers {
+		if workerName(p) == "batch" {
+			p.Exit(86)
+		}
+	}
+	m.waitEvent(serverstarter.EventWorkerExited, "batch")
+
+	// NOTE: The name is still valid but the worker is not running anymore.
+	for _, line := range []string{"reload batch", "reload --dry-run batch"} {
+		if got, want := m.command(line), "error: worker batch is not running"; got != want {
+			t.Errorf("response to %q mismatch, got=%q, want=%q", line, got, want)
+		}
+	}
+	if resp := m.command("reload web"); !strings.HasPrefix(resp, "ok worker=web old_pid=") {
+		t.Errorf("unexpected response to reload of running worker: %q", resp)
+	}
+	m.stop()
+}
+
+// waitResponse waits for the response from respC returned by commandAsync.
+func waitResponse(t *testing.T, respC <-chan string) string {
+	t.Helper()
+	select {
+	case resp := <-respC:
+		return resp
+	case <-time.After(10 * time.Second):
+		t.Fatal("no response from master")
+	}
+	return ""
+}
+
+// releasingRunner returns the FakeRunner whose initial worker sends ready
+// at once and the later workers send ready when a value is sent to the
+// returned channel, so that the tests can send commands during a reload.
+func releasingRunner() (*FakeRunner, chan<- struct{}) {
+	release := make(chan struct{})
+	r := &FakeRunner{
+		OnStart: func(p *FakeProcess) {
+			if p.Pid() != fakePIDBase+1 {
+				<-release
+			}
+			p.SendReady()
+		},
+	}
+	return r, release
+}
+
+func TestControlBusyQueue(t *testing.T) {
+	r, release := releasingRunner()
+	m := startFakeMaster(t, r)
+	m.waitEvent(serverstarter.EventWorkerReady, "")
+
+	respA := m.commandAsync("reload")
+	if _, err := r.WaitStarted(2, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	respB := m.commandAsync("reload")
+	m.waitOutput("during reload, queued", 1)
+	if resp := m.command("status"); !strings.Contains(resp, " reloading=true reload_queued=true ") {
+		t.Errorf("unexpected status during reload with queued one: %q", resp)
+	}
+	respC := m.commandAsync("reload")
+	m.waitOutput("during reload, merged with queued one", 1)
+	if got, want := m.command("reload --dry-run"), `error: another reload command "reload" is already queued`; got != want {
+		t.Errorf("response to different reload command mismatch, got=%q, want=%q", got, want)
+	}
+
+	release <- struct{}{}
+	if resp := waitResponse(t, respA); !strings.HasPrefix(resp, fmt.Sprintf("ok old_pid=%d new_pid=%d ", fakePIDBase+1, fakePIDBase+2)) {
+		t.Errorf("unexpected response to first reload: %q", resp)
+	}
+
+	// NOTE: The reload command received after the queued reload starts is
+	// queued again instead of getting the result of the reload started before it.
+	if _, err := r.WaitStarted(3, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	respD := m.commandAsync("reload")
+	m.waitOutput("during reload, queued", 2)
+	release <- struct{}{}
+	resp := waitResponse(t, respB)
+	if !strings.HasPrefix(resp, fmt.Sprintf("ok old_pid=%d new_pid=%d ", fakePIDBase+2, fakePIDBase+3)) {
+		t.Errorf("unexpected response to queued reload: %q", resp)
+	}
+	if got := waitResponse(t, respC); got != resp {
+		t.Errorf("response to merged reload mismatch, got=%q, want=%q", got, resp)
+	}
+	release <- struct{}{}
+	if resp := waitResponse(t, respD); !strings.HasPrefix(resp, fmt.Sprintf("ok old_pid=%d new_pid=%d ", fakePIDBase+3, fakePIDBase+4)) {
+		t.Errorf("unexpected response to reload queued after queued one started: %q", resp)
+	}
+	m.stop()
+}
+
+func TestControlBusyReject(t *testing.T) {
+	r, release := releasingRunner()
+	m := startFakeMaster(t, r, serverstarter.SetControlBusyPolicy(serverstarter.ControlBusyReject))
+	m.waitEvent(serverstarter.EventWorkerReady, "")
+
+	respA := m.commandAsync("reload")
+	if _, err := r.WaitStarted(2, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		line string
+		want string
+	}{
+		{line: "reload", want: "busy: reload already in progress"},
+		{line: "reload --dry-run", want: "busy: reload already in progress"},
+		{line: "checksum " + strings.Repeat("0", 64), want: "busy"},
+		{line: "stop", want: "busy"},
+	} {
+		if got := m.command(c.line); got != c.want {
+			t.Errorf("response to %q during reload mismatch, got=%q, want=%q", c.line, got, c.want)
+		}
+	}
+	// NOTE: The status is available during a reload.
+	if resp := m.command("status"); !strings.Contains(resp, " reloading=true reload_queued=false ") {
+		t.Errorf("unexpected status during reload: %q", resp)
+	}
+
+	release <- struct{}{}
+	if resp := waitResponse(t, respA); !strings.HasPrefix(resp, "ok old_pid=") {
+		t.Errorf("unexpected response to reload: %q", resp)
+	}
+	m.stop()
+}
+
+func TestControlReloadNamedWorker(t *testing.T) {
+	r := &FakeRunner{}
+	m := startFakeMaster(t, r, addWorkers("web", "batch")...)
+	workers, err := r.WaitStarted(2, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.waitEvent(serverstarter.EventWorkerReady, "web")
+	m.waitEvent(serverstarter.EventWorkerReady, "batch")
+	pids := make(map[string]int)
+	for _, p := range workers {
+		pids[workerName(p)] = p.Pid()
+	}
+	if len(pids) != 2 || pids["web"] == 0 || pids["batch"] == 0 {
+		t.Fatalf("unexpected initial workers: %v", pids)
+	}
+
+	// NOTE: Only the worker with the name is replaced.
+	resp := m.command("reload batch")
+	if want := fmt.Sprintf("ok worker=batch old_pid=%d new_pid=%d ", pids["batch"], fakePIDBase+3); !strings.HasPrefix(resp, want) {
+		t.Errorf("unexpected response to reload of named worker, got=%q, want prefix %q", resp, want)
+	}
+	workers = r.Started()
+	if len(workers) != 3 || workerName(workers[2]) != "batch" {
+		t.Fatalf("unexpected workers after reload of named worker: %d workers", len(workers))
+	}
+	for _, p := range workers[:2] {
+		got := p.Received()
+		if workerName(p) == "web" && len(got) != 0 {
+			t.Errorf("worker web received signals %v by reload of batch", got)
+		}
+		if workerName(p) == "batch" && (len(got) != 1 || got[0] != syscall.SIGTERM) {
+			t.Errorf("signals to old worker batch mismatch, got=%v, want=[SIGTERM]", got)
+		}
+	}
+
+	if got, want := m.command("reload nosuch"), `error: unknown worker "nosuch"`; got != want {
+		t.Errorf("response to reload of unknown worker mismatch, got=%q, want=%q", got, want)
+	}
+	if got, want := m.command("reload --dry-run web"), "ok"; got != want {
+		t.Errorf("response to dry run reload of named worker mismatch, got=%q, want=%q", got, want)
+	}
+
+	// NOTE: The reload without a name replaces all the workers one by one.
+	resp = m.command("reload")
+	if !strings.HasPrefix(resp, "ok worker=web old_pid=") || !strings.Contains(resp, " worker=batch old_pid=") {
+		t.Errorf("unexpected response to reload of all workers: %q", resp)
+	}
+	m.stop()
+}
+
+func TestControlSocketProtocol(t *testing.T) {
+	r := &FakeRunner{}
+	m := startFakeMaster(t, r)
+	m.waitEvent(serverstarter.EventWorkerReady, "")
+
+	// NOTE: A client can send commands one by one on a connection.
+	c := m.dial()
+	defer c.Close()
+	for _, cmd := range []struct {
+		line       string
+		wantPrefix string
+	}{
+		{line: "", wantPrefix: "error: empty command"},
+		{line: "nosuch", wantPrefix: `error: unknown command "nosuch"`},
+		{line: "status now", wantPrefix: `error: command "status" takes no arguments`},
+		{line: "last-reload", wantPrefix: "error: no reload has been done"},
+		{line: "status", wantPrefix: "ok generation=1 reloading=false reload_queued=false "},
+		{line: "  reload  ", wantPrefix: fmt.Sprintf("ok old_pid=%d new_pid=%d duration=", fakePIDBase+1, fakePIDBase+2)},
+		{line: "last-reload", wantPrefix: "ok started_at="},
+		{line: "status", wantPrefix: "ok generation=2 reloading=false reload_queued=false graceful_shutdowns=1 "},
+		{line: "checksum " + strings.Repeat("AB", 32), wantPrefix: "ok"},
+		{line: "stop", wantPrefix: "ok"},
+	} {
+		if got := sendCommand(t, c, cmd.line); !strings.HasPrefix(got, cmd.wantPrefix) {
+			t.Errorf("response to %q mismatch, got=%q, want prefix %q", cmd.line, got, cmd.wantPrefix)
+		}
+	}
+	m.wait()
+	if _, err := os.Stat(m.control); !os.IsNotExist(err) {
+		t.Errorf("control socket is not removed after master exited; %v", err)
+	}
+}
+
+func TestControlLastReloadResult(t *testing.T) {
+	r := &FakeRunner{}
+	m := startFakeMaster(t, r)
+	m.waitEvent(serverstarter.EventWorkerReady, "")
+	resp := m.command("reload")
+	// NOTE: The response to last-reload is the one to the reload with the start time.
+	last := m.command("last-reload")
+	i := strings.Index(last, " old_pid=")
+	if !strings.HasPrefix(last, "ok started_at=") || i == -1 || "ok"+last[i:] != resp {
+		t.Errorf("response to last-reload %q does not match response to reload %q", last, resp)
+	}
+	m.stop()
+}
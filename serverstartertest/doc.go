@@ -0,0 +1,36 @@
+// Package serverstartertest provides a fake master for testing the worker code
+// using serverstarter in the same process, and a fake runner of workers for
+// testing the master, without starting the master and worker processes.
+//
+// NewMaster passes the listeners to the worker code over a socket pair in
+// the same way as the master with SetPassFDsOverSocket, and receives the ready
+// notification and the other messages from it:
+//
+//	l, _ := net.Listen("tcp", "127.0.0.1:0")
+//	m, err := serverstartertest.NewMaster(serverstartertest.Options{Listeners: []net.Listener{l}})
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	defer m.Close()
+//	go runWorker() // calls serverstarter.New().Listeners() and SendReady()
+//	if err := m.WaitReady(5 * time.Second); err != nil {
+//		t.Fatal(err)
+//	}
+//
+// FakeRunner is a fake serverstarter.ProcessRunner for testing the master
+// without starting worker processes. The fake workers are driven by the test:
+//
+//	r := &serverstartertest.FakeRunner{}
+//	s := serverstarter.New(serverstarter.SetProcessRunner(r))
+//	go s.RunMaster(l)
+//	workers, err := r.WaitStarted(1, 5*time.Second)
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	workers[0].Exit(1) // the master restarts the worker
+//	if _, err := r.WaitStarted(2, 5*time.Second); err != nil {
+//		t.Fatal(err)
+//	}
+//
+// This package is not supported on Windows.
+package serverstartertest
@@ -0,0 +1,328 @@
+//go:build !windows
+
+package serverstartertest
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hnakamur/serverstarter/internal/testhook"
+)
+
+const (
+	// envFDSocket is the environment variable for the socket over which
+	// the master passes the file descriptors and the worker sends messages.
+	envFDSocket = "SERVERSTARTER_FD_SOCKET"
+	// envProtocolVersion is the environment variable for the version of
+	// the message protocol which the master supports.
+	envProtocolVersion = "SERVERSTARTER_PROTOCOL_VERSION"
+	// envMasterPID is the environment variable for the process ID of the master,
+	// which is unset since the fake master is this process itself.
+	envMasterPID = "SERVERSTARTER_MASTER_PID"
+	// envGeneration is the environment variable for the generation number.
+	envGeneration = "SERVERSTARTER_GENERATION"
+	// envWorkerIndex is the environment variable for the index in the pool.
+	envWorkerIndex = "SERVERSTARTER_WORKER_INDEX"
+	// defaultEnvName is the default of Options.EnvName.
+	defaultEnvName = "LISTEN_FDS"
+
+	// protocolVersion is the version of the framed message protocol.
+	protocolVersion = 1
+	// frameByte is the first byte of a framed message.
+	frameByte = 'F'
+)
+
+// MessageType is the type of a message sent from the worker to the master.
+type MessageType byte
+
+// The types of the messages sent by the methods of serverstarter.Starter.
+const (
+	// MessageReady is sent by SendReady.
+	MessageReady MessageType = 'r'
+	// MessageWarm is sent by SendWarm.
+	MessageWarm MessageType = 'w'
+	// MessageDrain is sent by SendDrainProgress. The payload is the number
+	// of the active connections in 4 bytes big endian.
+	MessageDrain MessageType = 'd'
+	// MessageListenerReady is sent by SendListenerReady. The payload is
+	// the index of the listener in 4 bytes big endian.
+	MessageListenerReady MessageType = 'l'
+	// MessageRecycle is sent by RequestRecycle.
+	MessageRecycle MessageType = 'c'
+	// MessageReloadRequest is sent by RequestReload.
+	MessageReloadRequest MessageType = 'h'
+	// MessageRetire is sent by SendRetiring.
+	MessageRetire MessageType = 'x'
+	// MessageHeartbeat is sent by Heartbeat. The fake master replies to it.
+	MessageHeartbeat MessageType = 'b'
+	// MessageMetadata is sent by SendMetadata. The payload is "key=value".
+	MessageMetadata MessageType = 'm'
+	// MessageListenRequest is sent by RequestListen. The fake master does
+	// not pass new listeners.
+	MessageListenRequest MessageType = 'a'
+)
+
+// Message is a message sent from the worker to the master.
+type Message struct {
+	Type    MessageType
+	Payload []byte
+}
+
+// Options is the options for NewMaster.
+type Options struct {
+	// Listeners are passed to the worker as the listeners passed to RunMaster.
+	// They are duplicated, so the caller keeps the ownership of them.
+	Listeners []net.Listener
+
+	// Generation is the generation number of the worker. If zero, 1 is used.
+	Generation int
+
+	// WorkerIndex is the index of the worker in the pool set by SetWorkerCount.
+	WorkerIndex int
+
+	// EnvName is the environment variable name set by SetEnvName in the worker.
+	// If empty, "LISTEN_FDS" is used.
+	EnvName string
+
+	// Env is the environment variables set in addition while the master is open.
+	Env map[string]string
+}
+
+// Master is a fake master which passes the listeners to the worker code
+// running in this process and receives the messages from it.
+type Master struct {
+	conn  *net.UnixConn
+	msgC  chan Message
+	done  chan struct{}
+	err   error
+	saved map[string]*string
+}
+
+var (
+	activeMu sync.Mutex
+	active   bool
+)
+
+// NewMaster sets up the environment of this process as a worker started by
+// the master, so that the Starters created by serverstarter.New after this
+// act as the worker: IsMaster returns false, Listeners and Inherited return
+// the listeners in opts.Listeners, and SendReady and the other messages are
+// sent to the returned Master.
+//
+// Only one Master can be open in a process at a time, since the environment
+// is shared by the process. Close must be called to restore the environment.
+func NewMaster(opts Options) (*Master, error) {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+	if active {
+		return nil, errors.New("error in NewMaster; another master is open")
+	}
+
+	files := make([]*os.File, 0, len(opts.Listeners))
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, l := range opts.Listeners {
+		fl, ok := l.(interface{ File() (*os.File, error) })
+		if !ok {
+			return nil, fmt.Errorf("error in NewMaster; unsupported listener type %T", l)
+		}
+		f, err := fl.File()
+		if err != nil {
+			return nil, fmt.Errorf("error in NewMaster after getting file of listener; %w", err)
+		}
+		files = append(files, f)
+	}
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, fmt.Errorf("error in NewMaster after creating socket pair; %w", err)
+	}
+	parent := os.NewFile(uintptr(fds[0]), "fakeMaster")
+	c, err := net.FileConn(parent)
+	parent.Close()
+	if err != nil {
+		syscall.Close(fds[1])
+		return nil, fmt.Errorf("error in NewMaster after creating connection; %w", err)
+	}
+	m := &Master{conn: c.(*net.UnixConn), msgC: make(chan Message, 16), done: make(chan struct{})}
+	if err := m.sendFDs(files); err != nil {
+		m.conn.Close()
+		syscall.Close(fds[1])
+		return nil, fmt.Errorf("error in NewMaster after sending file descriptors; %w", err)
+	}
+
+	generation := opts.Generation
+	if generation == 0 {
+		generation = 1
+	}
+	envName := opts.EnvName
+	if envName == "" {
+		envName = defaultEnvName
+	}
+	env := map[string]string{
+		envName:            strconv.Itoa(len(files)),
+		envFDSocket:        strconv.Itoa(fds[1]),
+		envProtocolVersion: strconv.Itoa(protocolVersion),
+		envGeneration:      strconv.Itoa(generation),
+		envWorkerIndex:     strconv.Itoa(opts.WorkerIndex),
+	}
+	for k, v := range opts.Env {
+		env[k] = v
+	}
+	m.saved = make(map[string]*string)
+	m.saveEnv(envMasterPID)
+	os.Unsetenv(envMasterPID)
+	for k, v := range env {
+		m.saveEnv(k)
+		os.Setenv(k, v)
+	}
+	testhook.ResetWorker()
+	active = true
+
+	go m.readMessages()
+	return m, nil
+}
+
+// sendFDs sends the header and the file descriptors of the listeners in
+// the same way as the master with SetPassFDsOverSocket.
+func (m *Master) sendFDs(files []*os.File) error {
+	header, err := json.Marshal(map[string]int{"listeners": len(files)})
+	if err != nil {
+		return err
+	}
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(header)))
+	if _, err := m.conn.Write(append(size[:], header...)); err != nil {
+		return err
+	}
+	for _, f := range files {
+		if _, _, err := m.conn.WriteMsgUnix([]byte{0}, syscall.UnixRights(int(f.Fd())), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveEnv saves the environment variable with key to restore it in Close.
+func (m *Master) saveEnv(key string) {
+	if _, ok := m.saved[key]; ok {
+		return
+	}
+	var saved *string
+	if v, ok := os.LookupEnv(key); ok {
+		saved = &v
+	}
+	m.saved[key] = saved
+}
+
+// readMessages reads the messages from the worker and sends them to msgC
+// until it gets an error. It replies to heartbeats.
+func (m *Master) readMessages() {
+	defer close(m.msgC)
+	for {
+		var header [5]byte
+		if _, err := io.ReadFull(m.conn, header[:]); err != nil {
+			m.err = err
+			return
+		}
+		if header[0] != frameByte {
+			m.err = fmt.Errorf("unexpected first byte %q of message", header[0])
+			return
+		}
+		msg := Message{
+			Type:    MessageType(header[2]),
+			Payload: make([]byte, binary.BigEndian.Uint16(header[3:])),
+		}
+		if _, err := io.ReadFull(m.conn, msg.Payload); err != nil {
+			m.err = err
+			return
+		}
+		if msg.Type == MessageHeartbeat {
+			reply := []byte{frameByte, protocolVersion, byte(MessageHeartbeat), 0, 0}
+			if _, err := m.conn.Write(reply); err != nil {
+				m.err = err
+				return
+			}
+		}
+		select {
+		case m.msgC <- msg:
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// Next returns the next message from the worker. It returns an error if
+// no message is received within timeout or the worker closes the pipe.
+func (m *Master) Next(timeout time.Duration) (Message, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case msg, ok := <-m.msgC:
+		if !ok {
+			return Message{}, fmt.Errorf("worker closed pipe to master; %w", m.err)
+		}
+		return msg, nil
+	case <-timer.C:
+		return Message{}, fmt.Errorf("no message from worker within %s", timeout)
+	}
+}
+
+// WaitReady waits for the worker to send ready, skipping the other messages.
+func (m *Master) WaitReady(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		msg, err := m.Next(time.Until(deadline))
+		if err != nil {
+			return fmt.Errorf("error in WaitReady; %w", err)
+		}
+		if msg.Type == MessageReady {
+			return nil
+		}
+	}
+}
+
+// Signal sends sig to this process as the master sends the graceful shutdown
+// signal to the worker. The worker code must handle sig with signal.Notify,
+// or the test process is terminated.
+func (m *Master) Signal(sig os.Signal) error {
+	p, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		return err
+	}
+	return p.Signal(sig)
+}
+
+// Close closes the pipe to the worker and restores the environment of this
+// process. The listeners returned to the worker code are left open.
+//
+// NOTE: The socket of the worker is not closed, since the Starter of the worker
+// code may have it and close it later.
+func (m *Master) Close() error {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+	close(m.done)
+	err := m.conn.Close()
+	for k, v := range m.saved {
+		if v == nil {
+			os.Unsetenv(k)
+		} else {
+			os.Setenv(k, *v)
+		}
+	}
+	testhook.ResetWorker()
+	active = false
+	return err
+}
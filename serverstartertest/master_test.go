@@ -0,0 +1,129 @@
+//go:build !windows
+
+package serverstartertest
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hnakamur/serverstarter"
+)
+
+func TestMaster(t *testing.T) {
+	for generation := 1; generation <= 2; generation++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		m, err := NewMaster(Options{Listeners: []net.Listener{l}, Generation: generation, WorkerIndex: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s := serverstarter.New()
+		if s.IsMaster() {
+			t.Fatal("IsMaster returned true in fake worker environment")
+		}
+		if got := s.Generation(); got != generation {
+			t.Errorf("generation mismatch, got=%d, want=%d", got, generation)
+		}
+		if got := s.WorkerIndex(); got != 1 {
+			t.Errorf("worker index mismatch, got=%d, want=1", got)
+		}
+		listeners, err := s.Listeners()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(listeners) != 1 || listeners[0].Addr().String() != l.Addr().String() {
+			t.Fatalf("unexpected listeners %v, want one for %s", listeners, l.Addr())
+		}
+		listeners[0].Close()
+
+		if err := s.SendWarm(); !errors.Is(err, serverstarter.ErrReadyNotSent) {
+			t.Errorf("unexpected error from SendWarm before SendReady; %v", err)
+		}
+		if err := s.SendReady(); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.WaitReady(5 * time.Second); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Heartbeat(5 * time.Second); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.SendMetadata("config", "v1"); err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range []Message{{Type: MessageHeartbeat}, {Type: MessageMetadata, Payload: []byte("config=v1")}} {
+			msg, err := m.Next(5 * time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.Type != want.Type || string(msg.Payload) != string(want.Payload) {
+				t.Errorf("message mismatch, got=%q %q, want=%q %q", msg.Type, msg.Payload, want.Type, want.Payload)
+			}
+		}
+
+		if err := m.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if !serverstarter.New().IsMaster() {
+			t.Error("IsMaster returned false after closing fake master")
+		}
+	}
+}
+
+func TestMasterConcurrentSends(t *testing.T) {
+	m, err := NewMaster(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	s := serverstarter.New()
+	if err := s.SendReady(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WaitReady(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	const goroutines, count = 8, 20
+	value := strings.Repeat("v", 4096)
+	errC := make(chan error, goroutines+1)
+	for i := 0; i < goroutines; i++ {
+		go func(key string) {
+			for j := 0; j < count; j++ {
+				if err := s.SendMetadata(key, value); err != nil {
+					errC <- err
+					return
+				}
+			}
+			errC <- nil
+		}(strconv.Itoa(i))
+	}
+	go func() { errC <- s.SendWarm() }()
+
+	for i := 0; i < goroutines*count+1; i++ {
+		msg, err := m.Next(5 * time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type == MessageWarm {
+			continue
+		}
+		if msg.Type != MessageMetadata || !strings.HasSuffix(string(msg.Payload), "="+value) {
+			t.Fatalf("unexpected message %q with payload of %d bytes", msg.Type, len(msg.Payload))
+		}
+	}
+	for i := 0; i < goroutines+1; i++ {
+		if err := <-errC; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+//go:build !windows
+
+package serverstartertest
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hnakamur/serverstarter"
+)
+
+// fakePIDBase is the base of the process IDs of the fake workers, which is
+// above the maximum process ID of Linux, so that the signals sent to them by
+// mistake do not reach real processes.
+const fakePIDBase = 1 << 22
+
+// FakeRunner is a serverstarter.ProcessRunner which starts fake workers without
+// starting processes, for testing the signal handling and the restart logic of
+// the master with serverstarter.SetProcessRunner deterministically.
+// The zero value is ready to use.
+type FakeRunner struct {
+	// OnStart is called in a new goroutine for each fake worker started by
+	// the master. If nil, the fake worker sends ready at once.
+	OnStart func(p *FakeProcess)
+
+	// OnSignal is called when the master sends sig to the fake worker p, except
+	// for SIGKILL which always kills it. If nil, the fake worker exits with
+	// the status 0 on SIGTERM and SIGINT, and ignores the other signals.
+	OnSignal func(p *FakeProcess, sig os.Signal)
+
+	mu       sync.Mutex
+	changed  chan struct{}
+	started  []*FakeProcess
+	startErr error
+}
+
+// Start starts a fake worker for cmd.
+func (r *FakeRunner) Start(cmd *exec.Cmd) (serverstarter.Process, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.startErr != nil {
+		return nil, r.startErr
+	}
+	var msgFile *os.File
+	for _, f := range cmd.ExtraFiles {
+		if f != nil {
+			msgFile = f
+			break
+		}
+	}
+	if msgFile == nil {
+		return nil, errors.New("no socket to master in command")
+	}
+	fd, err := syscall.Dup(int(msgFile.Fd()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to duplicate socket to master; %w", err)
+	}
+	syscall.CloseOnExec(fd)
+	p := &FakeProcess{
+		Cmd:    cmd,
+		runner: r,
+		pid:    fakePIDBase + len(r.started) + 1,
+		msgW:   os.NewFile(uintptr(fd), "fakeWorker"),
+		exitC:  make(chan struct{}),
+	}
+	r.started = append(r.started, p)
+	if r.changed != nil {
+		close(r.changed)
+		r.changed = nil
+	}
+	onStart := r.OnStart
+	if onStart == nil {
+		onStart = func(p *FakeProcess) { p.SendReady() }
+	}
+	go onStart(p)
+	return p, nil
+}
+
+// SetStartError makes Start fail with err, or succeed if err is nil.
+func (r *FakeRunner) SetStartError(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.startErr = err
+}
+
+// Started returns the fake workers started so far in the order of starting.
+func (r *FakeRunner) Started() []*FakeProcess {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*FakeProcess(nil), r.started...)
+}
+
+// WaitStarted waits until n fake workers are started and returns them in
+// the order of starting.
+func (r *FakeRunner) WaitStarted(n int, timeout time.Duration) ([]*FakeProcess, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		r.mu.Lock()
+		if len(r.started) >= n {
+			started := append([]*FakeProcess(nil), r.started[:n]...)
+			r.mu.Unlock()
+			return started, nil
+		}
+		if r.changed == nil {
+			r.changed = make(chan struct{})
+		}
+		changed := r.changed
+		count := len(r.started)
+		r.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return nil, fmt.Errorf("only %d of %d workers started within %s", count, n, timeout)
+		}
+	}
+}
+
+// FakeProcess is a fake worker started by FakeRunner.
+type FakeProcess struct {
+	// Cmd is the command prepared by the master for the worker, whose
+	// arguments and environment variables can be checked in tests.
+	Cmd *exec.Cmd
+
+	runner *FakeRunner
+	pid    int
+	msgW   *os.File
+
+	mu       sync.Mutex
+	received []os.Signal
+	exited   bool
+	exitErr  error
+	exitC    chan struct{}
+}
+
+// FakeExitError is the error returned from FakeProcess.Wait when the fake worker
+// exits with a non-zero status or is killed.
+type FakeExitError struct {
+	// Code is the exit code, or -1 if the fake worker is killed by Signal.
+	Code int
+	// Signal is the signal which killed the fake worker, or nil.
+	Signal os.Signal
+}
+
+func (e *FakeExitError) Error() string {
+	if e.Signal != nil {
+		return "signal: " + e.Signal.String()
+	}
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
+// ExitCode returns the exit code, which the master uses like the one of
+// *exec.ExitError.
+func (e *FakeExitError) ExitCode() int {
+	return e.Code
+}
+
+// Pid returns the fake process ID.
+func (p *FakeProcess) Pid() int {
+	return p.pid
+}
+
+// Signal records sig and handles it as described in FakeRunner.OnSignal.
+func (p *FakeProcess) Signal(sig os.Signal) error {
+	p.mu.Lock()
+	if p.exited {
+		p.mu.Unlock()
+		return errors.New("os: process already finished")
+	}
+	p.received = append(p.received, sig)
+	p.mu.Unlock()
+
+	switch {
+	case sig == syscall.SIGKILL:
+		p.exit(&FakeExitError{Code: -1, Signal: sig})
+	case p.runner.OnSignal != nil:
+		p.runner.OnSignal(p, sig)
+	case sig == syscall.SIGTERM || sig == syscall.SIGINT:
+		p.Exit(0)
+	}
+	return nil
+}
+
+// Received returns the signals which the master has sent to the fake worker.
+func (p *FakeProcess) Received() []os.Signal {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]os.Signal(nil), p.received...)
+}
+
+// Wait waits for the fake worker to exit.
+func (p *FakeProcess) Wait() error {
+	<-p.exitC
+	return p.exitErr
+}
+
+// Exited returns the channel which is closed when the fake worker exits.
+func (p *FakeProcess) Exited() <-chan struct{} {
+	return p.exitC
+}
+
+// Exit makes the fake worker exit with code.
+func (p *FakeProcess) Exit(code int) {
+	var err error
+	if code != 0 {
+		err = &FakeExitError{Code: code}
+	}
+	p.exit(err)
+}
+
+func (p *FakeProcess) exit(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.exited {
+		return
+	}
+	p.exited = true
+	p.exitErr = err
+	p.msgW.Close()
+	close(p.exitC)
+}
+
+// SendReady sends ready to the master like serverstarter.Starter.SendReady.
+func (p *FakeProcess) SendReady() error {
+	return p.Send(MessageReady, nil)
+}
+
+// Send sends the message of typ with payload to the master.
+func (p *FakeProcess) Send(typ MessageType, payload []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.exited {
+		return errors.New("fake worker already exited")
+	}
+	b := []byte{frameByte, protocolVersion, byte(typ), 0, 0}
+	binary.BigEndian.PutUint16(b[3:], uint16(len(payload)))
+	_, err := p.msgW.Write(append(b, payload...))
+	return err
+}
@@ -0,0 +1,407 @@
+//go:build !windows
+
+package serverstartertest
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hnakamur/serverstarter"
+)
+
+func TestFakeRunner(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &FakeRunner{}
+	readyC := make(chan int, 10)
+	s := serverstarter.New(serverstarter.SetProcessRunner(r), serverstarter.SetOutput(ioutil.Discard),
+		serverstarter.SetEventHandler(func(e serverstarter.Event) {
+			if e.Type == serverstarter.EventWorkerReady {
+				readyC <- e.PID
+			}
+		}))
+	waitReady := func(p *FakeProcess) {
+		t.Helper()
+		select {
+		case pid := <-readyC:
+			if pid != p.Pid() {
+				t.Fatalf("ready worker mismatch, got=%d, want=%d", pid, p.Pid())
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("master did not receive ready")
+		}
+	}
+	errC := make(chan error, 1)
+	go func() {
+		errC <- s.RunMaster(l)
+	}()
+
+	// NOTE: The master handles the signals before starting the initial worker.
+	workers, err := r.WaitStarted(1, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitReady(workers[0])
+	workers[0].Exit(1)
+	workers, err = r.WaitStarted(2, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Generation(); got != 2 {
+		t.Errorf("generation mismatch after restart, got=%d, want=2", got)
+	}
+
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	workers, err = r.WaitStarted(3, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-workers[1].Exited():
+	case <-time.After(5 * time.Second):
+		t.Fatal("old worker was not stopped after reload")
+	}
+	if got := workers[1].Received(); len(got) != 1 || got[0] != syscall.SIGTERM {
+		t.Errorf("signals to old worker mismatch, got=%v, want=[SIGTERM]", got)
+	}
+
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	select {
+	case err := <-errC:
+		if err != nil {
+			t.Errorf("master exited with error; %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("master did not exit")
+	}
+	select {
+	case <-workers[2].Exited():
+	default:
+		t.Error("worker was not stopped with master")
+	}
+}
+
+func TestFakeRunnerReloadFailure(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &FakeRunner{
+		OnStart: func(p *FakeProcess) {
+			if p.Pid() == fakePIDBase+1 {
+				p.SendReady()
+			} else {
+				p.Exit(3)
+			}
+		},
+	}
+	events := make(chan serverstarter.Event, 10)
+	s := serverstarter.New(serverstarter.SetProcessRunner(r), serverstarter.SetOutput(ioutil.Discard),
+		serverstarter.SetEventHandler(func(e serverstarter.Event) {
+			if e.Type == serverstarter.EventWorkerReady || e.Type == serverstarter.EventReloadFailed {
+				events <- e
+			}
+		}))
+	errC := make(chan error, 1)
+	go func() {
+		errC <- s.RunMaster(l)
+	}()
+	waitEvent := func(typ serverstarter.EventType) serverstarter.Event {
+		t.Helper()
+		select {
+		case e := <-events:
+			if e.Type != typ {
+				t.Fatalf("event mismatch, got=%s, want=%s", e.Type, typ)
+			}
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatalf("master did not emit %s", typ)
+		}
+		return serverstarter.Event{}
+	}
+
+	waitEvent(serverstarter.EventWorkerReady)
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	e := waitEvent(serverstarter.EventReloadFailed)
+	var startErr *serverstarter.WorkerStartError
+	if !errors.As(e.Err, &startErr) {
+		t.Fatalf("error is not WorkerStartError; %v", e.Err)
+	}
+	if startErr.PID != fakePIDBase+2 || startErr.ExitCode != 3 {
+		t.Errorf("unexpected WorkerStartError; %v", startErr)
+	}
+
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	select {
+	case err := <-errC:
+		if err != nil {
+			t.Errorf("master exited with error; %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("master did not exit")
+	}
+}
+
+func TestFakeRunnerDrainedWorkerExit(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &FakeRunner{
+		OnSignal: func(p *FakeProcess, sig os.Signal) {
+			if sig != syscall.SIGTERM {
+				return
+			}
+			// NOTE: The old worker reports no active connections and exits
+			// shortly after that, like a worker which drained cleanly.
+			go func() {
+				p.Send(MessageDrain, []byte{0, 0, 0, 0})
+				time.Sleep(100 * time.Millisecond)
+				p.Exit(0)
+			}()
+		},
+	}
+	events := make(chan serverstarter.Event, 10)
+	s := serverstarter.New(serverstarter.SetProcessRunner(r), serverstarter.SetOutput(ioutil.Discard),
+		serverstarter.SetEventHandler(func(e serverstarter.Event) {
+			if e.Type == serverstarter.EventWorkerReady || e.Type == serverstarter.EventOldWorkerExited {
+				events <- e
+			}
+		}))
+	errC := make(chan error, 1)
+	go func() {
+		errC <- s.RunMaster(l)
+	}()
+	waitEvent := func(typ serverstarter.EventType) serverstarter.Event {
+		t.Helper()
+		select {
+		case e := <-events:
+			if e.Type != typ {
+				t.Fatalf("event mismatch, got=%s, want=%s", e.Type, typ)
+			}
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatalf("master did not emit %s", typ)
+		}
+		return serverstarter.Event{}
+	}
+
+	waitEvent(serverstarter.EventWorkerReady)
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	waitEvent(serverstarter.EventWorkerReady)
+	if e := waitEvent(serverstarter.EventOldWorkerExited); e.Forced {
+		t.Error("exit of old worker which drained cleanly was counted as forced")
+	}
+	workers := r.Started()
+	if got := workers[0].Received(); len(got) != 1 || got[0] != syscall.SIGTERM {
+		t.Errorf("signals to old worker mismatch, got=%v, want=[SIGTERM]", got)
+	}
+	if stats := s.Stats(); stats.GracefulShutdowns != 1 || stats.ForcedShutdowns != 0 {
+		t.Errorf("shutdown counts mismatch, got graceful=%d forced=%d, want graceful=1 forced=0", stats.GracefulShutdowns, stats.ForcedShutdowns)
+	}
+
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	select {
+	case err := <-errC:
+		if err != nil {
+			t.Errorf("master exited with error; %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("master did not exit")
+	}
+}
+
+// drainingRunner returns the FakeRunner whose initial worker ignores the graceful
+// shutdown signal and calls onDrain instead, and the other workers exit on it.
+func drainingRunner(onDrain func(p *FakeProcess)) *FakeRunner {
+	return &FakeRunner{
+		OnSignal: func(p *FakeProcess, sig os.Signal) {
+			if sig != syscall.SIGTERM {
+				return
+			}
+			if p.Pid() == fakePIDBase+1 {
+				go onDrain(p)
+				return
+			}
+			p.Exit(0)
+		},
+	}
+}
+
+func TestFakeRunnerDrainPolicyWait(t *testing.T) {
+	var mu sync.Mutex
+	var reported []int
+	policy := serverstarter.DrainPolicyFunc(func(stats serverstarter.DrainStats) (serverstarter.DrainDecision, time.Duration) {
+		if stats.ActiveConnsReported {
+			mu.Lock()
+			reported = append(reported, stats.ActiveConns)
+			mu.Unlock()
+		}
+		return serverstarter.DrainWait, 10 * time.Millisecond
+	})
+	r := drainingRunner(func(p *FakeProcess) {
+		p.Send(MessageDrain, []byte{0, 0, 0, 3})
+		time.Sleep(100 * time.Millisecond)
+		p.Exit(0)
+	})
+	m := startFakeMaster(t, r, serverstarter.SetDrainPolicy(policy))
+	m.waitEvent(serverstarter.EventWorkerReady, "")
+
+	if resp := m.command("reload"); !strings.HasPrefix(resp, "ok old_pid=") {
+		t.Errorf("unexpected response to reload: %q", resp)
+	}
+	if e := m.waitEvent(serverstarter.EventDrainProgress, ""); e.ActiveConns != 3 {
+		t.Errorf("active connections in drain progress mismatch, got=%d, want=3", e.ActiveConns)
+	}
+	if e := m.waitEvent(serverstarter.EventOldWorkerExited, ""); e.Forced {
+		t.Error("exit of old worker which the policy waited for was counted as forced")
+	}
+	mu.Lock()
+	if len(reported) == 0 || reported[len(reported)-1] != 3 {
+		t.Errorf("active connections passed to policy mismatch, got=%v, want last 3", reported)
+	}
+	mu.Unlock()
+	if got := r.Started()[0].Received(); len(got) != 1 || got[0] != syscall.SIGTERM {
+		t.Errorf("signals to old worker mismatch, got=%v, want=[SIGTERM]", got)
+	}
+	m.stop()
+}
+
+func TestFakeRunnerDrainPolicyContinue(t *testing.T) {
+	policy := serverstarter.DrainPolicyFunc(func(stats serverstarter.DrainStats) (serverstarter.DrainDecision, time.Duration) {
+		return serverstarter.DrainContinue, 0
+	})
+	r := drainingRunner(func(p *FakeProcess) {})
+	m := startFakeMaster(t, r, serverstarter.SetDrainPolicy(policy))
+	m.waitEvent(serverstarter.EventWorkerReady, "")
+
+	// NOTE: The reload finishes while the old worker keeps running.
+	if resp := m.command("reload"); !strings.HasPrefix(resp, "ok old_pid=") {
+		t.Errorf("unexpected response to reload: %q", resp)
+	}
+	old := r.Started()[0]
+	select {
+	case <-old.Exited():
+		t.Error("old worker was stopped though the policy continued")
+	default:
+	}
+	if got := old.Received(); len(got) != 1 || got[0] != syscall.SIGTERM {
+		t.Errorf("signals to old worker mismatch, got=%v, want=[SIGTERM]", got)
+	}
+	old.Exit(0)
+	m.stop()
+}
+
+func TestFakeRunnerDrainPolicyEscalate(t *testing.T) {
+	policy := serverstarter.DrainPolicyFunc(func(stats serverstarter.DrainStats) (serverstarter.DrainDecision, time.Duration) {
+		return serverstarter.DrainEscalate, 0
+	})
+	r := drainingRunner(func(p *FakeProcess) {})
+	m := startFakeMaster(t, r, serverstarter.SetDrainPolicy(policy))
+	m.waitEvent(serverstarter.EventWorkerReady, "")
+
+	if resp := m.command("reload"); !strings.HasPrefix(resp, "ok old_pid=") {
+		t.Errorf("unexpected response to reload: %q", resp)
+	}
+	if e := m.waitEvent(serverstarter.EventOldWorkerExited, ""); !e.Forced {
+		t.Error("exit of old worker killed by the policy was not counted as forced")
+	}
+	if got := r.Started()[0].Received(); len(got) != 2 || got[0] != syscall.SIGTERM || got[1] != syscall.SIGKILL {
+		t.Errorf("signals to old worker mismatch, got=%v, want=[SIGTERM killed]", got)
+	}
+	if stats := m.s.Stats(); stats.ForcedShutdowns != 1 || !stats.LastShutdownForced {
+		t.Errorf("forced shutdown stats mismatch, got forced=%d last=%v, want forced=1 last=true", stats.ForcedShutdowns, stats.LastShutdownForced)
+	}
+	m.stop()
+}
+
+func TestFakeRunnerStopOldFirst(t *testing.T) {
+	var oldExitedAtStart []bool
+	var mu sync.Mutex
+	var r *FakeRunner
+	r = &FakeRunner{
+		OnStart: func(p *FakeProcess) {
+			if started := r.Started(); len(started) > 1 {
+				exited := false
+				select {
+				case <-started[0].Exited():
+					exited = true
+				default:
+				}
+				mu.Lock()
+				oldExitedAtStart = append(oldExitedAtStart, exited)
+				mu.Unlock()
+			}
+			p.SendReady()
+		},
+	}
+	m := startFakeMaster(t, r, serverstarter.SetReloadStrategy(serverstarter.ReloadStopOldFirst))
+	m.waitEvent(serverstarter.EventWorkerReady, "")
+
+	resp := m.command("reload")
+	if want := fmt.Sprintf("ok old_pid=%d new_pid=%d ", fakePIDBase+1, fakePIDBase+2); !strings.HasPrefix(resp, want) {
+		t.Errorf("unexpected response to reload, got=%q, want prefix %q", resp, want)
+	}
+	mu.Lock()
+	if len(oldExitedAtStart) != 1 || !oldExitedAtStart[0] {
+		t.Errorf("new worker was started before old worker exited")
+	}
+	mu.Unlock()
+	m.stop()
+}
+
+func TestFakeRunnerStopOldFirstNewWorkerFails(t *testing.T) {
+	r := &FakeRunner{
+		OnStart: func(p *FakeProcess) {
+			if p.Pid() == fakePIDBase+1 {
+				p.SendReady()
+			} else {
+				p.Exit(3)
+			}
+		},
+	}
+	m := startFakeMaster(t, r, serverstarter.SetReloadStrategy(serverstarter.ReloadStopOldFirst))
+	m.waitEvent(serverstarter.EventWorkerReady, "")
+
+	// NOTE: No worker is left to fall back on, so the reload fails and
+	// the master exits with the error instead of running with no worker.
+	if resp := m.command("reload"); !strings.HasPrefix(resp, "error: ") {
+		t.Errorf("unexpected response to failed reload: %q", resp)
+	}
+	select {
+	case err := <-m.errC:
+		var startErr *serverstarter.WorkerStartError
+		if !errors.As(err, &startErr) {
+			t.Fatalf("error is not WorkerStartError; %v", err)
+		}
+		if startErr.PID != fakePIDBase+2 || startErr.ExitCode != 3 {
+			t.Errorf("unexpected WorkerStartError; %v", startErr)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("master did not exit after new worker failed")
+	}
+	results := m.s.LastReload()
+	if len(results) != 1 || results[0].OldPID != fakePIDBase+1 || results[0].NewPID != 0 || results[0].Err == nil {
+		t.Errorf("unexpected reload results: %v", results)
+	}
+	for _, p := range r.Started() {
+		select {
+		case <-p.Exited():
+		default:
+			t.Errorf("worker pid=%d is still running", p.Pid())
+		}
+	}
+	if got := r.Started()[0].Received(); len(got) != 1 || got[0] != syscall.SIGTERM {
+		t.Errorf("signals to old worker mismatch, got=%v, want=[SIGTERM]", got)
+	}
+}
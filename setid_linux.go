@@ -0,0 +1,12 @@
+//go:build linux && !386 && !arm
+
+package serverstarter
+
+import "syscall"
+
+// The system calls for setting the credential with 32-bit IDs.
+const (
+	sysSetgroups = syscall.SYS_SETGROUPS
+	sysSetgid    = syscall.SYS_SETGID
+	sysSetuid    = syscall.SYS_SETUID
+)
@@ -0,0 +1,72 @@
+package serverstarter
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// SocketOption is an integer socket option set on a listener with setsockopt(2).
+type SocketOption struct {
+	// Name is the name of the option used in errors, for example "TCP_DEFER_ACCEPT".
+	Name string
+	// Level is the protocol level of the option, for example syscall.IPPROTO_TCP.
+	Level int
+	// Option is the option number, for example syscall.TCP_DEFER_ACCEPT.
+	Option int
+	// Value is the value of the option.
+	Value int
+
+	// unsupported is true for the option which is not supported on this platform.
+	unsupported bool
+}
+
+// String returns the name and the value of the option.
+func (o SocketOption) String() string {
+	return fmt.Sprintf("%s=%d", o.Name, o.Value)
+}
+
+// EnsureSocketOptions sets the socket options on the listener l which are lost,
+// and returns the options it set again. It is meant to be called in the worker
+// with the same options as ListenOptions.SocketOptions used by the master,
+// so that the options survive even if the platform does not keep them on
+// the socket passed from the master.
+//
+// An option is regarded as kept if both of its value on the socket and
+// opts are zero or both are non-zero, since the kernel may round the value,
+// for example TCP_DEFER_ACCEPT.
+func EnsureSocketOptions(l net.Listener, opts []SocketOption) ([]SocketOption, error) {
+	sc, ok := l.(syscall.Conn)
+	if !ok {
+		return nil, fmt.Errorf("error in EnsureSocketOptions; listener of type %T does not have SyscallConn method", l)
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return nil, fmt.Errorf("error in EnsureSocketOptions after getting raw connection; %w", err)
+	}
+	var reapplied []SocketOption
+	var sockErr error
+	if err := rc.Control(func(fd uintptr) {
+		for _, opt := range opts {
+			value, err := getSocketOption(fd, opt)
+			if err != nil {
+				sockErr = err
+				return
+			}
+			if (value != 0) == (opt.Value != 0) {
+				continue
+			}
+			if err := setSocketOption(fd, opt); err != nil {
+				sockErr = err
+				return
+			}
+			reapplied = append(reapplied, opt)
+		}
+	}); err != nil {
+		return nil, fmt.Errorf("error in EnsureSocketOptions after accessing socket; %w", err)
+	}
+	if sockErr != nil {
+		return reapplied, fmt.Errorf("error in EnsureSocketOptions; %w", sockErr)
+	}
+	return reapplied, nil
+}
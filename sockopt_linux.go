@@ -0,0 +1,26 @@
+package serverstarter
+
+import "syscall"
+
+// tcpFastOpen is TCP_FASTOPEN which is not defined in the syscall package for linux.
+const tcpFastOpen = 0x17
+
+// TCPDeferAccept returns the socket option TCP_DEFER_ACCEPT, which makes
+// the listener wake up the worker only when data arrives on a new connection,
+// waiting for at most the seconds.
+func TCPDeferAccept(seconds int) SocketOption {
+	return SocketOption{Name: "TCP_DEFER_ACCEPT", Level: syscall.IPPROTO_TCP, Option: syscall.TCP_DEFER_ACCEPT, Value: seconds}
+}
+
+// TCPFastOpen returns the socket option TCP_FASTOPEN, which enables TCP Fast Open
+// on the listener with the maximum length of the queue of the pending requests.
+func TCPFastOpen(queueLen int) SocketOption {
+	return SocketOption{Name: "TCP_FASTOPEN", Level: syscall.IPPROTO_TCP, Option: tcpFastOpen, Value: queueLen}
+}
+
+// IPTransparent returns the socket option IP_TRANSPARENT, which lets the listener
+// accept the connections to the addresses not local to the host, for example
+// for a transparent proxy. It requires the CAP_NET_ADMIN capability.
+func IPTransparent() SocketOption {
+	return SocketOption{Name: "IP_TRANSPARENT", Level: syscall.IPPROTO_IP, Option: syscall.IP_TRANSPARENT, Value: 1}
+}
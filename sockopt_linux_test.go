@@ -0,0 +1,62 @@
+package serverstarter
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestSocketOptionsSurviveFileListener(t *testing.T) {
+	opts := []SocketOption{TCPDeferAccept(5), TCPFastOpen(16), IPTransparent()}
+	s := New()
+	l, err := s.ListenWithOptions("tcp", "127.0.0.1:0", ListenOptions{SocketOptions: opts})
+	if errors.Is(err, syscall.EPERM) {
+		opts = opts[:2]
+		l, err = s.ListenWithOptions("tcp", "127.0.0.1:0", ListenOptions{SocketOptions: opts})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// NOTE: This is the round trip of passing the listener from the master to the worker.
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	inherited, err := net.FileListener(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inherited.Close()
+
+	reapplied, err := EnsureSocketOptions(inherited, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reapplied) != 0 {
+		t.Errorf("socket options are lost: %v", reapplied)
+	}
+}
+
+func TestEnsureSocketOptions(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	opts := []SocketOption{TCPDeferAccept(5), TCPFastOpen(16)}
+	reapplied, err := EnsureSocketOptions(l, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reapplied) != len(opts) {
+		t.Errorf("unexpected reapplied options: got %v, want %v", reapplied, opts)
+	}
+	if reapplied, err = EnsureSocketOptions(l, opts); err != nil || len(reapplied) != 0 {
+		t.Errorf("unexpected result of second call: %v, %v", reapplied, err)
+	}
+}
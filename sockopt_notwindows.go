@@ -0,0 +1,32 @@
+//go:build !windows
+
+package serverstarter
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// getSocketOption returns the value of the socket option opt on the socket fd.
+func getSocketOption(fd uintptr, opt SocketOption) (int, error) {
+	if opt.unsupported {
+		return 0, fmt.Errorf("socket option %s is not supported on this platform", opt.Name)
+	}
+	value, err := syscall.GetsockoptInt(int(fd), opt.Level, opt.Option)
+	if err != nil {
+		return 0, os.NewSyscallError("getsockopt "+opt.Name, err)
+	}
+	return value, nil
+}
+
+// setSocketOption sets the socket option opt on the socket fd.
+func setSocketOption(fd uintptr, opt SocketOption) error {
+	if opt.unsupported {
+		return fmt.Errorf("socket option %s is not supported on this platform", opt.Name)
+	}
+	if err := syscall.SetsockoptInt(int(fd), opt.Level, opt.Option, opt.Value); err != nil {
+		return os.NewSyscallError("setsockopt "+opt.Name, err)
+	}
+	return nil
+}
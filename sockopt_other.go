@@ -0,0 +1,21 @@
+//go:build !linux
+
+package serverstarter
+
+// TCPDeferAccept returns the socket option TCP_DEFER_ACCEPT, which is not
+// supported on this platform.
+func TCPDeferAccept(seconds int) SocketOption {
+	return SocketOption{Name: "TCP_DEFER_ACCEPT", Value: seconds, unsupported: true}
+}
+
+// TCPFastOpen returns the socket option TCP_FASTOPEN, which is not supported
+// on this platform.
+func TCPFastOpen(queueLen int) SocketOption {
+	return SocketOption{Name: "TCP_FASTOPEN", Value: queueLen, unsupported: true}
+}
+
+// IPTransparent returns the socket option IP_TRANSPARENT, which is not supported
+// on this platform.
+func IPTransparent() SocketOption {
+	return SocketOption{Name: "IP_TRANSPARENT", Value: 1, unsupported: true}
+}
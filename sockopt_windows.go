@@ -0,0 +1,11 @@
+package serverstarter
+
+import "fmt"
+
+func getSocketOption(fd uintptr, opt SocketOption) (int, error) {
+	return 0, fmt.Errorf("socket option %s is not supported on this platform", opt.Name)
+}
+
+func setSocketOption(fd uintptr, opt SocketOption) error {
+	return fmt.Errorf("socket option %s is not supported on this platform", opt.Name)
+}
@@ -2,10 +2,13 @@
 package serverstarter
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"strconv"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -13,17 +16,166 @@ import (
 const (
 	stdFdCount          = 3 // stdin, stdout, stderr
 	defaultEnvListenFDs = "LISTEN_FDS"
+	envGeneration       = "SERVERSTARTER_GENERATION"
 	readyByte           = 'r'
+	warmByte            = 'w'
+	drainByte           = 'd'
+	listenerReadyByte   = 'l'
+	recycleByte         = 'c'
+	reloadRequestByte   = 'h'
+	retireByte          = 'x'
+	heartbeatByte       = 'b'
+	metadataByte        = 'm'
+	listenRequestByte   = 'a'
+	frameByte           = 'F'
 )
 
 // Starter is a server starter.
+//
+// A Starter is safe for concurrent use. In the master, RunMaster must be called
+// only once, and Stats, LastReload and Generation can be called from other
+// goroutines while it is running. In the worker, the methods which send messages
+// to the master, such as SendReady, SendDrainProgress and SendMetadata, can be
+// called from multiple goroutines, and the messages are not interleaved.
 type Starter struct {
 	envListenFDs                  string
 	workingDirectory              string
 	listeners                     []net.Listener
+	listenerFiles                 []*os.File
+	extraFiles                    []*os.File
+	logFilePaths                  []string
+	logFiles                      []*logFile
+	extraEnvMap                   map[string]string
+	extraEnvFunc                  func(generation int) (map[string]string, error)
+	envAllowlist                  []string
+	envDenylist                   []string
+	workerArgs                    []string
+	workerArgsSet                 bool
+	workerArgsFunc                func(generation int) ([]string, error)
+	appendedWorkerArgs            []string
 	gracefulShutdownSignalToChild syscall.Signal
 	childShutdownWaitTimeout      time.Duration
-	readyPipeR                    *os.File
+	masterShutdownTimeout         time.Duration
+	controlFile                   string
+	controlSocket                 string
+	controlBusyPolicy             ControlBusyPolicy
+	listenOptions                 ListenOptions
+	keepOldUntilWarmTimeout       time.Duration
+	newWorkerProbation            time.Duration
+	reloadOverlap                 time.Duration
+	killOldDelay                  time.Duration
+	reloadStrategy                ReloadStrategy
+	reloadFailurePolicy           ReloadFailurePolicy
+	reloadDebounce                time.Duration
+	signals                       chan os.Signal
+	waitListenersReady            bool
+	masterUpgrade                 bool
+	masterStateLoaded             bool
+	masterState                   *masterState
+	takeoverSocket                string
+	takeoverConn                  *net.UnixConn
+	takeoverServer                *takeoverServer
+	passFDsOverSocket             bool
+	listenerNames                 []string
+	firstFD                       int
+	noRestartExitCode             int
+	packetConns                   []net.PacketConn
+	packetConnNames               []string
+	packetConnFiles               []*os.File
+	sctpListeners                 []syscall.Conn
+	sctpNames                     []string
+	sctpFiles                     []*os.File
+	sctpAddrs                     []string
+	readyListenerIndexes          []int
+	drainPolicy                   DrainPolicy
+	workerCredential              *workerCredential
+	workerChroot                  string
+	workerSpecs                   []WorkerSpec
+	slots                         []*workerSlot
+	workerTempDirEnabled          bool
+	workerTempDirParent           string
+	workerRlimits                 map[int]rlimit
+	workerWrapper                 []string
+	workerBinary                  string
+	binaryChecksumPolicy          BinaryChecksumPolicy
+	expectedBinaryChecksum        string
+	reloadValidationArgs          []string
+	reloadValidationTimeout       time.Duration
+	workerOOMScoreAdj             *int
+	workerPdeathsig               syscall.Signal
+	detachedStateFile             string
+	childSubreaper                bool
+	initMode                      bool
+	signalWorkerProcessGroup      bool
+	processTitle                  string
+	out                           output
+	dialSyslog                    func() (logBackend, error)
+	journaldIdentifier            string
+	journal                       *journal
+	workerLogDir                  string
+	workerLogKeep                 int
+	webhookURL                    string
+	webhookMaxRetries             int
+	webhookInitialBackoff         time.Duration
+	webhookTimeout                time.Duration
+	webhook                       *webhook
+	eventHooks                    map[EventType][]string
+	eventHookTimeout              time.Duration
+	tracer                        Tracer
+	maxWorkerLifetime             time.Duration
+	recycleWorkers                bool
+	maxWorkerRSS                  uint64
+	maxWorkerRSSDuration          time.Duration
+	rssCheckC                     <-chan time.Time
+	unixSocketFiles               []string
+	listenerGroups                map[string][]int
+	workerCount                   int
+	shardPolicy                   ShardPolicy
+	reusePortPool                 bool
+	reusePortFiles                []*os.File
+	serverStarterEnv              bool
+	einhornEnv                    bool
+	einhornSockPath               string
+	einhornWorkers                map[int]*worker
+	nginxSignals                  bool
+	processRunner                 ProcessRunner
+	reloadCtx                     context.Context
+	orphanedWorkers               []detachedWorker
+	workerNice                    *int
+	workerCPUAffinity             []int
+	drainingWorkerNice            *int
+	eventHandler                  func(Event)
+	readyFailurePolicy            ReadyFailurePolicy
+	readyMaxRetries               int
+	readyInitialBackoff           time.Duration
+	controlRequests               chan controlRequest
+	deferredSignals               []os.Signal
+	deferredRequests              []controlRequest
+
+	// pipeMu protects the pipe to the master in the worker.
+	pipeMu          sync.Mutex
+	readyPipeW      *os.File
+	readyPipeClosed bool
+	warmSent        bool
+
+	// mu protects the fields below.
+	mu           sync.Mutex
+	stats        Stats
+	busy         bool
+	queuedReload *queuedReload
+	lastReload   []ReloadResult
+	generation   int
+}
+
+type rlimit struct {
+	cur uint64
+	max uint64
+}
+
+type workerCredential struct {
+	uid    uint32
+	gid    uint32
+	groups []uint32
 }
 
 // Option is the type for configuring a Starter.
@@ -33,8 +185,15 @@ type Option func(s *Starter)
 func New(options ...Option) *Starter {
 	s := &Starter{
 		envListenFDs:                  defaultEnvListenFDs,
+		firstFD:                       stdFdCount,
 		gracefulShutdownSignalToChild: syscall.SIGTERM,
 		childShutdownWaitTimeout:      time.Minute,
+		readyMaxRetries:               3,
+		readyInitialBackoff:           100 * time.Millisecond,
+		webhookMaxRetries:             3,
+		webhookInitialBackoff:         time.Second,
+		webhookTimeout:                5 * time.Second,
+		eventHookTimeout:              30 * time.Second,
 	}
 	for _, o := range options {
 		o(s)
@@ -66,63 +225,550 @@ func SetChildShutdownWaitTimeout(timeout time.Duration) Option {
 	}
 }
 
+// SetMasterShutdownTimeout sets the timeout for waiting the workers to exit after
+// the master receives a SIGINT or a SIGTERM and sends a SIGTERM to them. The workers
+// which do not exit within the timeout are killed with SIGKILL, and then the master exits.
+// If no SetMasterShutdownTimeout is called, the master waits for the workers to exit
+// without timeout.
+func SetMasterShutdownTimeout(timeout time.Duration) Option {
+	return func(s *Starter) {
+		s.masterShutdownTimeout = timeout
+	}
+}
+
+// SetKeepOldWorkerUntilWarm makes the master keep the old worker running after
+// the new worker sends ready on SIGHUP, until the new worker sends warm with SendWarm
+// or the timeout elapses. If the new worker exits before sending warm,
+// the master keeps the old worker as a hot fallback and stops the reload.
+// If no SetKeepOldWorkerUntilWarm is called, the master stops the old worker
+// as soon as the new worker sends ready.
+func SetKeepOldWorkerUntilWarm(timeout time.Duration) Option {
+	return func(s *Starter) {
+		s.keepOldUntilWarmTimeout = timeout
+	}
+}
+
+// SetNewWorkerProbation makes the master keep the old worker running for the
+// probation period d after the new worker sends ready (and warm when
+// SetKeepOldWorkerUntilWarm is used) on reload. If the new worker exits during
+// the probation period, the master aborts the reload and keeps the old worker.
+// If no SetNewWorkerProbation is called, there is no probation period.
+func SetNewWorkerProbation(d time.Duration) Option {
+	return func(s *Starter) {
+		s.newWorkerProbation = d
+	}
+}
+
+// SetReloadOverlap sets the overlap window on reload, during which both the old
+// and new workers keep accepting connections before the master sends the graceful
+// shutdown signal to the old worker. This smooths load spikes and gives
+// connection pools time to rebalance. The overlap window starts after the new
+// worker sends ready and passes the probation period set by SetNewWorkerProbation.
+// If the new worker exits during the overlap window, the master aborts the reload
+// and keeps the old worker.
+// If no SetReloadOverlap is called, there is no overlap window.
+func SetReloadOverlap(d time.Duration) Option {
+	return func(s *Starter) {
+		s.reloadOverlap = d
+	}
+}
+
+// SetKillOldDelay sets the delay before the master sends the graceful shutdown
+// signal to the old worker after the new worker gets ready on reload.
+// This is the same as --kill-old-delay of Server::Starter, and gives load balancers
+// and DNS caches a grace window before the old worker stops accepting.
+// The master handles a SIGINT, a SIGTERM and the control command "stop" received
+// during the delay after stopping the old worker without waiting for the rest of
+// the delay. If the new worker exits during the delay, the master aborts the reload
+// and keeps the old worker.
+// If no SetKillOldDelay is called, there is no delay.
+func SetKillOldDelay(d time.Duration) Option {
+	return func(s *Starter) {
+		s.killOldDelay = d
+	}
+}
+
+// SetReloadDebounce sets the duration for which the master waits after receiving
+// a SIGHUP before starting a reload, so that SIGHUPs sent in quick succession,
+// for example by a deploy script, are merged into one reload. If the master
+// receives a SIGINT or a SIGTERM while waiting, it cancels the reload and exits.
+//
+// Regardless of this option, SIGHUPs received while a reload is in progress are
+// merged into the reload in progress.
+// If no SetReloadDebounce is called, the master starts a reload immediately.
+func SetReloadDebounce(d time.Duration) Option {
+	return func(s *Starter) {
+		s.reloadDebounce = d
+	}
+}
+
+// ReloadStrategy is the order of starting the new worker and stopping the old
+// worker on reload.
+type ReloadStrategy int
+
+const (
+	// ReloadStartNewFirst makes the master start the new worker and stop the old
+	// worker after the new worker gets ready. This is the default strategy.
+	ReloadStartNewFirst ReloadStrategy = iota
+	// ReloadStopOldFirst makes the master stop the old worker gracefully first and
+	// then start the new worker. Connections accepted in the meantime are queued
+	// in the kernel backlog of the listeners. This is for hosts which cannot fit
+	// two copies of a large worker in memory.
+	//
+	// Since no worker is left to fall back on, the master exits with an error
+	// if the new worker fails to get ready.
+	ReloadStopOldFirst
+)
+
+// SetReloadStrategy sets the strategy for reload.
+// If no SetReloadStrategy is called, the default value is ReloadStartNewFirst.
+func SetReloadStrategy(strategy ReloadStrategy) Option {
+	return func(s *Starter) {
+		s.reloadStrategy = strategy
+	}
+}
+
+// ReloadFailurePolicy is the policy for the master when the new worker fails
+// to start or to get ready on reload.
+type ReloadFailurePolicy int
+
+const (
+	// ReloadFailureKeepOld makes the master report the failure and keep
+	// the old worker running. This is the default policy.
+	ReloadFailureKeepOld ReloadFailurePolicy = iota
+	// ReloadFailureExit makes the master exit with an error, leaving the old
+	// worker running so that it keeps serving until the process manager
+	// restarts the master.
+	ReloadFailureExit
+	// ReloadFailureStopOldAndExit makes the master stop the old workers and
+	// then exit with an error.
+	ReloadFailureStopOldAndExit
+)
+
+// SetReloadFailurePolicy sets the policy for the master when the new worker fails
+// to start or to get ready on reload. A fatal policy is useful for deploys from CI,
+// where the failed reload should fail the pipeline instead of leaving the old
+// version running silently.
+// If no SetReloadFailurePolicy is called, the default value is ReloadFailureKeepOld.
+//
+// The policy does not apply to the dry run reload.
+func SetReloadFailurePolicy(policy ReloadFailurePolicy) Option {
+	return func(s *Starter) {
+		s.reloadFailurePolicy = policy
+	}
+}
+
+// SetNoRestartExitCode sets the exit code with which a worker tells the master
+// that it exits intentionally and must not be restarted, for example when it
+// detects a fatal misconfiguration which restarting does not fix. Without this,
+// such a worker would be restarted over and over.
+//
+// When a worker exits with code, the master does not restart it. The master exits
+// with an error if no other worker programs added by AddWorker are running.
+// code must be between 1 and 255. If no SetNoRestartExitCode is called or code
+// is 0, the master always restarts workers.
+func SetNoRestartExitCode(code int) Option {
+	return func(s *Starter) {
+		s.noRestartExitCode = code
+	}
+}
+
+// SetWorkerCredential sets the user ID, the group ID and the supplementary group IDs
+// of worker processes. This can be used to run workers as an unprivileged user
+// while the master runs as root to bind privileged ports like :80 and :443.
+// If no SetWorkerCredential is called, workers run as the same user as the master.
+//
+// This option is not supported on Windows.
+func SetWorkerCredential(uid, gid uint32, groups []uint32) Option {
+	return func(s *Starter) {
+		s.workerCredential = &workerCredential{uid: uid, gid: gid, groups: groups}
+	}
+}
+
+// SetWorkerChroot sets the directory which worker processes use as the root directory.
+// The master changes the root directory of a worker to dir and the working directory
+// to "/" just before executing the worker, so the worker has a restricted filesystem
+// view while the master keeps full access for starting new workers.
+//
+// The executable of the worker must exist at the same path under dir as
+// the one the master sees, and the master must have the privilege to call chroot(2).
+//
+// This option is not supported on Windows.
+func SetWorkerChroot(dir string) Option {
+	return func(s *Starter) {
+		s.workerChroot = dir
+	}
+}
+
+// SetWorkerTempDir makes the master create a temporary directory for each worker
+// under the directory parent and pass it to the worker as the environment variable
+// TMPDIR. The master removes the directory after the worker exits, so temporary
+// files left by workers do not accumulate across reloads.
+// If parent is empty, the default directory for temporary files of the master is used.
+func SetWorkerTempDir(parent string) Option {
+	return func(s *Starter) {
+		s.workerTempDirEnabled = true
+		s.workerTempDirParent = parent
+	}
+}
+
+// SetWorkerWrapper sets the command and arguments to run workers under a wrapper
+// such as numactl, chrt or strace. The master starts the wrapper with the arguments
+// in wrapper followed by the absolute path of the worker binary and the arguments
+// of the master, for example ["numactl", "--cpunodebind=0"] results in
+// "numactl --cpunodebind=0 /path/to/binary args...".
+//
+// The file descriptors for listeners are passed to the wrapper at the same positions,
+// so the wrapper must keep them open for the worker. Also the wrapper should execute
+// the worker in place of itself, since the master sends signals to the process
+// it started, and the worker forked by the wrapper fails to get the listeners.
+func SetWorkerWrapper(wrapper []string) Option {
+	return func(s *Starter) {
+		s.workerWrapper = wrapper
+	}
+}
+
+// SetWorkerBinary sets the path of the executable of worker processes, so that
+// the master and workers can be separate executables, for example a tiny master
+// running as root and a large application running as an unprivileged user.
+// If path contains no path separators, it is searched in the directories named
+// by the PATH environment variable. The path is resolved every time the master
+// starts a worker, so replacing the executable or the symbolic link at path
+// takes effect on the next reload.
+//
+// Workers are still started with the command line arguments of the master unless
+// SetWorkerArgs or SetWorkerArgsFunc is called.
+// If no SetWorkerBinary is called, workers run the same executable as the master.
+func SetWorkerBinary(path string) Option {
+	return func(s *Starter) {
+		s.workerBinary = path
+	}
+}
+
+// SetWorkerOOMScoreAdj sets the OOM score adjustment of worker processes, which
+// the master writes to /proc/<pid>/oom_score_adj just after starting a worker.
+// The value must be in the range from -1000 to 1000. Setting a value higher than
+// the master's one makes workers killed before the master under memory pressure,
+// so that the master survives and restarts workers.
+//
+// This option is supported only on Linux.
+func SetWorkerOOMScoreAdj(score int) Option {
+	return func(s *Starter) {
+		s.workerOOMScoreAdj = &score
+	}
+}
+
+// SetSignalWorkerProcessGroup makes the master send the graceful shutdown signal
+// and SIGKILL to the process group of a worker instead of the worker itself,
+// so that the helper processes spawned by the worker are also terminated on
+// reload and shutdown instead of leaking. With this option, each worker is started
+// in its own process group whose ID is the process ID of the worker, so the
+// signals sent to the process group of the master, for example a SIGINT from
+// the terminal, are not delivered to the workers.
+//
+// The helper processes must stay in the process group of the worker, that is,
+// they must not call setpgid or setsid.
+func SetSignalWorkerProcessGroup() Option {
+	return func(s *Starter) {
+		s.signalWorkerProcessGroup = true
+	}
+}
+
+// SetWorkerPdeathsig sets the signal which the kernel sends to worker processes
+// when the master dies, for example syscall.SIGTERM. Without this, if the master
+// crashes or is killed by the OOM killer, the workers are left as orphans holding
+// the listening ports, and a fresh master fails to bind them.
+//
+// The signal is sent to the process started by the master, which is the wrapper
+// set by SetWorkerWrapper if any.
+//
+// This option is supported only on Linux. It cannot be used with SetDetachedWorkers.
+func SetWorkerPdeathsig(sig syscall.Signal) Option {
+	return func(s *Starter) {
+		s.workerPdeathsig = sig
+	}
+}
+
+// SetWorkerNice sets the nice value of worker processes, which the master sets
+// just after starting a worker.
+//
+// This option is not supported on Windows.
+func SetWorkerNice(nice int) Option {
+	return func(s *Starter) {
+		s.workerNice = &nice
+	}
+}
+
+// SetWorkerCPUAffinity sets the CPUs which worker processes are allowed to run on,
+// which the master sets just after starting a worker.
+//
+// This option is supported only on Linux.
+func SetWorkerCPUAffinity(cpus []int) Option {
+	return func(s *Starter) {
+		s.workerCPUAffinity = cpus
+	}
+}
+
+// SetDrainingWorkerNice sets the nice value which the master sets to the old worker
+// when it sends the graceful shutdown signal on SIGHUP. This can be used to
+// deprioritize the old worker while it is draining and the new worker is running.
+//
+// This option is not supported on Windows.
+func SetDrainingWorkerNice(nice int) Option {
+	return func(s *Starter) {
+		s.drainingWorkerNice = &nice
+	}
+}
+
 // IsMaster returns whether this process is the master or not.
 // It returns true if this process is the master, and returns false if this process is the worker.
 func (s *Starter) IsMaster() bool {
-	_, isWorker := os.LookupEnv(s.envListenFDs)
-	return !isWorker
+	_, isWorker := lookupWorkerEnv(s.envListenFDs)
+	return !isWorker && !s.startedByServerStarter() && !s.startedByEinhorn()
+}
+
+// Generation returns the generation number of the worker. The master increments
+// the generation number every time it starts a worker, starting from 1 for the
+// initial worker, and passes it to the worker as the environment variable
+// SERVERSTARTER_GENERATION. Workers can use it to tag logs and metrics.
+//
+// When this is called by the master process, it returns the generation number of
+// the last worker the master started, or 0 if it has not started any worker.
+// It is safe to call Generation from another goroutine while RunMaster is running.
+func (s *Starter) Generation() int {
+	if s.IsMaster() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.generation
+	}
+	v := os.Getenv(envGeneration)
+	if s.startedByServerStarter() {
+		v = os.Getenv(envServerStarterGeneration)
+	}
+	generation, err := strconv.Atoi(v)
+	if err != nil {
+		return 0
+	}
+	return generation
+}
+
+// nextGeneration increments the generation number and returns it.
+func (s *Starter) nextGeneration() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.generation++
+	return s.generation
 }
 
 // Listeners returns the listeners passed from the master if this is called by the worker process.
-// It returns nil when this is called by the master process.
+// It returns nil when this is called by the master process, or by a process
+// started by the worker after the worker gets the listeners, since the environment
+// variables which describe the file descriptors passed from the master are removed
+// from the environment of the worker then. It returns an error wrapping ErrNotWorker
+// when this is called by a process to which the master does not pass the
+// listeners, for example a worker forked by the wrapper set by SetWorkerWrapper.
+//
+// The listeners are created on the first call in the process and the same
+// listeners are returned after that, even if Listeners is called on another
+// Starter, so that the same file descriptor is not wrapped more than once.
+//
+// Listeners is kept for compatibility. New code should use Inherited, which returns
+// the listeners with other things passed from the master.
 func (s *Starter) Listeners() ([]net.Listener, error) {
-	countStr, isWorker := os.LookupEnv(s.envListenFDs)
-	if !isWorker {
+	if s.IsMaster() {
 		return nil, nil
 	}
 
-	count, err := strconv.Atoi(countStr)
-	if err != nil {
-		return nil, fmt.Errorf("error in Listeners after getting invalid listener count; %v", err)
-	}
-	listeners := make([]net.Listener, count)
-	for i := 0; i < count; i++ {
-		fd := uintptr(stdFdCount + 1 + i)
-		file := os.NewFile(fd, "listener")
-		l, err := net.FileListener(file)
+	inherited.mu.Lock()
+	defer inherited.mu.Unlock()
+	if inherited.listeners == nil {
+		fds, err := s.inheritedFDsLocked()
 		if err != nil {
-			return nil, fmt.Errorf("error in Listeners after failing to create listener; %v", err)
+			return nil, fmt.Errorf("error in Listeners after getting inherited file descriptors; %w", err)
+		}
+		listeners := make([]net.Listener, len(fds.listeners))
+		for i, fd := range fds.listeners {
+			file := os.NewFile(fd, "listener")
+			l, err := net.FileListener(file)
+			if err != nil {
+				closeListeners(listeners[:i])
+				return nil, fmt.Errorf("error in Listeners after failing to create listener; %w", err)
+			}
+			// NOTE: The socket file must not be removed when the worker exits,
+			// since the next worker uses the same socket.
+			if ul, ok := l.(*net.UnixListener); ok {
+				ul.SetUnlinkOnClose(false)
+			}
+			listeners[i] = l
 		}
-		listeners[i] = l
+		inherited.listeners = listeners
+	}
+	// NOTE: We return a copy so that the caller cannot modify the cached one.
+	return append([]net.Listener(nil), inherited.listeners...), nil
+}
+
+func closeListeners(listeners []net.Listener) {
+	for _, l := range listeners {
+		l.Close()
+	}
+}
+
+// ReadyFailurePolicy is the policy for the worker when SendReady fails.
+type ReadyFailurePolicy int
+
+const (
+	// ReadyFailureReturn makes SendReady return the error to the caller.
+	// This is the default policy.
+	ReadyFailureReturn ReadyFailurePolicy = iota
+	// ReadyFailureAbort makes SendReady print the error and exit the worker
+	// process with the status 1.
+	ReadyFailureAbort
+	// ReadyFailureRetry makes SendReady retry sending with backoff set by
+	// SetReadyRetry. If all retries fail, SendReady returns the last error.
+	ReadyFailureRetry
+	// ReadyFailureContinue makes SendReady print the error and return nil,
+	// so that the worker continues running without the master's knowledge of its readiness.
+	ReadyFailureContinue
+)
+
+// SetReadyFailurePolicy sets the policy for the worker when SendReady fails.
+// If no SetReadyFailurePolicy is called, the default value is ReadyFailureReturn.
+//
+// Regardless of the policy, the worker closes the pipe to the master when
+// SendReady finally fails, so that the master detects it and fails the reload
+// immediately instead of waiting for ready notification.
+func SetReadyFailurePolicy(policy ReadyFailurePolicy) Option {
+	return func(s *Starter) {
+		s.readyFailurePolicy = policy
+	}
+}
+
+// SetReadyRetry sets the maximum number of retries and the initial backoff duration
+// for ReadyFailureRetry. The backoff duration is doubled for each retry.
+// If no SetReadyRetry is called, the default values are 3 and 100 milliseconds.
+func SetReadyRetry(maxRetries int, initialBackoff time.Duration) Option {
+	return func(s *Starter) {
+		s.readyMaxRetries = maxRetries
+		s.readyInitialBackoff = initialBackoff
 	}
-	return listeners, nil
 }
 
 // SendReady sends ready notification from child to parent.
+//
+// The worker can call SendReady as soon as it starts accepting connections and
+// call SendWarm later when it is fully warmed up (for example after filling caches).
+// What happens when it fails depends on the policy set by SetReadyFailurePolicy.
 func (s *Starter) SendReady() error {
-	fd := uintptr(stdFdCount)
-	readyPipeW := os.NewFile(fd, "readyPipeW")
+	err := s.sendMessage(readyByte)
+	if err != nil && s.readyFailurePolicy == ReadyFailureRetry {
+		backoff := s.readyInitialBackoff
+		for i := 0; i < s.readyMaxRetries && err != nil; i++ {
+			time.Sleep(backoff)
+			backoff *= 2
+			err = s.sendMessage(readyByte)
+		}
+	}
+	if err == nil {
+		return nil
+	}
 
-	defer readyPipeW.Close()
-	_, err := readyPipeW.Write([]byte{readyByte})
-	if err != nil {
-		return fmt.Errorf("failed to send ready to parent; %v", err)
+	err = fmt.Errorf("failed to send ready to parent; %w", err)
+	s.closeReadyPipe()
+	switch s.readyFailurePolicy {
+	case ReadyFailureAbort:
+		fmt.Fprintf(os.Stderr, "exiting worker pid=%d: %v\n", os.Getpid(), err)
+		os.Exit(1)
+	case ReadyFailureContinue:
+		fmt.Fprintf(os.Stderr, "continuing worker pid=%d: %v\n", os.Getpid(), err)
+		return nil
+	}
+	return err
+}
+
+// SendWarm sends warm notification from child to parent.
+// It must be called after SendReady and it can be called only once.
+func (s *Starter) SendWarm() error {
+	s.pipeMu.Lock()
+	if s.readyPipeW == nil {
+		s.pipeMu.Unlock()
+		return fmt.Errorf("SendWarm %w", ErrReadyNotSent)
+	}
+	if s.warmSent {
+		s.pipeMu.Unlock()
+		return errors.New("SendWarm can be called only once")
+	}
+	s.warmSent = true
+	s.pipeMu.Unlock()
+	if err := s.sendMessage(warmByte); err != nil {
+		return fmt.Errorf("failed to send warm to parent; %w", err)
 	}
 	return nil
 }
 
-// waitReady received ready notification from child to parent.
-func (s *Starter) waitReady() error {
-	var b [1]byte
-	n, err := s.readyPipeR.Read(b[:])
-	if err != nil {
-		return fmt.Errorf("read error in receiving ready notification; %v", err)
+// RequestReload asks the master to reload all the workers as if it received
+// SIGHUP, for example when the worker detects a new version of its
+// configuration, so that no external process is needed to signal the master.
+// A reload request received before the initial workers get ready is queued
+// like SIGHUP, and the one received during a reload is ignored.
+//
+// It must be called after SendReady.
+func (s *Starter) RequestReload() error {
+	if s.readyPipe() == nil {
+		return fmt.Errorf("RequestReload %w", ErrReadyNotSent)
 	}
+	if err := s.sendMessage(reloadRequestByte); err != nil {
+		return fmt.Errorf("failed to send reload request to parent; %w", err)
+	}
+	return nil
+}
 
-	if n != 1 || b[0] != readyByte {
-		return fmt.Errorf("protocol error in receiving ready notification; %v", err)
+// sendToMaster writes bytes to the pipe to the master.
+func (s *Starter) sendToMaster(b ...byte) error {
+	// NOTE: start_server of Server::Starter and Einhorn have no pipe to the worker.
+	if s.startedByServerStarter() || s.startedByEinhorn() {
+		return nil
+	}
+	s.pipeMu.Lock()
+	defer s.pipeMu.Unlock()
+	if s.readyPipeClosed {
+		return ErrPipeClosed
 	}
+	if s.readyPipeW == nil {
+		fd, err := s.masterFD()
+		if err != nil {
+			return err
+		}
+		// NOTE: The pipe is kept open after sending ready for sending warm
+		// and drain progress later, so we do not want it to be inherited by
+		// processes which the worker starts.
+		closeOnExec(fd)
+		// NOTE: We make it non-blocking so that os.File uses the poller and
+		// Heartbeat can set the deadline for reading the reply.
+		setNonblock(fd)
+		s.readyPipeW = os.NewFile(fd, "readyPipeW")
+	}
+	// NOTE: We hold pipeMu while writing so that the messages sent from
+	// multiple goroutines are not interleaved.
+	_, err := s.readyPipeW.Write(b)
+	return err
+}
 
-	s.readyPipeR.Close()
-	return nil
+// readyPipe returns the pipe to the master, or nil if no message has been
+// sent to the master yet or the pipe is closed.
+func (s *Starter) readyPipe() *os.File {
+	s.pipeMu.Lock()
+	defer s.pipeMu.Unlock()
+	return s.readyPipeW
+}
+
+// closeReadyPipe closes the pipe to the master so that the master detects
+// the worker failed to send ready.
+func (s *Starter) closeReadyPipe() {
+	s.pipeMu.Lock()
+	defer s.pipeMu.Unlock()
+	if s.readyPipeW != nil {
+		s.readyPipeW.Close()
+		s.readyPipeW = nil
+	}
+	s.readyPipeClosed = true
 }
@@ -0,0 +1,88 @@
+package serverstarter
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// envServerStarterPort is the environment variable which start_server of
+	// Server::Starter sets for passing the addresses and the file descriptors
+	// of the listeners in the form "ADDR=FD;ADDR=FD".
+	envServerStarterPort = "SERVER_STARTER_PORT"
+	// envServerStarterGeneration is the environment variable which start_server
+	// of Server::Starter sets for passing the generation number of the worker.
+	envServerStarterGeneration = "SERVER_STARTER_GENERATION"
+)
+
+// SetServerStarterEnv makes the master and the worker use the environment
+// variables of start_server of Server::Starter in addition to LISTEN_FDS, so that
+// the workers written for start_server or github.com/lestrrat-go/server-starter
+// run under this master and the workers using this package run under start_server.
+//
+// The master sets SERVER_STARTER_PORT, for example "80=4;127.0.0.1:8080=5",
+// and SERVER_STARTER_GENERATION for the workers. The worker started by
+// start_server, which sets SERVER_STARTER_PORT but not LISTEN_FDS, gets
+// the listeners from SERVER_STARTER_PORT. Since start_server has no pipe to
+// the worker, SendReady and the other notifications to the master do nothing
+// in such a worker.
+//
+// It cannot be used with SetPassFDsOverSocket, since the file descriptors of
+// the listeners in the worker are not known to the master.
+func SetServerStarterEnv(enabled bool) Option {
+	return func(s *Starter) {
+		s.serverStarterEnv = enabled
+	}
+}
+
+// startedByServerStarter returns whether this process is the worker started by
+// start_server of Server::Starter, not by the master of this package.
+func (s *Starter) startedByServerStarter() bool {
+	if !s.serverStarterEnv {
+		return false
+	}
+	if _, ok := lookupWorkerEnv(s.envListenFDs); ok {
+		return false
+	}
+	_, ok := os.LookupEnv(envServerStarterPort)
+	return ok
+}
+
+// serverStarterPort returns the value of SERVER_STARTER_PORT for the listeners
+// with the addresses at the file descriptors from firstFD.
+func serverStarterPort(addrs []net.Addr, firstFD int) string {
+	ports := make([]string, len(addrs))
+	for i, addr := range addrs {
+		name := addr.String()
+		// NOTE: start_server uses only the port for the listener bound to all addresses.
+		if a, ok := addr.(*net.TCPAddr); ok && (a.IP == nil || a.IP.IsUnspecified()) {
+			name = strconv.Itoa(a.Port)
+		}
+		ports[i] = name + "=" + strconv.Itoa(firstFD+i)
+	}
+	return strings.Join(ports, ";")
+}
+
+// parseServerStarterPort returns the file descriptors in the value of
+// SERVER_STARTER_PORT in the same order.
+func parseServerStarterPort(v string) ([]uintptr, error) {
+	var fds []uintptr
+	for _, port := range strings.Split(v, ";") {
+		if port == "" {
+			continue
+		}
+		i := strings.LastIndexByte(port, '=')
+		if i == -1 {
+			return nil, fmt.Errorf("invalid %s entry %q", envServerStarterPort, port)
+		}
+		fd, err := strconv.Atoi(port[i+1:])
+		if err != nil || fd < 0 {
+			return nil, fmt.Errorf("invalid file descriptor in %s entry %q", envServerStarterPort, port)
+		}
+		fds = append(fds, uintptr(fd))
+	}
+	return fds, nil
+}
@@ -0,0 +1,29 @@
+package serverstarter
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestServerStarterPort(t *testing.T) {
+	addrs := []net.Addr{
+		&net.TCPAddr{Port: 80},
+		&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8080},
+		&net.UnixAddr{Net: "unix", Name: "/tmp/app.sock"},
+	}
+	v := serverStarterPort(addrs, 4)
+	if want := "80=4;127.0.0.1:8080=5;/tmp/app.sock=6"; v != want {
+		t.Errorf("unexpected port: got %q, want %q", v, want)
+	}
+	fds, err := parseServerStarterPort(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uintptr{4, 5, 6}; !reflect.DeepEqual(fds, want) {
+		t.Errorf("unexpected fds: got %v, want %v", fds, want)
+	}
+	if _, err := parseServerStarterPort("80"); err == nil {
+		t.Error("got no error for entry without fd")
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !windows
+
+package serverstarter
+
+import "log/syslog"
+
+// SetSyslog makes the master send its human-readable messages to the syslog
+// server instead of the output set by SetOutput. The master connects to the
+// syslog server when RunMaster is called.
+//
+// If network is empty, the master connects to the local syslog server.
+// Otherwise see net.Dial for the description of the network and raddr parameters.
+// facility is the facility of the messages, for example syslog.LOG_DAEMON, and
+// the severity is syslog.LOG_INFO for messages and syslog.LOG_ERR for error
+// messages. If tag is empty, the program name is used.
+func SetSyslog(network, raddr string, facility syslog.Priority, tag string) Option {
+	return func(s *Starter) {
+		s.dialSyslog = func() (logBackend, error) {
+			return syslog.Dial(network, raddr, facility, tag)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package serverstarter
+
+import "net"
+
+// SetTakeoverSocket sets the path of the unix socket for taking over from a running
+// master. When a master starts, it connects to the socket and, if a master is
+// listening on it, takes over the listeners and the log files set by SetLogFiles
+// from the running master, which are passed with SCM_RIGHTS. After the workers
+// of the new master get ready, the running master stops its workers gracefully
+// and exits, and the new master starts listening on the socket for the next
+// takeover. This allows replacing the master without closing the sockets.
+//
+// The workers of the running master are not adopted by the new master, since
+// they are not children of the new master. The new master gets the listeners
+// from Listen, so the master must bind the listeners with Listen instead of
+// net.Listen.
+//
+// This option is not supported on Windows.
+func SetTakeoverSocket(path string) Option {
+	return func(s *Starter) {
+		s.takeoverSocket = path
+	}
+}
+
+// takeoverServer is the server for the takeover socket.
+type takeoverServer struct {
+	listener *net.UnixListener
+	// requests receives the connections from the new masters whose workers
+	// are ready.
+	requests chan *net.UnixConn
+	done     chan struct{}
+}
@@ -0,0 +1,262 @@
+//go:build !windows
+
+package serverstarter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+const (
+	takeoverRequest = "takeover\n"
+	takeoverReady   = "ready\n"
+	takeoverDone    = "done\n"
+
+	// takeoverRequestTimeout is the timeout for receiving the request and
+	// sending the state over the takeover socket.
+	takeoverRequestTimeout = 10 * time.Second
+)
+
+// receiveTakeoverState connects to the takeover socket and receives the state
+// from the running master. It returns nil if no master is listening on the socket.
+// The connection is kept in takeoverConn to notify the running master after
+// the workers get ready.
+func (s *Starter) receiveTakeoverState() (*masterState, error) {
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Net: "unix", Name: s.takeoverSocket})
+	if err != nil {
+		if errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error in receiveTakeoverState after connecting to takeover socket; %w", err)
+	}
+	state, err := receiveTakeoverStateFrom(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	s.out.printf("taking over from running master pid=%d\n", state.PID)
+	s.takeoverConn = conn
+	return state, nil
+}
+
+func receiveTakeoverStateFrom(conn *net.UnixConn) (*masterState, error) {
+	conn.SetDeadline(time.Now().Add(takeoverRequestTimeout))
+	defer conn.SetDeadline(time.Time{})
+	if _, err := io.WriteString(conn, takeoverRequest); err != nil {
+		return nil, fmt.Errorf("error in receiveTakeoverState after sending request; %w", err)
+	}
+	data, err := readFrame(conn)
+	if err != nil {
+		return nil, fmt.Errorf("error in receiveTakeoverState after receiving state; %w", err)
+	}
+	var state masterState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("error in receiveTakeoverState after decoding state; %w", err)
+	}
+
+	// NOTE: The file descriptors in the state are the indexes of the received
+	// file descriptors, which are replaced with the received ones.
+	fds, err := receiveFDs(conn, len(state.Listeners)+len(state.PacketConns)+2*len(state.LogFiles))
+	if err != nil {
+		return nil, fmt.Errorf("error in receiveTakeoverState after receiving file descriptors; %w", err)
+	}
+	for i := range state.Listeners {
+		state.Listeners[i].FD = fds[state.Listeners[i].FD]
+	}
+	for i := range state.PacketConns {
+		state.PacketConns[i].FD = fds[state.PacketConns[i].FD]
+	}
+	for i := range state.LogFiles {
+		state.LogFiles[i].ReadFD = fds[state.LogFiles[i].ReadFD]
+		state.LogFiles[i].WriteFD = fds[state.LogFiles[i].WriteFD]
+	}
+	return &state, nil
+}
+
+// finishTakeover notifies the old master that the workers of this master are ready,
+// so that the old master stops its workers and exits. If it fails, the old master
+// keeps running.
+func (s *Starter) finishTakeover() error {
+	conn := s.takeoverConn
+	s.takeoverConn = nil
+	if _, err := io.WriteString(conn, takeoverReady); err != nil {
+		conn.Close()
+		return fmt.Errorf("error in finishTakeover after notifying old master of ready; %w", err)
+	}
+	// NOTE: We do not wait for the old master to stop its workers here, since it
+	// may take long.
+	go func() {
+		defer conn.Close()
+		done := make([]byte, len(takeoverDone))
+		if _, err := io.ReadFull(conn, done); err != nil || string(done) != takeoverDone {
+			s.out.eprintf("old master exited without finishing takeover: %v\n", err)
+			return
+		}
+		s.out.printf("old master finished takeover\n")
+	}()
+	return nil
+}
+
+// startTakeoverServer starts listening on the takeover socket and serving
+// the state to new masters.
+func (s *Starter) startTakeoverServer() (*takeoverServer, error) {
+	if err := os.Remove(s.takeoverSocket); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error in startTakeoverServer after removing existing takeover socket; %w", err)
+	}
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Net: "unix", Name: s.takeoverSocket})
+	if err != nil {
+		return nil, fmt.Errorf("error in startTakeoverServer after listening on takeover socket; %w", err)
+	}
+	srv := &takeoverServer{
+		listener: l,
+		requests: make(chan *net.UnixConn),
+		done:     make(chan struct{}),
+	}
+	go s.serveTakeover(srv)
+	return srv, nil
+}
+
+func (s *Starter) serveTakeover(srv *takeoverServer) {
+	for {
+		conn, err := srv.listener.AcceptUnix()
+		if err != nil {
+			select {
+			case <-srv.done:
+			default:
+				s.out.eprintf("stopped accepting takeover connections: %v\n", err)
+			}
+			return
+		}
+		go s.handleTakeoverConn(srv, conn)
+	}
+}
+
+// handleTakeoverConn sends the state to the new master and waits for
+// the workers of the new master to get ready.
+func (s *Starter) handleTakeoverConn(srv *takeoverServer, conn *net.UnixConn) {
+	if err := s.sendTakeoverState(conn); err != nil {
+		s.out.eprintf("failed to send state to new master: %v\n", err)
+		conn.Close()
+		return
+	}
+	ready := make([]byte, len(takeoverReady))
+	if _, err := io.ReadFull(conn, ready); err != nil || string(ready) != takeoverReady {
+		s.out.eprintf("new master aborted takeover: %v\n", err)
+		conn.Close()
+		return
+	}
+	select {
+	case srv.requests <- conn:
+	case <-srv.done:
+		conn.Close()
+	}
+}
+
+func (s *Starter) sendTakeoverState(conn *net.UnixConn) error {
+	conn.SetDeadline(time.Now().Add(takeoverRequestTimeout))
+	defer conn.SetDeadline(time.Time{})
+	req := make([]byte, len(takeoverRequest))
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return fmt.Errorf("error in sendTakeoverState after receiving request; %w", err)
+	}
+	if string(req) != takeoverRequest {
+		return fmt.Errorf("error in sendTakeoverState; invalid request %q", req)
+	}
+
+	state, fds, err := s.takeoverState()
+	if err != nil {
+		return fmt.Errorf("error in sendTakeoverState after duplicating file descriptors; %w", err)
+	}
+	defer closeFDs(fds)
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("error in sendTakeoverState after encoding state; %w", err)
+	}
+	if err := writeFrame(conn, data); err != nil {
+		return fmt.Errorf("error in sendTakeoverState after sending state; %w", err)
+	}
+	if err := sendFDs(conn, fds); err != nil {
+		return fmt.Errorf("error in sendTakeoverState after sending file descriptors; %w", err)
+	}
+	return nil
+}
+
+// takeoverState returns the state for the new master and the duplicated file
+// descriptors passed with it, which the caller must close.
+//
+// NOTE: This is called in the goroutine serving the takeover socket, so we hold
+// mu while reading the listeners, which the control commands may modify, and
+// duplicate the file descriptors so that they are not closed while being sent.
+func (s *Starter) takeoverState() (masterState, []int, error) {
+	state := masterState{PID: os.Getpid(), Generation: s.Generation()}
+	var files []*os.File
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, f := range s.listenerFiles {
+		addr := s.listeners[i].Addr()
+		state.Listeners = append(state.Listeners, listenerState{Network: addr.Network(), Address: addr.String(), FD: len(files)})
+		files = append(files, f)
+	}
+	for i, f := range s.packetConnFiles {
+		addr := s.packetConns[i].LocalAddr()
+		state.PacketConns = append(state.PacketConns, listenerState{Network: addr.Network(), Address: addr.String(), FD: len(files)})
+		files = append(files, f)
+	}
+	for _, f := range s.logFiles {
+		state.LogFiles = append(state.LogFiles, logFileState{Path: f.path, ReadFD: len(files), WriteFD: len(files) + 1})
+		files = append(files, f.pipeR, f.pipeW)
+	}
+	fds := make([]int, 0, len(files))
+	for _, f := range files {
+		// NOTE: The duplicated file descriptors must not leak to the workers
+		// started by another goroutine meanwhile.
+		fd, err := dupCloseOnExec(int(f.Fd()))
+		if err != nil {
+			closeFDs(fds)
+			return masterState{}, nil, err
+		}
+		fds = append(fds, fd)
+	}
+	return state, fds, nil
+}
+
+// close stops the server. The socket file is kept if the master has handed over
+// to a new master, since the new master listens on the same path.
+func (srv *takeoverServer) close(handedOver bool) {
+	close(srv.done)
+	if handedOver {
+		srv.listener.SetUnlinkOnClose(false)
+	}
+	srv.listener.Close()
+}
+
+// handOver stops the workers gracefully after the workers of the new master
+// get ready, and notifies the new master. The workers of the old generation
+// kept by SetNginxSignals are stopped too, since they are not handed over.
+func (s *Starter) handOver(conn *net.UnixConn) {
+	defer conn.Close()
+	s.out.printf("workers of new master are ready, stopping workers\n")
+	for _, w := range s.runningWorkers() {
+		pid := w.pid()
+		if err := s.signalChild(w, s.gracefulShutdownSignalToChild); err != nil {
+			s.out.eprintf("failed to send signal %q to worker pid=%d: %v\n", s.gracefulShutdownSignalToChild, pid, err)
+			continue
+		}
+		if err := s.drainOldWorker(w); err != nil {
+			s.out.eprintf("failed to stop worker pid=%d: %v\n", pid, err)
+		}
+	}
+	for _, slot := range s.slots {
+		slot.oldChild = nil
+	}
+	if _, err := io.WriteString(conn, takeoverDone); err != nil {
+		s.out.eprintf("failed to notify new master of finishing takeover: %v\n", err)
+	}
+	s.out.printf("handed over to new master, exiting.\n")
+}
@@ -0,0 +1,6 @@
+package serverstarter
+
+// receiveTakeoverState does nothing on Windows, since SetTakeoverSocket is not supported.
+func (s *Starter) receiveTakeoverState() (*masterState, error) {
+	return nil, nil
+}
@@ -0,0 +1,123 @@
+package serverstarter
+
+import "context"
+
+// Tracer is the interface for tracing reloads used by SetTracer. It can be
+// implemented with a tracer of OpenTelemetry like below, so that this package
+// does not depend on OpenTelemetry.
+//
+//	type otelTracer struct{ tracer trace.Tracer }
+//
+//	func (t otelTracer) Start(ctx context.Context, name string) (context.Context, serverstarter.Span) {
+//		ctx, span := t.tracer.Start(ctx, name)
+//		return ctx, otelSpan{span}
+//	}
+//
+//	type otelSpan struct{ trace.Span }
+//
+//	func (s otelSpan) SetAttribute(key string, value interface{}) {
+//		switch v := value.(type) {
+//		case int:
+//			s.SetAttributes(attribute.Int(key, v))
+//		case string:
+//			s.SetAttributes(attribute.String(key, v))
+//		}
+//	}
+//
+//	func (s otelSpan) RecordError(err error) {
+//		s.Span.RecordError(err)
+//		s.SetStatus(codes.Error, err.Error())
+//	}
+//
+//	func (s otelSpan) End() { s.Span.End() }
+type Tracer interface {
+	// Start starts a span with name as a child of the span in ctx if any, and
+	// returns the context with the new span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is the interface of a span started by Tracer.
+type Span interface {
+	// SetAttribute sets the attribute of the span. value is an int or a string.
+	SetAttribute(key string, value interface{})
+	// RecordError records err as the error of the span.
+	RecordError(err error)
+	// End ends the span.
+	End()
+}
+
+// SetTracer sets the tracer with which the master traces reloads. The master
+// starts a span "serverstarter.reload" for the reload of each worker with
+// the attributes "worker", "old_pid", "new_pid" and "outcome", which is one of
+// "succeeded", "failed" and "kept_old". The child spans below are started in it.
+//
+//   - "serverstarter.spawn": starting the new worker.
+//   - "serverstarter.wait_ready": waiting for the new worker to get ready.
+//   - "serverstarter.drain_old_worker": waiting for the old worker to exit
+//     after sending the graceful shutdown signal.
+//   - "serverstarter.kill": killing a worker with SIGKILL.
+//
+// The child spans have the attribute "pid" of the worker.
+func SetTracer(tracer Tracer) Option {
+	return func(s *Starter) {
+		s.tracer = tracer
+	}
+}
+
+// noopSpan is the span used when no tracer is set.
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key string, value interface{}) {}
+func (noopSpan) RecordError(err error)                      {}
+func (noopSpan) End()                                       {}
+
+// startSpan starts a span with name as a child of the span of the reload in
+// progress if any. It returns the span and the context with it.
+func (s *Starter) startSpan(name string) (context.Context, Span) {
+	if s.tracer == nil {
+		return s.reloadCtx, noopSpan{}
+	}
+	ctx := s.reloadCtx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return s.tracer.Start(ctx, name)
+}
+
+// traced calls fn in the span with name and the attribute pid, and records
+// the error returned from fn in the span.
+func (s *Starter) traced(name string, pid int, fn func() error) error {
+	_, span := s.startSpan(name)
+	span.SetAttribute("pid", pid)
+	err := fn()
+	endSpan(span, err)
+	return err
+}
+
+// endSpan records err in span if it is not nil and ends span.
+func endSpan(span Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+}
+
+// endReloadSpan sets the attributes for the result of the reload and the error
+// err returned from reloadSlot to span, and ends span.
+func endReloadSpan(span Span, result ReloadResult, err error) {
+	outcome := "succeeded"
+	switch {
+	case err != nil:
+		outcome = "failed"
+	case result.Err != nil:
+		outcome = "kept_old"
+	}
+	if result.NewPID != 0 {
+		span.SetAttribute("new_pid", result.NewPID)
+	}
+	span.SetAttribute("outcome", outcome)
+	if err == nil {
+		err = result.Err
+	}
+	endSpan(span, err)
+}
@@ -0,0 +1,117 @@
+package serverstarter
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// keepUnixSocketFiles makes the unix domain socket listeners not remove their
+// socket files when they are closed, and returns the paths of the socket files.
+//
+// NOTE: The socket file must be kept while the master is running, since the new
+// worker keeps accepting on the same socket after the old worker exits. The master
+// removes the files with removeUnixSocketFiles on the final shutdown.
+func keepUnixSocketFiles(listeners []net.Listener) []string {
+	var paths []string
+	for _, l := range listeners {
+		ul, ok := l.(*net.UnixListener)
+		if !ok {
+			continue
+		}
+		ul.SetUnlinkOnClose(false)
+		if path := ul.Addr().String(); isUnixSocketFile(path) {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// removeUnixSocketFiles removes the socket files of the unix domain socket listeners.
+func removeUnixSocketFiles(out *output, paths []string) {
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			out.eprintf("failed to remove unix domain socket file %s: %v\n", path, err)
+		}
+	}
+}
+
+// isUnixSocketFile returns whether the address of a unix domain socket is
+// the path of a file, not an unnamed nor an abstract one.
+func isUnixSocketFile(path string) bool {
+	return path != "" && !isAbstractUnixSocket(path)
+}
+
+// isAbstractUnixSocket returns whether the address of a unix domain socket is
+// in the abstract namespace of Linux. The leading NUL byte of the address
+// is written as '@' in Go.
+func isAbstractUnixSocket(addr string) bool {
+	return addr != "" && (addr[0] == '@' || addr[0] == 0)
+}
+
+// ParseListenAddress parses a listen address in one of the following forms and
+// returns the network and the address for Listen.
+//
+//	"host:port", ":port"      TCP
+//	"tcp://host:port"         TCP ("tcp4://" and "tcp6://" also work)
+//	"unix:/path", "/path"     unix domain socket at the path
+//	"unix:@name", "@name"     unix domain socket in the abstract namespace (Linux only)
+//	"unixpacket:/path"        unix domain socket of SOCK_SEQPACKET
+func ParseListenAddress(s string) (network, address string, err error) {
+	switch {
+	case s == "":
+		return "", "", errors.New("empty listen address")
+	case strings.HasPrefix(s, "/") || strings.HasPrefix(s, "@"):
+		network, address = "unix", s
+	default:
+		if i := strings.Index(s, "://"); i != -1 {
+			network, address = s[:i], s[i+len("://"):]
+		} else if i := strings.IndexByte(s, ':'); i != -1 && (s[:i] == "unix" || s[:i] == "unixpacket") {
+			network, address = s[:i], s[i+1:]
+		} else {
+			network, address = "tcp", s
+		}
+	}
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return "", "", fmt.Errorf("invalid listen address %q; %w", s, err)
+		}
+	case "unix", "unixpacket":
+		if address == "" {
+			return "", "", fmt.Errorf("invalid listen address %q; empty path", s)
+		}
+		if isAbstractUnixSocket(address) && !abstractUnixSocketSupported {
+			return "", "", fmt.Errorf("invalid listen address %q; abstract unix domain socket is not supported on this platform", s)
+		}
+	default:
+		return "", "", fmt.Errorf("invalid listen address %q; unsupported network %q", s, network)
+	}
+	return network, address, nil
+}
+
+// removeStaleUnixSocketFile removes the socket file at path if no process listens
+// on it, which is left when the previous master crashed. It writes a message to out
+// when it removes the file.
+func removeStaleUnixSocketFile(out *output, network, path string) error {
+	if !isUnixSocketFile(path) {
+		return nil
+	}
+	fi, err := os.Stat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+	c, err := net.Dial(network, path)
+	if err == nil {
+		c.Close()
+		return nil
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return nil
+	}
+	out.printf("removing stale unix domain socket file %s\n", path)
+	return os.Remove(path)
+}
@@ -0,0 +1,5 @@
+package serverstarter
+
+// abstractUnixSocketSupported is whether the abstract namespace of unix domain
+// sockets, whose addresses start with '@', is supported on this platform.
+const abstractUnixSocketSupported = true
@@ -0,0 +1,41 @@
+package serverstarter
+
+import "testing"
+
+func TestParseListenAddress(t *testing.T) {
+	type testCase struct {
+		input   string
+		network string
+		address string
+	}
+	testCases := []testCase{
+		{input: ":8080", network: "tcp", address: ":8080"},
+		{input: "127.0.0.1:8080", network: "tcp", address: "127.0.0.1:8080"},
+		{input: "tcp6://[::1]:8080", network: "tcp6", address: "[::1]:8080"},
+		{input: "/run/app.sock", network: "unix", address: "/run/app.sock"},
+		{input: "unix:/run/app.sock", network: "unix", address: "/run/app.sock"},
+		{input: "unix:///run/app.sock", network: "unix", address: "/run/app.sock"},
+		{input: "unixpacket:/run/app.sock", network: "unixpacket", address: "/run/app.sock"},
+	}
+	if abstractUnixSocketSupported {
+		testCases = append(testCases,
+			testCase{input: "@app", network: "unix", address: "@app"},
+			testCase{input: "unix:@app", network: "unix", address: "@app"})
+	}
+	for _, tc := range testCases {
+		network, address, err := ParseListenAddress(tc.input)
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", tc.input, err)
+			continue
+		}
+		if network != tc.network || address != tc.address {
+			t.Errorf("result mismatch for %q, got=%s %s, want=%s %s", tc.input, network, address, tc.network, tc.address)
+		}
+	}
+
+	for _, input := range []string{"", "8080", "udp://:53", "unix:"} {
+		if _, _, err := ParseListenAddress(input); err == nil {
+			t.Errorf("expected error for %q", input)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package serverstarter
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// envMasterState is the environment variable name for passing the state of
+// the master to the new master when the master upgrades itself.
+const envMasterState = "SERVERSTARTER_MASTER_STATE"
+
+// SetMasterUpgrade makes the master upgrade itself on a SIGUSR2.
+// The master re-executes its own executable with the same process ID, keeping
+// the listeners, the log files set by SetLogFiles and the running workers,
+// so that a new version of the master takes effect without dropping the sockets.
+//
+// The new master gets the listeners from Listen, so the master must bind
+// the listeners with Listen instead of net.Listen. It cannot be used with
+// SetControlFile, since the control file also uses SIGUSR2. It cannot be used
+// with SetExtraFiles, SetReusePortPool nor the SCTP listeners passed to
+// RunMasterWith either, since they are not handed over to the new master.
+//
+// This option is not supported on Windows.
+func SetMasterUpgrade(enabled bool) Option {
+	return func(s *Starter) {
+		s.masterUpgrade = enabled
+	}
+}
+
+// masterState is the state handed over from the master to the new master.
+type masterState struct {
+	PID         int             `json:"pid"`
+	Generation  int             `json:"generation"`
+	Listeners   []listenerState `json:"listeners"`
+	PacketConns []listenerState `json:"packet_conns"`
+	LogFiles    []logFileState  `json:"log_files"`
+	Workers     []workerState   `json:"workers"`
+
+	// used is the set of the indexes of Listeners which are already returned
+	// from upgradedListener.
+	used map[int]bool
+	// usedPacketConns is the set of the indexes of PacketConns which are
+	// already returned from upgradedPacketConn.
+	usedPacketConns map[int]bool
+}
+
+// listenerState is a listener handed over to the new master.
+type listenerState struct {
+	Network string `json:"network"`
+	Address string `json:"address"`
+	FD      int    `json:"fd"`
+}
+
+// logFileState is a log file set by SetLogFiles handed over to the new master.
+type logFileState struct {
+	Path    string `json:"path"`
+	ReadFD  int    `json:"read_fd"`
+	WriteFD int    `json:"write_fd"`
+}
+
+// workerState is a running worker handed over to the new master.
+type workerState struct {
+	Name       string    `json:"name"`
+	PID        int       `json:"pid"`
+	MsgFD      int       `json:"msg_fd"`
+	Generation int       `json:"generation"`
+	StartedAt  time.Time `json:"started_at"`
+}
+
+// inheritedMasterState returns the state handed over from the old master if
+// this process is the new master started by a master upgrade or taking over
+// from a running master with SetTakeoverSocket. It returns nil otherwise.
+func (s *Starter) inheritedMasterState() (*masterState, error) {
+	if s.masterStateLoaded {
+		return s.masterState, nil
+	}
+	s.masterStateLoaded = true
+	if !s.IsMaster() {
+		return nil, nil
+	}
+	v, ok := os.LookupEnv(envMasterState)
+	if !ok {
+		if s.takeoverSocket == "" {
+			return nil, nil
+		}
+		state, err := s.receiveTakeoverState()
+		if err != nil {
+			return nil, fmt.Errorf("error in inheritedMasterState after taking over from running master; %w", err)
+		}
+		s.masterState = state
+		return s.masterState, nil
+	}
+	var state masterState
+	if err := json.Unmarshal([]byte(v), &state); err != nil {
+		return nil, fmt.Errorf("error in inheritedMasterState after decoding state; %w", err)
+	}
+	s.masterState = &state
+	return s.masterState, nil
+}
+
+// createdUnixSocketFiles returns the paths in paths excluding the socket files
+// of the unix domain socket listeners handed over from the old master, which
+// this process must not remove since the old master may be still running.
+func (s *Starter) createdUnixSocketFiles(paths []string) []string {
+	state := s.masterState
+	if state == nil {
+		return paths
+	}
+	var created []string
+	for _, path := range paths {
+		inherited := false
+		for i, ls := range state.Listeners {
+			if state.used[i] && (ls.Network == "unix" || ls.Network == "unixpacket") && ls.Address == path {
+				inherited = true
+				break
+			}
+		}
+		if !inherited {
+			created = append(created, path)
+		}
+	}
+	return created
+}
+
+// upgradedListener returns the listener handed over from the old master which
+// matches network and addr. It returns nil if this process is not started by
+// a master upgrade.
+func (s *Starter) upgradedListener(network, addr string) (net.Listener, error) {
+	state, err := s.inheritedMasterState()
+	if err != nil || state == nil {
+		return nil, err
+	}
+	for i, ls := range state.Listeners {
+		if state.used[i] {
+			continue
+		}
+		a, err := resolveListenerAddr(ls.Network, ls.Address)
+		if err != nil || !addrMatches(network, addr, a) {
+			continue
+		}
+		f := os.NewFile(uintptr(ls.FD), "listener")
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error in upgradedListener after creating listener from fd %d; %w", ls.FD, err)
+		}
+		if state.used == nil {
+			state.used = make(map[int]bool)
+		}
+		state.used[i] = true
+		return l, nil
+	}
+	return nil, fmt.Errorf("error in upgradedListener after failing to find listener handed over from old master for network=%s, addr=%s", network, addr)
+}
+
+// upgradedPacketConn returns the packet connection handed over from the old
+// master which matches network and addr. It returns nil if this process is not
+// started by a master upgrade.
+func (s *Starter) upgradedPacketConn(network, addr string) (net.PacketConn, error) {
+	state, err := s.inheritedMasterState()
+	if err != nil || state == nil {
+		return nil, err
+	}
+	for i, ps := range state.PacketConns {
+		if state.usedPacketConns[i] {
+			continue
+		}
+		a, err := resolveListenerAddr(ps.Network, ps.Address)
+		if err != nil || !addrMatches(network, addr, a) {
+			continue
+		}
+		f := os.NewFile(uintptr(ps.FD), "packetconn")
+		c, err := net.FilePacketConn(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error in upgradedPacketConn after creating packet connection from fd %d; %w", ps.FD, err)
+		}
+		if state.usedPacketConns == nil {
+			state.usedPacketConns = make(map[int]bool)
+		}
+		state.usedPacketConns[i] = true
+		return c, nil
+	}
+	return nil, fmt.Errorf("error in upgradedPacketConn after failing to find packet connection handed over from old master for network=%s, addr=%s", network, addr)
+}
+
+// resolveListenerAddr returns the address of a listener from its network
+// and string form.
+func resolveListenerAddr(network, addr string) (net.Addr, error) {
+	switch network {
+	case "unix", "unixpacket", "unixgram":
+		return &net.UnixAddr{Net: network, Name: addr}, nil
+	case "udp", "udp4", "udp6":
+		return net.ResolveUDPAddr(network, addr)
+	default:
+		return net.ResolveTCPAddr(network, addr)
+	}
+}
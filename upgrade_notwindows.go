@@ -0,0 +1,217 @@
+//go:build !windows
+
+package serverstarter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// upgradeMaster re-executes the executable of the master with the same process ID,
+// handing over the listeners, the log files and the running workers to the new master.
+// It returns only if it fails to re-execute, and the master keeps running in that case.
+func (s *Starter) upgradeMaster() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("error in upgradeMaster after getting executable; %w", err)
+	}
+
+	// NOTE: We duplicate the file descriptors to hand over with the close-on-exec
+	// flag, and clear the flag just before executing the new master.
+	var dups []int
+	dup := func(fd uintptr) (int, error) {
+		d, err := dupCloseOnExec(int(fd))
+		if err != nil {
+			return 0, err
+		}
+		dups = append(dups, d)
+		return d, nil
+	}
+	defer func() {
+		for _, d := range dups {
+			syscall.Close(d)
+		}
+	}()
+
+	state := masterState{Generation: s.Generation()}
+	for i, f := range s.listenerFiles {
+		fd, err := dup(f.Fd())
+		if err != nil {
+			return fmt.Errorf("error in upgradeMaster after duplicating listener; %w", err)
+		}
+		addr := s.listeners[i].Addr()
+		state.Listeners = append(state.Listeners, listenerState{Network: addr.Network(), Address: addr.String(), FD: fd})
+	}
+	for i, f := range s.packetConnFiles {
+		fd, err := dup(f.Fd())
+		if err != nil {
+			return fmt.Errorf("error in upgradeMaster after duplicating packet connection; %w", err)
+		}
+		addr := s.packetConns[i].LocalAddr()
+		state.PacketConns = append(state.PacketConns, listenerState{Network: addr.Network(), Address: addr.String(), FD: fd})
+	}
+	for _, f := range s.logFiles {
+		readFD, err := dup(f.pipeR.Fd())
+		if err != nil {
+			return fmt.Errorf("error in upgradeMaster after duplicating log pipe; %w", err)
+		}
+		writeFD, err := dup(f.pipeW.Fd())
+		if err != nil {
+			return fmt.Errorf("error in upgradeMaster after duplicating log pipe; %w", err)
+		}
+		state.LogFiles = append(state.LogFiles, logFileState{Path: f.path, ReadFD: readFD, WriteFD: writeFD})
+	}
+	for _, slot := range s.slots {
+		w := slot.child
+		// NOTE: The pipe from the worker is already closed if the worker closed it.
+		msgFD, err := w.dupMsgR()
+		if err != nil {
+			return fmt.Errorf("error in upgradeMaster after duplicating pipe from worker %s; %w", w.label(), err)
+		}
+		if msgFD >= 0 {
+			dups = append(dups, msgFD)
+		}
+		state.Workers = append(state.Workers, workerState{
+			Name:       slot.spec.Name,
+			PID:        w.pid(),
+			MsgFD:      msgFD,
+			Generation: w.generation,
+			StartedAt:  w.startedAt,
+		})
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("error in upgradeMaster after encoding state; %w", err)
+	}
+
+	env := []string{envMasterState + "=" + string(data)}
+	for _, v := range os.Environ() {
+		if envKey(v) != envMasterState {
+			env = append(env, v)
+		}
+	}
+	s.out.printf("upgrading master: pid=%d, executable=%s\n", os.Getpid(), exe)
+	if err := execWithFDs(exe, os.Args, env, dups); err != nil {
+		return fmt.Errorf("error in upgradeMaster after executing %s; %w", exe, err)
+	}
+	return nil
+}
+
+// execWithFDs executes the program at path in place of this process, passing
+// fds which have the close-on-exec flag. It holds syscall.ForkLock while fds
+// do not have the flag, and sets the flag again if it fails to execute.
+func execWithFDs(path string, args, env []string, fds []int) error {
+	syscall.ForkLock.Lock()
+	defer syscall.ForkLock.Unlock()
+	for i, fd := range fds {
+		if err := clearCloseOnExec(fd); err != nil {
+			for _, fd := range fds[:i] {
+				syscall.CloseOnExec(fd)
+			}
+			return err
+		}
+	}
+	err := syscall.Exec(path, args, env)
+	for _, fd := range fds {
+		syscall.CloseOnExec(fd)
+	}
+	return err
+}
+
+// adoptWorkers adopts the workers handed over from the old master for the slots.
+// The slots for which no worker is handed over are left without workers.
+// It does nothing if this process is not started by a master upgrade.
+func (s *Starter) adoptWorkers() error {
+	state, err := s.inheritedMasterState()
+	if err != nil || state == nil {
+		return err
+	}
+	s.mu.Lock()
+	s.generation = state.Generation
+	s.mu.Unlock()
+
+	for _, slot := range s.slots {
+		for _, ws := range state.Workers {
+			if ws.Name == slot.spec.Name {
+				slot.child = s.adoptWorker(slot, ws)
+				slot.ready = true
+				s.out.printf("adopted worker from old master: %s\n", slot.child.label())
+				break
+			}
+		}
+	}
+	// NOTE: Close the pipes from the workers whose programs are removed.
+	for _, ws := range state.Workers {
+		if s.findSlot(ws.Name) == nil {
+			s.out.eprintf("worker pid=%d, name=%s handed over from old master is not supervised anymore\n", ws.PID, ws.Name)
+			if ws.MsgFD >= 0 {
+				syscall.Close(ws.MsgFD)
+			}
+		}
+	}
+	return nil
+}
+
+// adoptWorker returns the worker for the running worker handed over from the old master.
+// Since this process has the same process ID as the old master, the worker is
+// still a child of this process and can be waited for.
+func (s *Starter) adoptWorker(slot *workerSlot, ws workerState) *worker {
+	// NOTE: os.FindProcess always succeeds on Unix systems.
+	p, _ := os.FindProcess(ws.PID)
+	w := &worker{
+		out:        &s.out,
+		process:    cmdProcess{cmd: &exec.Cmd{Process: p}},
+		slot:       slot,
+		generation: ws.Generation,
+		startedAt:  ws.StartedAt,
+		waitErrC:   make(chan error, 1),
+		msgC:       make(chan byte, 2),
+		drainC:     make(chan struct{}, 1),
+		readySent:  true,
+	}
+	s.setRetireTime(w)
+	registerProcess(ws.PID)
+	go w.wait()
+	if ws.MsgFD < 0 {
+		w.readErr = io.EOF
+		close(w.msgC)
+		return w
+	}
+	closeOnExec(uintptr(ws.MsgFD))
+	r := os.NewFile(uintptr(ws.MsgFD), "readyPipeR")
+	w.msgR = r
+	go w.readMessages(r)
+	return w
+}
+
+// dupMsgR returns a duplicate of the read end of the pipe from the worker
+// with the close-on-exec flag, or -1 if the pipe is already closed.
+//
+// NOTE: We use SyscallConn instead of Fd since Fd puts the file into blocking
+// mode, and we hold mu so that readMessages does not close the file meanwhile.
+func (w *worker) dupMsgR() (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.msgR == nil {
+		return -1, nil
+	}
+	rc, err := w.msgR.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	d := -1
+	var dupErr error
+	if err := rc.Control(func(fd uintptr) {
+		d, dupErr = dupCloseOnExec(int(fd))
+	}); err != nil {
+		return 0, err
+	}
+	if dupErr != nil {
+		return 0, dupErr
+	}
+	return d, nil
+}
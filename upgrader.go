@@ -0,0 +1,244 @@
+package serverstarter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// envUpgraderState is the environment variable name for passing the state of
+// the old process to the new process started by Upgrader.Upgrade.
+const envUpgraderState = "SERVERSTARTER_UPGRADER_STATE"
+
+// defaultUpgraderReadyTimeout is the default of UpgraderOptions.ReadyTimeout.
+const defaultUpgraderReadyTimeout = time.Minute
+
+// UpgraderOptions is the options for NewUpgrader.
+type UpgraderOptions struct {
+	// ReadyTimeout is the time to wait for the new process to call Ready in Upgrade.
+	// If zero, one minute is used.
+	ReadyTimeout time.Duration
+
+	// PIDFile is the path of the file to which the process writes its process ID
+	// when it calls Ready, for example for the PIDFile of a systemd service,
+	// since the process ID changes on every upgrade.
+	PIDFile string
+
+	// ListenOptions is the options for binding a listener in Listen.
+	ListenOptions ListenOptions
+}
+
+// Upgrader upgrades a process in place without a master. On Upgrade, the process
+// starts a new process of its own executable with the same arguments and hands
+// its listeners directly to it, and the old process exits after the new process
+// calls Ready. It is useful when the process is already supervised, for example
+// by systemd, and a long-lived master is not wanted.
+//
+// Upgrader is an alternative to RunMaster and they cannot be used together in
+// a process. It is safe to call the methods of Upgrader from multiple goroutines.
+type Upgrader struct {
+	opts UpgraderOptions
+
+	mu        sync.Mutex
+	state     *upgraderState
+	used      map[int]bool
+	listeners []net.Listener
+	readyW    *os.File
+	ready     bool
+	upgrading bool
+	stopped   bool
+	exitC     chan struct{}
+}
+
+// upgraderState is the state handed over from the old process to the new process.
+type upgraderState struct {
+	Listeners []listenerState `json:"listeners"`
+	ReadyFD   int             `json:"ready_fd"`
+}
+
+// NewUpgrader returns a new Upgrader. If this process is started by Upgrade of
+// the old process, it takes the listeners handed over from the old process.
+func NewUpgrader(opts UpgraderOptions) (*Upgrader, error) {
+	if opts.ReadyTimeout == 0 {
+		opts.ReadyTimeout = defaultUpgraderReadyTimeout
+	}
+	u := &Upgrader{opts: opts, exitC: make(chan struct{})}
+	v, ok := os.LookupEnv(envUpgraderState)
+	if !ok {
+		return u, nil
+	}
+	// NOTE: The processes started by this process must not take over the state.
+	os.Unsetenv(envUpgraderState)
+	var state upgraderState
+	if err := json.Unmarshal([]byte(v), &state); err != nil {
+		return nil, fmt.Errorf("error in NewUpgrader after decoding state; %w", err)
+	}
+	u.state = &state
+	u.readyW = os.NewFile(uintptr(state.ReadyFD), "ready")
+	return u, nil
+}
+
+// HasParent returns whether this process is started by Upgrade of the old process.
+func (u *Upgrader) HasParent() bool {
+	return u.state != nil
+}
+
+// Listen returns a listener for the network and address, which is handed over
+// to the new process on Upgrade. It returns the listener handed over from
+// the old process if any matches network and addr, and binds a new listener
+// with UpgraderOptions.ListenOptions otherwise. The socket file of a unix
+// domain socket listener is not removed when the listener is closed.
+func (u *Upgrader) Listen(network, addr string) (net.Listener, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	l, err := u.inheritedListener(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if l == nil {
+		if network == "unix" || network == "unixpacket" {
+			// NOTE: Upgrader has no output option, so the message is written to
+			// os.Stdout by the zero value of output.
+			if err := removeStaleUnixSocketFile(&output{}, network, addr); err != nil {
+				return nil, fmt.Errorf("error in Upgrader.Listen after removing stale unix domain socket file; %w", err)
+			}
+		}
+		lc := net.ListenConfig{Control: u.opts.ListenOptions.control}
+		if l, err = lc.Listen(context.Background(), network, addr); err != nil {
+			return nil, fmt.Errorf("error in Upgrader.Listen after binding listener; %w", err)
+		}
+	}
+	// NOTE: The socket file must be kept when the old process closes the listener.
+	keepUnixSocketFiles([]net.Listener{l})
+	u.listeners = append(u.listeners, l)
+	return l, nil
+}
+
+// inheritedListener returns the listener handed over from the old process which
+// matches network and addr, or nil if none matches.
+func (u *Upgrader) inheritedListener(network, addr string) (net.Listener, error) {
+	if u.state == nil {
+		return nil, nil
+	}
+	for i, ls := range u.state.Listeners {
+		if u.used[i] {
+			continue
+		}
+		a, err := resolveListenerAddr(ls.Network, ls.Address)
+		if err != nil || !addrMatches(network, addr, a) {
+			continue
+		}
+		f := os.NewFile(uintptr(ls.FD), "listener")
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error in Upgrader.Listen after creating listener from fd %d; %w", ls.FD, err)
+		}
+		if u.used == nil {
+			u.used = make(map[int]bool)
+		}
+		u.used[i] = true
+		return l, nil
+	}
+	return nil, nil
+}
+
+// Ready notifies the old process that this process is ready to serve, which makes
+// the old process exit, and writes the process ID to UpgraderOptions.PIDFile.
+// The listeners handed over from the old process which are not taken with Listen
+// are closed. It must be called after getting all listeners with Listen.
+func (u *Upgrader) Ready() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.ready {
+		return nil
+	}
+	u.ready = true
+	if u.opts.PIDFile != "" {
+		if err := writePIDFile(u.opts.PIDFile, os.Getpid()); err != nil {
+			return fmt.Errorf("error in Upgrader.Ready after writing pid file; %w", err)
+		}
+	}
+	if u.state == nil {
+		return nil
+	}
+	for i, ls := range u.state.Listeners {
+		if !u.used[i] {
+			os.NewFile(uintptr(ls.FD), "listener").Close()
+		}
+	}
+	defer u.readyW.Close()
+	if _, err := u.readyW.Write([]byte{readyByte}); err != nil {
+		return fmt.Errorf("error in Upgrader.Ready after notifying old process; %w", err)
+	}
+	return nil
+}
+
+// Upgrade starts a new process of the executable of this process with the same
+// arguments and environment, hands the listeners got by Listen to it and waits
+// for it to call Ready. When it returns nil, the channel returned from Exit is
+// closed and this process should stop accepting and exit after finishing
+// the in-flight requests. When it returns an error, for example the new process
+// exits or does not get ready in UpgraderOptions.ReadyTimeout, the new process
+// is killed and this process should keep running.
+//
+// This is not supported on Windows.
+func (u *Upgrader) Upgrade() error {
+	u.mu.Lock()
+	switch {
+	case u.stopped:
+		u.mu.Unlock()
+		return errors.New("error in Upgrader.Upgrade; upgrader is stopped")
+	case u.upgrading:
+		u.mu.Unlock()
+		return errors.New("error in Upgrader.Upgrade; upgrade is in progress")
+	}
+	u.upgrading = true
+	listeners := append([]net.Listener(nil), u.listeners...)
+	u.mu.Unlock()
+
+	err := u.upgrade(listeners)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.upgrading = false
+	if err != nil {
+		return err
+	}
+	if !u.stopped {
+		u.stopped = true
+		close(u.exitC)
+	}
+	return nil
+}
+
+// Exit returns the channel which is closed when Upgrade succeeds or Stop is called.
+func (u *Upgrader) Exit() <-chan struct{} {
+	return u.exitC
+}
+
+// Stop prevents further upgrades and closes the channel returned from Exit.
+func (u *Upgrader) Stop() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !u.stopped {
+		u.stopped = true
+		close(u.exitC)
+	}
+}
+
+// writePIDFile writes pid to the file at path atomically.
+func writePIDFile(path string, pid int) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.Itoa(pid)+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
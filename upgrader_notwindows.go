@@ -0,0 +1,80 @@
+//go:build !windows
+
+package serverstarter
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// upgrade starts the new process with the listeners and waits for it to get ready.
+func (u *Upgrader) upgrade(listeners []net.Listener) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("error in Upgrader.Upgrade after getting executable; %w", err)
+	}
+	files, err := listenerFiles(listeners)
+	if err != nil {
+		return fmt.Errorf("error in Upgrader.Upgrade after getting files from listeners; %w", err)
+	}
+	defer closeFiles(files)
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("error in Upgrader.Upgrade after creating pipe; %w", err)
+	}
+	defer readyR.Close()
+
+	// NOTE: The pipe is at the first file descriptor and the listeners follow it.
+	state := upgraderState{ReadyFD: stdFdCount}
+	for i, l := range listeners {
+		addr := l.Addr()
+		state.Listeners = append(state.Listeners, listenerState{Network: addr.Network(), Address: addr.String(), FD: stdFdCount + 1 + i})
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		readyW.Close()
+		return fmt.Errorf("error in Upgrader.Upgrade after encoding state; %w", err)
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), envUpgraderState+"="+string(data))
+	cmd.ExtraFiles = append([]*os.File{readyW}, files...)
+	err = cmd.Start()
+	// NOTE: This is needed to detect the exit of the new process by EOF.
+	readyW.Close()
+	if err != nil {
+		return fmt.Errorf("error in Upgrader.Upgrade after starting new process; %w", err)
+	}
+
+	readyC := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		if _, err := readyR.Read(buf); err != nil {
+			readyC <- fmt.Errorf("new process pid=%d exited before getting ready; %w", cmd.Process.Pid, err)
+			return
+		}
+		readyC <- nil
+	}()
+	timer := time.NewTimer(u.opts.ReadyTimeout)
+	defer timer.Stop()
+	select {
+	case err = <-readyC:
+	case <-timer.C:
+		err = fmt.Errorf("new process pid=%d did not get ready in %s; %w", cmd.Process.Pid, u.opts.ReadyTimeout, ErrReadyTimeout)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("error in Upgrader.Upgrade; %w", err)
+	}
+	// NOTE: We reap the new process in case it exits before this process.
+	go cmd.Wait()
+	return nil
+}
@@ -0,0 +1,111 @@
+//go:build !windows
+
+package serverstarter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func init() {
+	helpers["upgrader"] = upgraderHelper
+}
+
+// upgraderAddrEnv is the environment variable for the address on which
+// upgraderHelper listens.
+const upgraderAddrEnv = "SERVERSTARTER_TEST_UPGRADER_ADDR"
+
+// upgraderHelper upgrades itself on a SIGHUP and writes its process ID to
+// the connections.
+func upgraderHelper() {
+	u, err := NewUpgrader(UpgraderOptions{ReadyTimeout: 10 * time.Second})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create upgrader; %v\n", err)
+		os.Exit(1)
+	}
+	l, err := u.Listen("tcp", os.Getenv(upgraderAddrEnv))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to listen; %v\n", err)
+		os.Exit(1)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(c, "%d", os.Getpid())
+			c.Close()
+		}
+	}()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGTERM)
+	if err := u.Ready(); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to get ready; %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("upgrader ready: pid=%d, has_parent=%v\n", os.Getpid(), u.HasParent())
+	for {
+		select {
+		case sig := <-signals:
+			if sig == syscall.SIGTERM {
+				u.Stop()
+				continue
+			}
+			if err := u.Upgrade(); err != nil {
+				fmt.Fprintf(os.Stderr, "failed to upgrade; %v\n", err)
+			}
+		case <-u.Exit():
+			l.Close()
+			fmt.Printf("upgrader exiting: pid=%d\n", os.Getpid())
+			return
+		}
+	}
+}
+
+func TestUpgrader(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	p := startHelper(t, "upgrader", upgraderAddrEnv+"="+addr)
+	p.waitLine("upgrader ready: pid="+strconv.Itoa(p.cmd.Process.Pid)+", has_parent=false", 10*time.Second)
+
+	p.signal(syscall.SIGHUP)
+	lines := p.waitLines(10*time.Second, "has_parent=true", "upgrader exiting: pid="+strconv.Itoa(p.cmd.Process.Pid))
+	var newPID int
+	if _, err := fmt.Sscanf(lines[0], "upgrader ready: pid=%d,", &newPID); err != nil {
+		t.Fatalf("unexpected line: %q", lines[0])
+	}
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect to new process; %v", err)
+	}
+	data, err := ioutil.ReadAll(c)
+	c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.TrimSpace(string(data)), strconv.Itoa(newPID); got != want {
+		t.Errorf("unexpected pid of process accepting connection: got %s, want %s", got, want)
+	}
+
+	if err := syscall.Kill(newPID, syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	p.waitLine("upgrader exiting: pid="+strconv.Itoa(newPID), 10*time.Second)
+	if err := p.cmd.Wait(); err != nil {
+		t.Errorf("old process exited with error; %v", err)
+	}
+}
@@ -0,0 +1,11 @@
+package serverstarter
+
+import (
+	"fmt"
+	"net"
+)
+
+// upgrade returns an error, since Upgrader.Upgrade is not supported on Windows.
+func (u *Upgrader) upgrade(listeners []net.Listener) error {
+	return fmt.Errorf("error in Upgrader.Upgrade; %w", ErrUnsupported)
+}
@@ -0,0 +1,68 @@
+//go:build !windows
+
+package serverstarter
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// validateWorker runs the worker binary for the worker program in slot with
+// the validation arguments and returns an error if it fails.
+func (s *Starter) validateWorker(slot *workerSlot) error {
+	binary, err := s.workerBinaryPath(slot)
+	if err != nil {
+		return fmt.Errorf("error in validateWorker after looking path of the worker binary location; %w", err)
+	}
+	// NOTE: We pass the generation number which the new worker will have.
+	generation := s.Generation() + 1
+	args, err := s.workerCommandArgs(slot, generation)
+	if err != nil {
+		return fmt.Errorf("error in validateWorker after getting worker arguments; %w", err)
+	}
+	args = append(args, s.reloadValidationArgs...)
+	env, err := s.buildEnv(slot, generation, []string{envValidate + "=1"})
+	if err != nil {
+		return fmt.Errorf("error in validateWorker after building environment variables; %w", err)
+	}
+
+	cmd := exec.Command(binary, args...)
+	cmd.Env = env
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = s.workerSysProcAttr()
+	if s.workerChroot != "" {
+		cmd.Dir = "/"
+		if cmd.Path, err = filepath.Abs(cmd.Path); err != nil {
+			return fmt.Errorf("error in validateWorker after getting absolute path of the executable; %w", err)
+		}
+	}
+	startedAt := time.Now()
+	if err := startCommand(cmd); err != nil {
+		return fmt.Errorf("error in validateWorker after starting validation process; %w", err)
+	}
+	errC := make(chan error, 1)
+	go func() { errC <- waitCommand(cmd) }()
+
+	var timeoutC <-chan time.Time
+	if s.reloadValidationTimeout > 0 {
+		timer := time.NewTimer(s.reloadValidationTimeout)
+		defer timer.Stop()
+		timeoutC = timer.C
+	}
+	select {
+	case err := <-errC:
+		if err != nil {
+			return fmt.Errorf("validation process pid=%d failed; %w", cmd.Process.Pid, err)
+		}
+	case <-timeoutC:
+		cmd.Process.Kill()
+		<-errC
+		return fmt.Errorf("validation process pid=%d timed out after %s", cmd.Process.Pid, s.reloadValidationTimeout)
+	}
+	s.out.printf("validated new worker binary, elapsed=%s\n", time.Since(startedAt))
+	return nil
+}
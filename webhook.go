@@ -0,0 +1,164 @@
+package serverstarter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// webhookQueueSize is the maximum number of notifications which wait to be sent.
+const webhookQueueSize = 64
+
+// SetWebhookURL sets the URL to which the master POSTs a JSON payload on
+// the events below, so that restarts can be notified to a chat or an alerting
+// service without a watcher process.
+//
+//   - EventReloadStarted, EventReloadSucceeded and EventReloadFailed
+//   - EventWorkerExited, that is, a worker crashed
+//
+// The payload is an object with the fields "event", "time", "master_pid",
+// "pid", "worker", "generation" and "error", where "worker", "generation" and
+// "error" are omitted if they are not set in the Event.
+//
+// The notifications are sent in the order of the events from another goroutine,
+// so that a slow webhook does not block the master. When the master exits,
+// it waits for the queued notifications to be sent.
+func SetWebhookURL(url string) Option {
+	return func(s *Starter) {
+		s.webhookURL = url
+	}
+}
+
+// SetWebhookRetry sets the maximum count of retries and the initial backoff duration
+// for sending a notification to the URL set by SetWebhookURL. The backoff
+// duration is doubled for each retry. The master retries when it fails to
+// send a notification or the response status code is not 2xx.
+// The default values are 3 and 1 second.
+func SetWebhookRetry(maxRetries int, initialBackoff time.Duration) Option {
+	return func(s *Starter) {
+		s.webhookMaxRetries = maxRetries
+		s.webhookInitialBackoff = initialBackoff
+	}
+}
+
+// SetWebhookTimeout sets the timeout for each request to the URL set by SetWebhookURL.
+// The default value is 5 seconds.
+func SetWebhookTimeout(timeout time.Duration) Option {
+	return func(s *Starter) {
+		s.webhookTimeout = timeout
+	}
+}
+
+// webhookPayload is the JSON payload sent to the URL set by SetWebhookURL.
+type webhookPayload struct {
+	Event      EventType `json:"event"`
+	Time       time.Time `json:"time"`
+	MasterPID  int       `json:"master_pid"`
+	PID        int       `json:"pid"`
+	Worker     string    `json:"worker,omitempty"`
+	Generation int       `json:"generation,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// webhook sends the notifications to the URL set by SetWebhookURL.
+type webhook struct {
+	url            string
+	client         *http.Client
+	maxRetries     int
+	initialBackoff time.Duration
+	out            *output
+	queue          chan webhookPayload
+	done           chan struct{}
+}
+
+// startWebhook starts the goroutine to send the notifications to the URL
+// set by SetWebhookURL.
+func (s *Starter) startWebhook() *webhook {
+	h := &webhook{
+		url:            s.webhookURL,
+		client:         &http.Client{Timeout: s.webhookTimeout},
+		maxRetries:     s.webhookMaxRetries,
+		initialBackoff: s.webhookInitialBackoff,
+		out:            &s.out,
+		queue:          make(chan webhookPayload, webhookQueueSize),
+		done:           make(chan struct{}),
+	}
+	go h.run()
+	return h
+}
+
+// isWebhookEvent returns whether the event of type t is notified with SetWebhookURL.
+func isWebhookEvent(t EventType) bool {
+	switch t {
+	case EventReloadStarted, EventReloadSucceeded, EventReloadFailed, EventWorkerExited:
+		return true
+	}
+	return false
+}
+
+// notify queues the notification for the event e.
+func (h *webhook) notify(e Event) {
+	payload := webhookPayload{
+		Event:      e.Type,
+		Time:       e.Time,
+		MasterPID:  os.Getpid(),
+		PID:        e.PID,
+		Worker:     e.Worker,
+		Generation: e.Generation,
+	}
+	if e.Err != nil {
+		payload.Error = e.Err.Error()
+	}
+	select {
+	case h.queue <- payload:
+	default:
+		h.out.eprintf("dropped webhook notification for event %s since too many notifications are queued\n", e.Type)
+	}
+}
+
+// close waits for the queued notifications to be sent.
+func (h *webhook) close() {
+	close(h.queue)
+	<-h.done
+}
+
+func (h *webhook) run() {
+	defer close(h.done)
+	for payload := range h.queue {
+		if err := h.send(payload); err != nil {
+			h.out.eprintf("failed to send webhook notification for event %s: %v\n", payload.Event, err)
+		}
+	}
+}
+
+// send sends the payload with retries.
+func (h *webhook) send(payload webhookPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("error in send after marshaling payload; %w", err)
+	}
+	backoff := h.initialBackoff
+	for i := 0; ; i++ {
+		err = h.post(body)
+		if err == nil || i >= h.maxRetries {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (h *webhook) post(body []byte) error {
+	resp, err := h.client.Post(h.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
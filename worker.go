@@ -0,0 +1,306 @@
+package serverstarter
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// worker is a worker process started by the master.
+type worker struct {
+	out     *output
+	process Process
+	slot    *workerSlot
+	// generation is the generation number of the worker. See Starter.Generation.
+	generation int
+	startedAt  time.Time
+	waitErrC   chan error
+	// msgC receives the types of the messages sent from the worker with
+	// SendReady, SendWarm, RequestRecycle, RequestReload, SendRetiring and
+	// RequestListen.
+	// It is closed when the worker closes the pipe or exits.
+	msgC chan byte
+	// msgs is the queue of the message types which readMessages received and
+	// forwardMessages has not sent to msgC yet.
+	msgs msgQueue
+	// readErr is the error which stopped reading the pipe. It must be read
+	// only after msgC is closed.
+	readErr error
+	// retireAt is the time when the master recycles the worker for
+	// SetMaxWorkerLifetime or RequestRecycle, or zero if the worker is not
+	// recycled.
+	retireAt time.Time
+	// retireReason is the reason for recycling the worker at retireAt.
+	retireReason string
+	// recycleHeldUntil is the time until which the master does not recycle
+	// the worker after a reload for recycling it failed.
+	recycleHeldUntil time.Time
+	// rssExceededSince is the time since when the RSS of the worker has
+	// exceeded the limit set by SetMaxWorkerRSS, or zero if it has not.
+	rssExceededSince time.Time
+	// tempDir is the temporary directory for the worker set by SetWorkerTempDir.
+	tempDir string
+	// drainC receives a value when the worker reports drain progress with
+	// SendDrainProgress.
+	drainC chan struct{}
+	// pendingReadyListeners is the set of the indexes of the listeners for which
+	// the worker has not sent ready with SendListenerReady yet. It is nil if
+	// SetWaitListenersReady is not used. It is accessed only in readMessages.
+	pendingReadyListeners map[int]bool
+	// readySent is true if ready has been sent to msgC. It is accessed only in
+	// readMessages.
+	readySent bool
+
+	// mu protects the fields below.
+	mu                  sync.Mutex
+	activeConns         int
+	activeConnsReported bool
+	retiring            bool
+	listenRequests      []string
+	// msgR is the read end of the pipe from the worker. It is closed and set
+	// to nil by readMessages when it stops reading the pipe.
+	msgR *os.File
+	// ackW is the end of the socket to the master kept for relaying the ACK of
+	// Einhorn for SetEinhornEnv. It is closed after relaying the ACK or when
+	// the worker exits.
+	ackW *os.File
+}
+
+func (w *worker) pid() int {
+	return w.process.Pid()
+}
+
+// label returns the string to identify the worker in logs.
+func (w *worker) label() string {
+	if w.slot != nil && w.slot.spec.Name != "" {
+		return fmt.Sprintf("pid=%d, name=%s", w.pid(), w.slot.spec.Name)
+	}
+	return fmt.Sprintf("pid=%d", w.pid())
+}
+
+// wait waits for the worker to exit, removes the temporary directory for
+// the worker, and sends the result to waitErrC.
+func (w *worker) wait() {
+	err := w.process.Wait()
+	w.closeAck()
+	w.removeTempDir()
+	w.waitErrC <- err
+}
+
+// closeAck closes the end of the socket kept for relaying the ACK, so that
+// the master detects the worker exited without sending ready.
+func (w *worker) closeAck() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.ackW != nil {
+		w.ackW.Close()
+		w.ackW = nil
+	}
+}
+
+func (w *worker) removeTempDir() {
+	if w.tempDir == "" {
+		return
+	}
+	if err := os.RemoveAll(w.tempDir); err != nil {
+		w.out.eprintf("failed to remove temporary directory for worker: %v\n", err)
+	}
+}
+
+// waitReady receives ready notification from the worker.
+func (w *worker) waitReady() error {
+	b, ok := <-w.msgC
+	return w.checkReady(b, ok)
+}
+
+// checkReady checks the result of receiving the first byte from msgC of a worker
+// and returns an error if it is not ready notification.
+func (w *worker) checkReady(b byte, ok bool) error {
+	if !ok {
+		if w.readErr == io.EOF {
+			return errors.New("worker closed the ready pipe without sending ready notification")
+		}
+		return fmt.Errorf("read error in receiving ready notification; %w", w.readErr)
+	}
+	if b != readyByte {
+		return fmt.Errorf("protocol error in receiving ready notification; unexpected byte %q", b)
+	}
+	return nil
+}
+
+// readMessages reads messages from the socket and queues their types for msgC
+// until it gets an error. The error is set to readErr before msgC is closed.
+// Drain progress messages are not sent to msgC but recorded in the worker.
+// Listener ready messages are not sent to msgC either, but ready is sent
+// to msgC when all the listeners which the master waits for get ready.
+// Heartbeats are replied and metadata is logged here.
+//
+// It never blocks on msgC, so that it keeps replying to heartbeats and
+// recording drain progress while the master does not receive from msgC,
+// for example while it waits for a new worker in a reload.
+func (w *worker) readMessages(r *os.File) {
+	go w.forwardMessages()
+	defer w.msgs.close()
+	defer w.closeMsgR()
+	for {
+		typ, payload, err := readMessage(r)
+		if err != nil {
+			w.readErr = err
+			return
+		}
+		switch typ {
+		case drainByte, listenerReadyByte:
+			if len(payload) != 4 {
+				w.out.eprintf("ignored malformed message %q from worker: %s\n", typ, w.label())
+				continue
+			}
+			n := int(binary.BigEndian.Uint32(payload))
+			if typ == drainByte {
+				w.setActiveConns(n)
+			} else {
+				w.listenerReady(n)
+			}
+			continue
+		case heartbeatByte:
+			// NOTE: We ignore the error since the worker adopted from an older
+			// master may have a pipe which cannot be written.
+			r.Write(appendFrame(nil, heartbeatByte, nil))
+			continue
+		case metadataByte:
+			w.out.printf("received metadata from worker: %s, %s\n", w.label(), payload)
+			continue
+		case listenRequestByte:
+			w.addListenRequest(string(payload))
+		case readyByte:
+			if w.readySent {
+				continue
+			}
+			w.readySent = true
+		case retireByte:
+			// NOTE: We record it here since the worker may exit before
+			// the master receives it from msgC.
+			w.setRetiring()
+		}
+		w.msgs.push(typ)
+	}
+}
+
+// forwardMessages sends the message types queued by readMessages to msgC in
+// order, and closes msgC after readMessages stops and all of them are sent.
+func (w *worker) forwardMessages() {
+	defer close(w.msgC)
+	for {
+		typ, ok := w.msgs.pop()
+		if !ok {
+			return
+		}
+		w.msgC <- typ
+	}
+}
+
+// msgQueue is the queue of the message types from a worker. A type which is
+// already in the queue is not added again, since the master handles the same
+// messages in a row only once, so the queue is bounded by the number of
+// the message types.
+type msgQueue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	types  []byte
+	closed bool
+}
+
+// push adds typ to the queue unless it is already in the queue.
+func (q *msgQueue) push(typ byte) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, t := range q.types {
+		if t == typ {
+			return
+		}
+	}
+	q.types = append(q.types, typ)
+	q.condLocked().Signal()
+}
+
+// close makes pop return false after the queue becomes empty.
+func (q *msgQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.condLocked().Signal()
+}
+
+// pop removes the first type from the queue and returns it, waiting until
+// the queue is not empty. It returns false if the queue is empty and closed.
+func (q *msgQueue) pop() (byte, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	cond := q.condLocked()
+	for len(q.types) == 0 {
+		if q.closed {
+			return 0, false
+		}
+		cond.Wait()
+	}
+	typ := q.types[0]
+	q.types = q.types[1:]
+	return typ, true
+}
+
+// condLocked returns the condition variable signaled when the queue changes.
+// It must be called with mu held.
+func (q *msgQueue) condLocked() *sync.Cond {
+	if q.cond == nil {
+		q.cond = sync.NewCond(&q.mu)
+	}
+	return q.cond
+}
+
+// closeMsgR closes the read end of the pipe from the worker.
+func (w *worker) closeMsgR() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.msgR != nil {
+		w.msgR.Close()
+		w.msgR = nil
+	}
+}
+
+// listenerReady records the listener at index got ready and sends ready to msgC
+// if all the listeners which the master waits for are ready.
+func (w *worker) listenerReady(index int) {
+	w.out.printf("received ready for listener %d from worker: %s\n", index, w.label())
+	if w.pendingReadyListeners == nil || w.readySent {
+		return
+	}
+	delete(w.pendingReadyListeners, index)
+	if len(w.pendingReadyListeners) == 0 {
+		w.readySent = true
+		w.msgs.push(readyByte)
+	}
+}
+
+// setActiveConns records the number of in-flight connections reported by
+// the worker and notifies it with drainC.
+func (w *worker) setActiveConns(n int) {
+	w.mu.Lock()
+	w.activeConns = n
+	w.activeConnsReported = true
+	w.mu.Unlock()
+	select {
+	case w.drainC <- struct{}{}:
+	default:
+	}
+}
+
+// reportedActiveConns returns the number of in-flight connections reported last
+// by the worker and whether it has been reported.
+func (w *worker) reportedActiveConns() (n int, reported bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.activeConns, w.activeConnsReported
+}
@@ -0,0 +1,97 @@
+package serverstarter
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestReadMessagesDoesNotBlock(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	wk := &worker{
+		out:    &output{w: ioutil.Discard},
+		msgC:   make(chan byte, 2),
+		drainC: make(chan struct{}, 1),
+	}
+	go wk.readMessages(r)
+
+	// NOTE: The master does not receive from msgC meanwhile, but the drain
+	// progress sent after the other messages must be recorded.
+	var msgs []byte
+	for _, typ := range []byte{readyByte, warmByte, reloadRequestByte, reloadRequestByte, recycleByte, reloadRequestByte} {
+		msgs = appendFrame(msgs, typ, nil)
+	}
+	msgs = appendFrame(msgs, drainByte, []byte{0, 0, 0, 3})
+	if _, err := w.Write(msgs); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-wk.drainC:
+	case <-time.After(5 * time.Second):
+		t.Fatal("drain progress is not recorded while msgC is not received")
+	}
+	if n, reported := wk.reportedActiveConns(); n != 3 || !reported {
+		t.Errorf("drain progress mismatch, got=%d, %v, want=3, true", n, reported)
+	}
+
+	w.Close()
+	var got []byte
+	for typ := range wk.msgC {
+		got = append(got, typ)
+	}
+	// NOTE: The reload requests may be coalesced depending on the timing.
+	if len(got) < 4 || got[0] != readyByte || got[1] != warmByte || got[2] != reloadRequestByte ||
+		bytes.IndexByte(got, recycleByte) == -1 {
+		t.Errorf("message types mismatch, got=%q", got)
+	}
+	if wk.readErr != io.EOF {
+		t.Errorf("read error mismatch, got=%v, want=%v", wk.readErr, io.EOF)
+	}
+}
+
+func TestMsgQueue(t *testing.T) {
+	var q msgQueue
+	for _, typ := range []byte{readyByte, reloadRequestByte, warmByte, reloadRequestByte, reloadRequestByte} {
+		q.push(typ)
+	}
+	q.close()
+	var got []byte
+	for {
+		typ, ok := q.pop()
+		if !ok {
+			break
+		}
+		got = append(got, typ)
+	}
+	if want := []byte{readyByte, reloadRequestByte, warmByte}; !bytes.Equal(got, want) {
+		t.Errorf("message types mismatch, got=%q, want=%q", got, want)
+	}
+
+	// NOTE: The type which is already popped is queued again.
+	q2 := &msgQueue{}
+	q2.push(reloadRequestByte)
+	if typ, ok := q2.pop(); !ok || typ != reloadRequestByte {
+		t.Fatalf("pop mismatch, got=%q, %v", typ, ok)
+	}
+	popped := make(chan byte)
+	go func() {
+		typ, _ := q2.pop()
+		popped <- typ
+	}()
+	q2.push(reloadRequestByte)
+	select {
+	case typ := <-popped:
+		if typ != reloadRequestByte {
+			t.Errorf("pop mismatch, got=%q, want=%q", typ, reloadRequestByte)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("pop does not return after push")
+	}
+}
@@ -0,0 +1,98 @@
+package serverstarter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SetWorkerLogDir makes the master redirect the standard output and the standard
+// error of each worker to a log file in dir instead of those of the master.
+// The log file is "worker-<generation>.log", or "<name>-<generation>.log" for
+// a worker added by AddWorker, so each generation of workers writes to its own file.
+//
+// When the master starts a worker, it removes the old log files of the same
+// worker program so that at most keep files are left, including the file for
+// the new worker. The files are removed from the least recently modified one.
+// If keep is 0 or less, the master does not remove log files.
+//
+// This option is not supported on Windows.
+func SetWorkerLogDir(dir string, keep int) Option {
+	return func(s *Starter) {
+		s.workerLogDir = dir
+		s.workerLogKeep = keep
+	}
+}
+
+// workerLogPrefix returns the prefix of the log file names for the worker program in slot.
+func workerLogPrefix(slot *workerSlot) string {
+	if slot.spec.Name != "" {
+		return slot.spec.Name + "-"
+	}
+	return "worker-"
+}
+
+// openWorkerLogFile opens the log file for the worker w in the directory set by
+// SetWorkerLogDir, and removes the old log files exceeding the retention.
+func (s *Starter) openWorkerLogFile(w *worker) (*os.File, error) {
+	prefix := workerLogPrefix(w.slot)
+	name := prefix + strconv.Itoa(w.generation) + ".log"
+	file, err := os.OpenFile(filepath.Join(s.workerLogDir, name), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error in openWorkerLogFile after opening log file; %w", err)
+	}
+	if s.workerLogKeep > 0 {
+		if err := s.removeOldWorkerLogFiles(prefix, name); err != nil {
+			s.out.eprintf("failed to remove old worker log files: %v\n", err)
+		}
+	}
+	return file, nil
+}
+
+// removeOldWorkerLogFiles removes the log files with prefix other than current
+// so that at most the number of files set by SetWorkerLogDir are left.
+func (s *Starter) removeOldWorkerLogFiles(prefix, current string) error {
+	infos, err := ioutil.ReadDir(s.workerLogDir)
+	if err != nil {
+		return err
+	}
+	type oldFile struct {
+		info       os.FileInfo
+		generation int
+	}
+	var olds []oldFile
+	for _, info := range infos {
+		name := info.Name()
+		if name == current || !info.Mode().IsRegular() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ".log") {
+			continue
+		}
+		// NOTE: We check the generation is a number, so that the files of
+		// another worker program whose name has the prefix are not removed.
+		generation, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".log"))
+		if err != nil {
+			continue
+		}
+		olds = append(olds, oldFile{info: info, generation: generation})
+	}
+	if len(olds) < s.workerLogKeep {
+		return nil
+	}
+	sort.Slice(olds, func(i, j int) bool {
+		ti, tj := olds[i].info.ModTime(), olds[j].info.ModTime()
+		if !ti.Equal(tj) {
+			return ti.After(tj)
+		}
+		return olds[i].generation > olds[j].generation
+	})
+	for _, f := range olds[s.workerLogKeep-1:] {
+		if err := os.Remove(filepath.Join(s.workerLogDir, f.info.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		s.out.printf("removed old worker log file %s\n", f.info.Name())
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package serverstarter
+
+import (
+	"fmt"
+	"os"
+)
+
+// WorkerSpec is the specification of a worker program which the master supervises.
+type WorkerSpec struct {
+	// Name is the name of the worker program, which is used in logs, events and
+	// the control command "reload NAME". It must be unique among worker programs.
+	Name string
+
+	// Binary is the path of the executable of the worker program.
+	// If empty, the one set by SetWorkerBinary or the executable of the master is used.
+	Binary string
+
+	// Args is the command line arguments of the worker program, not including
+	// the program name. If nil, the ones set by SetWorkerArgs or SetWorkerArgsFunc,
+	// or the ones of the master are used. The arguments set by AppendWorkerArgs
+	// are appended in any case.
+	Args []string
+
+	// Env is the environment variables added to the worker program. They override
+	// the ones set by SetExtraEnv and SetExtraEnvFunc with the same keys.
+	Env map[string]string
+
+	// Listeners is the indexes of the listeners passed to RunMaster which are
+	// passed to the worker program in the same order. If nil, all listeners are passed.
+	Listeners []int
+
+	// ListenerGroup is the name of the listener group set by SetListenerGroup
+	// whose listeners are passed to the worker program. It cannot be used
+	// together with Listeners.
+	ListenerGroup string
+}
+
+// AddWorker adds a worker program which the master supervises, so that an HTTP
+// frontend and a background consumer in separate executables can be run by one
+// master, for example. The master runs a worker for each worker program, restarts
+// them independently when they exit, and reloads them one by one on a SIGHUP.
+// A worker program can be reloaded alone with the control command "reload NAME".
+//
+// The other options, for example SetWorkerCredential and SetDrainPolicy, are applied
+// to all worker programs.
+// If no AddWorker is called, the master supervises a single worker program
+// configured with the other options.
+func AddWorker(spec WorkerSpec) Option {
+	return func(s *Starter) {
+		s.workerSpecs = append(s.workerSpecs, spec)
+	}
+}
+
+// SetListenerGroup defines the listener group with the name, which consists of
+// the listeners passed to RunMaster at indexes, for example "public" for
+// the data plane and "admin" for the admin plane. The worker programs added by
+// AddWorker with WorkerSpec.ListenerGroup serve the listeners of the group, and
+// the control command "reload-group NAME" reloads only the worker programs
+// serving the group, so the admin plane can be rolled without touching
+// the data plane.
+func SetListenerGroup(name string, indexes ...int) Option {
+	return func(s *Starter) {
+		if s.listenerGroups == nil {
+			s.listenerGroups = make(map[string][]int)
+		}
+		s.listenerGroups[name] = indexes
+	}
+}
+
+// workerSlot is a worker program supervised by the master and its current worker.
+type workerSlot struct {
+	spec WorkerSpec
+	// listenerFiles is the files of the listeners passed to the worker program.
+	listenerFiles []*os.File
+	// listenerIndexes is the indexes of the listeners passed to RunMaster
+	// for listenerFiles.
+	listenerIndexes []int
+	// poolIndex is the index of the worker in the pool set by SetWorkerCount.
+	poolIndex int
+	child     *worker
+	// oldChild is the worker of the old generation kept running after a SIGUSR2
+	// with SetNginxSignals until a SIGQUIT.
+	oldChild *worker
+	// ready is true after the initial worker sends ready.
+	ready bool
+}
+
+// newWorkerSlots returns the worker slots for the worker programs added by AddWorker.
+func (s *Starter) newWorkerSlots() ([]*workerSlot, error) {
+	specs := s.workerSpecs
+	if len(specs) == 0 {
+		specs = []WorkerSpec{{}}
+	}
+	names := make(map[string]bool)
+	var slots []*workerSlot
+	for _, spec := range specs {
+		slot := &workerSlot{spec: spec, listenerFiles: s.listenerFiles}
+		indexes := spec.Listeners
+		if spec.ListenerGroup != "" {
+			if spec.Listeners != nil {
+				return nil, fmt.Errorf("both listeners and listener group are set for worker %q", spec.Name)
+			}
+			group, ok := s.listenerGroups[spec.ListenerGroup]
+			if !ok {
+				return nil, fmt.Errorf("unknown listener group %q for worker %q", spec.ListenerGroup, spec.Name)
+			}
+			indexes = append([]int{}, group...)
+		}
+		if indexes != nil {
+			slot.listenerFiles = make([]*os.File, len(indexes))
+			for j, index := range indexes {
+				if index < 0 || index >= len(s.listenerFiles) {
+					return nil, fmt.Errorf("invalid listener index %d for worker %q", index, spec.Name)
+				}
+				slot.listenerFiles[j] = s.listenerFiles[index]
+			}
+			slot.listenerIndexes = indexes
+		} else {
+			slot.listenerIndexes = make([]int, len(s.listenerFiles))
+			for j := range slot.listenerIndexes {
+				slot.listenerIndexes[j] = j
+			}
+		}
+		pool, err := s.poolSlots(slot)
+		if err != nil {
+			return nil, err
+		}
+		for _, slot := range pool {
+			if names[slot.spec.Name] {
+				return nil, fmt.Errorf("duplicate worker name %q", slot.spec.Name)
+			}
+			names[slot.spec.Name] = true
+		}
+		slots = append(slots, pool...)
+	}
+	return slots, nil
+}
+
+// findSlot returns the worker slot for the worker program with the name,
+// or nil if it is not found.
+func (s *Starter) findSlot(name string) *workerSlot {
+	for _, slot := range s.slots {
+		if slot.spec.Name == name {
+			return slot
+		}
+	}
+	return nil
+}
+
+// hasWorker returns whether the worker program with the name is added by AddWorker,
+// or the worker with the name is in the pool set by SetWorkerCount.
+func (s *Starter) hasWorker(name string) bool {
+	specs := s.workerSpecs
+	if len(specs) == 0 {
+		specs = []WorkerSpec{{}}
+	}
+	for _, spec := range specs {
+		if s.workerCount <= 1 {
+			if spec.Name == name && name != "" {
+				return true
+			}
+			continue
+		}
+		for i := 0; i < s.workerCount; i++ {
+			if poolWorkerName(spec.Name, i) == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// groupSlots returns the worker slots serving the listener group with the name.
+func (s *Starter) groupSlots(name string) []*workerSlot {
+	var slots []*workerSlot
+	for _, slot := range s.slots {
+		if slot.spec.ListenerGroup == name {
+			slots = append(slots, slot)
+		}
+	}
+	return slots
+}
+
+// removeSlot returns slots without slot.
+func removeSlot(slots []*workerSlot, slot *workerSlot) []*workerSlot {
+	var result []*workerSlot
+	for _, sl := range slots {
+		if sl != slot {
+			result = append(result, sl)
+		}
+	}
+	return result
+}
@@ -0,0 +1,59 @@
+package serverstarter
+
+import "testing"
+
+func TestHasWorker(t *testing.T) {
+	testCases := []struct {
+		opts  []Option
+		names map[string]bool
+	}{
+		{
+			names: map[string]bool{"": false, "worker": false, "worker-0": false},
+		},
+		{
+			opts:  []Option{AddWorker(WorkerSpec{Name: "web"}), AddWorker(WorkerSpec{Name: "batch"})},
+			names: map[string]bool{"web": true, "batch": true, "": false, "nosuch": false, "web-0": false},
+		},
+		{
+			opts:  []Option{SetWorkerCount(2)},
+			names: map[string]bool{"worker-0": true, "worker-1": true, "worker-2": false, "worker": false},
+		},
+		{
+			opts:  []Option{SetWorkerCount(2), AddWorker(WorkerSpec{Name: "web"})},
+			names: map[string]bool{"web-0": true, "web-1": true, "web": false, "worker-0": false},
+		},
+	}
+	for i, c := range testCases {
+		s := New(c.opts...)
+		for name, want := range c.names {
+			if got := s.hasWorker(name); got != want {
+				t.Errorf("case %d: hasWorker(%q) mismatch, got=%v, want=%v", i, name, got, want)
+			}
+		}
+	}
+}
+
+func TestFindSlot(t *testing.T) {
+	s := New(AddWorker(WorkerSpec{Name: "web"}), AddWorker(WorkerSpec{Name: "batch"}))
+	slots, err := s.newWorkerSlots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.slots = slots
+	if slot := s.findSlot("batch"); slot == nil || slot != slots[1] {
+		t.Errorf("slot for batch mismatch, got=%v, want=%v", slot, slots[1])
+	}
+	// NOTE: The slot is removed when the worker exits not to be restarted.
+	s.slots = removeSlot(s.slots, slots[1])
+	if slot := s.findSlot("batch"); slot != nil {
+		t.Errorf("removed slot is found, got=%v", slot)
+	}
+	if !s.hasWorker("batch") {
+		t.Error("name of removed slot must be still valid")
+	}
+
+	s = New(AddWorker(WorkerSpec{Name: "web"}), AddWorker(WorkerSpec{Name: "web"}))
+	if _, err := s.newWorkerSlots(); err == nil {
+		t.Error("duplicate worker names must be rejected")
+	}
+}